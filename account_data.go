@@ -0,0 +1,236 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const auditEventAccountDeleted = "account_deleted"
+
+var errStorageNotConfigured = errors.New("video storage is not configured")
+
+// deleteUserMedia removes every stored file the user's rows point at: the
+// avatar, video thumbnails and the video objects in S3. Files that are
+// already gone are skipped so a failed deletion can simply be retried.
+func (cfg *apiConfig) deleteUserMedia(ctx context.Context, user database.User, videos []database.Video) error {
+	if err := cfg.removeAvatarAssets(user); err != nil {
+		return err
+	}
+	return cfg.deleteVideoMedia(ctx, videos)
+}
+
+// removeAvatarAssets removes every rendition of the user's avatar.
+func (cfg *apiConfig) removeAvatarAssets(user database.User) error {
+	if user.AvatarURL == nil {
+		return nil
+	}
+	for _, assetURL := range renditionURLs(*user.AvatarURL, user.AvatarSrcset) {
+		if err := cfg.removeAsset(assetURL); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteVideoMedia removes the thumbnails and S3 objects of the videos.
+// Media stored in blobs may be shared with other videos, so it's left for
+// removeOrphanedBlobs to delete once the videos' rows are gone.
+func (cfg *apiConfig) deleteVideoMedia(ctx context.Context, videos []database.Video) error {
+	for _, video := range videos {
+		if video.ThumbnailBlobHash == "" {
+			for _, assetURL := range thumbnailAssetURLs(video) {
+				if err := cfg.removeAsset(assetURL); err != nil {
+					return err
+				}
+			}
+		}
+		if video.VideoURL == nil || video.VideoBlobHash != "" {
+			continue
+		}
+		if key, ok := cfg.localVideoKey(video.ID, *video.VideoURL); ok {
+			err := os.Remove(cfg.localVideoPath(key))
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+			continue
+		}
+		key, ok := cfg.videoObjectKey(*video.VideoURL)
+		if !ok {
+			continue
+		}
+		if cfg.s3Client == nil {
+			return errStorageNotConfigured
+		}
+		s3Ctx, done := cfg.startS3Operation(ctx, "DeleteObject", key)
+		_, err := cfg.s3Client.DeleteObject(s3Ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(cfg.s3Bucket),
+			Key:    aws.String(key),
+		})
+		done(err)
+		if err != nil {
+			return fmt.Errorf("couldn't delete video %s: %w", video.ID, err)
+		}
+	}
+	return nil
+}
+
+func (cfg *apiConfig) removeAsset(assetURL string) error {
+	assetPath, ok := cfg.assetPath(assetURL)
+	if !ok {
+		return nil
+	}
+	if err := os.Remove(assetPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// writeUserExport writes a ZIP archive of everything stored about the user:
+// their profile, the metadata of each video and playlist, the workspaces
+// they belong to, and the original media files. Videos in workspaces belong
+// to the team rather than the user and are left out.
+func (cfg *apiConfig) writeUserExport(ctx context.Context, w io.Writer, user database.User, videos []database.Video) error {
+	zw := zip.NewWriter(w)
+
+	if err := writeZipJSON(zw, "profile.json", user); err != nil {
+		return err
+	}
+	if err := writeZipJSON(zw, "videos.json", videos); err != nil {
+		return err
+	}
+
+	playlists, err := cfg.requestDB(ctx).GetPlaylists(user.ID)
+	if err != nil {
+		return err
+	}
+	type exportedPlaylist struct {
+		database.Playlist
+		VideoIDs []uuid.UUID `json:"video_ids"`
+	}
+	exportedPlaylists := make([]exportedPlaylist, 0, len(playlists))
+	for _, playlist := range playlists {
+		items, err := cfg.requestDB(ctx).GetPlaylistVideos(playlist.ID)
+		if err != nil {
+			return err
+		}
+		ids := make([]uuid.UUID, 0, len(items))
+		for _, item := range items {
+			ids = append(ids, item.ID)
+		}
+		exportedPlaylists = append(exportedPlaylists, exportedPlaylist{Playlist: playlist, VideoIDs: ids})
+	}
+	if err := writeZipJSON(zw, "playlists.json", exportedPlaylists); err != nil {
+		return err
+	}
+
+	workspaces, err := cfg.requestDB(ctx).GetUserWorkspaces(user.ID)
+	if err != nil {
+		return err
+	}
+	if err := writeZipJSON(zw, "workspaces.json", workspaces); err != nil {
+		return err
+	}
+
+	if user.AvatarURL != nil {
+		if err := cfg.writeZipAsset(zw, "media/avatar", *user.AvatarURL); err != nil {
+			return err
+		}
+	}
+
+	for _, video := range videos {
+		dir := path.Join("media", "videos", video.ID.String())
+		if video.ThumbnailURL != nil {
+			if err := cfg.writeZipAsset(zw, path.Join(dir, "thumbnail"), *video.ThumbnailURL); err != nil {
+				return err
+			}
+		}
+		if video.VideoURL == nil {
+			continue
+		}
+		if key, ok := cfg.localVideoKey(video.ID, *video.VideoURL); ok {
+			err := writeZipLocalFile(zw, path.Join(dir, "video"+path.Ext(key)), cfg.localVideoPath(key))
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		key, ok := cfg.videoObjectKey(*video.VideoURL)
+		if !ok {
+			continue
+		}
+		if cfg.s3Client == nil {
+			return errStorageNotConfigured
+		}
+		s3Ctx, done := cfg.startS3Operation(ctx, "GetObject", key)
+		obj, err := cfg.s3Client.GetObject(s3Ctx, &s3.GetObjectInput{
+			Bucket: aws.String(cfg.s3Bucket),
+			Key:    aws.String(key),
+		})
+		done(err)
+		if err != nil {
+			return fmt.Errorf("couldn't download video %s: %w", video.ID, err)
+		}
+		err = writeZipFile(zw, path.Join(dir, "video"+path.Ext(key)), obj.Body)
+		obj.Body.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return zw.Close()
+}
+
+// writeZipAsset copies a locally stored asset into the archive, keeping its
+// extension. Assets that no longer exist are left out.
+func (cfg *apiConfig) writeZipAsset(zw *zip.Writer, name, assetURL string) error {
+	assetPath, ok := cfg.assetPath(assetURL)
+	if !ok {
+		return nil
+	}
+	return writeZipLocalFile(zw, name+filepath.Ext(assetPath), assetPath)
+}
+
+// writeZipLocalFile copies a file from disk into the archive, leaving it out
+// if it no longer exists.
+func writeZipLocalFile(zw *zip.Writer, name, filePath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+	return writeZipFile(zw, name, file)
+}
+
+func writeZipFile(zw *zip.Writer, name string, r io.Reader) error {
+	entry, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(entry, r)
+	return err
+}
+
+func writeZipJSON(zw *zip.Writer, name string, v any) error {
+	entry, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(entry)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
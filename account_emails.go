@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/mailer"
+	"github.com/google/uuid"
+)
+
+const (
+	emailVerificationTTL = 48 * time.Hour
+	passwordResetTTL     = time.Hour
+)
+
+// pendingEmails counts emails still being sent by sendEmailInBackground.
+var pendingEmails sync.WaitGroup
+
+// sendEmailInBackground runs send after the request has been answered, for
+// handlers whose response mustn't reveal how long sending took. send isn't
+// cancelled with the request, and its failure is only logged.
+func sendEmailInBackground(ctx context.Context, kind string, send func(ctx context.Context) error) {
+	ctx = context.WithoutCancel(ctx)
+	pendingEmails.Add(1)
+	go func() {
+		defer pendingEmails.Done()
+		if err := send(ctx); err != nil {
+			loggerFrom(ctx).Error("Couldn't send email", "kind", kind, "error", err)
+		}
+	}()
+}
+
+// issueUserToken creates a single-use token for the given purpose, replacing
+// any that are still outstanding, and returns its plaintext.
+func (cfg *apiConfig) issueUserToken(ctx context.Context, userID uuid.UUID, email string, purpose database.UserTokenPurpose, ttl time.Duration) (string, error) {
+	if err := cfg.requestDB(ctx).InvalidateUserTokens(userID, purpose); err != nil {
+		return "", err
+	}
+
+	token, err := auth.MakeOneTimeToken()
+	if err != nil {
+		return "", err
+	}
+
+	err = cfg.requestDB(ctx).CreateUserToken(database.CreateUserTokenParams{
+		TokenHash: auth.HashToken(token),
+		UserID:    userID,
+		Purpose:   purpose,
+		Email:     email,
+		ExpiresAt: time.Now().UTC().Add(ttl),
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// sendVerificationEmail emails a link proving ownership of email, which may
+// differ from the user's current address while an email change is pending.
+func (cfg *apiConfig) sendVerificationEmail(ctx context.Context, userID uuid.UUID, email string) error {
+	token, err := cfg.issueUserToken(ctx, userID, email, database.UserTokenVerifyEmail, emailVerificationTTL)
+	if err != nil {
+		return err
+	}
+
+	link := cfg.appLink("verify_email_token", token)
+	return cfg.mailer.Send(ctx, mailer.Message{
+		To:      email,
+		Subject: "Verify your Tubely email address",
+		Body: fmt.Sprintf(
+			"Confirm this is your email address by opening the link below:\n\n%s\n\nThe link expires in %d hours. If you didn't sign up for Tubely, you can ignore this email.\n",
+			link,
+			int(emailVerificationTTL.Hours()),
+		),
+	})
+}
+
+func (cfg *apiConfig) sendPasswordResetEmail(ctx context.Context, user database.User) error {
+	token, err := cfg.issueUserToken(ctx, user.ID, user.Email, database.UserTokenResetPassword, passwordResetTTL)
+	if err != nil {
+		return err
+	}
+
+	link := cfg.appLink("reset_password_token", token)
+	return cfg.mailer.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your Tubely password",
+		Body: fmt.Sprintf(
+			"Someone asked to reset the password for your Tubely account. To choose a new password, open the link below:\n\n%s\n\nThe link expires in %d minutes. If you didn't ask for this, you can ignore this email.\n",
+			link,
+			int(passwordResetTTL.Minutes()),
+		),
+	})
+}
+
+// sendEmailChangeVerification emails the new address a link that completes
+// an email change. The change doesn't happen until the link is followed.
+func (cfg *apiConfig) sendEmailChangeVerification(ctx context.Context, userID uuid.UUID, newEmail string) error {
+	token, err := cfg.issueUserToken(ctx, userID, newEmail, database.UserTokenChangeEmail, emailVerificationTTL)
+	if err != nil {
+		return err
+	}
+
+	link := cfg.appLink("change_email_token", token)
+	return cfg.mailer.Send(ctx, mailer.Message{
+		To:      newEmail,
+		Subject: "Confirm your new Tubely email address",
+		Body: fmt.Sprintf(
+			"To finish changing your Tubely email address to this one, open the link below:\n\n%s\n\nThe link expires in %d hours. If you didn't ask for this, you can ignore this email.\n",
+			link,
+			int(emailVerificationTTL.Hours()),
+		),
+	})
+}
+
+// sendEmailChangedNotice tells the old address about a completed change, so
+// the owner notices if someone else took over their account.
+func (cfg *apiConfig) sendEmailChangedNotice(ctx context.Context, oldEmail, newEmail string) error {
+	return cfg.mailer.Send(ctx, mailer.Message{
+		To:      oldEmail,
+		Subject: "Your Tubely email address was changed",
+		Body: fmt.Sprintf(
+			"The email address on your Tubely account was changed to %s. If you didn't do this, reset your password and contact support.\n",
+			newEmail,
+		),
+	})
+}
+
+// appLink builds a link into the web app carrying a single query parameter.
+func (cfg *apiConfig) appLink(param, value string) string {
+	base := cfg.appBaseURL
+	if base == "" {
+		base = "http://localhost:" + cfg.port
+	}
+	return base + "/app/?" + url.Values{param: {value}}.Encode()
+}
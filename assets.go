@@ -1,7 +1,11 @@
 package main
 
 import (
+	"net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"strings"
 )
 
 func (cfg apiConfig) ensureAssetsDir() error {
@@ -10,3 +14,44 @@ func (cfg apiConfig) ensureAssetsDir() error {
 	}
 	return nil
 }
+
+// assetPath maps a URL returned by saveThumbnail back to its file in the
+// assets directory. The host is ignored since it depends on how the server
+// was reached when the URL was made.
+func (cfg *apiConfig) assetPath(assetURL string) (string, bool) {
+	parsed, err := url.Parse(assetURL)
+	if err != nil {
+		return "", false
+	}
+	dir, name := path.Split(parsed.Path)
+	if dir != "/assets/" || name == "" || name == "." || name == ".." {
+		return "", false
+	}
+	return filepath.Join(cfg.assetsRoot, name), true
+}
+
+// cloudFrontBaseURL returns the distribution URL videos are served from,
+// without a trailing slash, or "" if none is configured.
+func (cfg *apiConfig) cloudFrontBaseURL() string {
+	base := strings.TrimSpace(cfg.s3CfDistribution)
+	if base == "" {
+		return ""
+	}
+	if !strings.HasPrefix(base, "http://") && !strings.HasPrefix(base, "https://") {
+		base = "https://" + base
+	}
+	return strings.TrimRight(base, "/")
+}
+
+// videoObjectKey maps a video URL back to its key in the S3 bucket.
+func (cfg *apiConfig) videoObjectKey(videoURL string) (string, bool) {
+	base := cfg.cloudFrontBaseURL()
+	if base == "" {
+		return "", false
+	}
+	key, ok := strings.CutPrefix(videoURL, base+"/")
+	if !ok || key == "" {
+		return "", false
+	}
+	return key, true
+}
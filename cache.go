@@ -1,10 +1,231 @@
 package main
 
-import "net/http"
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
 
-func noCacheMiddleware(next http.Handler) http.Handler {
+// cachePolicy is how responses on a route may be cached. cacheControl is
+// only sent with successful responses; errors are always no-store so a
+// transient failure doesn't stick in a cache. With etag set, responses get a
+// strong ETag and matching If-None-Match requests are answered with 304.
+type cachePolicy struct {
+	cacheControl string
+	etag         bool
+	// varyAuth marks responses that depend on who's asking.
+	varyAuth bool
+}
+
+var (
+	// immutableCachePolicy is for URLs whose content never changes, such as
+	// assets stored under random or content-derived names.
+	immutableCachePolicy = cachePolicy{
+		cacheControl: "public, max-age=31536000, immutable",
+	}
+	// revalidateCachePolicy lets clients keep a copy but check it's still
+	// current before every use, which costs a 304 when nothing changed.
+	revalidateCachePolicy = cachePolicy{
+		cacheControl: "no-cache",
+		etag:         true,
+	}
+	// shortCachePolicy is for shared, mutable resources where being a minute
+	// out of date is fine.
+	shortCachePolicy = cachePolicy{
+		cacheControl: "public, max-age=60",
+		etag:         true,
+	}
+	// privateRevalidateCachePolicy is revalidateCachePolicy for responses
+	// that differ per user and mustn't be stored by shared caches.
+	privateRevalidateCachePolicy = cachePolicy{
+		cacheControl: "private, no-cache",
+		etag:         true,
+		varyAuth:     true,
+	}
+	// jwksCachePolicy gives verifiers a few minutes between refetches; new
+	// keys are published before they start signing.
+	jwksCachePolicy = cachePolicy{
+		cacheControl: "public, max-age=300",
+	}
+	noStoreCachePolicy = cachePolicy{
+		cacheControl: "no-store",
+	}
+)
+
+// cacheMiddleware applies policy to every response from next. ETags are
+// computed from the response body, so the handler's output is buffered;
+// only use it with etag on routes that return small bodies.
+func cacheMiddleware(policy cachePolicy, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Cache-Control", "no-store")
-		next.ServeHTTP(w, r)
+		if policy.varyAuth {
+			w.Header().Add("Vary", "Authorization")
+		}
+		if !policy.etag || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+			next.ServeHTTP(&cacheHeaderWriter{ResponseWriter: w, cacheControl: policy.cacheControl}, r)
+			return
+		}
+
+		bw := &bufferedResponseWriter{parent: w, header: w.Header(), status: http.StatusOK}
+		next.ServeHTTP(bw, r)
+
+		setCacheControl(w.Header(), bw.status, policy.cacheControl)
+		if bw.status != http.StatusOK {
+			w.WriteHeader(bw.status)
+			w.Write(bw.body.Bytes())
+			return
+		}
+
+		etag := w.Header().Get("ETag")
+		if etag == "" {
+			sum := sha256.Sum256(bw.body.Bytes())
+			etag = `"` + base64.RawURLEncoding.EncodeToString(sum[:16]) + `"`
+			w.Header().Set("ETag", etag)
+		}
+		if etagMatches(r.Header.Get("If-None-Match"), etag) {
+			w.Header().Del("Content-Type")
+			w.Header().Del("Content-Length")
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		if r.Method != http.MethodHead {
+			w.Write(bw.body.Bytes())
+		}
 	})
 }
+
+// staticFileHandler serves the files under root at prefix, with the cache
+// policy policyFor picks for each file name. Files get an ETag from their
+// size and modification time so http.FileServer can answer If-None-Match
+// without reading them.
+func staticFileHandler(prefix, root string, policyFor func(name string) cachePolicy) http.Handler {
+	files := http.StripPrefix(prefix, http.FileServer(http.Dir(root)))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := path.Clean("/" + strings.TrimPrefix(r.URL.Path, prefix))
+		policy := policyFor(name)
+
+		info, err := os.Stat(filepath.Join(root, filepath.FromSlash(name)))
+		if err == nil && info.Mode().IsRegular() {
+			w.Header().Set("ETag", fileETag(info))
+		}
+		files.ServeHTTP(&cacheHeaderWriter{ResponseWriter: w, cacheControl: policy.cacheControl}, r)
+	})
+}
+
+// assetCachePolicy caches uploaded assets forever when they're stored under
+// a generated name, since those are never reused for different content.
+// Anything else in the assets directory has to be revalidated.
+func assetCachePolicy(name string) cachePolicy {
+	if isGeneratedAssetName(path.Base(name)) {
+		return immutableCachePolicy
+	}
+	return revalidateCachePolicy
+}
+
+// isGeneratedAssetName reports whether name looks like one made by
+// saveThumbnail: at least 32 URL-safe base64 or hex characters and an
+// extension.
+func isGeneratedAssetName(name string) bool {
+	stem := strings.TrimSuffix(name, path.Ext(name))
+	if len(stem) < 32 {
+		return false
+	}
+	for _, c := range stem {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func fileETag(info os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size())
+}
+
+// etagMatches implements the weak comparison If-None-Match calls for.
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func setCacheControl(h http.Header, status int, cacheControl string) {
+	if h.Get("Cache-Control") != "" {
+		return
+	}
+	if status < 300 || status == http.StatusNotModified || status == http.StatusPartialContent {
+		h.Set("Cache-Control", cacheControl)
+		return
+	}
+	h.Set("Cache-Control", noStoreCachePolicy.cacheControl)
+}
+
+// cacheHeaderWriter sets Cache-Control once the status is known.
+type cacheHeaderWriter struct {
+	http.ResponseWriter
+	cacheControl string
+	wroteHeader  bool
+}
+
+func (w *cacheHeaderWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		setCacheControl(w.Header(), code, w.cacheControl)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *cacheHeaderWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *cacheHeaderWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// bufferedResponseWriter holds back the body and status so a response can be
+// inspected before it's sent. Headers are written straight through.
+type bufferedResponseWriter struct {
+	// parent is the writer the response is eventually sent to. It isn't
+	// exposed with Unwrap, since flushing it would bypass the buffer.
+	parent      http.ResponseWriter
+	header      http.Header
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (w *bufferedResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *bufferedResponseWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.status = code
+	}
+}
+
+func (w *bufferedResponseWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return w.body.Write(b)
+}
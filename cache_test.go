@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStaticFileCaching(t *testing.T) {
+	assetsRoot := t.TempDir()
+	generated := strings.Repeat("Ab1_", 11) + ".png"
+	for _, name := range []string{generated, "logo.png"} {
+		if err := os.WriteFile(filepath.Join(assetsRoot, name), []byte("image bytes"), 0644); err != nil {
+			t.Fatalf("failed to write asset: %v", err)
+		}
+	}
+	handler := staticFileHandler("/assets", assetsRoot, assetCachePolicy)
+
+	get := func(path string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := get("/assets/"+generated, nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected asset to be served, got %d", rr.Code)
+	}
+	if got := rr.Header().Get("Cache-Control"); got != immutableCachePolicy.cacheControl {
+		t.Fatalf("expected generated asset to be immutable, got %q", got)
+	}
+	etag := rr.Header().Get("ETag")
+	if etag == "" {
+		t.Fatalf("expected an ETag")
+	}
+	if rr := get("/assets/"+generated, map[string]string{"If-None-Match": etag}); rr.Code != http.StatusNotModified {
+		t.Fatalf("expected matching ETag to return 304, got %d", rr.Code)
+	}
+
+	if got := get("/assets/logo.png", nil).Header().Get("Cache-Control"); got != revalidateCachePolicy.cacheControl {
+		t.Fatalf("expected other assets to be revalidated, got %q", got)
+	}
+	if got := get("/assets/"+strings.Repeat("x", 40)+".png", nil).Header().Get("Cache-Control"); got != "no-store" {
+		t.Fatalf("expected missing asset not to be cached, got %q", got)
+	}
+}
+
+func TestCacheMiddlewareETag(t *testing.T) {
+	body := `{"videos":[]}`
+	handler := cacheMiddleware(shortCachePolicy, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("fail") != "" {
+			respondWithError(w, http.StatusInternalServerError, "broken", nil)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(body))
+	}))
+
+	get := func(path, ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := get("/api/videos/public", "")
+	if rr.Code != http.StatusOK || rr.Body.String() != body {
+		t.Fatalf("expected body to pass through, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if got := rr.Header().Get("Cache-Control"); got != shortCachePolicy.cacheControl {
+		t.Fatalf("expected short caching, got %q", got)
+	}
+	etag := rr.Header().Get("ETag")
+	if etag == "" {
+		t.Fatalf("expected an ETag")
+	}
+
+	rr = get("/api/videos/public", `"other", W/`+etag)
+	if rr.Code != http.StatusNotModified || rr.Body.Len() != 0 {
+		t.Fatalf("expected 304 without a body, got %d: %q", rr.Code, rr.Body.String())
+	}
+
+	rr = get("/api/videos/public?fail=1", "")
+	if rr.Code != http.StatusInternalServerError {
+		t.Fatalf("expected error to pass through, got %d", rr.Code)
+	}
+	if got := rr.Header().Get("Cache-Control"); got != "no-store" {
+		t.Fatalf("expected errors not to be cached, got %q", got)
+	}
+	if rr.Header().Get("ETag") != "" {
+		t.Fatalf("expected no ETag on errors")
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+type clientIPContextKey struct{}
+
+// clientIP returns the IP address of the client that made the request: the
+// connecting peer, or the address a trusted proxy in front of the server
+// says it forwarded the request for.
+func clientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPContextKey{}).(string); ok {
+		return ip
+	}
+	return peerIP(r)
+}
+
+func peerIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// parseTrustedProxies parses TRUSTED_PROXIES, a comma-separated list of
+// CIDRs or single addresses.
+func parseTrustedProxies(raw string) ([]netip.Prefix, error) {
+	var proxies []netip.Prefix
+	for _, field := range strings.Split(raw, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if !strings.Contains(field, "/") {
+			addr, err := netip.ParseAddr(field)
+			if err != nil {
+				return nil, fmt.Errorf("invalid TRUSTED_PROXIES entry %q: %w", field, err)
+			}
+			proxies = append(proxies, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TRUSTED_PROXIES entry %q: %w", field, err)
+		}
+		proxies = append(proxies, prefix.Masked())
+	}
+	return proxies, nil
+}
+
+func (cfg *apiConfig) trustedProxy(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range cfg.trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedClientIP works out the client's address from X-Forwarded-For
+// when the peer is a trusted proxy. Each proxy appends the address it got
+// the request from, so the list is read from the right, skipping the
+// trusted proxies; anything further left could have been made up by the
+// client.
+func (cfg *apiConfig) forwardedClientIP(r *http.Request) string {
+	peer := peerIP(r)
+	addr, err := netip.ParseAddr(peer)
+	if err != nil || !cfg.trustedProxy(addr) {
+		return peer
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			// The last trusted proxy passed on something that isn't an
+			// address, so it's the closest thing to the client there is.
+			break
+		}
+		client = addr.Unmap().String()
+		if !cfg.trustedProxy(addr) {
+			break
+		}
+	}
+	return client
+}
+
+// clientIPMiddleware resolves each request's client address once, for
+// clientIP. Without trusted proxies it's always the connecting peer, since
+// any client can set forwarding headers.
+func (cfg *apiConfig) clientIPMiddleware(next http.Handler) http.Handler {
+	if len(cfg.trustedProxies) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), clientIPContextKey{}, cfg.forwardedClientIP(r))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	trustedProxies, err := parseTrustedProxies("10.0.0.0/8, 192.0.2.10")
+	if err != nil {
+		t.Fatalf("failed to parse trusted proxies: %v", err)
+	}
+	if _, err := parseTrustedProxies("10.0.0.0/8,not-an-ip"); err == nil {
+		t.Fatalf("expected an invalid entry to be rejected")
+	}
+	cfg := apiConfig{trustedProxies: trustedProxies, rateLimits: newMemoryRateLimitStore()}
+
+	var got string
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/login", func(w http.ResponseWriter, r *http.Request) {
+		got = clientIP(r)
+	})
+	handler := cfg.clientIPMiddleware(cfg.rateLimitMiddleware(mux))
+
+	send := func(remoteAddr string, forwardedFor ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/login", nil)
+		req.RemoteAddr = remoteAddr
+		for _, header := range forwardedFor {
+			req.Header.Add("X-Forwarded-For", header)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, tc := range []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor []string
+		want         string
+	}{
+		{"direct client", "203.0.113.5:1234", nil, "203.0.113.5"},
+		{"untrusted peer's header is ignored", "203.0.113.5:1234", []string{"198.51.100.1"}, "203.0.113.5"},
+		{"trusted proxy", "10.1.2.3:1234", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"spoofed entries left of the client", "10.1.2.3:1234", []string{"1.1.1.1, 198.51.100.1"}, "198.51.100.1"},
+		{"chain of trusted proxies", "10.1.2.3:1234", []string{"198.51.100.1, 192.0.2.10", "10.9.9.9"}, "198.51.100.1"},
+		{"trusted proxy without header", "10.1.2.3:1234", nil, "10.1.2.3"},
+		{"garbage from the client", "10.1.2.3:1234", []string{"nonsense, 198.51.100.1"}, "198.51.100.1"},
+		{"garbage from the proxy", "10.1.2.3:1234", []string{"198.51.100.1, nonsense"}, "10.1.2.3"},
+		{"mapped IPv6", "[::ffff:10.1.2.3]:1234", []string{"::ffff:198.51.100.1"}, "198.51.100.1"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got = ""
+			send(tc.remoteAddr, tc.forwardedFor...)
+			if got != tc.want {
+				t.Fatalf("expected client IP %s, got %s", tc.want, got)
+			}
+		})
+	}
+
+	// Clients behind the load balancer get their own rate limit buckets.
+	for i := 0; i < authRateLimit.burst; i++ {
+		send("10.1.2.3:1234", "198.51.100.7")
+	}
+	if w := send("10.1.2.3:1234", "198.51.100.7"); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected the client to be limited, got %d", w.Code)
+	}
+	if w := send("10.1.2.3:1234", "198.51.100.8"); w.Code != http.StatusOK {
+		t.Fatalf("expected another client behind the same proxy to be allowed, got %d", w.Code)
+	}
+}
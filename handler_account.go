@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// handlerUsersMeDelete permanently deletes the account and everything in it.
+// Accounts with a password have to confirm it; SSO-only accounts don't have
+// one, so their access token is all there is to check.
+func (cfg *apiConfig) handlerUsersMeDelete(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Password string `json:"password"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateAccessToken(r.Context(), token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	user, err := cfg.requestDB(r.Context()).GetUser(userID)
+	if err != nil || user == nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return
+	}
+
+	if user.Password != "" {
+		match, err := auth.CheckPasswordHash(params.Password, user.Password)
+		if err != nil || !match {
+			respondWithError(w, http.StatusUnauthorized, "Incorrect password", err)
+			return
+		}
+	}
+
+	// A workspace with no owner left couldn't be managed by anyone, so the
+	// user has to hand it over or delete it first.
+	soleOwned, err := cfg.requestDB(r.Context()).GetSoleOwnedWorkspaces(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get workspaces", err)
+		return
+	}
+	if len(soleOwned) > 0 {
+		respondWithError(w, http.StatusConflict, fmt.Sprintf("You are the only owner of workspace %q; transfer or delete it first", soleOwned[0].Name), nil)
+		return
+	}
+
+	videos, err := cfg.requestDB(r.Context()).GetVideos(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get videos", err)
+		return
+	}
+
+	// Media goes first: if it fails partway the account is still there and
+	// the request can be retried, whereas deleting the rows first would leave
+	// files nothing points at.
+	if err := cfg.deleteUserMedia(r.Context(), *user, videos); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete stored media", err)
+		return
+	}
+
+	if err := cfg.requestDB(r.Context()).DeleteUser(userID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete user", err)
+		return
+	}
+	cfg.cleanUpBlobs(r.Context())
+
+	if _, err := cfg.requestDB(r.Context()).ClearLoginAttempts(accountThrottleKey(user.Email)); err != nil {
+		loggerFrom(r.Context()).Error("Couldn't clear login attempts for deleted user", "user_id", userID, "error", err)
+	}
+
+	err = cfg.requestDB(r.Context()).CreateAuditEvent(database.CreateAuditEventParams{
+		Type:      auditEventAccountDeleted,
+		IPAddress: clientIP(r),
+		Details:   fmt.Sprintf("user %s deleted their account and %d videos", userID, len(videos)),
+	})
+	if err != nil {
+		loggerFrom(r.Context()).Error("Couldn't record account deletion", "user_id", userID, "error", err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerUsersMeExport streams a ZIP archive of the user's data. Once the
+// archive has started there's no way to report an error to the client, so
+// failures after that point only end up in the log and a truncated download.
+func (cfg *apiConfig) handlerUsersMeExport(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateAccessToken(r.Context(), token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	user, err := cfg.requestDB(r.Context()).GetUser(userID)
+	if err != nil || user == nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return
+	}
+
+	videos, err := cfg.requestDB(r.Context()).GetVideos(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get videos", err)
+		return
+	}
+
+	filename := fmt.Sprintf("tubely-export-%s.zip", time.Now().UTC().Format("2006-01-02"))
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+
+	if err := cfg.writeUserExport(r.Context(), w, *user, videos); err != nil {
+		loggerFrom(r.Context()).Error("Couldn't export user data", "user_id", userID, "error", err)
+	}
+}
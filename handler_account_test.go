@@ -0,0 +1,212 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// fakeS3 is a path-style S3 endpoint that keeps objects in memory and only
+// understands the requests the handlers make.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *s3.Client) {
+	t.Helper()
+	store := &fakeS3{objects: map[string][]byte{}}
+	srv := httptest.NewServer(store)
+	t.Cleanup(srv.Close)
+
+	client := s3.New(s3.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(srv.URL),
+		UsePathStyle: true,
+		Credentials: aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "test", SecretAccessKey: "test"}, nil
+		}),
+	})
+	return store, client
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch r.Method {
+	case http.MethodPut:
+		body, _ := io.ReadAll(r.Body)
+		f.objects[r.URL.Path] = body
+	case http.MethodGet:
+		body, ok := f.objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`<Error><Code>NoSuchKey</Code></Error>`))
+			return
+		}
+		w.Write(body)
+	case http.MethodDelete:
+		delete(f.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestAccountExportAndDeletion(t *testing.T) {
+	tempDir := t.TempDir()
+	dbPath := filepath.Join(tempDir, "test.db")
+
+	dbClient, err := database.NewClient(dbPath)
+	if err != nil {
+		t.Fatalf("failed to create db client: %v", err)
+	}
+
+	jwtKeys, err := loadJWTKeys("test-secret", "", "")
+	if err != nil {
+		t.Fatalf("failed to load jwt keys: %v", err)
+	}
+
+	store, s3Client := newFakeS3(t)
+	store.objects["/tubely-test/landscape/abc.mp4"] = []byte("video bytes")
+
+	cfg := apiConfig{
+		db:               dbClient,
+		jwtKeys:          jwtKeys,
+		assetsRoot:       tempDir,
+		port:             "8091",
+		s3Client:         s3Client,
+		s3Bucket:         "tubely-test",
+		s3CfDistribution: "cdn.example.com",
+	}
+
+	hashedPassword, err := auth.HashPassword("password")
+	if err != nil {
+		t.Fatalf("failed to hash password: %v", err)
+	}
+	user, err := dbClient.CreateUser(database.CreateUserParams{
+		Email:    "leaving@example.com",
+		Password: hashedPassword,
+	})
+	if err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+
+	video, err := dbClient.CreateVideo(database.CreateVideoParams{
+		Title:  "Goodbye",
+		UserID: user.ID,
+	})
+	if err != nil {
+		t.Fatalf("failed to create video: %v", err)
+	}
+	thumbnailPath := filepath.Join(tempDir, "thumb.png")
+	if err := os.WriteFile(thumbnailPath, []byte("thumbnail bytes"), 0o644); err != nil {
+		t.Fatalf("failed to write thumbnail: %v", err)
+	}
+	thumbnailURL := "http://localhost:8091/assets/thumb.png"
+	videoURL := "https://cdn.example.com/landscape/abc.mp4"
+	video.ThumbnailURL = &thumbnailURL
+	video.VideoURL = &videoURL
+	if err := dbClient.UpdateVideo(video); err != nil {
+		t.Fatalf("failed to update video: %v", err)
+	}
+
+	httpReq := httptest.NewRequest(http.MethodPost, "/api/login", nil)
+	accessToken, refreshToken, err := cfg.createSession(httpReq, *user)
+	if err != nil {
+		t.Fatalf("failed to create session: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("DELETE /api/users/me", cfg.handlerUsersMeDelete)
+	mux.HandleFunc("GET /api/users/me/export", cfg.handlerUsersMeExport)
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := do(http.MethodGet, "/api/users/me/export", "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected export to succeed, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "application/zip" {
+		t.Fatalf("expected zip content type, got %q", ct)
+	}
+
+	archive, err := zip.NewReader(bytes.NewReader(rr.Body.Bytes()), int64(rr.Body.Len()))
+	if err != nil {
+		t.Fatalf("failed to open export archive: %v", err)
+	}
+	files := map[string]string{}
+	for _, f := range archive.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatalf("failed to open %s: %v", f.Name, err)
+		}
+		data, _ := io.ReadAll(rc)
+		rc.Close()
+		files[f.Name] = string(data)
+	}
+
+	var exportedUser database.User
+	if err := json.Unmarshal([]byte(files["profile.json"]), &exportedUser); err != nil || exportedUser.Email != user.Email {
+		t.Fatalf("expected profile in export, got %q: %v", files["profile.json"], err)
+	}
+	if strings.Contains(files["profile.json"], hashedPassword) {
+		t.Fatalf("expected password hash to be left out of the export")
+	}
+	var exportedVideos []database.Video
+	if err := json.Unmarshal([]byte(files["videos.json"]), &exportedVideos); err != nil || len(exportedVideos) != 1 {
+		t.Fatalf("expected video metadata in export, got %q: %v", files["videos.json"], err)
+	}
+	mediaDir := "media/videos/" + video.ID.String() + "/"
+	if files[mediaDir+"thumbnail.png"] != "thumbnail bytes" {
+		t.Fatalf("expected thumbnail in export, got files %v", archive.File)
+	}
+	if files[mediaDir+"video.mp4"] != "video bytes" {
+		t.Fatalf("expected original video in export")
+	}
+
+	if rr := do(http.MethodDelete, "/api/users/me", `{"password":"wrong"}`); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected wrong password to be rejected, got %d", rr.Code)
+	}
+	if rr := do(http.MethodDelete, "/api/users/me", `{"password":"password"}`); rr.Code != http.StatusNoContent {
+		t.Fatalf("expected account deletion to succeed, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	if _, err := os.Stat(thumbnailPath); !os.IsNotExist(err) {
+		t.Fatalf("expected thumbnail file to be deleted, got %v", err)
+	}
+	if len(store.objects) != 0 {
+		t.Fatalf("expected video object to be deleted, still have %v", store.objects)
+	}
+	if got, err := dbClient.GetUser(user.ID); err != nil || got != nil {
+		t.Fatalf("expected user to be deleted, got %v, %v", got, err)
+	}
+	if got, err := dbClient.GetVideo(video.ID); err != nil || got.ID != uuid.Nil {
+		t.Fatalf("expected video to be deleted, got %v, %v", got.ID, err)
+	}
+	if got, err := dbClient.GetRefreshToken(refreshToken); err != nil || got.Token != "" {
+		t.Fatalf("expected sessions to be deleted, got %v", err)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+const auditEventLoginUnlock = "login_unlock"
+
+// authorizeAdmin checks the request carries ADMIN_API_KEY as an
+// "Authorization: ApiKey <key>" header, responding with an error if not.
+// Admin endpoints are disabled entirely when no key is configured.
+func (cfg *apiConfig) authorizeAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if cfg.adminAPIKey == "" {
+		respondWithError(w, http.StatusForbidden, "Admin API is not configured", nil)
+		return false
+	}
+	key, err := auth.GetAPIKey(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find API key", err)
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(key), []byte(cfg.adminAPIKey)) != 1 {
+		respondWithError(w, http.StatusUnauthorized, "Invalid API key", nil)
+		return false
+	}
+	return true
+}
+
+// isAdmin reports whether the request carries ADMIN_API_KEY, for endpoints
+// that show admins more rather than refusing everyone else.
+func (cfg *apiConfig) isAdmin(r *http.Request) bool {
+	if cfg.adminAPIKey == "" {
+		return false
+	}
+	key, err := auth.GetAPIKey(r.Header)
+	return err == nil && subtle.ConstantTimeCompare([]byte(key), []byte(cfg.adminAPIKey)) == 1
+}
+
+func (cfg *apiConfig) handlerAdminUnlockLogin(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Email     string `json:"email"`
+		IPAddress string `json:"ip_address"`
+	}
+	type response struct {
+		Unlocked []string `json:"unlocked"`
+	}
+
+	if !cfg.authorizeAdmin(w, r) {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	keys := []string{}
+	if params.Email != "" {
+		keys = append(keys, accountThrottleKey(params.Email))
+	}
+	if params.IPAddress != "" {
+		keys = append(keys, ipThrottleKey(params.IPAddress))
+	}
+	if len(keys) == 0 {
+		respondWithError(w, http.StatusBadRequest, "Email or IP address is required", nil)
+		return
+	}
+
+	unlocked := []string{}
+	for _, key := range keys {
+		cleared, err := cfg.requestDB(r.Context()).ClearLoginAttempts(key)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't unlock login", err)
+			return
+		}
+		if !cleared {
+			continue
+		}
+		unlocked = append(unlocked, key)
+
+		err = cfg.requestDB(r.Context()).CreateAuditEvent(database.CreateAuditEventParams{
+			Type:      auditEventLoginUnlock,
+			IPAddress: clientIP(r),
+			Details:   fmt.Sprintf("%s unlocked by admin", key),
+		})
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't record audit event", err)
+			return
+		}
+	}
+
+	respondWithJSON(w, http.StatusOK, response{
+		Unlocked: unlocked,
+	})
+}
+
+func (cfg *apiConfig) handlerAdminAuditEvents(w http.ResponseWriter, r *http.Request) {
+	if !cfg.authorizeAdmin(w, r) {
+		return
+	}
+
+	limit := 100
+	if limitParam := r.URL.Query().Get("limit"); limitParam != "" {
+		parsed, err := strconv.Atoi(limitParam)
+		if err != nil || parsed < 1 || parsed > 1000 {
+			respondWithError(w, http.StatusBadRequest, "Limit must be between 1 and 1000", err)
+			return
+		}
+		limit = parsed
+	}
+
+	events, err := cfg.requestDB(r.Context()).GetAuditEvents(limit)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve audit events", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, events)
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// healthCheck is one dependency the server needs. check returns a short
+// description of what it found, like a version, or why the dependency
+// can't be used.
+type healthCheck struct {
+	name    string
+	timeout time.Duration
+	check   func(ctx context.Context) (string, error)
+}
+
+// healthCheckResult is what a check found. Only admins get more than the
+// status, since the details name the bucket and the versions of what the
+// server runs.
+type healthCheckResult struct {
+	Status     string  `json:"status"`
+	Detail     string  `json:"detail,omitempty"`
+	Error      string  `json:"error,omitempty"`
+	DurationMS float64 `json:"duration_ms,omitempty"`
+}
+
+type healthResponse struct {
+	Status string                       `json:"status"`
+	Checks map[string]healthCheckResult `json:"checks"`
+}
+
+// readyzCacheTTL is how long a readiness result is reused. The checks run
+// ffmpeg and call S3, so they shouldn't run for every probe.
+const readyzCacheTTL = 5 * time.Second
+
+// healthCache keeps the last health response for ttl. Callers that find it
+// stale while it's being refreshed wait for the new one rather than running
+// the checks again.
+type healthCache struct {
+	ttl time.Duration
+
+	mu        sync.Mutex
+	resp      healthResponse
+	checkedAt time.Time
+}
+
+func newHealthCache(ttl time.Duration) *healthCache {
+	return &healthCache{ttl: ttl}
+}
+
+func (c *healthCache) get(run func() healthResponse) healthResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.checkedAt.IsZero() && time.Since(c.checkedAt) < c.ttl {
+		return c.resp
+	}
+	c.resp = run()
+	c.checkedAt = time.Now()
+	return c.resp
+}
+
+// handlerHealthz is the liveness probe. It only checks what's local to the
+// process, so a slow S3 or a missing ffmpeg doesn't get it restarted.
+func (cfg *apiConfig) handlerHealthz(w http.ResponseWriter, r *http.Request) {
+	cfg.respondWithHealth(w, r, runHealthChecks(r.Context(), cfg.livenessChecks()))
+}
+
+// handlerReadyz is the readiness probe: the server should get traffic only
+// if everything an upload needs is working. Results are cached in
+// cfg.readyzCache, when set.
+func (cfg *apiConfig) handlerReadyz(w http.ResponseWriter, r *http.Request) {
+	run := func() healthResponse {
+		// The result is shared, so it isn't cut short if this client goes
+		// away.
+		return runHealthChecks(context.WithoutCancel(r.Context()), cfg.readinessChecks())
+	}
+	if cfg.readyzCache == nil {
+		cfg.respondWithHealth(w, r, run())
+		return
+	}
+	cfg.respondWithHealth(w, r, cfg.readyzCache.get(run))
+}
+
+func (cfg *apiConfig) readinessChecks() []healthCheck {
+	checks := cfg.livenessChecks()
+	if cfg.s3Client != nil {
+		checks = append(checks, healthCheck{name: "s3", timeout: 3 * time.Second, check: cfg.checkS3Bucket})
+	} else {
+		checks = append(checks, healthCheck{name: "videos_dir", timeout: 2 * time.Second, check: func(context.Context) (string, error) {
+			if err := os.MkdirAll(cfg.videosRoot, 0755); err != nil {
+				return "", err
+			}
+			return checkDirWritable(cfg.videosRoot)
+		}})
+	}
+	checks = append(checks,
+		healthCheck{name: "ffmpeg", timeout: 3 * time.Second, check: checkMediaBinary("ffmpeg")},
+		healthCheck{name: "ffprobe", timeout: 3 * time.Second, check: checkMediaBinary("ffprobe")},
+	)
+	return checks
+}
+
+func (cfg *apiConfig) livenessChecks() []healthCheck {
+	return []healthCheck{
+		{name: "database", timeout: 2 * time.Second, check: func(ctx context.Context) (string, error) {
+			// Unlike requestDB, this gives up when the check times out.
+			version, err := cfg.db.WithContext(ctx).Ping()
+			if err != nil {
+				return "", err
+			}
+			return "sqlite " + version, nil
+		}},
+		{name: "assets_dir", timeout: 2 * time.Second, check: func(context.Context) (string, error) {
+			return checkDirWritable(cfg.assetsRoot)
+		}},
+	}
+}
+
+// runHealthChecks runs the checks concurrently and collects each one's
+// result, logging the ones that failed.
+func runHealthChecks(ctx context.Context, checks []healthCheck) healthResponse {
+	resp := healthResponse{Status: "ok", Checks: make(map[string]healthCheckResult, len(checks))}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, check := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result := runHealthCheck(ctx, check)
+			mu.Lock()
+			defer mu.Unlock()
+			resp.Checks[check.name] = result
+			if result.Status != "ok" {
+				resp.Status = "fail"
+			}
+		}()
+	}
+	wg.Wait()
+
+	for name, result := range resp.Checks {
+		if result.Status != "ok" {
+			loggerFrom(ctx).Warn("Health check failed", "check", name, "error", result.Error)
+		}
+	}
+	return resp
+}
+
+// respondWithHealth responds with the checks' results, with a 503 if any
+// failed. Callers without the admin API key only see pass or fail.
+func (cfg *apiConfig) respondWithHealth(w http.ResponseWriter, r *http.Request, resp healthResponse) {
+	code := http.StatusOK
+	if resp.Status != "ok" {
+		code = http.StatusServiceUnavailable
+	}
+	if !cfg.isAdmin(r) {
+		checks := make(map[string]healthCheckResult, len(resp.Checks))
+		for name, result := range resp.Checks {
+			checks[name] = healthCheckResult{Status: result.Status}
+		}
+		resp.Checks = checks
+	}
+	respondWithJSON(w, code, resp)
+}
+
+// runHealthCheck runs check with its timeout. Checks that can't be
+// cancelled, like file system calls, are given up on when it expires and
+// left to finish in the background.
+func runHealthCheck(ctx context.Context, check healthCheck) healthCheckResult {
+	ctx, cancel := context.WithTimeout(ctx, check.timeout)
+	defer cancel()
+
+	type outcome struct {
+		detail string
+		err    error
+	}
+	done := make(chan outcome, 1)
+	start := time.Now()
+	go func() {
+		detail, err := check.check(ctx)
+		done <- outcome{detail, err}
+	}()
+
+	var result outcome
+	select {
+	case result = <-done:
+	case <-ctx.Done():
+		result.err = ctx.Err()
+	}
+	if errors.Is(result.err, context.DeadlineExceeded) {
+		result.err = fmt.Errorf("timed out after %s", check.timeout)
+	}
+
+	status := healthCheckResult{
+		Status:     "ok",
+		Detail:     result.detail,
+		DurationMS: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if result.err != nil {
+		status.Status = "fail"
+		status.Error = result.err.Error()
+	}
+	return status
+}
+
+// checkDirWritable checks that files can be created in dir.
+func checkDirWritable(dir string) (string, error) {
+	f, err := os.CreateTemp(dir, ".healthcheck-*")
+	if err != nil {
+		return "", err
+	}
+	name := f.Name()
+	closeErr := f.Close()
+	if err := errors.Join(closeErr, os.Remove(name)); err != nil {
+		return "", err
+	}
+	return "writable", nil
+}
+
+func (cfg *apiConfig) checkS3Bucket(ctx context.Context) (string, error) {
+	ctx, done := cfg.startS3Operation(ctx, "HeadBucket", "")
+	_, err := cfg.s3Client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(cfg.s3Bucket)})
+	done(err)
+	if err != nil {
+		return "", err
+	}
+	return "bucket " + cfg.s3Bucket + " reachable", nil
+}
+
+// checkMediaBinary checks that the ffmpeg or ffprobe binary is on the PATH
+// and runs, returning its version line. It's run directly rather than
+// through runMediaCommand so probes don't skew the processing metrics.
+func checkMediaBinary(name string) func(ctx context.Context) (string, error) {
+	return func(ctx context.Context) (string, error) {
+		path, err := exec.LookPath(name)
+		if err != nil {
+			return "", err
+		}
+		var stdout, stderr bytes.Buffer
+		cmd := exec.CommandContext(ctx, path, "-version")
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			if ctx.Err() != nil {
+				return "", ctx.Err()
+			}
+			return "", fmt.Errorf("%s -version: %w: %s", name, err, strings.TrimSpace(stderr.String()))
+		}
+		version, _, _ := strings.Cut(stdout.String(), "\n")
+		return strings.TrimSpace(version), nil
+	}
+}
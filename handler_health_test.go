@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestHandlerHealth(t *testing.T) {
+	tempDir := t.TempDir()
+	dbClient, err := database.NewClient(filepath.Join(tempDir, "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create db client: %v", err)
+	}
+	cfg := apiConfig{
+		db:          dbClient,
+		assetsRoot:  tempDir,
+		videosRoot:  filepath.Join(tempDir, "videos"),
+		port:        "8091",
+		adminAPIKey: "admin-key",
+		readyzCache: newHealthCache(time.Hour),
+	}
+
+	// Stand-ins for ffmpeg and ffprobe, so the checks don't depend on them
+	// being installed.
+	binDir := filepath.Join(tempDir, "bin")
+	if err := os.Mkdir(binDir, 0755); err != nil {
+		t.Fatalf("failed to create bin dir: %v", err)
+	}
+	for _, name := range []string{"ffmpeg", "ffprobe"} {
+		script := "#!/bin/sh\necho '" + name + " version 7.0-test'\necho 'built with gcc'\n"
+		if err := os.WriteFile(filepath.Join(binDir, name), []byte(script), 0755); err != nil {
+			t.Fatalf("failed to write fake %s: %v", name, err)
+		}
+	}
+	t.Setenv("PATH", binDir)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", cfg.handlerHealthz)
+	mux.HandleFunc("GET /readyz", cfg.handlerReadyz)
+	handler := cfg.requestLoggingMiddleware(mux)
+
+	get := func(path string) (int, healthResponse) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Authorization", "ApiKey admin-key")
+		handler.ServeHTTP(w, req)
+		var resp healthResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("failed to decode %s response %q: %v", path, w.Body.String(), err)
+		}
+		return w.Code, resp
+	}
+
+	code, resp := get("/healthz")
+	if code != http.StatusOK || resp.Status != "ok" {
+		t.Fatalf("expected liveness to pass, got %d: %+v", code, resp)
+	}
+	if len(resp.Checks) != 2 || resp.Checks["database"].Status != "ok" || resp.Checks["assets_dir"].Status != "ok" {
+		t.Fatalf("expected only the database and assets dir to be checked, got %+v", resp.Checks)
+	}
+
+	code, resp = get("/readyz")
+	if code != http.StatusOK || resp.Status != "ok" {
+		t.Fatalf("expected readiness to pass, got %d: %+v", code, resp)
+	}
+	for _, name := range []string{"database", "assets_dir", "videos_dir", "ffmpeg", "ffprobe"} {
+		if resp.Checks[name].Status != "ok" {
+			t.Fatalf("expected %s check to pass, got %+v", name, resp.Checks)
+		}
+	}
+	if got := resp.Checks["ffprobe"].Detail; got != "ffprobe version 7.0-test" {
+		t.Fatalf("expected ffprobe's version, got %q", got)
+	}
+
+	// Anyone can probe, but only admins see what the checks found.
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "version") || strings.Contains(w.Body.String(), "duration_ms") {
+		t.Fatalf("expected anonymous readiness to show only statuses, got %d: %s", w.Code, w.Body.String())
+	}
+
+	if err := os.Remove(filepath.Join(binDir, "ffprobe")); err != nil {
+		t.Fatalf("failed to remove fake ffprobe: %v", err)
+	}
+	if code, _ := get("/readyz"); code != http.StatusOK {
+		t.Fatalf("expected readiness to be cached, got %d", code)
+	}
+	cfg.readyzCache.checkedAt = time.Time{}
+	code, resp = get("/readyz")
+	if code != http.StatusServiceUnavailable || resp.Status != "fail" {
+		t.Fatalf("expected readiness to fail without ffprobe, got %d: %+v", code, resp)
+	}
+	if resp.Checks["ffprobe"].Status != "fail" || resp.Checks["ffprobe"].Error == "" || resp.Checks["ffmpeg"].Status != "ok" {
+		t.Fatalf("expected only the ffprobe check to fail, got %+v", resp.Checks)
+	}
+	if code, _ := get("/healthz"); code != http.StatusOK {
+		t.Fatalf("expected liveness to pass without ffprobe, got %d", code)
+	}
+}
@@ -0,0 +1,9 @@
+package main
+
+import "net/http"
+
+// handlerJWKS publishes the public keys access tokens are signed with so
+// other services can verify them without sharing a secret.
+func (cfg *apiConfig) handlerJWKS(w http.ResponseWriter, r *http.Request) {
+	respondWithJSON(w, http.StatusOK, cfg.jwtKeys.JWKS())
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/google/uuid"
+)
+
+func TestJWTKeyRotationAndJWKS(t *testing.T) {
+	keysDir := t.TempDir()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate rsa key: %v", err)
+	}
+	writePEM(t, filepath.Join(keysDir, "2026-01.pem"), "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey))
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate ed25519 key: %v", err)
+	}
+	edDER, err := x509.MarshalPKCS8PrivateKey(edKey)
+	if err != nil {
+		t.Fatalf("failed to marshal ed25519 key: %v", err)
+	}
+	writePEM(t, filepath.Join(keysDir, "2026-02.pem"), "PRIVATE KEY", edDER)
+
+	legacyKeys, err := loadJWTKeys("test-secret", "", "")
+	if err != nil {
+		t.Fatalf("failed to load legacy keys: %v", err)
+	}
+	oldKeys, err := loadJWTKeys("test-secret", keysDir, "2026-01")
+	if err != nil {
+		t.Fatalf("failed to load keys: %v", err)
+	}
+	newKeys, err := loadJWTKeys("test-secret", keysDir, "2026-02")
+	if err != nil {
+		t.Fatalf("failed to load rotated keys: %v", err)
+	}
+
+	userID := uuid.New()
+	for name, issuer := range map[string]*auth.KeySet{
+		"legacy HS256":  legacyKeys,
+		"retired RS256": oldKeys,
+		"active EdDSA":  newKeys,
+	} {
+		token, err := issuer.MakeJWT(userID, 0, time.Hour)
+		if err != nil {
+			t.Fatalf("%s: failed to create jwt: %v", name, err)
+		}
+		claims, err := newKeys.ParseJWT(token)
+		if err != nil {
+			t.Fatalf("%s: expected token to validate after rotation: %v", name, err)
+		}
+		if claims.Subject != userID.String() {
+			t.Fatalf("%s: unexpected subject %s", name, claims.Subject)
+		}
+	}
+
+	cfg := apiConfig{jwtKeys: newKeys}
+	rr := httptest.NewRecorder()
+	cfg.handlerJWKS(rr, httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status OK, got %d", rr.Code)
+	}
+
+	var jwks auth.JWKS
+	if err := json.Unmarshal(rr.Body.Bytes(), &jwks); err != nil {
+		t.Fatalf("failed to unmarshal jwks: %v", err)
+	}
+	if len(jwks.Keys) != 2 {
+		t.Fatalf("expected 2 public keys (no HMAC secret), got %d", len(jwks.Keys))
+	}
+	if jwks.Keys[0].KeyID != "2026-01" || jwks.Keys[0].KeyType != "RSA" || jwks.Keys[0].Algorithm != "RS256" {
+		t.Fatalf("unexpected RSA jwk: %+v", jwks.Keys[0])
+	}
+	if jwks.Keys[1].KeyID != "2026-02" || jwks.Keys[1].KeyType != "OKP" || jwks.Keys[1].Algorithm != "EdDSA" {
+		t.Fatalf("unexpected Ed25519 jwk: %+v", jwks.Keys[1])
+	}
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	t.Helper()
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("failed to write %s: %v", path, err)
+	}
+}
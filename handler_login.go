@@ -3,10 +3,10 @@ package main
 import (
 	"encoding/json"
 	"net/http"
-	"time"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
 )
 
 func (cfg *apiConfig) handlerLogin(w http.ResponseWriter, r *http.Request) {
@@ -28,45 +28,54 @@ func (cfg *apiConfig) handlerLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := cfg.db.GetUserByEmail(params.Email)
+	wait, err := cfg.loginRetryAfter(r.Context(), accountThrottleKey(params.Email), ipThrottleKey(clientIP(r)))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check login attempts", err)
+		return
+	}
+	if wait > 0 {
+		respondWithLoginThrottled(w, wait)
+		return
+	}
+
+	user, err := cfg.requestDB(r.Context()).GetUserByEmail(params.Email)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Incorrect email or password", err)
 		return
 	}
 
 	match, err := auth.CheckPasswordHash(params.Password, user.Password)
-	if err != nil {
+	if err != nil || !match {
+		var userID *uuid.UUID
+		if user.ID != uuid.Nil {
+			userID = &user.ID
+		}
+		if recordErr := cfg.recordLoginFailure(r, params.Email, userID); recordErr != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't record failed login", recordErr)
+			return
+		}
 		respondWithError(w, http.StatusUnauthorized, "Incorrect email or password", err)
 		return
 	}
-	if !match {
-		respondWithError(w, http.StatusUnauthorized, "Incorrect email or password", nil)
+
+	if _, err := cfg.requestDB(r.Context()).ClearLoginAttempts(accountThrottleKey(params.Email)); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't reset login attempts", err)
 		return
 	}
 
-	accessToken, err := auth.MakeJWT(
-		user.ID,
-		cfg.jwtSecret,
-		time.Hour*24*30,
-	)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't create access JWT", err)
+	if cfg.requireEmailVerification && user.EmailVerifiedAt == nil {
+		respondWithError(w, http.StatusForbidden, "Email address not verified", nil)
 		return
 	}
 
-	refreshToken, err := auth.MakeRefreshToken()
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't create refresh token", err)
+	if user.TOTPEnabledAt != nil {
+		cfg.respondWithMFAChallenge(w, user)
 		return
 	}
 
-	_, err = cfg.db.CreateRefreshToken(database.CreateRefreshTokenParams{
-		UserID:    user.ID,
-		Token:     refreshToken,
-		ExpiresAt: time.Now().UTC().Add(time.Hour * 24 * 60),
-	})
+	accessToken, refreshToken, err := cfg.createSession(r, user)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't save refresh token", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create session", err)
 		return
 	}
 
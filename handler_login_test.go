@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestHandlerLoginBacksOffAfterFailuresAndAdminUnlocks(t *testing.T) {
+	tempDir := t.TempDir()
+	dbPath := filepath.Join(tempDir, "test.db")
+
+	dbClient, err := database.NewClient(dbPath)
+	if err != nil {
+		t.Fatalf("failed to create db client: %v", err)
+	}
+
+	jwtKeys, err := loadJWTKeys("test-secret", "", "")
+	if err != nil {
+		t.Fatalf("failed to load jwt keys: %v", err)
+	}
+
+	cfg := apiConfig{
+		db:          dbClient,
+		jwtKeys:     jwtKeys,
+		assetsRoot:  tempDir,
+		port:        "8091",
+		adminAPIKey: "admin-key",
+	}
+
+	hashedPassword, err := auth.HashPassword("super-secret")
+	if err != nil {
+		t.Fatalf("failed to hash password: %v", err)
+	}
+
+	_, err = cfg.db.CreateUser(database.CreateUserParams{
+		Email:    "lockout@example.com",
+		Password: hashedPassword,
+	})
+	if err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/login", cfg.handlerLogin)
+	mux.HandleFunc("POST /admin/login_lockouts/unlock", cfg.handlerAdminUnlockLogin)
+
+	login := func(password string) *httptest.ResponseRecorder {
+		body := `{"email":"lockout@example.com","password":"` + password + `"}`
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/api/login", strings.NewReader(body)))
+		return rr
+	}
+
+	for i := 0; i < accountLoginPolicy.freeAttempts; i++ {
+		if rr := login("wrong"); rr.Code != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: expected status Unauthorized, got %d", i+1, rr.Code)
+		}
+	}
+
+	rr := login("super-secret")
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected login to be throttled, got %d", rr.Code)
+	}
+	if rr.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected Retry-After header on throttled login")
+	}
+
+	unlockReq := httptest.NewRequest(http.MethodPost, "/admin/login_lockouts/unlock", strings.NewReader(`{"email":"lockout@example.com"}`))
+	unlockReq.Header.Set("Authorization", "ApiKey wrong-key")
+	unlockRR := httptest.NewRecorder()
+	mux.ServeHTTP(unlockRR, unlockReq)
+	if unlockRR.Code != http.StatusUnauthorized {
+		t.Fatalf("expected unlock with wrong key to be rejected, got %d", unlockRR.Code)
+	}
+
+	unlockReq = httptest.NewRequest(http.MethodPost, "/admin/login_lockouts/unlock", strings.NewReader(`{"email":"Lockout@Example.com"}`))
+	unlockReq.Header.Set("Authorization", "ApiKey admin-key")
+	unlockRR = httptest.NewRecorder()
+	mux.ServeHTTP(unlockRR, unlockReq)
+	if unlockRR.Code != http.StatusOK {
+		t.Fatalf("expected unlock status OK, got %d", unlockRR.Code)
+	}
+
+	if rr := login("super-secret"); rr.Code != http.StatusOK {
+		t.Fatalf("expected login after unlock to succeed, got %d", rr.Code)
+	}
+}
+
+func TestLoginThrottlePolicyDelay(t *testing.T) {
+	policy := accountLoginPolicy
+	if d := policy.delay(policy.freeAttempts - 1); d != 0 {
+		t.Fatalf("expected no delay within free attempts, got %s", d)
+	}
+	if d := policy.delay(policy.freeAttempts + 1); d != 2*policy.backoffBase {
+		t.Fatalf("expected backoff to double, got %s", d)
+	}
+	if d := policy.delay(policy.lockoutAttempts); d != policy.lockoutDuration {
+		t.Fatalf("expected lockout at %d failures, got %s", policy.lockoutAttempts, d)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestHandlerMetrics(t *testing.T) {
+	dbClient, err := database.NewClient(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create db client: %v", err)
+	}
+	jwtKeys, err := loadJWTKeys("test-secret", "", "")
+	if err != nil {
+		t.Fatalf("failed to load jwt keys: %v", err)
+	}
+	cfg := apiConfig{db: dbClient, jwtKeys: jwtKeys, port: "8091", metricsToken: "scrape-token"}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/tags", cfg.handlerTagsRetrieve)
+	mux.HandleFunc("GET /metrics", cfg.handlerMetrics)
+	handler := cfg.requestLoggingMiddleware(mux)
+
+	user, err := dbClient.CreateUser(database.CreateUserParams{Email: "metrics@example.com", Password: "unused"})
+	if err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	token, err := jwtKeys.MakeJWT(user.ID, user.TokenVersion, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create jwt: %v", err)
+	}
+	req := httptest.NewRequest("GET", "/api/tags", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected tags to load, got %d: %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected scrape without the token to be refused, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Authorization", "Bearer scrape-token")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected metrics, got %d: %s", w.Code, w.Body.String())
+	}
+	body := w.Body.String()
+	for _, want := range []string{
+		`tubely_http_requests_total{method="GET",route="GET /api/tags",status="200"}`,
+		`tubely_http_request_duration_seconds_bucket{method="GET",route="GET /api/tags",le="0.005"}`,
+		`tubely_db_query_duration_seconds_count{statement="select"}`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("expected metrics to contain %s, got:\n%s", want, body)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestTOTPEnrollmentAndTwoStepLogin(t *testing.T) {
+	tempDir := t.TempDir()
+	dbPath := filepath.Join(tempDir, "test.db")
+
+	dbClient, err := database.NewClient(dbPath)
+	if err != nil {
+		t.Fatalf("failed to create db client: %v", err)
+	}
+
+	jwtKeys, err := loadJWTKeys("test-secret", "", "")
+	if err != nil {
+		t.Fatalf("failed to load jwt keys: %v", err)
+	}
+
+	cfg := apiConfig{
+		db:         dbClient,
+		jwtKeys:    jwtKeys,
+		assetsRoot: tempDir,
+		port:       "8091",
+	}
+
+	hashedPassword, err := auth.HashPassword("super-secret")
+	if err != nil {
+		t.Fatalf("failed to hash password: %v", err)
+	}
+
+	user, err := cfg.db.CreateUser(database.CreateUserParams{
+		Email:    "mfa@example.com",
+		Password: hashedPassword,
+	})
+	if err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+
+	token, err := cfg.jwtKeys.MakeJWT(user.ID, user.TokenVersion, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create jwt: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/login", cfg.handlerLogin)
+	mux.HandleFunc("POST /api/login/mfa", cfg.handlerLoginMFA)
+	mux.HandleFunc("POST /api/mfa/totp/enroll", cfg.handlerTOTPEnroll)
+	mux.HandleFunc("POST /api/mfa/totp/confirm", cfg.handlerTOTPConfirm)
+
+	post := func(path, bearer, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		if bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+bearer)
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	enrollRR := post("/api/mfa/totp/enroll", token, "")
+	if enrollRR.Code != http.StatusOK {
+		t.Fatalf("expected enroll status OK, got %d", enrollRR.Code)
+	}
+	var enrollment struct {
+		Secret     string `json:"secret"`
+		OTPAuthURI string `json:"otpauth_uri"`
+	}
+	if err := json.Unmarshal(enrollRR.Body.Bytes(), &enrollment); err != nil {
+		t.Fatalf("failed to unmarshal enrollment: %v", err)
+	}
+	if !strings.HasPrefix(enrollment.OTPAuthURI, "otpauth://totp/Tubely:mfa@example.com?") {
+		t.Fatalf("unexpected otpauth uri: %s", enrollment.OTPAuthURI)
+	}
+
+	// Before confirmation the secret doesn't protect the account yet.
+	loginRR := post("/api/login", "", `{"email":"mfa@example.com","password":"super-secret"}`)
+	if strings.Contains(loginRR.Body.String(), "mfa_token") {
+		t.Fatalf("expected unconfirmed enrollment not to require MFA")
+	}
+
+	previousCode, err := auth.TOTPCode(enrollment.Secret, time.Now().Add(-30*time.Second))
+	if err != nil {
+		t.Fatalf("failed to generate totp code: %v", err)
+	}
+	confirmRR := post("/api/mfa/totp/confirm", token, `{"code":"`+previousCode+`"}`)
+	if confirmRR.Code != http.StatusOK {
+		t.Fatalf("expected confirm status OK, got %d", confirmRR.Code)
+	}
+	var confirmation struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	if err := json.Unmarshal(confirmRR.Body.Bytes(), &confirmation); err != nil {
+		t.Fatalf("failed to unmarshal recovery codes: %v", err)
+	}
+	if len(confirmation.RecoveryCodes) != recoveryCodeCount {
+		t.Fatalf("expected %d recovery codes, got %d", recoveryCodeCount, len(confirmation.RecoveryCodes))
+	}
+
+	challenge := func() string {
+		rr := post("/api/login", "", `{"email":"mfa@example.com","password":"super-secret"}`)
+		var resp struct {
+			MFARequired bool   `json:"mfa_required"`
+			MFAToken    string `json:"mfa_token"`
+			Token       string `json:"token"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("failed to unmarshal login response: %v", err)
+		}
+		if !resp.MFARequired || resp.MFAToken == "" || resp.Token != "" {
+			t.Fatalf("expected an MFA challenge instead of tokens, got %s", rr.Body.String())
+		}
+		if _, err := cfg.validateAccessToken(context.Background(), resp.MFAToken); err == nil {
+			t.Fatalf("MFA challenge token must not work as an access token")
+		}
+		return resp.MFAToken
+	}
+
+	mfaToken := challenge()
+	if rr := post("/api/login/mfa", "", `{"mfa_token":"`+mfaToken+`","code":"`+previousCode+`"}`); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected already-used TOTP code to be rejected, got %d", rr.Code)
+	}
+
+	currentCode, err := auth.TOTPCode(enrollment.Secret, time.Now())
+	if err != nil {
+		t.Fatalf("failed to generate totp code: %v", err)
+	}
+	if rr := post("/api/login/mfa", "", `{"mfa_token":"`+mfaToken+`","code":"`+currentCode+`"}`); rr.Code != http.StatusOK {
+		t.Fatalf("expected TOTP login to succeed, got %d", rr.Code)
+	}
+
+	recoveryCode := strings.ToUpper(confirmation.RecoveryCodes[0])
+	mfaToken = challenge()
+	if rr := post("/api/login/mfa", "", `{"mfa_token":"`+mfaToken+`","code":"`+recoveryCode+`"}`); rr.Code != http.StatusOK {
+		t.Fatalf("expected recovery code login to succeed, got %d", rr.Code)
+	}
+	if rr := post("/api/login/mfa", "", `{"mfa_token":"`+mfaToken+`","code":"`+recoveryCode+`"}`); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected recovery code to be single-use, got %d", rr.Code)
+	}
+}
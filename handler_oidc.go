@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+const oidcStateTTL = 10 * time.Minute
+
+// oidcStateCookie ties a login to the browser that started it. Without it
+// an attacker could send a victim to the callback with the attacker's own
+// code and state, signing the victim into the attacker's account.
+const oidcStateCookie = "tubely_oidc_state"
+
+// setOIDCStateCookie stores state in the browser for the callback to check,
+// or clears it when state is empty. It's only sent to the OIDC endpoints,
+// and Lax still lets it through on the IdP's top-level redirect back.
+func (cfg *apiConfig) setOIDCStateCookie(w http.ResponseWriter, state string) {
+	cookie := &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/api/oidc",
+		MaxAge:   int(oidcStateTTL / time.Second),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(cfg.oidc.oauth2.RedirectURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	}
+	if state == "" {
+		cookie.MaxAge = -1
+	}
+	http.SetCookie(w, cookie)
+}
+
+func (cfg *apiConfig) handlerOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if cfg.oidc == nil {
+		respondWithError(w, http.StatusNotFound, "SSO login is not configured", nil)
+		return
+	}
+
+	state, err := randomURLSafeString()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't generate login state", err)
+		return
+	}
+	nonce, err := randomURLSafeString()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't generate login nonce", err)
+		return
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	err = cfg.requestDB(r.Context()).CreateOIDCState(database.OIDCState{
+		State:        state,
+		Nonce:        nonce,
+		CodeVerifier: verifier,
+		ExpiresAt:    time.Now().UTC().Add(oidcStateTTL),
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save login state", err)
+		return
+	}
+
+	cfg.setOIDCStateCookie(w, state)
+	authURL := cfg.oidc.oauth2.AuthCodeURL(
+		state,
+		oidc.Nonce(nonce),
+		oauth2.S256ChallengeOption(verifier),
+	)
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+func (cfg *apiConfig) handlerOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		database.User
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	if cfg.oidc == nil {
+		respondWithError(w, http.StatusNotFound, "SSO login is not configured", nil)
+		return
+	}
+
+	query := r.URL.Query()
+	if providerErr := query.Get("error"); providerErr != "" {
+		respondWithError(w, http.StatusUnauthorized, "Identity provider returned an error: "+providerErr, nil)
+		return
+	}
+
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(query.Get("state"))) != 1 {
+		respondWithError(w, http.StatusBadRequest, "Login wasn't started from this browser", err)
+		return
+	}
+	cfg.setOIDCStateCookie(w, "")
+
+	state, err := cfg.requestDB(r.Context()).ConsumeOIDCState(query.Get("state"))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get login state", err)
+		return
+	}
+	if state == nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid or expired login state", nil)
+		return
+	}
+
+	token, err := cfg.oidc.oauth2.Exchange(r.Context(), query.Get("code"), oauth2.VerifierOption(state.CodeVerifier))
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't exchange authorization code", err)
+		return
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "Identity provider didn't return an ID token", nil)
+		return
+	}
+
+	idToken, err := cfg.oidc.verifier.Verify(r.Context(), rawIDToken)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't verify ID token", err)
+		return
+	}
+	if idToken.Nonce != state.Nonce {
+		respondWithError(w, http.StatusUnauthorized, "ID token nonce mismatch", nil)
+		return
+	}
+
+	var claims struct {
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't parse ID token claims", err)
+		return
+	}
+
+	user, err := cfg.findOrProvisionOIDCUser(r.Context(), idToken.Issuer, idToken.Subject, claims.Email, claims.EmailVerified)
+	if errors.Is(err, errOIDCEmailUnverified) || errors.Is(err, errOIDCAccountUnverified) {
+		respondWithError(w, http.StatusConflict, "An account with this email already exists", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't provision user", err)
+		return
+	}
+
+	if cfg.requireEmailVerification && user.EmailVerifiedAt == nil {
+		respondWithError(w, http.StatusForbidden, "Email address not verified", nil)
+		return
+	}
+
+	// The identity provider stands in for the password, not the second
+	// factor.
+	if user.TOTPEnabledAt != nil {
+		cfg.respondWithMFAChallenge(w, user)
+		return
+	}
+
+	accessToken, refreshToken, err := cfg.createSession(r, user)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create session", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, response{
+		User:         user,
+		Token:        accessToken,
+		RefreshToken: refreshToken,
+	})
+}
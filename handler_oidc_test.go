@@ -0,0 +1,430 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/mailer"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// mockIdP is a minimal OpenID provider: discovery, JWKS and a token endpoint
+// that enforces PKCE against the challenge from the authorization request.
+type mockIdP struct {
+	server        *httptest.Server
+	key           *rsa.PrivateKey
+	clientID      string
+	subject       string
+	email         string
+	emailVerified bool
+	challenge     string
+	nonce         string
+}
+
+func newMockIdP(t *testing.T, clientID string) *mockIdP {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate idp key: %v", err)
+	}
+	signingKey, err := auth.NewRSAKey("idp-key", key)
+	if err != nil {
+		t.Fatalf("failed to create idp signing key: %v", err)
+	}
+	keySet, err := auth.NewKeySet(signingKey)
+	if err != nil {
+		t.Fatalf("failed to create idp key set: %v", err)
+	}
+
+	idp := &mockIdP{key: key, clientID: clientID, emailVerified: true}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		respondWithJSON(w, http.StatusOK, map[string]any{
+			"issuer":                                idp.server.URL,
+			"authorization_endpoint":                idp.server.URL + "/authorize",
+			"token_endpoint":                        idp.server.URL + "/token",
+			"jwks_uri":                              idp.server.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		respondWithJSON(w, http.StatusOK, keySet.JWKS())
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		sum := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if r.FormValue("code") != "test-code" || base64.RawURLEncoding.EncodeToString(sum[:]) != idp.challenge {
+			respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+			return
+		}
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+			"iss":            idp.server.URL,
+			"sub":            idp.subject,
+			"aud":            idp.clientID,
+			"iat":            time.Now().Unix(),
+			"exp":            time.Now().Add(time.Minute).Unix(),
+			"nonce":          idp.nonce,
+			"email":          idp.email,
+			"email_verified": idp.emailVerified,
+		})
+		token.Header["kid"] = "idp-key"
+		idToken, err := token.SignedString(idp.key)
+		if err != nil {
+			respondWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+			return
+		}
+		respondWithJSON(w, http.StatusOK, map[string]any{
+			"access_token": "idp-access-token",
+			"token_type":   "Bearer",
+			"expires_in":   60,
+			"id_token":     idToken,
+		})
+	})
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+// completeOIDCLogin starts an SSO login and follows it back to the callback
+// as the browser would, with the IdP approving it.
+func completeOIDCLogin(t *testing.T, mux *http.ServeMux, idp *mockIdP) *httptest.ResponseRecorder {
+	t.Helper()
+	loginRR := httptest.NewRecorder()
+	mux.ServeHTTP(loginRR, httptest.NewRequest(http.MethodGet, "/api/oidc/login", nil))
+	if loginRR.Code != http.StatusFound {
+		t.Fatalf("expected redirect, got %d", loginRR.Code)
+	}
+	authURL, err := url.Parse(loginRR.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("invalid authorization url: %v", err)
+	}
+	idp.challenge = authURL.Query().Get("code_challenge")
+	idp.nonce = authURL.Query().Get("nonce")
+
+	callbackReq := httptest.NewRequest(http.MethodGet, "/api/oidc/callback?code=test-code&state="+url.QueryEscape(authURL.Query().Get("state")), nil)
+	for _, cookie := range loginRR.Result().Cookies() {
+		callbackReq.AddCookie(cookie)
+	}
+	callbackRR := httptest.NewRecorder()
+	mux.ServeHTTP(callbackRR, callbackReq)
+	return callbackRR
+}
+
+func TestHandlerOIDCLoginProvisionsAndLinksUser(t *testing.T) {
+	tempDir := t.TempDir()
+	dbPath := filepath.Join(tempDir, "test.db")
+
+	dbClient, err := database.NewClient(dbPath)
+	if err != nil {
+		t.Fatalf("failed to create db client: %v", err)
+	}
+
+	jwtKeys, err := loadJWTKeys("test-secret", "", "")
+	if err != nil {
+		t.Fatalf("failed to load jwt keys: %v", err)
+	}
+
+	idp := newMockIdP(t, "tubely")
+	idp.subject = "user-123"
+	idp.email = "sso@example.com"
+
+	oidcProvider, err := newOIDCClient(context.Background(), idp.server.URL, "tubely", "", "http://localhost:8091/api/oidc/callback")
+	if err != nil {
+		t.Fatalf("failed to configure oidc: %v", err)
+	}
+
+	cfg := apiConfig{
+		db:         dbClient,
+		jwtKeys:    jwtKeys,
+		assetsRoot: tempDir,
+		port:       "8091",
+		oidc:       oidcProvider,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/oidc/login", cfg.handlerOIDCLogin)
+	mux.HandleFunc("GET /api/oidc/callback", cfg.handlerOIDCCallback)
+
+	login := func() database.User {
+		loginRR := httptest.NewRecorder()
+		mux.ServeHTTP(loginRR, httptest.NewRequest(http.MethodGet, "/api/oidc/login", nil))
+		if loginRR.Code != http.StatusFound {
+			t.Fatalf("expected redirect, got %d", loginRR.Code)
+		}
+
+		authURL, err := url.Parse(loginRR.Header().Get("Location"))
+		if err != nil {
+			t.Fatalf("invalid authorization url: %v", err)
+		}
+		if authURL.Query().Get("code_challenge_method") != "S256" {
+			t.Fatalf("expected PKCE S256 challenge in %s", authURL)
+		}
+		idp.challenge = authURL.Query().Get("code_challenge")
+		idp.nonce = authURL.Query().Get("nonce")
+
+		cookies := loginRR.Result().Cookies()
+		if len(cookies) != 1 || !cookies[0].HttpOnly || cookies[0].SameSite != http.SameSiteLaxMode || cookies[0].Value != authURL.Query().Get("state") {
+			t.Fatalf("expected an HttpOnly, SameSite=Lax state cookie, got %+v", cookies)
+		}
+
+		callback := "/api/oidc/callback?code=test-code&state=" + url.QueryEscape(authURL.Query().Get("state"))
+		withCookies := func() *http.Request {
+			req := httptest.NewRequest(http.MethodGet, callback, nil)
+			for _, cookie := range loginRR.Result().Cookies() {
+				req.AddCookie(cookie)
+			}
+			return req
+		}
+
+		// Another browser can't complete the login, which would otherwise
+		// let an attacker sign a victim into the attacker's account.
+		csrfRR := httptest.NewRecorder()
+		mux.ServeHTTP(csrfRR, httptest.NewRequest(http.MethodGet, callback, nil))
+		if csrfRR.Code != http.StatusBadRequest {
+			t.Fatalf("expected callback without the state cookie to be rejected, got %d", csrfRR.Code)
+		}
+
+		callbackRR := httptest.NewRecorder()
+		mux.ServeHTTP(callbackRR, withCookies())
+		if callbackRR.Code != http.StatusOK {
+			t.Fatalf("expected callback status OK, got %d: %s", callbackRR.Code, callbackRR.Body.String())
+		}
+
+		var resp struct {
+			database.User
+			Token string `json:"token"`
+		}
+		if err := json.Unmarshal(callbackRR.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("failed to unmarshal callback response: %v", err)
+		}
+		if _, err := cfg.validateAccessToken(context.Background(), resp.Token); err != nil {
+			t.Fatalf("expected a valid access token: %v", err)
+		}
+
+		replayRR := httptest.NewRecorder()
+		mux.ServeHTTP(replayRR, withCookies())
+		if replayRR.Code != http.StatusBadRequest {
+			t.Fatalf("expected replayed callback to be rejected, got %d", replayRR.Code)
+		}
+		return resp.User
+	}
+
+	first := login()
+	if first.Email != "sso@example.com" {
+		t.Fatalf("unexpected provisioned email: %s", first.Email)
+	}
+
+	second := login()
+	if second.ID != first.ID {
+		t.Fatalf("expected second login to reuse user %s, got %s", first.ID, second.ID)
+	}
+
+	linked, err := cfg.db.GetUserByIdentity(idp.server.URL, "user-123")
+	if err != nil {
+		t.Fatalf("failed to look up identity: %v", err)
+	}
+	if linked == nil || linked.ID != first.ID {
+		t.Fatalf("expected identity to be linked to %s", first.ID)
+	}
+}
+
+func TestHandlerOIDCLoginRequiresMFA(t *testing.T) {
+	tempDir := t.TempDir()
+	dbClient, err := database.NewClient(filepath.Join(tempDir, "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create db client: %v", err)
+	}
+	jwtKeys, err := loadJWTKeys("test-secret", "", "")
+	if err != nil {
+		t.Fatalf("failed to load jwt keys: %v", err)
+	}
+
+	idp := newMockIdP(t, "tubely")
+	idp.subject = "user-456"
+	idp.email = "sso-mfa@example.com"
+	oidcProvider, err := newOIDCClient(context.Background(), idp.server.URL, "tubely", "", "http://localhost:8091/api/oidc/callback")
+	if err != nil {
+		t.Fatalf("failed to configure oidc: %v", err)
+	}
+	cfg := apiConfig{
+		db:         dbClient,
+		jwtKeys:    jwtKeys,
+		assetsRoot: tempDir,
+		port:       "8091",
+		oidc:       oidcProvider,
+	}
+
+	user, err := dbClient.CreateUser(database.CreateUserParams{Email: "sso-mfa@example.com", Password: "unused"})
+	if err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	if _, err := dbClient.MarkEmailVerified(user.ID, user.Email); err != nil {
+		t.Fatalf("failed to verify email: %v", err)
+	}
+	secret, err := auth.MakeTOTPSecret()
+	if err != nil {
+		t.Fatalf("failed to make totp secret: %v", err)
+	}
+	if err := dbClient.SetPendingTOTPSecret(user.ID, secret); err != nil {
+		t.Fatalf("failed to set totp secret: %v", err)
+	}
+	if err := dbClient.EnableTOTP(user.ID, nil); err != nil {
+		t.Fatalf("failed to enable totp: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/oidc/login", cfg.handlerOIDCLogin)
+	mux.HandleFunc("GET /api/oidc/callback", cfg.handlerOIDCCallback)
+	mux.HandleFunc("POST /api/login/mfa", cfg.handlerLoginMFA)
+
+	callbackRR := completeOIDCLogin(t, mux, idp)
+	if callbackRR.Code != http.StatusOK {
+		t.Fatalf("expected callback status OK, got %d: %s", callbackRR.Code, callbackRR.Body.String())
+	}
+	var challenge struct {
+		MFARequired bool   `json:"mfa_required"`
+		MFAToken    string `json:"mfa_token"`
+		Token       string `json:"token"`
+	}
+	if err := json.Unmarshal(callbackRR.Body.Bytes(), &challenge); err != nil {
+		t.Fatalf("failed to unmarshal callback response: %v", err)
+	}
+	if !challenge.MFARequired || challenge.MFAToken == "" || challenge.Token != "" {
+		t.Fatalf("expected an MFA challenge instead of tokens, got %s", callbackRR.Body.String())
+	}
+
+	code, err := auth.TOTPCode(secret, time.Now())
+	if err != nil {
+		t.Fatalf("failed to generate totp code: %v", err)
+	}
+	mfaRR := httptest.NewRecorder()
+	mux.ServeHTTP(mfaRR, httptest.NewRequest(http.MethodPost, "/api/login/mfa", strings.NewReader(`{"mfa_token":"`+challenge.MFAToken+`","code":"`+code+`"}`)))
+	if mfaRR.Code != http.StatusOK {
+		t.Fatalf("expected SSO login to complete with a TOTP code, got %d: %s", mfaRR.Code, mfaRR.Body.String())
+	}
+}
+
+func TestHandlerOIDCLoginOnlyLinksVerifiedAccounts(t *testing.T) {
+	tempDir := t.TempDir()
+	dbClient, err := database.NewClient(filepath.Join(tempDir, "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create db client: %v", err)
+	}
+	jwtKeys, err := loadJWTKeys("test-secret", "", "")
+	if err != nil {
+		t.Fatalf("failed to load jwt keys: %v", err)
+	}
+
+	idp := newMockIdP(t, "tubely")
+	idp.subject = "victim"
+	idp.email = "victim@example.com"
+	oidcProvider, err := newOIDCClient(context.Background(), idp.server.URL, "tubely", "", "http://localhost:8091/api/oidc/callback")
+	if err != nil {
+		t.Fatalf("failed to configure oidc: %v", err)
+	}
+	cfg := apiConfig{
+		db:         dbClient,
+		jwtKeys:    jwtKeys,
+		assetsRoot: tempDir,
+		port:       "8091",
+		oidc:       oidcProvider,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/oidc/login", cfg.handlerOIDCLogin)
+	mux.HandleFunc("GET /api/oidc/callback", cfg.handlerOIDCCallback)
+
+	// Someone else signed up with the address first and never verified it.
+	squatter, err := dbClient.CreateUser(database.CreateUserParams{Email: "victim@example.com", Password: "unused"})
+	if err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	if rr := completeOIDCLogin(t, mux, idp); rr.Code != http.StatusConflict {
+		t.Fatalf("expected SSO login not to link an unverified account, got %d: %s", rr.Code, rr.Body.String())
+	}
+	linked, err := dbClient.GetUserByIdentity(idp.server.URL, "victim")
+	if err != nil {
+		t.Fatalf("failed to look up identity: %v", err)
+	}
+	if linked != nil {
+		t.Fatalf("expected no identity to be linked, got user %s", linked.ID)
+	}
+
+	if _, err := dbClient.MarkEmailVerified(squatter.ID, squatter.Email); err != nil {
+		t.Fatalf("failed to verify email: %v", err)
+	}
+	rr := completeOIDCLogin(t, mux, idp)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected SSO login to link the verified account, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var resp database.User
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("failed to unmarshal callback response: %v", err)
+	}
+	if resp.ID != squatter.ID {
+		t.Fatalf("expected login as %s, got %s", squatter.ID, resp.ID)
+	}
+}
+
+func TestHandlerOIDCLoginRequiresVerifiedEmail(t *testing.T) {
+	tempDir := t.TempDir()
+	mailDir := filepath.Join(tempDir, "mail")
+	dbClient, err := database.NewClient(filepath.Join(tempDir, "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create db client: %v", err)
+	}
+	jwtKeys, err := loadJWTKeys("test-secret", "", "")
+	if err != nil {
+		t.Fatalf("failed to load jwt keys: %v", err)
+	}
+
+	idp := newMockIdP(t, "tubely")
+	idp.subject = "newcomer"
+	idp.email = "newcomer@example.com"
+	idp.emailVerified = false
+	oidcProvider, err := newOIDCClient(context.Background(), idp.server.URL, "tubely", "", "http://localhost:8091/api/oidc/callback")
+	if err != nil {
+		t.Fatalf("failed to configure oidc: %v", err)
+	}
+	cfg := apiConfig{
+		db:                       dbClient,
+		jwtKeys:                  jwtKeys,
+		assetsRoot:               tempDir,
+		port:                     "8091",
+		oidc:                     oidcProvider,
+		mailer:                   mailer.FileMailer{Dir: mailDir, From: "test@tubely.local"},
+		requireEmailVerification: true,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/oidc/login", cfg.handlerOIDCLogin)
+	mux.HandleFunc("GET /api/oidc/callback", cfg.handlerOIDCCallback)
+	mux.HandleFunc("POST /api/users/verify_email/confirm", cfg.handlerVerifyEmailConfirm)
+
+	if rr := completeOIDCLogin(t, mux, idp); rr.Code != http.StatusForbidden {
+		t.Fatalf("expected SSO login with an unverified email to be blocked, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	verifyToken := lastEmailLinkParam(t, mailDir, "verify_email_token")
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/api/users/verify_email/confirm", strings.NewReader(`{"token":"`+verifyToken+`"}`)))
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("expected email verification to succeed, got %d", rr.Code)
+	}
+
+	if rr := completeOIDCLogin(t, mux, idp); rr.Code != http.StatusOK {
+		t.Fatalf("expected SSO login to succeed once verified, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// handlerPasswordResetRequest always responds 202 so the endpoint can't be
+// used to discover which emails have accounts. The account is looked up and
+// emailed after responding, so the response time doesn't give it away
+// either.
+func (cfg *apiConfig) handlerPasswordResetRequest(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Email string `json:"email"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	sendEmailInBackground(r.Context(), "password reset", func(ctx context.Context) error {
+		user, err := cfg.requestDB(ctx).GetUserByEmail(params.Email)
+		if err != nil || user.ID == uuid.Nil {
+			return err
+		}
+		return cfg.sendPasswordResetEmail(ctx, user)
+	})
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// handlerPasswordResetConfirm sets a new password and signs the user out
+// everywhere, since a reset usually means the old password can't be trusted.
+func (cfg *apiConfig) handlerPasswordResetConfirm(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if params.Password == "" {
+		respondWithError(w, http.StatusBadRequest, "Password is required", nil)
+		return
+	}
+
+	userToken, err := cfg.requestDB(r.Context()).ConsumeUserToken(auth.HashToken(params.Token), database.UserTokenResetPassword)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check reset token", err)
+		return
+	}
+	if userToken == nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid or expired reset token", nil)
+		return
+	}
+
+	hashedPassword, err := auth.HashPassword(params.Password)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't hash password", err)
+		return
+	}
+	if err := cfg.requestDB(r.Context()).UpdateUserPassword(userToken.UserID, hashedPassword); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update password", err)
+		return
+	}
+
+	if err := cfg.requestDB(r.Context()).RevokeAllRefreshTokens(userToken.UserID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke sessions", err)
+		return
+	}
+	if err := cfg.requestDB(r.Context()).IncrementTokenVersion(userToken.UserID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't invalidate access tokens", err)
+		return
+	}
+
+	// Following the emailed link also proves the user owns the address.
+	if _, err := cfg.requestDB(r.Context()).MarkEmailVerified(userToken.UserID, userToken.Email); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't verify email", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
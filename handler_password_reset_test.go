@@ -0,0 +1,177 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/mailer"
+)
+
+var emailLinkPattern = regexp.MustCompile(`http://\S+`)
+
+// lastEmailLinkParam returns a query parameter from the link in the most
+// recent email written by a FileMailer.
+func lastEmailLinkParam(t *testing.T, mailDir, param string) string {
+	t.Helper()
+	pendingEmails.Wait()
+	paths, err := filepath.Glob(filepath.Join(mailDir, "*.eml"))
+	if err != nil || len(paths) == 0 {
+		t.Fatalf("expected an email in %s: %v", mailDir, err)
+	}
+	data, err := os.ReadFile(paths[len(paths)-1])
+	if err != nil {
+		t.Fatalf("failed to read email: %v", err)
+	}
+	link, err := url.Parse(emailLinkPattern.FindString(string(data)))
+	if err != nil {
+		t.Fatalf("invalid link in email: %v", err)
+	}
+	value := link.Query().Get(param)
+	if value == "" {
+		t.Fatalf("expected %s in email link %s", param, link)
+	}
+	return value
+}
+
+func TestEmailVerificationAndPasswordReset(t *testing.T) {
+	tempDir := t.TempDir()
+	dbPath := filepath.Join(tempDir, "test.db")
+	mailDir := filepath.Join(tempDir, "mail")
+
+	dbClient, err := database.NewClient(dbPath)
+	if err != nil {
+		t.Fatalf("failed to create db client: %v", err)
+	}
+
+	jwtKeys, err := loadJWTKeys("test-secret", "", "")
+	if err != nil {
+		t.Fatalf("failed to load jwt keys: %v", err)
+	}
+
+	cfg := apiConfig{
+		db:                       dbClient,
+		jwtKeys:                  jwtKeys,
+		assetsRoot:               tempDir,
+		port:                     "8091",
+		mailer:                   mailer.FileMailer{Dir: mailDir, From: "test@tubely.local"},
+		requireEmailVerification: true,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/users", cfg.handlerUsersCreate)
+	mux.HandleFunc("POST /api/login", cfg.handlerLogin)
+	mux.HandleFunc("POST /api/users/verify_email/confirm", cfg.handlerVerifyEmailConfirm)
+	mux.HandleFunc("POST /api/users/password_reset", cfg.handlerPasswordResetRequest)
+	mux.HandleFunc("POST /api/users/password_reset/confirm", cfg.handlerPasswordResetConfirm)
+
+	post := func(path, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+		return rr
+	}
+
+	if rr := post("/api/users", `{"email":"reset@example.com","password":"old-password"}`); rr.Code != http.StatusCreated {
+		t.Fatalf("expected user to be created, got %d", rr.Code)
+	}
+
+	if rr := post("/api/login", `{"email":"reset@example.com","password":"old-password"}`); rr.Code != http.StatusForbidden {
+		t.Fatalf("expected unverified login to be blocked, got %d", rr.Code)
+	}
+
+	verifyToken := lastEmailLinkParam(t, mailDir, "verify_email_token")
+	if rr := post("/api/users/verify_email/confirm", `{"token":"`+verifyToken+`"}`); rr.Code != http.StatusNoContent {
+		t.Fatalf("expected email verification to succeed, got %d", rr.Code)
+	}
+	if rr := post("/api/users/verify_email/confirm", `{"token":"`+verifyToken+`"}`); rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected verification token to be single-use, got %d", rr.Code)
+	}
+
+	if rr := post("/api/login", `{"email":"reset@example.com","password":"old-password"}`); rr.Code != http.StatusOK {
+		t.Fatalf("expected verified login to succeed, got %d", rr.Code)
+	}
+
+	if rr := post("/api/users/password_reset", `{"email":"nobody@example.com"}`); rr.Code != http.StatusAccepted {
+		t.Fatalf("expected reset request for unknown email to be accepted, got %d", rr.Code)
+	}
+	if rr := post("/api/users/password_reset", `{"email":"reset@example.com"}`); rr.Code != http.StatusAccepted {
+		t.Fatalf("expected reset request to be accepted, got %d", rr.Code)
+	}
+
+	pendingEmails.Wait()
+	if paths, _ := filepath.Glob(filepath.Join(mailDir, "*.eml")); len(paths) != 2 {
+		t.Fatalf("expected only the verification and reset emails, got %d", len(paths))
+	}
+	resetToken := lastEmailLinkParam(t, mailDir, "reset_password_token")
+	if rr := post("/api/users/password_reset/confirm", `{"token":"`+resetToken+`","password":"new-password"}`); rr.Code != http.StatusNoContent {
+		t.Fatalf("expected password reset to succeed, got %d", rr.Code)
+	}
+	if rr := post("/api/users/password_reset/confirm", `{"token":"`+resetToken+`","password":"another-password"}`); rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected reset token to be single-use, got %d", rr.Code)
+	}
+
+	if rr := post("/api/login", `{"email":"reset@example.com","password":"old-password"}`); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected old password to be rejected, got %d", rr.Code)
+	}
+	if rr := post("/api/login", `{"email":"reset@example.com","password":"new-password"}`); rr.Code != http.StatusOK {
+		t.Fatalf("expected new password to work, got %d", rr.Code)
+	}
+}
+
+func TestConsumeUserTokenOnce(t *testing.T) {
+	dbClient, err := database.NewClient(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create db client: %v", err)
+	}
+	user, err := dbClient.CreateUser(database.CreateUserParams{Email: "racer@example.com", Password: "unused"})
+	if err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	err = dbClient.CreateUserToken(database.CreateUserTokenParams{
+		TokenHash: "hash",
+		UserID:    user.ID,
+		Purpose:   database.UserTokenResetPassword,
+		ExpiresAt: time.Now().Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatalf("failed to create token: %v", err)
+	}
+
+	const attempts = 10
+	consumed := make(chan *database.UserToken, attempts)
+	var wg sync.WaitGroup
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			token, err := dbClient.ConsumeUserToken("hash", database.UserTokenResetPassword)
+			if err != nil {
+				t.Errorf("failed to consume token: %v", err)
+			}
+			consumed <- token
+		}()
+	}
+	wg.Wait()
+	close(consumed)
+
+	var winners []*database.UserToken
+	for token := range consumed {
+		if token != nil {
+			winners = append(winners, token)
+		}
+	}
+	if len(winners) != 1 {
+		t.Fatalf("expected the token to be consumed exactly once, got %d", len(winners))
+	}
+	if winners[0].UserID != user.ID || winners[0].UsedAt == nil {
+		t.Fatalf("expected the consumed token to be returned as used, got %+v", winners[0])
+	}
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+type playlistResponse struct {
+	database.Playlist
+	Videos []database.Video `json:"videos"`
+}
+
+// ownedPlaylist loads the playlist named in the request path and checks that
+// the caller owns it, writing the error response if not.
+func (cfg *apiConfig) ownedPlaylist(w http.ResponseWriter, r *http.Request) (database.Playlist, bool) {
+	playlistID, err := uuid.Parse(r.PathValue("playlistID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return database.Playlist{}, false
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return database.Playlist{}, false
+	}
+	userID, err := cfg.validateAccessToken(r.Context(), token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return database.Playlist{}, false
+	}
+
+	playlist, err := cfg.requestDB(r.Context()).GetPlaylist(playlistID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get playlist", err)
+		return database.Playlist{}, false
+	}
+	if playlist.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Playlist not found", nil)
+		return database.Playlist{}, false
+	}
+	if playlist.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "You don't own this playlist", nil)
+		return database.Playlist{}, false
+	}
+	return playlist, true
+}
+
+// playlistForViewer loads the playlist's items and drops the ones viewerID
+// isn't allowed to see, since a public playlist can still contain private
+// videos. That applies to the owner too: videos they added can later be
+// made private or unshared. The thumbnail and count are recomputed to match.
+func (cfg *apiConfig) playlistForViewer(ctx context.Context, playlist database.Playlist, viewerID uuid.UUID) (playlistResponse, error) {
+	videos, err := cfg.requestDB(ctx).GetPlaylistVideos(playlist.ID)
+	if err != nil {
+		return playlistResponse{}, err
+	}
+	visible, _, err := cfg.splitVisibleVideos(ctx, videos, viewerID)
+	if err != nil {
+		return playlistResponse{}, err
+	}
+
+	playlist.ItemCount = len(visible)
+	playlist.ThumbnailURL = nil
+	if len(visible) > 0 {
+		playlist.ThumbnailURL = visible[0].ThumbnailURL
+	}
+	return playlistResponse{Playlist: playlist, Videos: visible}, nil
+}
+
+// splitVisibleVideos separates the videos viewerID may see from the ones
+// they may not, keeping their order.
+func (cfg *apiConfig) splitVisibleVideos(ctx context.Context, videos []database.Video, viewerID uuid.UUID) (visible, hidden []database.Video, err error) {
+	visible = []database.Video{}
+	for _, video := range videos {
+		canView, err := cfg.canViewVideo(ctx, video, viewerID)
+		if err != nil {
+			return nil, nil, err
+		}
+		if canView {
+			visible = append(visible, video)
+		} else {
+			hidden = append(hidden, video)
+		}
+	}
+	return visible, hidden, nil
+}
+
+func (cfg *apiConfig) handlerPlaylistCreate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Title       string                   `json:"title"`
+		Description string                   `json:"description"`
+		Visibility  database.VideoVisibility `json:"visibility"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateAccessToken(r.Context(), token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	params.Title = strings.TrimSpace(params.Title)
+	if params.Title == "" {
+		respondWithError(w, http.StatusBadRequest, "Title is required", nil)
+		return
+	}
+	if params.Visibility != "" && !params.Visibility.Valid() {
+		respondWithError(w, http.StatusBadRequest, "Invalid visibility", nil)
+		return
+	}
+
+	playlist, err := cfg.requestDB(r.Context()).CreatePlaylist(database.CreatePlaylistParams{
+		Title:       params.Title,
+		Description: params.Description,
+		UserID:      userID,
+		Visibility:  params.Visibility,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create playlist", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, playlist)
+}
+
+func (cfg *apiConfig) handlerPlaylistsRetrieve(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateAccessToken(r.Context(), token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	playlists, err := cfg.requestDB(r.Context()).GetPlaylists(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve playlists", err)
+		return
+	}
+	for i, playlist := range playlists {
+		resp, err := cfg.playlistForViewer(r.Context(), playlist, userID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't get playlist items", err)
+			return
+		}
+		playlists[i] = resp.Playlist
+	}
+
+	respondWithJSON(w, http.StatusOK, playlists)
+}
+
+func (cfg *apiConfig) handlerPlaylistGet(w http.ResponseWriter, r *http.Request) {
+	playlistID, err := uuid.Parse(r.PathValue("playlistID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	viewerID, err := cfg.viewerID(r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	playlist, err := cfg.requestDB(r.Context()).GetPlaylist(playlistID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get playlist", err)
+		return
+	}
+	if playlist.ID == uuid.Nil ||
+		(playlist.Visibility == database.VideoVisibilityPrivate && playlist.UserID != viewerID) {
+		respondWithError(w, http.StatusNotFound, "Playlist not found", nil)
+		return
+	}
+
+	resp, err := cfg.playlistForViewer(r.Context(), playlist, viewerID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get playlist items", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+func (cfg *apiConfig) handlerPlaylistUpdate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Title       *string                   `json:"title"`
+		Description *string                   `json:"description"`
+		Visibility  *database.VideoVisibility `json:"visibility"`
+	}
+
+	playlist, ok := cfg.ownedPlaylist(w, r)
+	if !ok {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	if params.Title != nil {
+		playlist.Title = strings.TrimSpace(*params.Title)
+		if playlist.Title == "" {
+			respondWithError(w, http.StatusBadRequest, "Title is required", nil)
+			return
+		}
+	}
+	if params.Description != nil {
+		playlist.Description = *params.Description
+	}
+	if params.Visibility != nil {
+		if !params.Visibility.Valid() {
+			respondWithError(w, http.StatusBadRequest, "Invalid visibility", nil)
+			return
+		}
+		playlist.Visibility = *params.Visibility
+	}
+
+	if err := cfg.requestDB(r.Context()).UpdatePlaylist(playlist); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update playlist", err)
+		return
+	}
+
+	updated, err := cfg.requestDB(r.Context()).GetPlaylist(playlist.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve updated playlist", err)
+		return
+	}
+	resp, err := cfg.playlistForViewer(r.Context(), updated, updated.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get playlist items", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, resp.Playlist)
+}
+
+func (cfg *apiConfig) handlerPlaylistDelete(w http.ResponseWriter, r *http.Request) {
+	playlist, ok := cfg.ownedPlaylist(w, r)
+	if !ok {
+		return
+	}
+
+	if err := cfg.requestDB(r.Context()).DeletePlaylist(playlist.ID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete playlist", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerPlaylistItemAdd appends a video to the playlist. Any video the owner
+// can see may be added, including other users' public videos.
+func (cfg *apiConfig) handlerPlaylistItemAdd(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		VideoID uuid.UUID `json:"video_id"`
+	}
+
+	playlist, ok := cfg.ownedPlaylist(w, r)
+	if !ok {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	video, err := cfg.requestDB(r.Context()).GetVideo(params.VideoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	canView := false
+	if video.ID != uuid.Nil {
+		canView, err = cfg.canViewVideo(r.Context(), video, playlist.UserID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't check video access", err)
+			return
+		}
+	}
+	if !canView {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+
+	added, err := cfg.requestDB(r.Context()).AddPlaylistItem(playlist.ID, video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't add video to playlist", err)
+		return
+	}
+	if !added {
+		respondWithError(w, http.StatusConflict, "Video is already in the playlist", nil)
+		return
+	}
+
+	cfg.respondWithPlaylist(r.Context(), w, http.StatusCreated, playlist.ID)
+}
+
+func (cfg *apiConfig) handlerPlaylistItemRemove(w http.ResponseWriter, r *http.Request) {
+	playlist, ok := cfg.ownedPlaylist(w, r)
+	if !ok {
+		return
+	}
+
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		return
+	}
+
+	removed, err := cfg.requestDB(r.Context()).RemovePlaylistItem(playlist.ID, videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't remove video from playlist", err)
+		return
+	}
+	if !removed {
+		respondWithError(w, http.StatusNotFound, "Video isn't in the playlist", nil)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerPlaylistReorder sets the playlist's order. The request has to list
+// every video in the playlist the owner can see exactly once, so a client
+// working from a stale copy can't silently drop or duplicate items. Videos
+// the owner can no longer see keep their relative order at the end.
+func (cfg *apiConfig) handlerPlaylistReorder(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		VideoIDs []uuid.UUID `json:"video_ids"`
+	}
+
+	playlist, ok := cfg.ownedPlaylist(w, r)
+	if !ok {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	videos, err := cfg.requestDB(r.Context()).GetPlaylistVideos(playlist.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get playlist items", err)
+		return
+	}
+	visible, hidden, err := cfg.splitVisibleVideos(r.Context(), videos, playlist.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check video access", err)
+		return
+	}
+
+	current := make(map[uuid.UUID]bool, len(visible))
+	for _, video := range visible {
+		current[video.ID] = true
+	}
+	if len(params.VideoIDs) != len(current) {
+		respondWithError(w, http.StatusConflict, "Order must list every video in the playlist exactly once", nil)
+		return
+	}
+	for _, id := range params.VideoIDs {
+		if !current[id] {
+			respondWithError(w, http.StatusConflict, "Order must list every video in the playlist exactly once", nil)
+			return
+		}
+		delete(current, id)
+	}
+	order := params.VideoIDs
+	for _, video := range hidden {
+		order = append(order, video.ID)
+	}
+
+	if err := cfg.requestDB(r.Context()).ReorderPlaylist(playlist.ID, order); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't reorder playlist", err)
+		return
+	}
+
+	cfg.respondWithPlaylist(r.Context(), w, http.StatusOK, playlist.ID)
+}
+
+// respondWithPlaylist responds with the owner's view of the playlist, which
+// leaves out videos they can no longer see.
+func (cfg *apiConfig) respondWithPlaylist(ctx context.Context, w http.ResponseWriter, code int, playlistID uuid.UUID) {
+	playlist, err := cfg.requestDB(ctx).GetPlaylist(playlistID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve updated playlist", err)
+		return
+	}
+	resp, err := cfg.playlistForViewer(ctx, playlist, playlist.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get playlist items", err)
+		return
+	}
+	respondWithJSON(w, code, resp)
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func TestPlaylists(t *testing.T) {
+	tempDir := t.TempDir()
+	dbPath := filepath.Join(tempDir, "test.db")
+
+	dbClient, err := database.NewClient(dbPath)
+	if err != nil {
+		t.Fatalf("failed to create db client: %v", err)
+	}
+
+	jwtKeys, err := loadJWTKeys("test-secret", "", "")
+	if err != nil {
+		t.Fatalf("failed to load jwt keys: %v", err)
+	}
+
+	cfg := apiConfig{
+		db:         dbClient,
+		jwtKeys:    jwtKeys,
+		assetsRoot: tempDir,
+		port:       "8091",
+	}
+
+	user, err := dbClient.CreateUser(database.CreateUserParams{Email: "curator@example.com", Password: "unused"})
+	if err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	token, err := jwtKeys.MakeJWT(user.ID, user.TokenVersion, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create jwt: %v", err)
+	}
+
+	var videos []database.Video
+	for i, visibility := range []database.VideoVisibility{
+		database.VideoVisibilityPrivate,
+		database.VideoVisibilityPublic,
+		database.VideoVisibilityPublic,
+	} {
+		video, err := dbClient.CreateVideo(database.CreateVideoParams{
+			Title:      fmt.Sprintf("Video %d", i),
+			UserID:     user.ID,
+			Visibility: visibility,
+		})
+		if err != nil {
+			t.Fatalf("failed to create video: %v", err)
+		}
+		thumbnailURL := fmt.Sprintf("http://localhost:8091/assets/thumb%d.png", i)
+		video.ThumbnailURL = &thumbnailURL
+		if err := dbClient.UpdateVideo(video); err != nil {
+			t.Fatalf("failed to update video: %v", err)
+		}
+		videos = append(videos, video)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/playlists", cfg.handlerPlaylistCreate)
+	mux.HandleFunc("GET /api/playlists/{playlistID}", cfg.handlerPlaylistGet)
+	mux.HandleFunc("PATCH /api/playlists/{playlistID}", cfg.handlerPlaylistUpdate)
+	mux.HandleFunc("POST /api/playlists/{playlistID}/items", cfg.handlerPlaylistItemAdd)
+	mux.HandleFunc("PUT /api/playlists/{playlistID}/items", cfg.handlerPlaylistReorder)
+	mux.HandleFunc("DELETE /api/playlists/{playlistID}/items/{videoID}", cfg.handlerPlaylistItemRemove)
+
+	do := func(method, path, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+	decode := func(rr *httptest.ResponseRecorder) playlistResponse {
+		t.Helper()
+		var resp playlistResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("failed to decode playlist: %v", err)
+		}
+		return resp
+	}
+	order := func(resp playlistResponse) []uuid.UUID {
+		ids := []uuid.UUID{}
+		for _, video := range resp.Videos {
+			ids = append(ids, video.ID)
+		}
+		return ids
+	}
+
+	rr := do(http.MethodPost, "/api/playlists", token, `{"title":"Favourites"}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected playlist to be created, got %d", rr.Code)
+	}
+	playlist := decode(rr)
+	if playlist.Visibility != database.VideoVisibilityPrivate {
+		t.Fatalf("expected new playlists to be private, got %q", playlist.Visibility)
+	}
+	playlistPath := "/api/playlists/" + playlist.ID.String()
+
+	for _, video := range videos {
+		rr = do(http.MethodPost, playlistPath+"/items", token, `{"video_id":"`+video.ID.String()+`"}`)
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("expected video to be added, got %d", rr.Code)
+		}
+	}
+	if rr := do(http.MethodPost, playlistPath+"/items", token, `{"video_id":"`+videos[0].ID.String()+`"}`); rr.Code != http.StatusConflict {
+		t.Fatalf("expected duplicate item to conflict, got %d", rr.Code)
+	}
+	playlist = decode(rr)
+	if playlist.ItemCount != 3 || *playlist.ThumbnailURL != *videos[0].ThumbnailURL {
+		t.Fatalf("expected 3 items with the first video's thumbnail, got %+v", playlist.Playlist)
+	}
+
+	reordered := []uuid.UUID{videos[2].ID, videos[0].ID, videos[1].ID}
+	body, _ := json.Marshal(map[string][]uuid.UUID{"video_ids": reordered})
+	rr = do(http.MethodPut, playlistPath+"/items", token, string(body))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected reorder to succeed, got %d", rr.Code)
+	}
+	playlist = decode(rr)
+	if fmt.Sprint(order(playlist)) != fmt.Sprint(reordered) {
+		t.Fatalf("unexpected order after reorder: %v", order(playlist))
+	}
+	if *playlist.ThumbnailURL != *videos[2].ThumbnailURL {
+		t.Fatalf("expected thumbnail to follow the new first item")
+	}
+	body, _ = json.Marshal(map[string][]uuid.UUID{"video_ids": reordered[:2]})
+	if rr := do(http.MethodPut, playlistPath+"/items", token, string(body)); rr.Code != http.StatusConflict {
+		t.Fatalf("expected partial reorder to be rejected, got %d", rr.Code)
+	}
+
+	if rr := do(http.MethodGet, playlistPath, "", ""); rr.Code != http.StatusNotFound {
+		t.Fatalf("expected private playlist to be hidden, got %d", rr.Code)
+	}
+	if rr := do(http.MethodPatch, playlistPath, token, `{"visibility":"public"}`); rr.Code != http.StatusOK {
+		t.Fatalf("expected playlist update to succeed, got %d", rr.Code)
+	}
+	rr = do(http.MethodGet, playlistPath, "", "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected public playlist to be readable, got %d", rr.Code)
+	}
+	if public := decode(rr); public.ItemCount != 2 || len(public.Videos) != 2 {
+		t.Fatalf("expected private video to be hidden from anonymous viewers, got %v", order(public))
+	}
+
+	if err := dbClient.DeleteVideo(videos[2].ID); err != nil {
+		t.Fatalf("failed to delete video: %v", err)
+	}
+	playlist = decode(do(http.MethodGet, playlistPath, token, ""))
+	if fmt.Sprint(order(playlist)) != fmt.Sprint(reordered[1:]) {
+		t.Fatalf("expected deleted video to leave the playlist, got %v", order(playlist))
+	}
+
+	if rr := do(http.MethodDelete, playlistPath+"/items/"+videos[0].ID.String(), token, ""); rr.Code != http.StatusNoContent {
+		t.Fatalf("expected item removal to succeed, got %d", rr.Code)
+	}
+	body, _ = json.Marshal(map[string][]uuid.UUID{"video_ids": {videos[1].ID}})
+	rr = do(http.MethodPut, playlistPath+"/items", token, string(body))
+	if rr.Code != http.StatusOK || decode(rr).ItemCount != 1 {
+		t.Fatalf("expected single remaining item, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestPlaylistHidesVideosMadePrivate(t *testing.T) {
+	tempDir := t.TempDir()
+	dbClient, err := database.NewClient(filepath.Join(tempDir, "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create db client: %v", err)
+	}
+	jwtKeys, err := loadJWTKeys("test-secret", "", "")
+	if err != nil {
+		t.Fatalf("failed to load jwt keys: %v", err)
+	}
+	cfg := apiConfig{db: dbClient, jwtKeys: jwtKeys, assetsRoot: tempDir, port: "8091"}
+
+	curator, err := dbClient.CreateUser(database.CreateUserParams{Email: "curator@example.com", Password: "unused"})
+	if err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	uploader, err := dbClient.CreateUser(database.CreateUserParams{Email: "uploader@example.com", Password: "unused"})
+	if err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	token, err := jwtKeys.MakeJWT(curator.ID, curator.TokenVersion, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create jwt: %v", err)
+	}
+
+	var videos []database.Video
+	for i, owner := range []uuid.UUID{uploader.ID, curator.ID} {
+		video, err := dbClient.CreateVideo(database.CreateVideoParams{
+			Title:      fmt.Sprintf("Video %d", i),
+			UserID:     owner,
+			Visibility: database.VideoVisibilityPublic,
+		})
+		if err != nil {
+			t.Fatalf("failed to create video: %v", err)
+		}
+		thumbnailURL := fmt.Sprintf("http://localhost:8091/assets/thumb%d.png", i)
+		video.ThumbnailURL = &thumbnailURL
+		if err := dbClient.UpdateVideo(video); err != nil {
+			t.Fatalf("failed to update video: %v", err)
+		}
+		videos = append(videos, video)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/playlists", cfg.handlerPlaylistCreate)
+	mux.HandleFunc("GET /api/playlists", cfg.handlerPlaylistsRetrieve)
+	mux.HandleFunc("GET /api/playlists/{playlistID}", cfg.handlerPlaylistGet)
+	mux.HandleFunc("POST /api/playlists/{playlistID}/items", cfg.handlerPlaylistItemAdd)
+	mux.HandleFunc("PUT /api/playlists/{playlistID}/items", cfg.handlerPlaylistReorder)
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+	decode := func(rr *httptest.ResponseRecorder) playlistResponse {
+		t.Helper()
+		var resp playlistResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("failed to decode playlist: %v", err)
+		}
+		return resp
+	}
+
+	playlist := decode(do(http.MethodPost, "/api/playlists", `{"title":"Watch later"}`))
+	playlistPath := "/api/playlists/" + playlist.ID.String()
+	for _, video := range videos {
+		if rr := do(http.MethodPost, playlistPath+"/items", `{"video_id":"`+video.ID.String()+`"}`); rr.Code != http.StatusCreated {
+			t.Fatalf("expected video to be added, got %d", rr.Code)
+		}
+	}
+
+	// The uploader makes their video private after it was added.
+	videos[0].Visibility = database.VideoVisibilityPrivate
+	if err := dbClient.UpdateVideo(videos[0]); err != nil {
+		t.Fatalf("failed to update video: %v", err)
+	}
+
+	playlist = decode(do(http.MethodGet, playlistPath, ""))
+	if len(playlist.Videos) != 1 || playlist.Videos[0].ID != videos[1].ID {
+		t.Fatalf("expected the private video to be hidden from the playlist owner, got %+v", playlist.Videos)
+	}
+	if playlist.ItemCount != 1 || *playlist.ThumbnailURL != *videos[1].ThumbnailURL {
+		t.Fatalf("expected the count and thumbnail to skip the private video, got %+v", playlist.Playlist)
+	}
+
+	var playlists []database.Playlist
+	if err := json.Unmarshal(do(http.MethodGet, "/api/playlists", "").Body.Bytes(), &playlists); err != nil {
+		t.Fatalf("failed to decode playlists: %v", err)
+	}
+	if len(playlists) != 1 || playlists[0].ItemCount != 1 || *playlists[0].ThumbnailURL != *videos[1].ThumbnailURL {
+		t.Fatalf("expected the playlist list to skip the private video, got %+v", playlists)
+	}
+
+	rr := do(http.MethodPut, playlistPath+"/items", `{"video_ids":["`+videos[1].ID.String()+`"]}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected reorder of the visible videos to succeed, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if got := decode(rr); len(got.Videos) != 1 {
+		t.Fatalf("expected reorder not to reveal the private video, got %+v", got.Videos)
+	}
+}
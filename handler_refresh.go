@@ -2,7 +2,6 @@ package main
 
 import (
 	"net/http"
-	"time"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
 )
@@ -18,16 +17,25 @@ func (cfg *apiConfig) handlerRefresh(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := cfg.db.GetUserByRefreshToken(refreshToken)
+	user, err := cfg.requestDB(r.Context()).GetUserByRefreshToken(refreshToken)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't get user for refresh token", err)
 		return
 	}
+	if user == nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't get user for refresh token", nil)
+		return
+	}
+
+	if err := cfg.requestDB(r.Context()).TouchRefreshToken(refreshToken, r.UserAgent(), clientIP(r)); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update session", err)
+		return
+	}
 
-	accessToken, err := auth.MakeJWT(
+	accessToken, err := cfg.jwtKeys.MakeJWT(
 		user.ID,
-		cfg.jwtSecret,
-		time.Hour,
+		user.TokenVersion,
+		refreshAccessTokenTTL,
 	)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't validate token", err)
@@ -46,7 +54,7 @@ func (cfg *apiConfig) handlerRevoke(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = cfg.db.RevokeRefreshToken(refreshToken)
+	err = cfg.requestDB(r.Context()).RevokeRefreshToken(refreshToken)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke session", err)
 		return
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func TestHandlerSessionsRevokeAllInvalidatesTokens(t *testing.T) {
+	tempDir := t.TempDir()
+	dbPath := filepath.Join(tempDir, "test.db")
+
+	dbClient, err := database.NewClient(dbPath)
+	if err != nil {
+		t.Fatalf("failed to create db client: %v", err)
+	}
+
+	jwtKeys, err := loadJWTKeys("test-secret", "", "")
+	if err != nil {
+		t.Fatalf("failed to load jwt keys: %v", err)
+	}
+
+	cfg := apiConfig{
+		db:         dbClient,
+		jwtKeys:    jwtKeys,
+		assetsRoot: tempDir,
+		port:       "8091",
+	}
+
+	hashedPassword, err := auth.HashPassword("super-secret")
+	if err != nil {
+		t.Fatalf("failed to hash password: %v", err)
+	}
+
+	_, err = cfg.db.CreateUser(database.CreateUserParams{
+		Email:    "sessions@example.com",
+		Password: hashedPassword,
+	})
+	if err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/login", cfg.handlerLogin)
+	mux.HandleFunc("POST /api/refresh", cfg.handlerRefresh)
+	mux.HandleFunc("GET /api/sessions", cfg.handlerSessionsList)
+	mux.HandleFunc("DELETE /api/sessions", cfg.handlerSessionsRevokeAll)
+
+	loginReq := httptest.NewRequest(http.MethodPost, "/api/login", strings.NewReader(`{"email":"sessions@example.com","password":"super-secret"}`))
+	loginReq.Header.Set("User-Agent", "tubely-test/1.0")
+	loginReq.RemoteAddr = "203.0.113.7:5555"
+	loginRR := httptest.NewRecorder()
+	mux.ServeHTTP(loginRR, loginReq)
+
+	if loginRR.Code != http.StatusOK {
+		t.Fatalf("expected login status OK, got %d", loginRR.Code)
+	}
+
+	var login struct {
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.Unmarshal(loginRR.Body.Bytes(), &login); err != nil {
+		t.Fatalf("failed to unmarshal login response: %v", err)
+	}
+
+	listReq := httptest.NewRequest(http.MethodGet, "/api/sessions", nil)
+	listReq.Header.Set("Authorization", "Bearer "+login.Token)
+	listRR := httptest.NewRecorder()
+	mux.ServeHTTP(listRR, listReq)
+
+	if listRR.Code != http.StatusOK {
+		t.Fatalf("expected list status OK, got %d", listRR.Code)
+	}
+
+	var sessions []session
+	if err := json.Unmarshal(listRR.Body.Bytes(), &sessions); err != nil {
+		t.Fatalf("failed to unmarshal sessions: %v", err)
+	}
+	if len(sessions) != 1 {
+		t.Fatalf("expected 1 session, got %d", len(sessions))
+	}
+	if sessions[0].UserAgent != "tubely-test/1.0" {
+		t.Fatalf("unexpected user agent: %s", sessions[0].UserAgent)
+	}
+	if sessions[0].IPAddress != "203.0.113.7" {
+		t.Fatalf("unexpected ip address: %s", sessions[0].IPAddress)
+	}
+	if strings.Contains(listRR.Body.String(), login.RefreshToken) {
+		t.Fatalf("session list should not expose refresh tokens")
+	}
+
+	revokeReq := httptest.NewRequest(http.MethodDelete, "/api/sessions", nil)
+	revokeReq.Header.Set("Authorization", "Bearer "+login.Token)
+	revokeRR := httptest.NewRecorder()
+	mux.ServeHTTP(revokeRR, revokeReq)
+
+	if revokeRR.Code != http.StatusNoContent {
+		t.Fatalf("expected revoke status No Content, got %d", revokeRR.Code)
+	}
+
+	staleReq := httptest.NewRequest(http.MethodGet, "/api/sessions", nil)
+	staleReq.Header.Set("Authorization", "Bearer "+login.Token)
+	staleRR := httptest.NewRecorder()
+	mux.ServeHTTP(staleRR, staleReq)
+
+	if staleRR.Code != http.StatusUnauthorized {
+		t.Fatalf("expected old access token to be rejected, got %d", staleRR.Code)
+	}
+
+	refreshReq := httptest.NewRequest(http.MethodPost, "/api/refresh", nil)
+	refreshReq.Header.Set("Authorization", "Bearer "+login.RefreshToken)
+	refreshRR := httptest.NewRecorder()
+	mux.ServeHTTP(refreshRR, refreshReq)
+
+	if refreshRR.Code != http.StatusUnauthorized {
+		t.Fatalf("expected revoked refresh token to be rejected, got %d", refreshRR.Code)
+	}
+}
+
+func TestLegacySessionsGetUUIDSessionIDs(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	dbClient, err := database.NewClient(dbPath)
+	if err != nil {
+		t.Fatalf("failed to create db client: %v", err)
+	}
+	user, err := dbClient.CreateUser(database.CreateUserParams{Email: "legacy@example.com", Password: "unused"})
+	if err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+
+	// A refresh token as stored before sessions had IDs.
+	rawDB, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+	_, err = rawDB.Exec(`INSERT INTO refresh_tokens (token, user_id, expires_at) VALUES (?, ?, ?)`,
+		"legacy-token", user.ID, time.Now().Add(time.Hour))
+	rawDB.Close()
+	if err != nil {
+		t.Fatalf("failed to insert legacy refresh token: %v", err)
+	}
+
+	dbClient, err = database.NewClient(dbPath)
+	if err != nil {
+		t.Fatalf("failed to reopen db client: %v", err)
+	}
+	token, err := dbClient.GetRefreshToken("legacy-token")
+	if err != nil {
+		t.Fatalf("failed to get refresh token: %v", err)
+	}
+	if _, err := uuid.Parse(token.SessionID); err != nil || len(token.SessionID) != 36 {
+		t.Fatalf("expected a UUID session ID, got %q", token.SessionID)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// Share link passwords are guessed through a public endpoint, so they get the
+// same backoff and lockout treatment as logins.
+var shareLinkPasswordPolicy = loginThrottlePolicy{
+	freeAttempts:    5,
+	backoffBase:     time.Second,
+	lockoutAttempts: 20,
+	lockoutDuration: 15 * time.Minute,
+	window:          time.Hour,
+}
+
+func shareLinkThrottleKey(id uuid.UUID) string {
+	return "share_link:" + id.String()
+}
+
+// handlerShareLinkCreate creates a link to the video. The token is only
+// returned here; afterwards the owner can see the link's settings but not
+// its URL.
+func (cfg *apiConfig) handlerShareLinkCreate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		ExpiresAt *time.Time `json:"expires_at"`
+		MaxViews  *int       `json:"max_views"`
+		Password  string     `json:"password"`
+	}
+	type response struct {
+		database.ShareLink
+		Token string `json:"token"`
+		URL   string `json:"url"`
+	}
+
+	video, ok := cfg.editableVideo(w, r)
+	if !ok {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if params.ExpiresAt != nil && !params.ExpiresAt.After(time.Now()) {
+		respondWithError(w, http.StatusBadRequest, "Expiry must be in the future", nil)
+		return
+	}
+	if params.MaxViews != nil && *params.MaxViews < 1 {
+		respondWithError(w, http.StatusBadRequest, "Max views must be at least 1", nil)
+		return
+	}
+
+	var passwordHash string
+	if params.Password != "" {
+		passwordHash, err = auth.HashPassword(params.Password)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't hash password", err)
+			return
+		}
+	}
+
+	token, err := auth.MakeOneTimeToken()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create share token", err)
+		return
+	}
+
+	var expiresAt *time.Time
+	if params.ExpiresAt != nil {
+		t := params.ExpiresAt.UTC()
+		expiresAt = &t
+	}
+
+	link, err := cfg.requestDB(r.Context()).CreateShareLink(database.CreateShareLinkParams{
+		TokenHash:    auth.HashToken(token),
+		VideoID:      video.ID,
+		PasswordHash: passwordHash,
+		ExpiresAt:    expiresAt,
+		MaxViews:     params.MaxViews,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create share link", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, response{
+		ShareLink: link,
+		Token:     token,
+		URL:       cfg.appLink("share_token", token),
+	})
+}
+
+func (cfg *apiConfig) handlerShareLinksList(w http.ResponseWriter, r *http.Request) {
+	video, ok := cfg.editableVideo(w, r)
+	if !ok {
+		return
+	}
+
+	links, err := cfg.requestDB(r.Context()).GetShareLinks(video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get share links", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, links)
+}
+
+func (cfg *apiConfig) handlerShareLinkRevoke(w http.ResponseWriter, r *http.Request) {
+	video, ok := cfg.editableVideo(w, r)
+	if !ok {
+		return
+	}
+
+	linkID, err := uuid.Parse(r.PathValue("linkID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid share link ID", err)
+		return
+	}
+
+	revoked, err := cfg.requestDB(r.Context()).RevokeShareLink(video.ID, linkID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke share link", err)
+		return
+	}
+	if !revoked {
+		respondWithError(w, http.StatusNotFound, "Share link not found", nil)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerShareLinkResolve is the public side of a share link. Each successful
+// call counts as a view and returns the video's metadata with a short-lived
+// playback URL in place of the permanent one.
+func (cfg *apiConfig) handlerShareLinkResolve(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Password string `json:"password"`
+	}
+	type response struct {
+		Video             database.Video `json:"video"`
+		PlaybackURL       *string        `json:"playback_url"`
+		PlaybackExpiresAt *time.Time     `json:"playback_expires_at"`
+	}
+
+	params := parameters{}
+	if r.ContentLength != 0 {
+		decoder := json.NewDecoder(r.Body)
+		if err := decoder.Decode(&params); err != nil {
+			respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+			return
+		}
+	}
+
+	link, err := cfg.requestDB(r.Context()).GetShareLinkByTokenHash(auth.HashToken(r.PathValue("token")))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get share link", err)
+		return
+	}
+	now := time.Now().UTC()
+	if link.ID == uuid.Nil || !link.Active(now) {
+		respondWithError(w, http.StatusNotFound, "Share link not found or expired", nil)
+		return
+	}
+
+	if link.HasPassword {
+		throttleKey := shareLinkThrottleKey(link.ID)
+		wait, err := cfg.loginRetryAfter(r.Context(), throttleKey)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't check password attempts", err)
+			return
+		}
+		if wait > 0 {
+			respondWithThrottled(w, wait, "Too many wrong passwords, try again later")
+			return
+		}
+		if params.Password == "" {
+			respondWithError(w, http.StatusUnauthorized, "This link requires a password", nil)
+			return
+		}
+		match, err := auth.CheckPasswordHash(params.Password, link.PasswordHash)
+		if err != nil || !match {
+			if _, _, recordErr := cfg.recordThrottledFailure(r.Context(), throttleKey, shareLinkPasswordPolicy); recordErr != nil {
+				respondWithError(w, http.StatusInternalServerError, "Couldn't record password attempt", recordErr)
+				return
+			}
+			respondWithError(w, http.StatusUnauthorized, "Incorrect password", err)
+			return
+		}
+	}
+
+	video, err := cfg.requestDB(r.Context()).GetVideo(link.VideoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Share link not found or expired", nil)
+		return
+	}
+
+	allowed, err := cfg.requestDB(r.Context()).RecordShareLinkView(link.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't record view", err)
+		return
+	}
+	if !allowed {
+		respondWithError(w, http.StatusNotFound, "Share link not found or expired", nil)
+		return
+	}
+
+	// The playback URL mustn't outlive the link itself.
+	ttl := maxPlaybackURLTTL
+	if link.ExpiresAt != nil {
+		ttl = min(ttl, link.ExpiresAt.Sub(now))
+	}
+	playbackURL, err := cfg.presignVideoURL(r.Context(), video, ttl)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create playback URL", err)
+		return
+	}
+
+	resp := response{Video: video}
+	resp.Video.VideoURL = nil
+	if playbackURL != "" {
+		expiresAt := now.Add(ttl)
+		resp.PlaybackURL = &playbackURL
+		resp.PlaybackExpiresAt = &expiresAt
+	}
+
+	respondWithJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestShareLinks(t *testing.T) {
+	tempDir := t.TempDir()
+	dbPath := filepath.Join(tempDir, "test.db")
+
+	dbClient, err := database.NewClient(dbPath)
+	if err != nil {
+		t.Fatalf("failed to create db client: %v", err)
+	}
+
+	jwtKeys, err := loadJWTKeys("test-secret", "", "")
+	if err != nil {
+		t.Fatalf("failed to load jwt keys: %v", err)
+	}
+
+	_, s3Client := newFakeS3(t)
+	cfg := apiConfig{
+		db:               dbClient,
+		jwtKeys:          jwtKeys,
+		assetsRoot:       tempDir,
+		port:             "8091",
+		s3Client:         s3Client,
+		s3Bucket:         "tubely-test",
+		s3CfDistribution: "cdn.example.com",
+	}
+
+	user, err := dbClient.CreateUser(database.CreateUserParams{Email: "owner@example.com", Password: "unused"})
+	if err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	token, err := jwtKeys.MakeJWT(user.ID, user.TokenVersion, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create jwt: %v", err)
+	}
+
+	video, err := dbClient.CreateVideo(database.CreateVideoParams{Title: "Review me", UserID: user.ID})
+	if err != nil {
+		t.Fatalf("failed to create video: %v", err)
+	}
+	videoURL := "https://cdn.example.com/landscape/review.mp4"
+	video.VideoURL = &videoURL
+	if err := dbClient.UpdateVideo(video); err != nil {
+		t.Fatalf("failed to update video: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/videos/{videoID}/share_links", cfg.handlerShareLinksList)
+	mux.HandleFunc("POST /api/videos/{videoID}/share_links", cfg.handlerShareLinkCreate)
+	mux.HandleFunc("DELETE /api/videos/{videoID}/share_links/{linkID}", cfg.handlerShareLinkRevoke)
+	mux.HandleFunc("POST /api/share_links/{token}", cfg.handlerShareLinkResolve)
+
+	do := func(method, path, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+	linksPath := "/api/videos/" + video.ID.String() + "/share_links"
+
+	type createdLink struct {
+		database.ShareLink
+		Token string `json:"token"`
+	}
+	create := func(body string) createdLink {
+		t.Helper()
+		rr := do(http.MethodPost, linksPath, token, body)
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("expected share link to be created, got %d: %s", rr.Code, rr.Body.String())
+		}
+		var link createdLink
+		if err := json.Unmarshal(rr.Body.Bytes(), &link); err != nil {
+			t.Fatalf("failed to decode share link: %v", err)
+		}
+		return link
+	}
+
+	if rr := do(http.MethodPost, linksPath, token, `{"expires_at":"2000-01-01T00:00:00Z"}`); rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected past expiry to be rejected, got %d", rr.Code)
+	}
+
+	limited := create(`{"max_views":2}`)
+	var resolved struct {
+		Video       database.Video `json:"video"`
+		PlaybackURL *string        `json:"playback_url"`
+	}
+	for i := 0; i < 2; i++ {
+		rr := do(http.MethodPost, "/api/share_links/"+limited.Token, "", "")
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected view %d to succeed, got %d: %s", i+1, rr.Code, rr.Body.String())
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &resolved); err != nil {
+			t.Fatalf("failed to decode resolved link: %v", err)
+		}
+	}
+	if resolved.Video.ID != video.ID || resolved.Video.VideoURL != nil {
+		t.Fatalf("expected video metadata without its permanent URL, got %+v", resolved.Video)
+	}
+	if resolved.PlaybackURL == nil {
+		t.Fatalf("expected a playback URL")
+	}
+	playback, err := url.Parse(*resolved.PlaybackURL)
+	if err != nil || playback.Query().Get("X-Amz-Expires") == "" || !strings.HasSuffix(playback.Path, "/landscape/review.mp4") {
+		t.Fatalf("expected a presigned playback URL, got %s", *resolved.PlaybackURL)
+	}
+	if rr := do(http.MethodPost, "/api/share_links/"+limited.Token, "", ""); rr.Code != http.StatusNotFound {
+		t.Fatalf("expected link to stop working after max views, got %d", rr.Code)
+	}
+
+	protected := create(`{"password":"hunter2","expires_at":"` + time.Now().Add(time.Hour).Format(time.RFC3339) + `"}`)
+	if !protected.HasPassword || protected.ExpiresAt == nil {
+		t.Fatalf("expected password and expiry on link, got %+v", protected.ShareLink)
+	}
+	if rr := do(http.MethodPost, "/api/share_links/"+protected.Token, "", ""); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected missing password to be rejected, got %d", rr.Code)
+	}
+	if rr := do(http.MethodPost, "/api/share_links/"+protected.Token, "", `{"password":"wrong"}`); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected wrong password to be rejected, got %d", rr.Code)
+	}
+	if rr := do(http.MethodPost, "/api/share_links/"+protected.Token, "", `{"password":"hunter2"}`); rr.Code != http.StatusOK {
+		t.Fatalf("expected correct password to work, got %d", rr.Code)
+	}
+
+	rr := do(http.MethodGet, linksPath, token, "")
+	var links []database.ShareLink
+	if err := json.Unmarshal(rr.Body.Bytes(), &links); err != nil || len(links) != 2 {
+		t.Fatalf("expected 2 share links, got %s", rr.Body.String())
+	}
+	if strings.Contains(rr.Body.String(), protected.Token) {
+		t.Fatalf("expected tokens to be left out of the listing")
+	}
+
+	if rr := do(http.MethodDelete, linksPath+"/"+protected.ID.String(), token, ""); rr.Code != http.StatusNoContent {
+		t.Fatalf("expected revoke to succeed, got %d", rr.Code)
+	}
+	if rr := do(http.MethodPost, "/api/share_links/"+protected.Token, "", `{"password":"hunter2"}`); rr.Code != http.StatusNotFound {
+		t.Fatalf("expected revoked link to stop working, got %d", rr.Code)
+	}
+}
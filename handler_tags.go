@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+)
+
+const (
+	defaultTagSuggestions = 10
+	maxTagSuggestions     = 50
+)
+
+// handlerVideoTagsSet replaces the video's tags.
+func (cfg *apiConfig) handlerVideoTagsSet(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Tags []string `json:"tags"`
+	}
+
+	video, ok := cfg.editableVideo(w, r)
+	if !ok {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	slugs, err := normalizeTags(params.Tags)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+
+	if err := cfg.requestDB(r.Context()).SetVideoTags(video.ID, slugs); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't set tags", err)
+		return
+	}
+
+	updatedVideo, err := cfg.requestDB(r.Context()).GetVideo(video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve updated video", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, editorView(updatedVideo))
+}
+
+// handlerTagsRetrieve lists the tags on the caller's videos with how many of
+// their videos use each one.
+func (cfg *apiConfig) handlerTagsRetrieve(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateAccessToken(r.Context(), token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	counts, err := cfg.requestDB(r.Context()).GetUserTagCounts(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve tags", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, counts)
+}
+
+// handlerTagsAutocomplete suggests existing tags that start with the q query
+// parameter, most used first.
+func (cfg *apiConfig) handlerTagsAutocomplete(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateAccessToken(r.Context(), token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	limit := defaultTagSuggestions
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 {
+			respondWithError(w, http.StatusBadRequest, "Invalid limit", err)
+			return
+		}
+		limit = min(n, maxTagSuggestions)
+	}
+
+	prefix := normalizeTag(r.URL.Query().Get("q"))
+	suggestions, err := cfg.requestDB(r.Context()).SearchTags(userID, prefix, limit)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't search tags", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, suggestions)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestNormalizeTag(t *testing.T) {
+	cases := map[string]string{
+		"Go":           "go",
+		"  Web Dev  ":  "web-dev",
+		"web_dev":      "web-dev",
+		"WEB--DEV!":    "web-dev",
+		"C++ & Rust 2": "c-rust-2",
+		"!!!":          "",
+	}
+	for input, want := range cases {
+		if got := normalizeTag(input); got != want {
+			t.Errorf("normalizeTag(%q) = %q, want %q", input, got, want)
+		}
+	}
+}
+
+func TestVideoTags(t *testing.T) {
+	tempDir := t.TempDir()
+	dbPath := filepath.Join(tempDir, "test.db")
+
+	dbClient, err := database.NewClient(dbPath)
+	if err != nil {
+		t.Fatalf("failed to create db client: %v", err)
+	}
+
+	jwtKeys, err := loadJWTKeys("test-secret", "", "")
+	if err != nil {
+		t.Fatalf("failed to load jwt keys: %v", err)
+	}
+
+	cfg := apiConfig{
+		db:         dbClient,
+		jwtKeys:    jwtKeys,
+		assetsRoot: tempDir,
+		port:       "8091",
+	}
+
+	newUser := func(email string) (database.User, string) {
+		user, err := dbClient.CreateUser(database.CreateUserParams{Email: email, Password: "unused"})
+		if err != nil {
+			t.Fatalf("failed to create user: %v", err)
+		}
+		token, err := jwtKeys.MakeJWT(user.ID, user.TokenVersion, time.Hour)
+		if err != nil {
+			t.Fatalf("failed to create jwt: %v", err)
+		}
+		return *user, token
+	}
+	alice, aliceToken := newUser("alice@example.com")
+	bob, bobToken := newUser("bob@example.com")
+
+	newVideo := func(owner database.User, title string, visibility database.VideoVisibility) database.Video {
+		video, err := dbClient.CreateVideo(database.CreateVideoParams{Title: title, UserID: owner.ID, Visibility: visibility})
+		if err != nil {
+			t.Fatalf("failed to create video: %v", err)
+		}
+		return video
+	}
+	tutorial := newVideo(alice, "Tutorial", database.VideoVisibilityPublic)
+	vlog := newVideo(alice, "Vlog", database.VideoVisibilityPrivate)
+	secret := newVideo(bob, "Secret", database.VideoVisibilityPrivate)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/videos", cfg.handlerVideosRetrieve)
+	mux.HandleFunc("GET /api/videos/public", cfg.handlerVideosPublic)
+	mux.HandleFunc("PUT /api/videos/{videoID}/tags", cfg.handlerVideoTagsSet)
+	mux.HandleFunc("GET /api/tags", cfg.handlerTagsRetrieve)
+	mux.HandleFunc("GET /api/tags/autocomplete", cfg.handlerTagsAutocomplete)
+
+	do := func(method, path, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+	setTags := func(video database.Video, token, tags string) *httptest.ResponseRecorder {
+		return do(http.MethodPut, "/api/videos/"+video.ID.String()+"/tags", token, `{"tags":`+tags+`}`)
+	}
+
+	rr := setTags(tutorial, aliceToken, `["Go", "Web Dev", "go"]`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected tags to be set, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var video database.Video
+	if err := json.Unmarshal(rr.Body.Bytes(), &video); err != nil {
+		t.Fatalf("failed to decode video: %v", err)
+	}
+	if strings.Join(video.Tags, ",") != "go,web-dev" {
+		t.Fatalf("expected normalized, de-duplicated tags, got %v", video.Tags)
+	}
+	if rr := setTags(vlog, aliceToken, `["go", "travel"]`); rr.Code != http.StatusOK {
+		t.Fatalf("expected tags to be set, got %d", rr.Code)
+	}
+	if rr := setTags(secret, bobToken, `["gossip"]`); rr.Code != http.StatusOK {
+		t.Fatalf("expected tags to be set, got %d", rr.Code)
+	}
+	if rr := setTags(secret, aliceToken, `["mine"]`); rr.Code != http.StatusForbidden {
+		t.Fatalf("expected tagging someone else's video to be forbidden, got %d", rr.Code)
+	}
+	if rr := setTags(vlog, aliceToken, `["???"]`); rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected empty tag to be rejected, got %d", rr.Code)
+	}
+
+	var videos []database.Video
+	rr = do(http.MethodGet, "/api/videos?tag=Travel", aliceToken, "")
+	if err := json.Unmarshal(rr.Body.Bytes(), &videos); err != nil || len(videos) != 1 || videos[0].ID != vlog.ID {
+		t.Fatalf("expected only the vlog to be tagged travel, got %s", rr.Body.String())
+	}
+
+	var feed struct {
+		Videos []database.Video `json:"videos"`
+	}
+	rr = do(http.MethodGet, "/api/videos/public?tag=go", "", "")
+	if err := json.Unmarshal(rr.Body.Bytes(), &feed); err != nil || len(feed.Videos) != 1 || feed.Videos[0].ID != tutorial.ID {
+		t.Fatalf("expected only the public tutorial in the go feed, got %s", rr.Body.String())
+	}
+
+	var counts []database.TagCount
+	rr = do(http.MethodGet, "/api/tags", aliceToken, "")
+	if err := json.Unmarshal(rr.Body.Bytes(), &counts); err != nil {
+		t.Fatalf("failed to decode tag counts: %v", err)
+	}
+	if len(counts) != 3 || counts[0] != (database.TagCount{Slug: "go", Count: 2}) {
+		t.Fatalf("unexpected tag counts: %+v", counts)
+	}
+
+	rr = do(http.MethodGet, "/api/tags/autocomplete?q=Go", aliceToken, "")
+	if err := json.Unmarshal(rr.Body.Bytes(), &counts); err != nil {
+		t.Fatalf("failed to decode suggestions: %v", err)
+	}
+	if len(counts) != 1 || counts[0].Slug != "go" {
+		t.Fatalf("expected bob's private tag to stay hidden from alice, got %+v", counts)
+	}
+	rr = do(http.MethodGet, "/api/tags/autocomplete?q=go", bobToken, "")
+	if err := json.Unmarshal(rr.Body.Bytes(), &counts); err != nil {
+		t.Fatalf("failed to decode suggestions: %v", err)
+	}
+	if len(counts) != 2 || counts[0] != (database.TagCount{Slug: "go", Count: 1}) {
+		t.Fatalf("expected public go tag and bob's own gossip tag, got %+v", counts)
+	}
+
+	if err := dbClient.DeleteVideo(vlog.ID); err != nil {
+		t.Fatalf("failed to delete video: %v", err)
+	}
+	rr = do(http.MethodGet, "/api/tags", aliceToken, "")
+	if err := json.Unmarshal(rr.Body.Bytes(), &counts); err != nil || len(counts) != 2 {
+		t.Fatalf("expected deleted video's tags to be dropped, got %s", rr.Body.String())
+	}
+}
@@ -2,20 +2,16 @@ package main
 
 import (
 	"bytes"
-	"crypto/rand"
-	"encoding/base64"
-	"fmt"
 	"io"
-	"mime"
 	"net/http"
-	"os"
-	"path/filepath"
-	"strings"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 	"github.com/google/uuid"
 )
 
+const maxThumbnailSize = 20 << 20
+
 func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Request) {
 	videoIDString := r.PathValue("videoID")
 	videoID, err := uuid.Parse(videoIDString)
@@ -30,35 +26,13 @@ func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	userID, err := cfg.validateAccessToken(r.Context(), token)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
 		return
 	}
 
-	fmt.Println("uploading thumbnail for video", videoID, "by user", userID)
-
-	const maxMemory = 10 << 20
-	if err := r.ParseMultipartForm(maxMemory); err != nil {
-		respondWithError(w, http.StatusBadRequest, "Couldn't parse multipart form", err)
-		return
-	}
-
-	file, header, err := r.FormFile("thumbnail")
-	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Unable to parse form file", err)
-		return
-	}
-	defer file.Close()
-
-	mediaType := header.Header.Get("Content-Type")
-	if mediaType != "" {
-		if parsed, _, err := mime.ParseMediaType(mediaType); err == nil {
-			mediaType = parsed
-		}
-	}
-
-	video, err := cfg.db.GetVideo(videoID)
+	video, err := cfg.requestDB(r.Context()).GetVideo(videoID)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
 		return
@@ -67,88 +41,80 @@ func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Requ
 		respondWithError(w, http.StatusNotFound, "Video not found", nil)
 		return
 	}
-	if video.UserID != userID {
-		respondWithError(w, http.StatusUnauthorized, "You can't modify this video", nil)
+	canEdit, err := cfg.canEditVideo(r.Context(), video, userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check video access", err)
 		return
 	}
-
-	const sniffLen = 512
-	sniffBuf := make([]byte, sniffLen)
-	n, err := io.ReadFull(file, sniffBuf)
-	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't read thumbnail file", err)
+	if !canEdit {
+		respondWithError(w, http.StatusForbidden, "You can't modify this video", nil)
 		return
 	}
-	sniffBytes := sniffBuf[:n]
 
-	if len(sniffBytes) == 0 {
-		respondWithError(w, http.StatusBadRequest, "Empty thumbnail file", nil)
+	allowance, err := cfg.uploadAllowance(r.Context(), video, database.BlobKindThumbnail)
+	if err != nil {
+		respondWithUploadError(w, err, "Couldn't check storage quota")
 		return
 	}
 
-	if mediaType == "" || mediaType == "application/octet-stream" {
-		detectedType := http.DetectContentType(sniffBytes)
-		if detectedType != "" {
-			mediaType = detectedType
-		}
-	}
-
-	if mediaType == "" {
-		respondWithError(w, http.StatusBadRequest, "Couldn't determine media type", nil)
+	r.Body = http.MaxBytesReader(w, r.Body, maxThumbnailSize)
+	file, header, err := readUploadedImage(r, "thumbnail", maxThumbnailSize)
+	if err != nil {
+		respondWithUploadError(w, err, "Couldn't read thumbnail")
 		return
 	}
+	defer file.Close()
 
-	exts, _ := mime.ExtensionsByType(mediaType)
-	ext := ""
-	if len(exts) > 0 {
-		ext = exts[0]
-	}
-	if ext == "" {
-		if idx := strings.Index(mediaType, "/"); idx != -1 && idx < len(mediaType)-1 {
-			ext = "." + mediaType[idx+1:]
-		}
+	data, err := io.ReadAll(file)
+	uploadBytesTotal.WithLabelValues(string(database.BlobKindThumbnail)).Add(float64(len(data)))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't read thumbnail", err)
+		return
 	}
-	if ext == "" {
-		respondWithError(w, http.StatusBadRequest, "Couldn't determine file extension", nil)
+	scanResult, err := cfg.scanUpload(r, userID, video.ID, database.BlobKindThumbnail, bytes.NewReader(data))
+	if err != nil {
+		respondWithUploadError(w, err, "Couldn't scan thumbnail")
 		return
 	}
-	ext = strings.ToLower(ext)
-
-	randomBytes := make([]byte, 32)
-	if _, err := rand.Read(randomBytes); err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't generate thumbnail name", err)
+	thumbnail, err := cfg.storeThumbnailBlob(r.Context(), data, header.Header.Get("Content-Type"))
+	if err != nil {
+		respondWithUploadError(w, err, "Couldn't save thumbnail file")
 		return
 	}
-	randomName := base64.RawURLEncoding.EncodeToString(randomBytes)
-	destName := randomName + ext
-	destPath := filepath.Join(cfg.assetsRoot, destName)
 
-	destFile, err := os.Create(destPath)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't create thumbnail file", err)
+	if err := cfg.checkBlobAllowance(r, thumbnail, allowance); err != nil {
+		respondWithUploadError(w, err, "Couldn't check storage quota")
 		return
 	}
-	defer destFile.Close()
 
-	_, err = io.Copy(destFile, io.MultiReader(bytes.NewReader(sniffBytes), file))
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't save thumbnail file", err)
+	if err := cfg.requestDB(r.Context()).SetVideoThumbnail(video.ID, thumbnail.Key, thumbnail.Srcset, thumbnail.Hash, cfg.storageLimits()); err != nil {
+		if err := cfg.requestDB(r.Context()).ReleaseBlob(thumbnail.Kind, thumbnail.Hash); err != nil {
+			loggerFrom(r.Context()).Error("Couldn't release thumbnail blob", "hash", thumbnail.Hash, "error", err)
+		}
+		cfg.cleanUpBlobs(r.Context())
+		respondWithUploadError(w, cfg.storageLimitError(err), "Couldn't update video")
 		return
 	}
 
-	url := fmt.Sprintf("http://localhost:%s/assets/%s", cfg.port, destName)
-	video.ThumbnailURL = &url
+	cfg.recordScanResult(r.Context(), video.ID, database.BlobKindThumbnail, scanResult)
 
-	if err := cfg.db.UpdateVideo(video); err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
-		return
+	// Thumbnails from before blobs existed belong to this video alone. Either
+	// way the old renditions are cached as immutable under their own names,
+	// so nothing needs them once the video points at the new ones.
+	if video.ThumbnailBlobHash == "" {
+		for _, assetURL := range thumbnailAssetURLs(video) {
+			if err := cfg.removeAsset(assetURL); err != nil {
+				loggerFrom(r.Context()).Error("Couldn't remove old thumbnail", "url", assetURL, "error", err)
+			}
+		}
 	}
+	cfg.cleanUpBlobs(r.Context())
 
-	updatedVideo, err := cfg.db.GetVideo(videoID)
+	updatedVideo, err := cfg.requestDB(r.Context()).GetVideo(videoID)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve updated video", err)
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, updatedVideo)
+	respondWithJSON(w, http.StatusOK, editorView(updatedVideo))
 }
@@ -3,7 +3,12 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
@@ -28,9 +33,14 @@ func TestHandlerUploadThumbnailStoresFile(t *testing.T) {
 		t.Fatalf("failed to create db client: %v", err)
 	}
 
+	jwtKeys, err := loadJWTKeys("test-secret", "", "")
+	if err != nil {
+		t.Fatalf("failed to load jwt keys: %v", err)
+	}
+
 	cfg := apiConfig{
 		db:         dbClient,
-		jwtSecret:  "test-secret",
+		jwtKeys:    jwtKeys,
 		assetsRoot: tempDir,
 		port:       "8091",
 	}
@@ -57,7 +67,7 @@ func TestHandlerUploadThumbnailStoresFile(t *testing.T) {
 		t.Fatalf("failed to create video: %v", err)
 	}
 
-	token, err := auth.MakeJWT(user.ID, cfg.jwtSecret, time.Hour)
+	token, err := cfg.jwtKeys.MakeJWT(user.ID, user.TokenVersion, time.Hour)
 	if err != nil {
 		t.Fatalf("failed to create jwt: %v", err)
 	}
@@ -69,8 +79,7 @@ func TestHandlerUploadThumbnailStoresFile(t *testing.T) {
 		t.Fatalf("failed to create form file: %v", err)
 	}
 
-	sampleData := []byte{0x89, 0x50, 0x4e, 0x47, 0x0d, 0x0a, 0x1a, 0x0a}
-	if _, err := fileWriter.Write(sampleData); err != nil {
+	if err := png.Encode(fileWriter, testImage(1600, 900)); err != nil {
 		t.Fatalf("failed to write sample data: %v", err)
 	}
 
@@ -119,8 +128,40 @@ func TestHandlerUploadThumbnailStoresFile(t *testing.T) {
 	}
 
 	thumbnailFile := path.Base(parsedURL.Path)
-	if filepath.Ext(thumbnailFile) != ".png" {
-		t.Fatalf("expected png extension, got %s", filepath.Ext(thumbnailFile))
+	if !strings.HasSuffix(thumbnailFile, "-1280.jpg") {
+		t.Fatalf("expected the largest JPEG rendition, got %s", thumbnailFile)
+	}
+
+	for _, mediaType := range []string{"image/webp", "image/jpeg"} {
+		candidates := strings.Split(got.ThumbnailSrcset[mediaType], ", ")
+		if len(candidates) != 3 {
+			t.Fatalf("expected 3 %s renditions, got %q", mediaType, got.ThumbnailSrcset[mediaType])
+		}
+		for i, width := range []int{320, 640, 1280} {
+			fields := strings.Fields(candidates[i])
+			if len(fields) != 2 || fields[1] != fmt.Sprintf("%dw", width) {
+				t.Fatalf("unexpected srcset candidate %q", candidates[i])
+			}
+			assetPath, ok := cfg.assetPath(fields[0])
+			if !ok {
+				t.Fatalf("expected srcset URL under /assets, got %s", fields[0])
+			}
+			f, err := os.Open(assetPath)
+			if err != nil {
+				t.Fatalf("expected rendition at %s: %v", assetPath, err)
+			}
+			config, format, err := image.DecodeConfig(f)
+			f.Close()
+			if err != nil {
+				t.Fatalf("failed to decode rendition %s: %v", assetPath, err)
+			}
+			if config.Width != width || config.Height != width*9/16 {
+				t.Fatalf("expected %dx%d rendition, got %dx%d", width, width*9/16, config.Width, config.Height)
+			}
+			if "image/"+format != mediaType {
+				t.Fatalf("expected %s rendition, got %s", mediaType, format)
+			}
+		}
 	}
 
 	if strings.Contains(thumbnailFile, video.ID.String()) {
@@ -147,3 +188,263 @@ func TestHandlerUploadThumbnailStoresFile(t *testing.T) {
 		t.Fatalf("expected thumbnail file to be non-empty")
 	}
 }
+
+func testImage(width, height int) image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.NRGBA{R: uint8(x), G: uint8(y), B: 128, A: 255})
+		}
+	}
+	return img
+}
+
+func TestJPEGOrientation(t *testing.T) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, testImage(40, 20), nil); err != nil {
+		t.Fatalf("failed to encode jpeg: %v", err)
+	}
+	plain := buf.Bytes()
+	if got := jpegOrientation(plain); got != 1 {
+		t.Fatalf("expected JPEG without EXIF to be upright, got %d", got)
+	}
+
+	// A big-endian TIFF with one IFD entry: orientation 6 (rotate 90° CW).
+	tiff := []byte{
+		'M', 'M', 0, 42, 0, 0, 0, 8,
+		0, 1,
+		0x01, 0x12, 0, 3, 0, 0, 0, 1, 0, 6, 0, 0,
+		0, 0, 0, 0,
+	}
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+	app1 := []byte{0xFF, 0xE1, byte((len(segment) + 2) >> 8), byte(len(segment) + 2)}
+	withEXIF := append(append(append([]byte{}, plain[:2]...), app1...), segment...)
+	withEXIF = append(withEXIF, plain[2:]...)
+
+	if got := jpegOrientation(withEXIF); got != 6 {
+		t.Fatalf("expected orientation 6, got %d", got)
+	}
+
+	img, err := jpeg.Decode(bytes.NewReader(withEXIF))
+	if err != nil {
+		t.Fatalf("failed to decode jpeg with EXIF: %v", err)
+	}
+	upright := orient(resizeToWidth(img, 10, 6), 6)
+	if size := upright.Bounds().Size(); size != image.Pt(10, 20) {
+		t.Fatalf("expected rotated 10x20 image, got %v", size)
+	}
+}
+
+func TestDecodeUploadedImage(t *testing.T) {
+	encode := func(img image.Image) []byte {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			t.Fatalf("failed to encode image: %v", err)
+		}
+		return buf.Bytes()
+	}
+	// gifHeader is just the start of a GIF claiming the given size, which
+	// is all that's needed to hit the size checks.
+	gifHeader := func(width, height int) []byte {
+		return []byte{'G', 'I', 'F', '8', '9', 'a', byte(width), byte(width >> 8), byte(height), byte(height >> 8), 0, 0, 0}
+	}
+	valid := encode(testImage(32, 16))
+
+	tests := []struct {
+		name         string
+		data         []byte
+		declaredType string
+		wantCode     int
+		wantFormat   string
+	}{
+		{name: "png", data: valid, declaredType: "image/png", wantFormat: "png"},
+		{name: "undeclared type", data: valid, wantFormat: "png"},
+		{name: "octet-stream", data: valid, declaredType: "application/octet-stream", wantFormat: "png"},
+		{name: "empty", declaredType: "image/png", wantCode: http.StatusBadRequest},
+		{name: "svg", data: []byte(`<svg xmlns="http://www.w3.org/2000/svg"><script>alert(1)</script></svg>`), declaredType: "image/svg+xml", wantCode: http.StatusUnsupportedMediaType},
+		{name: "html disguised as png", data: []byte("<html><script>alert(1)</script></html>"), declaredType: "image/png", wantCode: http.StatusUnsupportedMediaType},
+		{name: "png declared as html", data: valid, declaredType: "text/html", wantCode: http.StatusUnsupportedMediaType},
+		{name: "too wide", data: encode(image.NewGray(image.Rect(0, 0, maxImageDimension+1, 1))), wantCode: http.StatusUnprocessableEntity},
+		{name: "too many pixels", data: gifHeader(8000, 8000), declaredType: "image/gif", wantCode: http.StatusUnprocessableEntity},
+		{name: "truncated", data: valid[:len(valid)/2], declaredType: "image/png", wantCode: http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img, format, err := decodeUploadedImage(tt.data, tt.declaredType)
+			if tt.wantCode == 0 {
+				if err != nil {
+					t.Fatalf("expected image to be accepted, got %v", err)
+				}
+				if format != tt.wantFormat || img.Bounds().Dx() != 32 {
+					t.Fatalf("unexpected decode result: %s %v", format, img.Bounds())
+				}
+				return
+			}
+			var uploadErr *uploadError
+			if !errors.As(err, &uploadErr) || uploadErr.code != tt.wantCode {
+				t.Fatalf("expected %d, got %v", tt.wantCode, err)
+			}
+		})
+	}
+}
+
+func TestUploadThumbnailDeduplicates(t *testing.T) {
+	tempDir := t.TempDir()
+	dbClient, err := database.NewClient(filepath.Join(tempDir, "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create db client: %v", err)
+	}
+	jwtKeys, err := loadJWTKeys("test-secret", "", "")
+	if err != nil {
+		t.Fatalf("failed to load jwt keys: %v", err)
+	}
+	assetsRoot := filepath.Join(tempDir, "assets")
+	if err := os.Mkdir(assetsRoot, 0755); err != nil {
+		t.Fatalf("failed to create assets dir: %v", err)
+	}
+	cfg := apiConfig{db: dbClient, jwtKeys: jwtKeys, assetsRoot: assetsRoot, port: "8091"}
+
+	user, err := dbClient.CreateUser(database.CreateUserParams{Email: "dedup@example.com", Password: "unused"})
+	if err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	token, err := jwtKeys.MakeJWT(user.ID, user.TokenVersion, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create jwt: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/thumbnail_upload/{videoID}", cfg.handlerUploadThumbnail)
+	mux.HandleFunc("DELETE /api/videos/{videoID}", cfg.handlerVideoMetaDelete)
+
+	upload := func(videoID string, img image.Image) database.Video {
+		t.Helper()
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		part, err := writer.CreateFormFile("thumbnail", "thumb.png")
+		if err != nil {
+			t.Fatalf("failed to create form file: %v", err)
+		}
+		if err := png.Encode(part, img); err != nil {
+			t.Fatalf("failed to encode thumbnail: %v", err)
+		}
+		writer.Close()
+		req := httptest.NewRequest(http.MethodPost, "/api/thumbnail_upload/"+videoID, body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected thumbnail upload to succeed, got %d: %s", rr.Code, rr.Body.String())
+		}
+		var video database.Video
+		if err := json.Unmarshal(rr.Body.Bytes(), &video); err != nil {
+			t.Fatalf("failed to decode video: %v", err)
+		}
+		return video
+	}
+	deleteVideo := func(videoID string) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodDelete, "/api/videos/"+videoID, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		if rr.Code != http.StatusNoContent {
+			t.Fatalf("expected video deletion to succeed, got %d", rr.Code)
+		}
+	}
+	countAssets := func() int {
+		entries, err := os.ReadDir(assetsRoot)
+		if err != nil {
+			t.Fatalf("failed to read assets: %v", err)
+		}
+		return len(entries)
+	}
+
+	var videos []database.Video
+	for _, title := range []string{"First", "Second"} {
+		video, err := dbClient.CreateVideo(database.CreateVideoParams{Title: title, UserID: user.ID})
+		if err != nil {
+			t.Fatalf("failed to create video: %v", err)
+		}
+		videos = append(videos, video)
+	}
+
+	img := testImage(400, 300)
+	first := upload(videos[0].ID.String(), img)
+	renditions := countAssets()
+	if renditions == 0 {
+		t.Fatalf("expected renditions to be stored")
+	}
+	second := upload(videos[1].ID.String(), img)
+	if second.ThumbnailURL == nil || *second.ThumbnailURL != *first.ThumbnailURL {
+		t.Fatalf("expected identical uploads to share a thumbnail, got %v and %v", first.ThumbnailURL, second.ThumbnailURL)
+	}
+	if countAssets() != renditions {
+		t.Fatalf("expected identical upload not to store new renditions")
+	}
+
+	// Replacing one video's thumbnail keeps the shared one for the other.
+	upload(videos[1].ID.String(), testImage(300, 300))
+	if countAssets() != 2*renditions {
+		t.Fatalf("expected both thumbnails to be stored, got %d files", countAssets())
+	}
+
+	deleteVideo(videos[0].ID.String())
+	if countAssets() != renditions {
+		t.Fatalf("expected unused thumbnail to be removed, got %d files", countAssets())
+	}
+	deleteVideo(videos[1].ID.String())
+	if countAssets() != 0 {
+		t.Fatalf("expected every thumbnail to be removed, got %d files", countAssets())
+	}
+}
+
+func TestUploadsRequireEditAccess(t *testing.T) {
+	tempDir := t.TempDir()
+	dbClient, err := database.NewClient(filepath.Join(tempDir, "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create db client: %v", err)
+	}
+	jwtKeys, err := loadJWTKeys("test-secret", "", "")
+	if err != nil {
+		t.Fatalf("failed to load jwt keys: %v", err)
+	}
+	cfg := apiConfig{
+		db:         dbClient,
+		jwtKeys:    jwtKeys,
+		assetsRoot: tempDir,
+		port:       "8091",
+	}
+
+	owner, err := cfg.db.CreateUser(database.CreateUserParams{Email: "owner@example.com", Password: "unused"})
+	if err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	other, err := cfg.db.CreateUser(database.CreateUserParams{Email: "other@example.com", Password: "unused"})
+	if err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	video, err := cfg.db.CreateVideo(database.CreateVideoParams{Title: "Not yours", UserID: owner.ID})
+	if err != nil {
+		t.Fatalf("failed to create video: %v", err)
+	}
+	token, err := cfg.jwtKeys.MakeJWT(other.ID, other.TokenVersion, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create jwt: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/thumbnail_upload/{videoID}", cfg.handlerUploadThumbnail)
+	mux.HandleFunc("POST /api/video_upload/{videoID}", cfg.handlerUploadVideo)
+
+	for _, path := range []string{"/api/thumbnail_upload/", "/api/video_upload/"} {
+		req := httptest.NewRequest(http.MethodPost, path+video.ID.String(), nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		if rr.Code != http.StatusForbidden {
+			t.Fatalf("expected %s by a non-editor to be forbidden, got %d", path, rr.Code)
+		}
+	}
+}
@@ -2,19 +2,21 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"mime"
 	"net/http"
 	"os"
-	"strings"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request) {
@@ -34,13 +36,18 @@ func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	userID, err := cfg.validateAccessToken(r.Context(), token)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
 		return
 	}
 
-	video, err := cfg.db.GetVideo(videoID)
+	// requestDB's statements carry on if the client goes away, which matters
+	// here: a blob reference taken below has to be recorded against the
+	// video or released again.
+	db := cfg.requestDB(r.Context())
+
+	video, err := db.GetVideo(videoID)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
 		return
@@ -49,12 +56,41 @@ func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request)
 		respondWithError(w, http.StatusNotFound, "Video not found", nil)
 		return
 	}
-	if video.UserID != userID {
-		respondWithError(w, http.StatusUnauthorized, "You can't modify this video", nil)
+	canEdit, err := cfg.canEditVideo(r.Context(), video, userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check video access", err)
+		return
+	}
+	if !canEdit {
+		respondWithError(w, http.StatusForbidden, "You can't modify this video", nil)
 		return
 	}
 
-	if err := r.ParseMultipartForm(maxUploadSize); err != nil {
+	// Quotas are checked before the body is read, and again once the video
+	// has been processed since that changes its size.
+	allowance, err := cfg.uploadAllowance(r.Context(), video, database.BlobKindVideo)
+	if err != nil {
+		respondWithUploadError(w, err, "Couldn't check storage quota")
+		return
+	}
+	if allowance < maxUploadSize {
+		if r.ContentLength > allowance+multipartOverhead {
+			respondWithUploadError(w, errStorageQuotaExceeded(), "Couldn't check storage quota")
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, allowance+multipartOverhead)
+	}
+
+	// Parsing reads the whole body, so this is where a slow client shows.
+	_, span := tracer.Start(r.Context(), "parse multipart form")
+	err = r.ParseMultipartForm(maxUploadSize)
+	endSpan(span, err)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			respondWithError(w, http.StatusRequestEntityTooLarge, "Video is larger than the upload limit or your remaining storage", err)
+			return
+		}
 		respondWithError(w, http.StatusBadRequest, "Couldn't parse multipart form", err)
 		return
 	}
@@ -107,45 +143,113 @@ func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request)
 	defer tempFile.Close()
 	defer os.Remove(tempFile.Name())
 
-	if _, err := io.Copy(tempFile, io.MultiReader(bytes.NewReader(sniffBytes), file)); err != nil {
+	// Hash while saving, so a file that's been uploaded before can be
+	// recognized without reading it again.
+	_, span = tracer.Start(r.Context(), "save upload")
+	hasher := sha256.New()
+	written, err := io.Copy(io.MultiWriter(tempFile, hasher), io.MultiReader(bytes.NewReader(sniffBytes), file))
+	uploadBytesTotal.WithLabelValues(string(database.BlobKindVideo)).Add(float64(written))
+	span.SetAttributes(attribute.Int64("tubely.upload.bytes", written))
+	if err != nil {
+		endSpan(span, err)
 		respondWithError(w, http.StatusInternalServerError, "Couldn't save temp video file", err)
 		return
 	}
+	hash := hex.EncodeToString(hasher.Sum(nil))
 
-	if err := tempFile.Sync(); err != nil {
+	err = tempFile.Sync()
+	endSpan(span, err)
+	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't flush temp video file", err)
 		return
 	}
 
-	aspectRatio, err := getVideoAspectRatio(tempFile.Name())
+	if _, err := tempFile.Seek(0, io.SeekStart); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't rewind temp video file", err)
+		return
+	}
+	_, span = tracer.Start(r.Context(), "scan upload")
+	scanResult, err := cfg.scanUpload(r, userID, video.ID, database.BlobKindVideo, tempFile)
+	endSpan(span, err)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't determine video aspect ratio", err)
+		respondWithUploadError(w, err, "Couldn't scan video")
 		return
 	}
 
-	if err := tempFile.Close(); err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't close temp file", err)
+	blob, err := db.AcquireBlob(database.BlobKindVideo, hash)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't look up video blob", err)
+		return
+	}
+	if blob.Hash == "" {
+		ctx, span := tracer.Start(r.Context(), "process video")
+		blob, err = cfg.processVideoBlob(ctx, video.ID, tempFile, mediaType, hash)
+		endSpan(span, err)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't process video", err)
+			return
+		}
+	}
+
+	if err := cfg.checkBlobAllowance(r, blob, allowance); err != nil {
+		respondWithUploadError(w, err, "Couldn't check storage quota")
+		return
+	}
+
+	videoURL, err := cfg.videoURL(video.ID, blob.Key)
+	if err == nil {
+		err = db.SetVideoFile(video.ID, videoURL, blob.Hash, cfg.storageLimits())
+	}
+	if err != nil {
+		if err := db.ReleaseBlob(blob.Kind, blob.Hash); err != nil {
+			loggerFrom(r.Context()).Error("Couldn't release video blob", "hash", blob.Hash, "error", err)
+		}
+		cfg.cleanUpBlobs(r.Context())
+		respondWithUploadError(w, cfg.storageLimitError(err), "Couldn't update video")
 		return
 	}
+	cfg.recordScanResult(r.Context(), video.ID, database.BlobKindVideo, scanResult)
+	cfg.cleanUpBlobs(r.Context())
 
-	processedPath, err := processVideoForFastStart(tempFile.Name())
+	updatedVideo, err := db.GetVideo(videoID)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't process video for fast start", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve updated video", err)
 		return
 	}
+
+	respondWithJSON(w, http.StatusOK, editorView(updatedVideo))
+}
+
+// processVideoBlob prepares a newly uploaded video for streaming and stores
+// it as a blob, returning a reference to the blob. tempFile is the upload,
+// which is closed.
+func (cfg *apiConfig) processVideoBlob(ctx context.Context, videoID uuid.UUID, tempFile *os.File, mediaType, hash string) (database.Blob, error) {
+	defer trackProcessingJob(database.BlobKindVideo)()
+
+	aspectRatio, err := getVideoAspectRatio(ctx, tempFile.Name())
+	if err != nil {
+		return database.Blob{}, fmt.Errorf("couldn't determine video aspect ratio: %w", err)
+	}
+
+	if err := tempFile.Close(); err != nil {
+		return database.Blob{}, fmt.Errorf("couldn't close temp file: %w", err)
+	}
+
+	processedPath, err := processVideoForFastStart(ctx, tempFile.Name())
+	if err != nil {
+		return database.Blob{}, fmt.Errorf("couldn't process video for fast start: %w", err)
+	}
 	defer os.Remove(processedPath)
 
 	processedFile, err := os.Open(processedPath)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't open processed video", err)
-		return
+		return database.Blob{}, fmt.Errorf("couldn't open processed video: %w", err)
 	}
 	defer processedFile.Close()
 
 	randomBytes := make([]byte, 32)
 	if _, err := rand.Read(randomBytes); err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't generate video key", err)
-		return
+		return database.Blob{}, fmt.Errorf("couldn't generate video key: %w", err)
 	}
 	baseKey := hex.EncodeToString(randomBytes) + ".mp4"
 
@@ -159,39 +263,28 @@ func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request)
 
 	objectKey := prefix + baseKey
 
-	_, err = cfg.s3Client.PutObject(r.Context(), &s3.PutObjectInput{
-		Bucket:      aws.String(cfg.s3Bucket),
-		Key:         aws.String(objectKey),
-		Body:        processedFile,
-		ContentType: aws.String(mediaType),
-	})
+	info, err := processedFile.Stat()
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't upload video", err)
-		return
+		return database.Blob{}, fmt.Errorf("couldn't stat processed video: %w", err)
 	}
-
-	cfBase := strings.TrimSpace(cfg.s3CfDistribution)
-	if cfBase == "" {
-		respondWithError(w, http.StatusInternalServerError, "CloudFront distribution not configured", nil)
-		return
-	}
-	if !strings.HasPrefix(cfBase, "http://") && !strings.HasPrefix(cfBase, "https://") {
-		cfBase = "https://" + cfBase
-	}
-	cfBase = strings.TrimRight(cfBase, "/")
-	videoURL := fmt.Sprintf("%s/%s", cfBase, objectKey)
-	video.VideoURL = &videoURL
-
-	if err := cfg.db.UpdateVideo(video); err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
-		return
+	if _, err := cfg.storeVideo(ctx, videoID, objectKey, mediaType, processedFile); err != nil {
+		return database.Blob{}, fmt.Errorf("couldn't upload video: %w", err)
 	}
 
-	updatedVideo, err := cfg.db.GetVideo(videoID)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve updated video", err)
-		return
+	// Storing the video can be abandoned along with the request, but once
+	// it's stored it has to be recorded or removed again.
+	ctx = context.WithoutCancel(ctx)
+	blob, err := cfg.requestDB(ctx).AddBlob(database.Blob{
+		Kind: database.BlobKindVideo,
+		Hash: hash,
+		Key:  objectKey,
+		Size: info.Size(),
+	})
+	if err != nil || blob.Key != objectKey {
+		// Either way, the video just stored isn't going to be used.
+		if err := cfg.deleteStoredVideo(ctx, objectKey); err != nil {
+			loggerFrom(ctx).Error("Couldn't remove unused video", "key", objectKey, "error", err)
+		}
 	}
-
-	respondWithJSON(w, http.StatusOK, updatedVideo)
+	return blob, err
 }
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestUploadVideoReusesStoredBlob(t *testing.T) {
+	tempDir := t.TempDir()
+	dbClient, err := database.NewClient(filepath.Join(tempDir, "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create db client: %v", err)
+	}
+	jwtKeys, err := loadJWTKeys("test-secret", "", "")
+	if err != nil {
+		t.Fatalf("failed to load jwt keys: %v", err)
+	}
+	cfg := apiConfig{
+		db:         dbClient,
+		jwtKeys:    jwtKeys,
+		assetsRoot: tempDir,
+		videosRoot: filepath.Join(tempDir, "videos"),
+		port:       "8091",
+	}
+
+	user, err := dbClient.CreateUser(database.CreateUserParams{Email: "uploader@example.com", Password: "unused"})
+	if err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	token, err := jwtKeys.MakeJWT(user.ID, user.TokenVersion, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create jwt: %v", err)
+	}
+
+	// The content has been uploaded and processed before, so uploading it
+	// again mustn't need ffmpeg.
+	content := append([]byte("\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00mp42isom"), []byte(strings.Repeat("frame", 100))...)
+	const key = "landscape/processed.mp4"
+	storedPath := cfg.localVideoPath(key)
+	if err := os.MkdirAll(filepath.Dir(storedPath), 0755); err != nil {
+		t.Fatalf("failed to create videos dir: %v", err)
+	}
+	if err := os.WriteFile(storedPath, []byte("processed"), 0644); err != nil {
+		t.Fatalf("failed to write stored video: %v", err)
+	}
+	blob := database.Blob{Kind: database.BlobKindVideo, Hash: uploadHash(content), Key: key}
+	if _, err := dbClient.AddBlob(blob); err != nil {
+		t.Fatalf("failed to add blob: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/video_upload/{videoID}", cfg.handlerUploadVideo)
+	mux.HandleFunc("DELETE /api/videos/{videoID}", cfg.handlerVideoMetaDelete)
+
+	var videos []database.Video
+	for _, title := range []string{"First", "Second"} {
+		video, err := dbClient.CreateVideo(database.CreateVideoParams{Title: title, UserID: user.ID})
+		if err != nil {
+			t.Fatalf("failed to create video: %v", err)
+		}
+		videos = append(videos, video)
+	}
+
+	for _, video := range videos {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		part, err := writer.CreateFormFile("video", "clip.mp4")
+		if err != nil {
+			t.Fatalf("failed to create form file: %v", err)
+		}
+		part.Write(content)
+		writer.Close()
+		req := httptest.NewRequest(http.MethodPost, "/api/video_upload/"+video.ID.String(), body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected upload to succeed, got %d: %s", rr.Code, rr.Body.String())
+		}
+		var got database.Video
+		if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+			t.Fatalf("failed to decode video: %v", err)
+		}
+		if got.VideoURL == nil || *got.VideoURL != cfg.localVideoStreamBase(video.ID)+"/"+key {
+			t.Fatalf("expected upload to reuse the stored video, got %v", got.VideoURL)
+		}
+	}
+
+	// Drop the reference AddBlob took, leaving the videos' ones.
+	if err := dbClient.ReleaseBlob(blob.Kind, blob.Hash); err != nil {
+		t.Fatalf("failed to release blob: %v", err)
+	}
+	for i, video := range videos {
+		req := httptest.NewRequest(http.MethodDelete, "/api/videos/"+video.ID.String(), nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		if rr.Code != http.StatusNoContent {
+			t.Fatalf("expected deletion to succeed, got %d", rr.Code)
+		}
+		_, err := os.Stat(storedPath)
+		if last := i == len(videos)-1; last != os.IsNotExist(err) {
+			t.Fatalf("expected stored video to be removed only with its last video, got %v after %d deletions", err, i+1)
+		}
+	}
+}
+
+func TestUploadVideoFinishesAfterClientDisconnects(t *testing.T) {
+	tempDir := t.TempDir()
+	dbClient, err := database.NewClient(filepath.Join(tempDir, "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create db client: %v", err)
+	}
+	jwtKeys, err := loadJWTKeys("test-secret", "", "")
+	if err != nil {
+		t.Fatalf("failed to load jwt keys: %v", err)
+	}
+	cfg := apiConfig{
+		db:         dbClient,
+		jwtKeys:    jwtKeys,
+		assetsRoot: tempDir,
+		videosRoot: filepath.Join(tempDir, "videos"),
+		port:       "8091",
+	}
+
+	user, err := dbClient.CreateUser(database.CreateUserParams{Email: "leaver@example.com", Password: "unused"})
+	if err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	token, err := jwtKeys.MakeJWT(user.ID, user.TokenVersion, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create jwt: %v", err)
+	}
+	video, err := dbClient.CreateVideo(database.CreateVideoParams{Title: "Abandoned", UserID: user.ID})
+	if err != nil {
+		t.Fatalf("failed to create video: %v", err)
+	}
+
+	content := append([]byte("\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00mp42isom"), []byte(strings.Repeat("frame", 100))...)
+	const key = "landscape/abandoned.mp4"
+	storedPath := cfg.localVideoPath(key)
+	if err := os.MkdirAll(filepath.Dir(storedPath), 0755); err != nil {
+		t.Fatalf("failed to create videos dir: %v", err)
+	}
+	if err := os.WriteFile(storedPath, []byte("processed"), 0644); err != nil {
+		t.Fatalf("failed to write stored video: %v", err)
+	}
+	if _, err := dbClient.AddBlob(database.Blob{Kind: database.BlobKindVideo, Hash: uploadHash(content), Key: key}); err != nil {
+		t.Fatalf("failed to add blob: %v", err)
+	}
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("video", "clip.mp4")
+	if err != nil {
+		t.Fatalf("failed to create form file: %v", err)
+	}
+	part.Write(content)
+	writer.Close()
+
+	// The client has gone by the time the handler gets to the database.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest(http.MethodPost, "/api/video_upload/"+video.ID.String(), body).WithContext(ctx)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.SetPathValue("videoID", video.ID.String())
+	cfg.handlerUploadVideo(httptest.NewRecorder(), req)
+
+	updated, err := dbClient.GetVideo(video.ID)
+	if err != nil {
+		t.Fatalf("failed to get video: %v", err)
+	}
+	if updated.VideoBlobHash != uploadHash(content) {
+		t.Fatalf("expected the upload to be recorded although the client left, got blob %q", updated.VideoBlobHash)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
 
@@ -33,7 +34,7 @@ func (cfg *apiConfig) handlerUsersCreate(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	user, err := cfg.db.CreateUser(database.CreateUserParams{
+	user, err := cfg.requestDB(r.Context()).CreateUser(database.CreateUserParams{
 		Email:    params.Email,
 		Password: hashedPassword,
 	})
@@ -42,5 +43,9 @@ func (cfg *apiConfig) handlerUsersCreate(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	sendEmailInBackground(r.Context(), "verification", func(ctx context.Context) error {
+		return cfg.sendVerificationEmail(ctx, user.ID, user.Email)
+	})
+
 	respondWithJSON(w, http.StatusCreated, user)
 }
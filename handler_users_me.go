@@ -0,0 +1,451 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	maxDisplayNameLength = 50
+	maxBioLength         = 500
+	maxAvatarSize        = 10 << 20
+)
+
+func (cfg *apiConfig) handlerUsersMeGet(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateAccessToken(r.Context(), token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	user, err := cfg.requestDB(r.Context()).GetUser(userID)
+	if err != nil || user == nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, user)
+}
+
+// handlerUsersMeUsage reports how much storage the user's videos take up
+// and how much they have left. Limits are null when there are none.
+func (cfg *apiConfig) handlerUsersMeUsage(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		BytesUsed      int64  `json:"bytes_used"`
+		BytesQuota     *int64 `json:"bytes_quota"`
+		BytesRemaining *int64 `json:"bytes_remaining"`
+		Videos         int    `json:"videos"`
+		VideoLimit     *int   `json:"video_limit"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateAccessToken(r.Context(), token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	usage, err := cfg.requestDB(r.Context()).GetStorageUsage(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get storage usage", err)
+		return
+	}
+
+	resp := response{BytesUsed: usage.Bytes, Videos: usage.Videos}
+	if cfg.storageQuota > 0 {
+		remaining := max(cfg.storageQuota-usage.Bytes, 0)
+		resp.BytesQuota = &cfg.storageQuota
+		resp.BytesRemaining = &remaining
+	}
+	if cfg.maxVideosPerUser > 0 {
+		resp.VideoLimit = &cfg.maxVideosPerUser
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// handlerUsersMeUpdate applies a partial profile update; omitted fields keep
+// their current values.
+func (cfg *apiConfig) handlerUsersMeUpdate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		DisplayName *string `json:"display_name"`
+		Bio         *string `json:"bio"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateAccessToken(r.Context(), token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	user, err := cfg.requestDB(r.Context()).GetUser(userID)
+	if err != nil || user == nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return
+	}
+
+	profile := database.UpdateUserProfileParams{
+		DisplayName: user.DisplayName,
+		Bio:         user.Bio,
+	}
+	if params.DisplayName != nil {
+		profile.DisplayName = strings.TrimSpace(*params.DisplayName)
+		if utf8.RuneCountInString(profile.DisplayName) > maxDisplayNameLength {
+			respondWithError(w, http.StatusBadRequest, "Display name is too long", nil)
+			return
+		}
+	}
+	if params.Bio != nil {
+		profile.Bio = strings.TrimSpace(*params.Bio)
+		if utf8.RuneCountInString(profile.Bio) > maxBioLength {
+			respondWithError(w, http.StatusBadRequest, "Bio is too long", nil)
+			return
+		}
+	}
+
+	if err := cfg.requestDB(r.Context()).UpdateUserProfile(userID, profile); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update profile", err)
+		return
+	}
+
+	updatedUser, err := cfg.requestDB(r.Context()).GetUser(userID)
+	if err != nil || updatedUser == nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve updated user", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, updatedUser)
+}
+
+func (cfg *apiConfig) handlerUsersMeAvatarUpload(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxAvatarSize)
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateAccessToken(r.Context(), token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	file, header, err := readUploadedImage(r, "avatar", maxAvatarSize)
+	if err != nil {
+		respondWithUploadError(w, err, "Couldn't read avatar")
+		return
+	}
+	defer file.Close()
+	uploadBytesTotal.WithLabelValues("avatar").Add(float64(header.Size))
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't read avatar", err)
+		return
+	}
+	user, err := cfg.requestDB(r.Context()).GetUser(userID)
+	if err != nil || user == nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return
+	}
+
+	// Avatars are processed like thumbnails, which strips their metadata.
+	avatar, err := cfg.saveThumbnail(data, header.Header.Get("Content-Type"))
+	if err != nil {
+		respondWithUploadError(w, err, "Couldn't save avatar file")
+		return
+	}
+	if err := cfg.requestDB(r.Context()).UpdateUserAvatar(userID, &avatar.url, avatar.srcset); err != nil {
+		if err := cfg.removeAvatarAssets(database.User{AvatarURL: &avatar.url, AvatarSrcset: avatar.srcset}); err != nil {
+			loggerFrom(r.Context()).Error("Couldn't remove unused avatar", "url", avatar.url, "error", err)
+		}
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update avatar", err)
+		return
+	}
+	cfg.removeReplacedAvatar(r.Context(), *user)
+
+	updatedUser, err := cfg.requestDB(r.Context()).GetUser(userID)
+	if err != nil || updatedUser == nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve updated user", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, updatedUser)
+}
+
+func (cfg *apiConfig) handlerUsersMeAvatarDelete(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateAccessToken(r.Context(), token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	user, err := cfg.requestDB(r.Context()).GetUser(userID)
+	if err != nil || user == nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return
+	}
+	if err := cfg.requestDB(r.Context()).UpdateUserAvatar(userID, nil, nil); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't remove avatar", err)
+		return
+	}
+	cfg.removeReplacedAvatar(r.Context(), *user)
+
+	updatedUser, err := cfg.requestDB(r.Context()).GetUser(userID)
+	if err != nil || updatedUser == nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve updated user", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, updatedUser)
+}
+
+// removeReplacedAvatar deletes the files of the avatar user had before it
+// was replaced or removed. The user row no longer points at them, so a
+// failure only leaves them orphaned and is logged.
+func (cfg *apiConfig) removeReplacedAvatar(ctx context.Context, user database.User) {
+	if err := cfg.removeAvatarAssets(user); err != nil {
+		loggerFrom(ctx).Error("Couldn't remove old avatar", "user_id", user.ID, "error", err)
+	}
+}
+
+// handlerUsersMePasswordChange requires the current password, then signs out
+// every other session and returns fresh tokens for this one.
+func (cfg *apiConfig) handlerUsersMePasswordChange(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+	type response struct {
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateAccessToken(r.Context(), token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if params.NewPassword == "" {
+		respondWithError(w, http.StatusBadRequest, "New password is required", nil)
+		return
+	}
+
+	user, err := cfg.requestDB(r.Context()).GetUser(userID)
+	if err != nil || user == nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return
+	}
+
+	match, err := auth.CheckPasswordHash(params.CurrentPassword, user.Password)
+	if err != nil || !match {
+		respondWithError(w, http.StatusUnauthorized, "Incorrect password", err)
+		return
+	}
+
+	hashedPassword, err := auth.HashPassword(params.NewPassword)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't hash password", err)
+		return
+	}
+	if err := cfg.requestDB(r.Context()).UpdateUserPassword(userID, hashedPassword); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update password", err)
+		return
+	}
+
+	if err := cfg.requestDB(r.Context()).RevokeAllRefreshTokens(userID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke sessions", err)
+		return
+	}
+	if err := cfg.requestDB(r.Context()).IncrementTokenVersion(userID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't invalidate access tokens", err)
+		return
+	}
+
+	user, err = cfg.requestDB(r.Context()).GetUser(userID)
+	if err != nil || user == nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return
+	}
+	accessToken, refreshToken, err := cfg.createSession(r, *user)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create session", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, response{
+		Token:        accessToken,
+		RefreshToken: refreshToken,
+	})
+}
+
+// handlerUsersMeEmailChange starts an email change by sending a confirmation
+// link to the new address; the account keeps its current email until then.
+func (cfg *apiConfig) handlerUsersMeEmailChange(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		NewEmail string `json:"new_email"`
+		Password string `json:"password"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateAccessToken(r.Context(), token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	params.NewEmail = strings.TrimSpace(params.NewEmail)
+	if params.NewEmail == "" {
+		respondWithError(w, http.StatusBadRequest, "New email is required", nil)
+		return
+	}
+
+	user, err := cfg.requestDB(r.Context()).GetUser(userID)
+	if err != nil || user == nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return
+	}
+
+	match, err := auth.CheckPasswordHash(params.Password, user.Password)
+	if err != nil || !match {
+		respondWithError(w, http.StatusUnauthorized, "Incorrect password", err)
+		return
+	}
+	if params.NewEmail == user.Email {
+		respondWithError(w, http.StatusBadRequest, "That's already your email address", nil)
+		return
+	}
+
+	existing, err := cfg.requestDB(r.Context()).GetUserByEmail(params.NewEmail)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check email", err)
+		return
+	}
+	if existing.ID != uuid.Nil {
+		respondWithError(w, http.StatusConflict, "Email address is already in use", nil)
+		return
+	}
+
+	if err := cfg.sendEmailChangeVerification(r.Context(), userID, params.NewEmail); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't send verification email", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (cfg *apiConfig) handlerUsersMeEmailConfirm(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Token string `json:"token"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	userToken, err := cfg.requestDB(r.Context()).ConsumeUserToken(auth.HashToken(params.Token), database.UserTokenChangeEmail)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check verification token", err)
+		return
+	}
+	if userToken == nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid or expired verification token", nil)
+		return
+	}
+
+	user, err := cfg.requestDB(r.Context()).GetUser(userToken.UserID)
+	if err != nil || user == nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return
+	}
+
+	existing, err := cfg.requestDB(r.Context()).GetUserByEmail(userToken.Email)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check email", err)
+		return
+	}
+	if existing.ID != uuid.Nil {
+		respondWithError(w, http.StatusConflict, "Email address is already in use", nil)
+		return
+	}
+
+	if err := cfg.requestDB(r.Context()).UpdateUserEmail(user.ID, userToken.Email); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update email", err)
+		return
+	}
+
+	if err := cfg.sendEmailChangedNotice(r.Context(), user.Email, userToken.Email); err != nil {
+		loggerFrom(r.Context()).Error("Couldn't send email change notice", "user_id", user.ID, "error", err)
+	}
+
+	updatedUser, err := cfg.requestDB(r.Context()).GetUser(user.ID)
+	if err != nil || updatedUser == nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve updated user", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, updatedUser)
+}
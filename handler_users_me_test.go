@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image/jpeg"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/mailer"
+)
+
+func TestUserProfileManagement(t *testing.T) {
+	tempDir := t.TempDir()
+	dbPath := filepath.Join(tempDir, "test.db")
+	mailDir := filepath.Join(tempDir, "mail")
+
+	dbClient, err := database.NewClient(dbPath)
+	if err != nil {
+		t.Fatalf("failed to create db client: %v", err)
+	}
+
+	jwtKeys, err := loadJWTKeys("test-secret", "", "")
+	if err != nil {
+		t.Fatalf("failed to load jwt keys: %v", err)
+	}
+
+	assetsRoot := filepath.Join(tempDir, "assets")
+	if err := os.Mkdir(assetsRoot, 0755); err != nil {
+		t.Fatalf("failed to create assets dir: %v", err)
+	}
+	cfg := apiConfig{
+		db:         dbClient,
+		jwtKeys:    jwtKeys,
+		assetsRoot: assetsRoot,
+		port:       "8091",
+		mailer:     mailer.FileMailer{Dir: mailDir, From: "test@tubely.local"},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/users", cfg.handlerUsersCreate)
+	mux.HandleFunc("POST /api/login", cfg.handlerLogin)
+	mux.HandleFunc("GET /api/users/me", cfg.handlerUsersMeGet)
+	mux.HandleFunc("PATCH /api/users/me", cfg.handlerUsersMeUpdate)
+	mux.HandleFunc("POST /api/users/me/avatar", cfg.handlerUsersMeAvatarUpload)
+	mux.HandleFunc("DELETE /api/users/me/avatar", cfg.handlerUsersMeAvatarDelete)
+	mux.HandleFunc("POST /api/users/me/password", cfg.handlerUsersMePasswordChange)
+	mux.HandleFunc("POST /api/users/me/email", cfg.handlerUsersMeEmailChange)
+	mux.HandleFunc("POST /api/users/me/email/confirm", cfg.handlerUsersMeEmailConfirm)
+
+	do := func(method, path, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+	login := func(email, password string) (int, string) {
+		rr := do(http.MethodPost, "/api/login", "", `{"email":"`+email+`","password":"`+password+`"}`)
+		var resp struct {
+			Token string `json:"token"`
+		}
+		json.Unmarshal(rr.Body.Bytes(), &resp)
+		return rr.Code, resp.Token
+	}
+
+	rr := do(http.MethodPost, "/api/users", "", `{"email":"me@example.com","password":"old-password"}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected user to be created, got %d", rr.Code)
+	}
+	if strings.Contains(rr.Body.String(), "password") {
+		t.Fatalf("expected password hash to be omitted from response: %s", rr.Body.String())
+	}
+	if rr := do(http.MethodPost, "/api/users", "", `{"email":"taken@example.com","password":"pw"}`); rr.Code != http.StatusCreated {
+		t.Fatalf("expected second user to be created, got %d", rr.Code)
+	}
+
+	code, token := login("me@example.com", "old-password")
+	if code != http.StatusOK {
+		t.Fatalf("expected login to succeed, got %d", code)
+	}
+
+	rr = do(http.MethodPatch, "/api/users/me", token, `{"display_name":"  Jane  ","bio":"Makes videos"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected profile update to succeed, got %d: %s", rr.Code, rr.Body.String())
+	}
+	rr = do(http.MethodPatch, "/api/users/me", token, `{"bio":"Still makes videos"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected partial profile update to succeed, got %d", rr.Code)
+	}
+	var profile database.User
+	if err := json.Unmarshal(rr.Body.Bytes(), &profile); err != nil {
+		t.Fatalf("failed to decode profile: %v", err)
+	}
+	if profile.DisplayName != "Jane" || profile.Bio != "Still makes videos" {
+		t.Fatalf("unexpected profile: %+v", profile)
+	}
+	if rr := do(http.MethodPatch, "/api/users/me", token, `{"display_name":"`+strings.Repeat("x", maxDisplayNameLength+1)+`"}`); rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected long display name to be rejected, got %d", rr.Code)
+	}
+
+	uploadAvatar := func(data []byte) {
+		t.Helper()
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		part, err := writer.CreateFormFile("avatar", "avatar.jpg")
+		if err != nil {
+			t.Fatalf("failed to create form file: %v", err)
+		}
+		part.Write(data)
+		writer.Close()
+		req := httptest.NewRequest(http.MethodPost, "/api/users/me/avatar", body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected avatar upload to succeed, got %d: %s", rr.Code, rr.Body.String())
+		}
+	}
+	assetFiles := func() []string {
+		t.Helper()
+		entries, err := os.ReadDir(assetsRoot)
+		if err != nil {
+			t.Fatalf("failed to read assets dir: %v", err)
+		}
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		return names
+	}
+
+	// A photo whose EXIF carries something that mustn't be published.
+	const secret = "GPS 51.5007 -0.1246"
+	var photo bytes.Buffer
+	if err := jpeg.Encode(&photo, testImage(800, 600), nil); err != nil {
+		t.Fatalf("failed to encode avatar: %v", err)
+	}
+	segment := append([]byte("Exif\x00\x00MM\x00\x2a\x00\x00\x00\x08\x00\x00"), secret...)
+	app1 := []byte{0xFF, 0xE1, byte((len(segment) + 2) >> 8), byte(len(segment) + 2)}
+	withEXIF := append(append(append([]byte{}, photo.Bytes()[:2]...), app1...), segment...)
+	withEXIF = append(withEXIF, photo.Bytes()[2:]...)
+	uploadAvatar(withEXIF)
+
+	rr = do(http.MethodGet, "/api/users/me", token, "")
+	if err := json.Unmarshal(rr.Body.Bytes(), &profile); err != nil {
+		t.Fatalf("failed to decode profile: %v", err)
+	}
+	if profile.AvatarURL == nil || !strings.HasSuffix(*profile.AvatarURL, "-640.jpg") {
+		t.Fatalf("expected avatar URL to be the largest JPEG rendition, got %v", profile.AvatarURL)
+	}
+	if !strings.Contains(profile.AvatarSrcset["image/webp"], "320w") {
+		t.Fatalf("expected avatar renditions, got %+v", profile.AvatarSrcset)
+	}
+	firstAvatar := assetFiles()
+	if len(firstAvatar) != 4 {
+		t.Fatalf("expected two widths in two formats, got %v", firstAvatar)
+	}
+	for _, name := range firstAvatar {
+		data, err := os.ReadFile(filepath.Join(assetsRoot, name))
+		if err != nil {
+			t.Fatalf("failed to read avatar: %v", err)
+		}
+		if bytes.Contains(data, []byte(secret)) {
+			t.Fatalf("expected %s to be stripped of metadata", name)
+		}
+	}
+
+	// Replacing or removing the avatar deletes the old files.
+	var second bytes.Buffer
+	if err := png.Encode(&second, testImage(64, 64)); err != nil {
+		t.Fatalf("failed to encode avatar: %v", err)
+	}
+	uploadAvatar(second.Bytes())
+	for _, name := range assetFiles() {
+		if slices.Contains(firstAvatar, name) {
+			t.Fatalf("expected replaced avatar %s to be removed", name)
+		}
+	}
+	rr = do(http.MethodDelete, "/api/users/me/avatar", token, "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected avatar removal to succeed, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var cleared database.User
+	if err := json.Unmarshal(rr.Body.Bytes(), &cleared); err != nil {
+		t.Fatalf("failed to decode profile: %v", err)
+	}
+	if cleared.AvatarURL != nil || len(cleared.AvatarSrcset) != 0 {
+		t.Fatalf("expected avatar to be cleared, got %v %v", cleared.AvatarURL, cleared.AvatarSrcset)
+	}
+	if files := assetFiles(); len(files) != 0 {
+		t.Fatalf("expected removed avatar's files to be deleted, got %v", files)
+	}
+
+	if rr := do(http.MethodPost, "/api/users/me/password", token, `{"current_password":"wrong","new_password":"new-password"}`); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected wrong current password to be rejected, got %d", rr.Code)
+	}
+	rr = do(http.MethodPost, "/api/users/me/password", token, `{"current_password":"old-password","new_password":"new-password"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected password change to succeed, got %d", rr.Code)
+	}
+	var tokens struct {
+		Token string `json:"token"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &tokens)
+	if rr := do(http.MethodGet, "/api/users/me", token, ""); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected old access token to be invalidated, got %d", rr.Code)
+	}
+	token = tokens.Token
+	if code, _ := login("me@example.com", "old-password"); code != http.StatusUnauthorized {
+		t.Fatalf("expected old password to be rejected, got %d", code)
+	}
+
+	if rr := do(http.MethodPost, "/api/users/me/email", token, `{"new_email":"taken@example.com","password":"new-password"}`); rr.Code != http.StatusConflict {
+		t.Fatalf("expected taken email to conflict, got %d", rr.Code)
+	}
+	if rr := do(http.MethodPost, "/api/users/me/email", token, `{"new_email":"new@example.com","password":"new-password"}`); rr.Code != http.StatusAccepted {
+		t.Fatalf("expected email change to be accepted, got %d", rr.Code)
+	}
+	if code, _ := login("me@example.com", "new-password"); code != http.StatusOK {
+		t.Fatalf("expected old email to keep working until confirmed, got %d", code)
+	}
+
+	changeToken := lastEmailLinkParam(t, mailDir, "change_email_token")
+	rr = do(http.MethodPost, "/api/users/me/email/confirm", "", `{"token":"`+changeToken+`"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected email change to be confirmed, got %d", rr.Code)
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &profile); err != nil {
+		t.Fatalf("failed to decode profile: %v", err)
+	}
+	if profile.Email != "new@example.com" || profile.EmailVerifiedAt == nil {
+		t.Fatalf("expected verified new email, got %+v", profile)
+	}
+	if code, _ := login("new@example.com", "new-password"); code != http.StatusOK {
+		t.Fatalf("expected login with new email to succeed, got %d", code)
+	}
+}
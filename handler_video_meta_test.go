@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"image/png"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
@@ -28,9 +29,14 @@ func TestHandlerVideosRetrieveReturnsAssetURL(t *testing.T) {
 		t.Fatalf("failed to create db client: %v", err)
 	}
 
+	jwtKeys, err := loadJWTKeys("test-secret", "", "")
+	if err != nil {
+		t.Fatalf("failed to load jwt keys: %v", err)
+	}
+
 	cfg := apiConfig{
 		db:         dbClient,
-		jwtSecret:  "test-secret",
+		jwtKeys:    jwtKeys,
 		assetsRoot: tempDir,
 		port:       "8091",
 	}
@@ -57,7 +63,7 @@ func TestHandlerVideosRetrieveReturnsAssetURL(t *testing.T) {
 		t.Fatalf("failed to create video: %v", err)
 	}
 
-	token, err := auth.MakeJWT(user.ID, cfg.jwtSecret, time.Hour)
+	token, err := cfg.jwtKeys.MakeJWT(user.ID, user.TokenVersion, time.Hour)
 	if err != nil {
 		t.Fatalf("failed to create jwt: %v", err)
 	}
@@ -70,8 +76,7 @@ func TestHandlerVideosRetrieveReturnsAssetURL(t *testing.T) {
 		t.Fatalf("failed to create form file: %v", err)
 	}
 
-	sampleData := []byte{0x89, 0x50, 0x4e, 0x47, 0x0d, 0x0a, 0x1a, 0x0a}
-	if _, err := fileWriter.Write(sampleData); err != nil {
+	if err := png.Encode(fileWriter, testImage(64, 36)); err != nil {
 		t.Fatalf("failed to write sample data: %v", err)
 	}
 
@@ -137,8 +142,8 @@ func TestHandlerVideosRetrieveReturnsAssetURL(t *testing.T) {
 	}
 
 	thumbnailFile := path.Base(parsedURL.Path)
-	if filepath.Ext(thumbnailFile) != ".png" {
-		t.Fatalf("expected png extension, got %s", filepath.Ext(thumbnailFile))
+	if filepath.Ext(thumbnailFile) != ".jpg" {
+		t.Fatalf("expected jpg extension, got %s", filepath.Ext(thumbnailFile))
 	}
 
 	if strings.Contains(thumbnailFile, video.ID.String()) {
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// editableVideo loads the video named in the request path and checks that the
+// caller may edit it, writing the error response if not.
+func (cfg *apiConfig) editableVideo(w http.ResponseWriter, r *http.Request) (database.Video, bool) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return database.Video{}, false
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return database.Video{}, false
+	}
+	userID, err := cfg.validateAccessToken(r.Context(), token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return database.Video{}, false
+	}
+
+	video, err := cfg.requestDB(r.Context()).GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return database.Video{}, false
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return database.Video{}, false
+	}
+	canEdit, err := cfg.canEditVideo(r.Context(), video, userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check video access", err)
+		return database.Video{}, false
+	}
+	if !canEdit {
+		respondWithError(w, http.StatusForbidden, "You can't modify this video", nil)
+		return database.Video{}, false
+	}
+	return video, true
+}
+
+func (cfg *apiConfig) handlerVideoSharesList(w http.ResponseWriter, r *http.Request) {
+	video, ok := cfg.editableVideo(w, r)
+	if !ok {
+		return
+	}
+
+	shares, err := cfg.requestDB(r.Context()).GetVideoShares(video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get shares", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, shares)
+}
+
+// handlerVideoShareCreate gives another user, identified by email, read
+// access to the video even while it's private.
+func (cfg *apiConfig) handlerVideoShareCreate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Email string `json:"email"`
+	}
+
+	video, ok := cfg.editableVideo(w, r)
+	if !ok {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	recipient, err := cfg.requestDB(r.Context()).GetUserByEmail(strings.TrimSpace(params.Email))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't look up user", err)
+		return
+	}
+	if recipient.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "No user with that email", nil)
+		return
+	}
+	if recipient.ID == video.UserID {
+		respondWithError(w, http.StatusBadRequest, "You can't share a video with yourself", nil)
+		return
+	}
+
+	if err := cfg.requestDB(r.Context()).ShareVideo(video.ID, recipient.ID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't share video", err)
+		return
+	}
+
+	shares, err := cfg.requestDB(r.Context()).GetVideoShares(video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get shares", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, shares)
+}
+
+func (cfg *apiConfig) handlerVideoShareDelete(w http.ResponseWriter, r *http.Request) {
+	video, ok := cfg.editableVideo(w, r)
+	if !ok {
+		return
+	}
+
+	userID, err := uuid.Parse(r.PathValue("userID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID", err)
+		return
+	}
+
+	removed, err := cfg.requestDB(r.Context()).UnshareVideo(video.ID, userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't unshare video", err)
+		return
+	}
+	if !removed {
+		respondWithError(w, http.StatusNotFound, "Video isn't shared with that user", nil)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// handlerVideoStream serves a locally stored video with support for byte
+// ranges and conditional requests, so browsers can seek without a CDN in
+// front. Since a <video> element can't send an Authorization header, a
+// playback token from /api/videos/{videoID}/playback in the token query
+// parameter is accepted instead.
+func (cfg *apiConfig) handlerVideoStream(w http.ResponseWriter, r *http.Request) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		return
+	}
+	key := r.PathValue("key")
+
+	video, err := cfg.requestDB(r.Context()).GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil || video.VideoURL == nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	// Only the current upload is served; URLs of replaced ones stop working.
+	storedKey, ok := cfg.localVideoKey(video.ID, *video.VideoURL)
+	if !ok || storedKey != key {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+
+	if token := r.URL.Query().Get("token"); token != "" {
+		tokenVideoID, err := cfg.jwtKeys.ParsePlaybackToken(token)
+		if err != nil {
+			respondWithError(w, http.StatusUnauthorized, "Invalid playback token", err)
+			return
+		}
+		if tokenVideoID != video.ID {
+			respondWithError(w, http.StatusNotFound, "Video not found", nil)
+			return
+		}
+	} else {
+		viewerID, err := cfg.viewerID(r)
+		if err != nil {
+			respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+			return
+		}
+		canView, err := cfg.canViewVideo(r.Context(), video, viewerID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't check video access", err)
+			return
+		}
+		if !canView {
+			respondWithError(w, http.StatusNotFound, "Video not found", nil)
+			return
+		}
+	}
+
+	file, err := os.Open(cfg.localVideoPath(key))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			respondWithError(w, http.StatusNotFound, "Video not found", err)
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Couldn't open video", err)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't stat video", err)
+		return
+	}
+
+	if contentType := mime.TypeByExtension(path.Ext(key)); contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.Header().Set("ETag", fileETag(info))
+	w.Header().Set("Cache-Control", "private, no-cache")
+	w.Header().Set("Vary", "Authorization")
+
+	// ServeContent handles Range, If-Range, If-None-Match and
+	// If-Modified-Since, and sniffs the content type if it isn't set.
+	http.ServeContent(w, r, path.Base(key), info.ModTime(), file)
+}
+
+// handlerVideoPlayback returns a short-lived URL the video can be played
+// from, whichever storage it's in.
+func (cfg *apiConfig) handlerVideoPlayback(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		PlaybackURL string    `json:"playback_url"`
+		ExpiresAt   time.Time `json:"expires_at"`
+	}
+
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		return
+	}
+
+	viewerID, err := cfg.viewerID(r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	video, err := cfg.requestDB(r.Context()).GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	canView, err := cfg.canViewVideo(r.Context(), video, viewerID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check video access", err)
+		return
+	}
+	if !canView {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+
+	expiresAt := time.Now().UTC().Add(maxPlaybackURLTTL)
+	playbackURL, err := cfg.presignVideoURL(r.Context(), video, maxPlaybackURLTTL)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create playback URL", err)
+		return
+	}
+	if playbackURL == "" {
+		respondWithError(w, http.StatusNotFound, "Video hasn't been uploaded", nil)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, response{
+		PlaybackURL: playbackURL,
+		ExpiresAt:   expiresAt,
+	})
+}
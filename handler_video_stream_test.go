@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestVideoStream(t *testing.T) {
+	tempDir := t.TempDir()
+	dbPath := filepath.Join(tempDir, "test.db")
+
+	dbClient, err := database.NewClient(dbPath)
+	if err != nil {
+		t.Fatalf("failed to create db client: %v", err)
+	}
+
+	jwtKeys, err := loadJWTKeys("test-secret", "", "")
+	if err != nil {
+		t.Fatalf("failed to load jwt keys: %v", err)
+	}
+
+	cfg := apiConfig{
+		db:         dbClient,
+		jwtKeys:    jwtKeys,
+		assetsRoot: tempDir,
+		videosRoot: filepath.Join(tempDir, "videos"),
+		port:       "8091",
+	}
+
+	user, err := dbClient.CreateUser(database.CreateUserParams{Email: "owner@example.com", Password: "unused"})
+	if err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	ownerToken, err := jwtKeys.MakeJWT(user.ID, user.TokenVersion, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create jwt: %v", err)
+	}
+
+	newVideo := func(title string) database.Video {
+		video, err := dbClient.CreateVideo(database.CreateVideoParams{Title: title, UserID: user.ID})
+		if err != nil {
+			t.Fatalf("failed to create video: %v", err)
+		}
+		return video
+	}
+	video := newVideo("Streamed")
+	other := newVideo("Other")
+
+	// Enough of an MP4 header for content sniffing.
+	content := append([]byte("\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00mp42isom"), []byte(strings.Repeat("frame", 100))...)
+	src := filepath.Join(tempDir, "upload.mp4")
+	if err := os.WriteFile(src, content, 0644); err != nil {
+		t.Fatalf("failed to write video: %v", err)
+	}
+	file, err := os.Open(src)
+	if err != nil {
+		t.Fatalf("failed to open video: %v", err)
+	}
+	defer file.Close()
+	videoURL, err := cfg.storeLocalVideo(video.ID, "landscape/abc.mp4", file)
+	if err != nil {
+		t.Fatalf("failed to store video: %v", err)
+	}
+	video.VideoURL = &videoURL
+	if err := dbClient.UpdateVideo(video); err != nil {
+		t.Fatalf("failed to update video: %v", err)
+	}
+	streamPath := "/api/videos/" + video.ID.String() + "/stream/landscape/abc.mp4"
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/videos/{videoID}/playback", cfg.handlerVideoPlayback)
+	mux.HandleFunc("GET /api/videos/{videoID}/stream/{key...}", cfg.handlerVideoStream)
+
+	do := func(path, token string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := do(streamPath, "", nil); rr.Code != http.StatusNotFound {
+		t.Fatalf("expected private video to be hidden from anonymous viewers, got %d", rr.Code)
+	}
+
+	rr := do(streamPath, ownerToken, nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected owner to stream video, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr.Body.String() != string(content) {
+		t.Fatalf("expected the stored video to be streamed")
+	}
+	if got := rr.Header().Get("Content-Type"); got != "video/mp4" {
+		t.Fatalf("expected video/mp4, got %q", got)
+	}
+	if rr.Header().Get("Accept-Ranges") != "bytes" {
+		t.Fatalf("expected range support to be advertised")
+	}
+	etag := rr.Header().Get("ETag")
+	if etag == "" {
+		t.Fatalf("expected an ETag")
+	}
+
+	rr = do(streamPath, ownerToken, map[string]string{"Range": "bytes=4-11"})
+	if rr.Code != http.StatusPartialContent {
+		t.Fatalf("expected partial content, got %d", rr.Code)
+	}
+	if rr.Body.String() != "ftypmp42" {
+		t.Fatalf("expected requested byte range, got %q", rr.Body.String())
+	}
+	if !strings.HasPrefix(rr.Header().Get("Content-Range"), "bytes 4-11/") {
+		t.Fatalf("unexpected Content-Range %q", rr.Header().Get("Content-Range"))
+	}
+
+	if rr := do(streamPath, ownerToken, map[string]string{"If-None-Match": etag}); rr.Code != http.StatusNotModified {
+		t.Fatalf("expected matching ETag to return 304, got %d", rr.Code)
+	}
+
+	rr = do("/api/videos/"+video.ID.String()+"/playback", ownerToken, nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected playback URL, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var playback struct {
+		PlaybackURL string `json:"playback_url"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &playback); err != nil {
+		t.Fatalf("failed to decode playback: %v", err)
+	}
+	parsed, err := url.Parse(playback.PlaybackURL)
+	if err != nil {
+		t.Fatalf("failed to parse playback URL: %v", err)
+	}
+	if rr := do(parsed.RequestURI(), "", nil); rr.Code != http.StatusOK {
+		t.Fatalf("expected playback token to allow anonymous streaming, got %d", rr.Code)
+	}
+
+	otherToken, err := jwtKeys.MakePlaybackToken(other.ID, time.Minute)
+	if err != nil {
+		t.Fatalf("failed to create playback token: %v", err)
+	}
+	if rr := do(streamPath+"?token="+otherToken, "", nil); rr.Code != http.StatusNotFound {
+		t.Fatalf("expected another video's token to be rejected, got %d", rr.Code)
+	}
+	if rr := do(streamPath+"?token=garbage", "", nil); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected invalid token to be rejected, got %d", rr.Code)
+	}
+	if rr := do("/api/videos/"+video.ID.String()+"/stream/landscape/old.mp4", ownerToken, nil); rr.Code != http.StatusNotFound {
+		t.Fatalf("expected replaced uploads not to be served, got %d", rr.Code)
+	}
+
+	video.Visibility = database.VideoVisibilityPublic
+	if err := dbClient.UpdateVideo(video); err != nil {
+		t.Fatalf("failed to update video: %v", err)
+	}
+	if rr := do(streamPath, "", nil); rr.Code != http.StatusOK {
+		t.Fatalf("expected public video to stream anonymously, got %d", rr.Code)
+	}
+}
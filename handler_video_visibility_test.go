@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestVideoVisibility(t *testing.T) {
+	tempDir := t.TempDir()
+	dbPath := filepath.Join(tempDir, "test.db")
+
+	dbClient, err := database.NewClient(dbPath)
+	if err != nil {
+		t.Fatalf("failed to create db client: %v", err)
+	}
+
+	jwtKeys, err := loadJWTKeys("test-secret", "", "")
+	if err != nil {
+		t.Fatalf("failed to load jwt keys: %v", err)
+	}
+
+	cfg := apiConfig{
+		db:         dbClient,
+		jwtKeys:    jwtKeys,
+		assetsRoot: tempDir,
+		port:       "8091",
+	}
+
+	newUser := func(email string) (database.User, string) {
+		user, err := dbClient.CreateUser(database.CreateUserParams{Email: email, Password: "unused"})
+		if err != nil {
+			t.Fatalf("failed to create user: %v", err)
+		}
+		token, err := jwtKeys.MakeJWT(user.ID, user.TokenVersion, time.Hour)
+		if err != nil {
+			t.Fatalf("failed to create jwt: %v", err)
+		}
+		return *user, token
+	}
+	owner, ownerToken := newUser("owner@example.com")
+	friend, friendToken := newUser("friend@example.com")
+	_, strangerToken := newUser("stranger@example.com")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/videos", cfg.handlerVideoMetaCreate)
+	mux.HandleFunc("GET /api/videos/public", cfg.handlerVideosPublic)
+	mux.HandleFunc("GET /api/videos/shared", cfg.handlerVideosShared)
+	mux.HandleFunc("GET /api/videos/{videoID}", cfg.handlerVideoGet)
+	mux.HandleFunc("PATCH /api/videos/{videoID}", cfg.handlerVideoMetaUpdate)
+	mux.HandleFunc("POST /api/videos/{videoID}/shares", cfg.handlerVideoShareCreate)
+	mux.HandleFunc("DELETE /api/videos/{videoID}/shares/{userID}", cfg.handlerVideoShareDelete)
+
+	do := func(method, path, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := do(http.MethodPost, "/api/videos", ownerToken, `{"title":"Secret"}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected video to be created, got %d", rr.Code)
+	}
+	var video database.Video
+	if err := json.Unmarshal(rr.Body.Bytes(), &video); err != nil {
+		t.Fatalf("failed to decode video: %v", err)
+	}
+	if video.Visibility != database.VideoVisibilityPrivate {
+		t.Fatalf("expected new videos to be private, got %q", video.Visibility)
+	}
+	videoPath := "/api/videos/" + video.ID.String()
+
+	if rr := do(http.MethodPost, "/api/videos", ownerToken, `{"title":"Bad","visibility":"friends"}`); rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected unknown visibility to be rejected, got %d", rr.Code)
+	}
+
+	if rr := do(http.MethodGet, videoPath, ownerToken, ""); rr.Code != http.StatusOK {
+		t.Fatalf("expected owner to read private video, got %d", rr.Code)
+	}
+	if rr := do(http.MethodGet, videoPath, "", ""); rr.Code != http.StatusNotFound {
+		t.Fatalf("expected anonymous read of private video to 404, got %d", rr.Code)
+	}
+	if rr := do(http.MethodGet, videoPath, strangerToken, ""); rr.Code != http.StatusNotFound {
+		t.Fatalf("expected stranger read of private video to 404, got %d", rr.Code)
+	}
+
+	if rr := do(http.MethodPost, videoPath+"/shares", friendToken, `{"email":"stranger@example.com"}`); rr.Code != http.StatusForbidden {
+		t.Fatalf("expected non-owner share to be forbidden, got %d", rr.Code)
+	}
+	if rr := do(http.MethodPost, videoPath+"/shares", ownerToken, `{"email":"friend@example.com"}`); rr.Code != http.StatusCreated {
+		t.Fatalf("expected share to succeed, got %d", rr.Code)
+	}
+	if rr := do(http.MethodGet, videoPath, friendToken, ""); rr.Code != http.StatusOK {
+		t.Fatalf("expected shared user to read private video, got %d", rr.Code)
+	}
+	rr = do(http.MethodGet, "/api/videos/shared", friendToken, "")
+	var shared []database.Video
+	if err := json.Unmarshal(rr.Body.Bytes(), &shared); err != nil || len(shared) != 1 {
+		t.Fatalf("expected one shared video, got %s", rr.Body.String())
+	}
+	if rr := do(http.MethodDelete, videoPath+"/shares/"+friend.ID.String(), ownerToken, ""); rr.Code != http.StatusNoContent {
+		t.Fatalf("expected unshare to succeed, got %d", rr.Code)
+	}
+	if rr := do(http.MethodGet, videoPath, friendToken, ""); rr.Code != http.StatusNotFound {
+		t.Fatalf("expected unshared user to lose access, got %d", rr.Code)
+	}
+
+	if rr := do(http.MethodPatch, videoPath, ownerToken, `{"visibility":"unlisted"}`); rr.Code != http.StatusOK {
+		t.Fatalf("expected visibility update to succeed, got %d", rr.Code)
+	}
+	if rr := do(http.MethodGet, videoPath, "", ""); rr.Code != http.StatusOK {
+		t.Fatalf("expected anonymous read of unlisted video, got %d", rr.Code)
+	}
+
+	var feed struct {
+		Videos     []database.Video `json:"videos"`
+		NextOffset *int             `json:"next_offset"`
+	}
+	rr = do(http.MethodGet, "/api/videos/public", "", "")
+	if err := json.Unmarshal(rr.Body.Bytes(), &feed); err != nil || len(feed.Videos) != 0 {
+		t.Fatalf("expected unlisted video to stay out of the feed, got %s", rr.Body.String())
+	}
+
+	for i := 0; i < 3; i++ {
+		_, err := dbClient.CreateVideo(database.CreateVideoParams{
+			Title:      fmt.Sprintf("Public %d", i),
+			UserID:     owner.ID,
+			Visibility: database.VideoVisibilityPublic,
+		})
+		if err != nil {
+			t.Fatalf("failed to create video: %v", err)
+		}
+	}
+
+	seen := 0
+	offset := 0
+	for page := 0; ; page++ {
+		rr = do(http.MethodGet, fmt.Sprintf("/api/videos/public?limit=2&offset=%d", offset), "", "")
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected feed to succeed, got %d", rr.Code)
+		}
+		feed.NextOffset = nil
+		if err := json.Unmarshal(rr.Body.Bytes(), &feed); err != nil {
+			t.Fatalf("failed to decode feed: %v", err)
+		}
+		seen += len(feed.Videos)
+		if feed.NextOffset == nil {
+			break
+		}
+		if page > 2 {
+			t.Fatalf("feed didn't terminate")
+		}
+		offset = *feed.NextOffset
+	}
+	if seen != 3 {
+		t.Fatalf("expected 3 public videos across pages, got %d", seen)
+	}
+
+	if rr := do(http.MethodGet, "/api/videos/public?limit=0", "", ""); rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected invalid limit to be rejected, got %d", rr.Code)
+	}
+}
+
+// Visibility gates the API, not media URLs: a private video's thumbnail
+// stays reachable at its /assets/ URL by anyone who has it.
+func TestPrivateVideoMediaURLs(t *testing.T) {
+	tempDir := t.TempDir()
+	dbClient, err := database.NewClient(filepath.Join(tempDir, "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create db client: %v", err)
+	}
+	jwtKeys, err := loadJWTKeys("test-secret", "", "")
+	if err != nil {
+		t.Fatalf("failed to load jwt keys: %v", err)
+	}
+	assetsRoot := filepath.Join(tempDir, "assets")
+	if err := os.Mkdir(assetsRoot, 0755); err != nil {
+		t.Fatalf("failed to create assets dir: %v", err)
+	}
+	cfg := apiConfig{
+		db:         dbClient,
+		jwtKeys:    jwtKeys,
+		assetsRoot: assetsRoot,
+		port:       "8091",
+	}
+
+	owner, err := dbClient.CreateUser(database.CreateUserParams{Email: "owner@example.com", Password: "unused"})
+	if err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	token, err := jwtKeys.MakeJWT(owner.ID, owner.TokenVersion, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create jwt: %v", err)
+	}
+	video, err := dbClient.CreateVideo(database.CreateVideoParams{Title: "Secret", UserID: owner.ID})
+	if err != nil {
+		t.Fatalf("failed to create video: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/assets/", staticFileHandler("/assets", assetsRoot, assetCachePolicy))
+	mux.HandleFunc("GET /api/videos/{videoID}", cfg.handlerVideoGet)
+	mux.HandleFunc("POST /api/thumbnail_upload/{videoID}", cfg.handlerUploadThumbnail)
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	fileWriter, err := writer.CreateFormFile("thumbnail", "thumb.png")
+	if err != nil {
+		t.Fatalf("failed to create form file: %v", err)
+	}
+	if err := png.Encode(fileWriter, testImage(640, 360)); err != nil {
+		t.Fatalf("failed to write sample data: %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("failed to close multipart writer: %v", err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/api/thumbnail_upload/"+video.ID.String(), body)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected thumbnail upload to succeed, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var uploaded database.Video
+	if err := json.Unmarshal(rr.Body.Bytes(), &uploaded); err != nil || uploaded.ThumbnailURL == nil {
+		t.Fatalf("expected thumbnail url in response, got %s", rr.Body.String())
+	}
+	thumbnailURL, err := url.Parse(*uploaded.ThumbnailURL)
+	if err != nil {
+		t.Fatalf("invalid thumbnail url: %v", err)
+	}
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/videos/"+video.ID.String(), nil))
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("expected anonymous read of private video to 404, got %d", rr.Code)
+	}
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, thumbnailURL.Path, nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected private video's thumbnail URL to be served without auth, got %d", rr.Code)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+const (
+	defaultFeedPageSize = 20
+	maxFeedPageSize     = 100
+)
+
+// handlerVideosPublic serves the browse feed of public videos. It needs no
+// authentication, is paginated with limit and offset query parameters, and can
+// be narrowed to one tag.
+func (cfg *apiConfig) handlerVideosPublic(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Videos     []database.Video `json:"videos"`
+		NextOffset *int             `json:"next_offset"`
+	}
+
+	limit := defaultFeedPageSize
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 {
+			respondWithError(w, http.StatusBadRequest, "Invalid limit", err)
+			return
+		}
+		limit = min(n, maxFeedPageSize)
+	}
+
+	offset := 0
+	if raw := r.URL.Query().Get("offset"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			respondWithError(w, http.StatusBadRequest, "Invalid offset", err)
+			return
+		}
+		offset = n
+	}
+
+	tag := ""
+	if raw := r.URL.Query().Get("tag"); raw != "" {
+		tag = normalizeTag(raw)
+	}
+
+	// Fetch one extra row to find out whether there's another page.
+	videos, err := cfg.requestDB(r.Context()).GetPublicVideos(tag, limit+1, offset)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve videos", err)
+		return
+	}
+
+	resp := response{Videos: videos}
+	if len(videos) > limit {
+		resp.Videos = videos[:limit]
+		next := offset + limit
+		resp.NextOffset = &next
+	}
+
+	respondWithJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const maxWorkspaceNameLength = 100
+
+type workspaceResponse struct {
+	database.Workspace
+	Role    database.WorkspaceRole     `json:"role"`
+	Members []database.WorkspaceMember `json:"members"`
+}
+
+// workspaceForMember loads the workspace named in the request path along with
+// the caller's role in it, writing the error response if that fails.
+// Workspaces the caller doesn't belong to are reported as missing.
+func (cfg *apiConfig) workspaceForMember(w http.ResponseWriter, r *http.Request) (database.Workspace, uuid.UUID, database.WorkspaceRole, bool) {
+	workspaceID, err := uuid.Parse(r.PathValue("workspaceID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return database.Workspace{}, uuid.Nil, "", false
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return database.Workspace{}, uuid.Nil, "", false
+	}
+	userID, err := cfg.validateAccessToken(r.Context(), token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return database.Workspace{}, uuid.Nil, "", false
+	}
+
+	role, err := cfg.requestDB(r.Context()).GetWorkspaceRole(workspaceID, userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check workspace access", err)
+		return database.Workspace{}, uuid.Nil, "", false
+	}
+	if role == "" {
+		respondWithError(w, http.StatusNotFound, "Workspace not found", nil)
+		return database.Workspace{}, uuid.Nil, "", false
+	}
+
+	workspace, err := cfg.requestDB(r.Context()).GetWorkspace(workspaceID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get workspace", err)
+		return database.Workspace{}, uuid.Nil, "", false
+	}
+	return workspace, userID, role, true
+}
+
+// ownedWorkspace is workspaceForMember restricted to the workspace's owners.
+func (cfg *apiConfig) ownedWorkspace(w http.ResponseWriter, r *http.Request) (database.Workspace, bool) {
+	workspace, _, role, ok := cfg.workspaceForMember(w, r)
+	if !ok {
+		return database.Workspace{}, false
+	}
+	if role != database.WorkspaceRoleOwner {
+		respondWithError(w, http.StatusForbidden, "Only workspace owners can do that", nil)
+		return database.Workspace{}, false
+	}
+	return workspace, true
+}
+
+func validWorkspaceName(name string) (string, bool) {
+	name = strings.TrimSpace(name)
+	return name, name != "" && len(name) <= maxWorkspaceNameLength
+}
+
+func (cfg *apiConfig) handlerWorkspaceCreate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Name string `json:"name"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateAccessToken(r.Context(), token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	name, ok := validWorkspaceName(params.Name)
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, "Name must be between 1 and 100 characters", nil)
+		return
+	}
+
+	workspace, err := cfg.requestDB(r.Context()).CreateWorkspace(name, userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create workspace", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, database.UserWorkspace{
+		Workspace: workspace,
+		Role:      database.WorkspaceRoleOwner,
+	})
+}
+
+func (cfg *apiConfig) handlerWorkspacesRetrieve(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateAccessToken(r.Context(), token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	workspaces, err := cfg.requestDB(r.Context()).GetUserWorkspaces(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve workspaces", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, workspaces)
+}
+
+func (cfg *apiConfig) handlerWorkspaceGet(w http.ResponseWriter, r *http.Request) {
+	workspace, _, role, ok := cfg.workspaceForMember(w, r)
+	if !ok {
+		return
+	}
+
+	members, err := cfg.requestDB(r.Context()).GetWorkspaceMembers(workspace.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get members", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, workspaceResponse{
+		Workspace: workspace,
+		Role:      role,
+		Members:   members,
+	})
+}
+
+func (cfg *apiConfig) handlerWorkspaceUpdate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Name string `json:"name"`
+	}
+
+	workspace, ok := cfg.ownedWorkspace(w, r)
+	if !ok {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	name, ok := validWorkspaceName(params.Name)
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, "Name must be between 1 and 100 characters", nil)
+		return
+	}
+	workspace.Name = name
+
+	if err := cfg.requestDB(r.Context()).UpdateWorkspace(workspace); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update workspace", err)
+		return
+	}
+
+	updated, err := cfg.requestDB(r.Context()).GetWorkspace(workspace.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve updated workspace", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, updated)
+}
+
+// handlerWorkspaceDelete deletes the workspace together with its videos.
+// Like account deletion, stored media goes first so a failure leaves
+// something to retry.
+func (cfg *apiConfig) handlerWorkspaceDelete(w http.ResponseWriter, r *http.Request) {
+	workspace, ok := cfg.ownedWorkspace(w, r)
+	if !ok {
+		return
+	}
+
+	videos, err := cfg.requestDB(r.Context()).GetWorkspaceVideos(workspace.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get videos", err)
+		return
+	}
+	if err := cfg.deleteVideoMedia(r.Context(), videos); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete stored media", err)
+		return
+	}
+
+	if err := cfg.requestDB(r.Context()).DeleteWorkspace(workspace.ID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete workspace", err)
+		return
+	}
+	cfg.cleanUpBlobs(r.Context())
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (cfg *apiConfig) handlerWorkspaceVideos(w http.ResponseWriter, r *http.Request) {
+	workspace, _, role, ok := cfg.workspaceForMember(w, r)
+	if !ok {
+		return
+	}
+
+	videos, err := cfg.requestDB(r.Context()).GetWorkspaceVideos(workspace.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve videos", err)
+		return
+	}
+
+	if role.CanEdit() {
+		respondWithJSON(w, http.StatusOK, editorViews(videos))
+		return
+	}
+	respondWithJSON(w, http.StatusOK, videos)
+}
+
+// handlerWorkspaceMemberAdd adds a user, identified by email, to the
+// workspace. Adding someone who's already a member changes their role.
+func (cfg *apiConfig) handlerWorkspaceMemberAdd(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Email string                 `json:"email"`
+		Role  database.WorkspaceRole `json:"role"`
+	}
+
+	workspace, ok := cfg.ownedWorkspace(w, r)
+	if !ok {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if params.Role == "" {
+		params.Role = database.WorkspaceRoleViewer
+	}
+	if !params.Role.Valid() {
+		respondWithError(w, http.StatusBadRequest, "Invalid role", nil)
+		return
+	}
+
+	member, err := cfg.requestDB(r.Context()).GetUserByEmail(strings.TrimSpace(params.Email))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't look up user", err)
+		return
+	}
+	if member.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "No user with that email", nil)
+		return
+	}
+
+	if err := cfg.requestDB(r.Context()).SetWorkspaceMember(workspace.ID, member.ID, params.Role); err != nil {
+		respondWithMemberError(w, err, "Couldn't add member")
+		return
+	}
+
+	cfg.respondWithWorkspaceMembers(r.Context(), w, http.StatusCreated, workspace.ID)
+}
+
+func (cfg *apiConfig) handlerWorkspaceMemberUpdate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Role database.WorkspaceRole `json:"role"`
+	}
+
+	workspace, ok := cfg.ownedWorkspace(w, r)
+	if !ok {
+		return
+	}
+	memberID, err := uuid.Parse(r.PathValue("userID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if !params.Role.Valid() {
+		respondWithError(w, http.StatusBadRequest, "Invalid role", nil)
+		return
+	}
+
+	current, err := cfg.requestDB(r.Context()).GetWorkspaceRole(workspace.ID, memberID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get member", err)
+		return
+	}
+	if current == "" {
+		respondWithError(w, http.StatusNotFound, "Member not found", nil)
+		return
+	}
+
+	if err := cfg.requestDB(r.Context()).SetWorkspaceMember(workspace.ID, memberID, params.Role); err != nil {
+		respondWithMemberError(w, err, "Couldn't update member")
+		return
+	}
+
+	cfg.respondWithWorkspaceMembers(r.Context(), w, http.StatusOK, workspace.ID)
+}
+
+// handlerWorkspaceMemberRemove lets owners remove anyone and every member
+// remove themselves, as long as the workspace keeps at least one owner.
+func (cfg *apiConfig) handlerWorkspaceMemberRemove(w http.ResponseWriter, r *http.Request) {
+	workspace, userID, role, ok := cfg.workspaceForMember(w, r)
+	if !ok {
+		return
+	}
+	memberID, err := uuid.Parse(r.PathValue("userID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID", err)
+		return
+	}
+	if memberID != userID && role != database.WorkspaceRoleOwner {
+		respondWithError(w, http.StatusForbidden, "Only workspace owners can do that", nil)
+		return
+	}
+
+	removed, err := cfg.requestDB(r.Context()).RemoveWorkspaceMember(workspace.ID, memberID)
+	if err != nil {
+		respondWithMemberError(w, err, "Couldn't remove member")
+		return
+	}
+	if !removed {
+		respondWithError(w, http.StatusNotFound, "Member not found", nil)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// respondWithMemberError writes the response for a failed membership
+// change, which is a conflict if it would have left the workspace without an
+// owner.
+func respondWithMemberError(w http.ResponseWriter, err error, msg string) {
+	if errors.Is(err, database.ErrLastWorkspaceOwner) {
+		respondWithError(w, http.StatusConflict, "A workspace needs at least one owner", nil)
+		return
+	}
+	respondWithError(w, http.StatusInternalServerError, msg, err)
+}
+
+func (cfg *apiConfig) respondWithWorkspaceMembers(ctx context.Context, w http.ResponseWriter, code int, workspaceID uuid.UUID) {
+	members, err := cfg.requestDB(ctx).GetWorkspaceMembers(workspaceID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get members", err)
+		return
+	}
+	respondWithJSON(w, code, members)
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestWorkspaces(t *testing.T) {
+	tempDir := t.TempDir()
+	dbPath := filepath.Join(tempDir, "test.db")
+
+	dbClient, err := database.NewClient(dbPath)
+	if err != nil {
+		t.Fatalf("failed to create db client: %v", err)
+	}
+
+	jwtKeys, err := loadJWTKeys("test-secret", "", "")
+	if err != nil {
+		t.Fatalf("failed to load jwt keys: %v", err)
+	}
+
+	cfg := apiConfig{
+		db:         dbClient,
+		jwtKeys:    jwtKeys,
+		assetsRoot: tempDir,
+		port:       "8091",
+	}
+
+	newUser := func(email string) (database.User, string) {
+		hash, err := auth.HashPassword("hunter2")
+		if err != nil {
+			t.Fatalf("failed to hash password: %v", err)
+		}
+		user, err := dbClient.CreateUser(database.CreateUserParams{Email: email, Password: hash})
+		if err != nil {
+			t.Fatalf("failed to create user: %v", err)
+		}
+		token, err := jwtKeys.MakeJWT(user.ID, user.TokenVersion, time.Hour)
+		if err != nil {
+			t.Fatalf("failed to create jwt: %v", err)
+		}
+		return *user, token
+	}
+	owner, ownerToken := newUser("owner@example.com")
+	editor, editorToken := newUser("editor@example.com")
+	viewer, viewerToken := newUser("viewer@example.com")
+	_, strangerToken := newUser("stranger@example.com")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/videos", cfg.handlerVideoMetaCreate)
+	mux.HandleFunc("GET /api/videos/{videoID}", cfg.handlerVideoGet)
+	mux.HandleFunc("PATCH /api/videos/{videoID}", cfg.handlerVideoMetaUpdate)
+	mux.HandleFunc("DELETE /api/videos/{videoID}", cfg.handlerVideoMetaDelete)
+	mux.HandleFunc("POST /api/workspaces", cfg.handlerWorkspaceCreate)
+	mux.HandleFunc("GET /api/workspaces", cfg.handlerWorkspacesRetrieve)
+	mux.HandleFunc("GET /api/workspaces/{workspaceID}", cfg.handlerWorkspaceGet)
+	mux.HandleFunc("DELETE /api/workspaces/{workspaceID}", cfg.handlerWorkspaceDelete)
+	mux.HandleFunc("GET /api/workspaces/{workspaceID}/videos", cfg.handlerWorkspaceVideos)
+	mux.HandleFunc("POST /api/workspaces/{workspaceID}/members", cfg.handlerWorkspaceMemberAdd)
+	mux.HandleFunc("PATCH /api/workspaces/{workspaceID}/members/{userID}", cfg.handlerWorkspaceMemberUpdate)
+	mux.HandleFunc("DELETE /api/workspaces/{workspaceID}/members/{userID}", cfg.handlerWorkspaceMemberRemove)
+	mux.HandleFunc("DELETE /api/users/me", cfg.handlerUsersMeDelete)
+
+	do := func(method, path, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := do(http.MethodPost, "/api/workspaces", ownerToken, `{"name":"Studio"}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected workspace to be created, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var workspace database.UserWorkspace
+	if err := json.Unmarshal(rr.Body.Bytes(), &workspace); err != nil {
+		t.Fatalf("failed to decode workspace: %v", err)
+	}
+	if workspace.Role != database.WorkspaceRoleOwner {
+		t.Fatalf("expected creator to be an owner, got %q", workspace.Role)
+	}
+	workspacePath := "/api/workspaces/" + workspace.ID.String()
+
+	for _, member := range []struct {
+		email, role string
+	}{
+		{editor.Email, "editor"},
+		{viewer.Email, "viewer"},
+	} {
+		body := fmt.Sprintf(`{"email":%q,"role":%q}`, member.email, member.role)
+		if rr := do(http.MethodPost, workspacePath+"/members", ownerToken, body); rr.Code != http.StatusCreated {
+			t.Fatalf("expected %s to be added, got %d: %s", member.email, rr.Code, rr.Body.String())
+		}
+	}
+	if rr := do(http.MethodPost, workspacePath+"/members", editorToken, `{"email":"stranger@example.com"}`); rr.Code != http.StatusForbidden {
+		t.Fatalf("expected editors not to manage members, got %d", rr.Code)
+	}
+	if rr := do(http.MethodGet, workspacePath, strangerToken, ""); rr.Code != http.StatusNotFound {
+		t.Fatalf("expected non-members to get 404, got %d", rr.Code)
+	}
+
+	videoBody := fmt.Sprintf(`{"title":"Team cut","workspace_id":%q}`, workspace.ID)
+	if rr := do(http.MethodPost, "/api/videos", viewerToken, videoBody); rr.Code != http.StatusForbidden {
+		t.Fatalf("expected viewers not to add videos, got %d", rr.Code)
+	}
+	if rr := do(http.MethodPost, "/api/videos", strangerToken, videoBody); rr.Code != http.StatusNotFound {
+		t.Fatalf("expected non-members not to add videos, got %d", rr.Code)
+	}
+	rr = do(http.MethodPost, "/api/videos", ownerToken, videoBody)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected owner to add a video, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var video database.Video
+	if err := json.Unmarshal(rr.Body.Bytes(), &video); err != nil {
+		t.Fatalf("failed to decode video: %v", err)
+	}
+	videoPath := "/api/videos/" + video.ID.String()
+
+	for _, token := range []string{editorToken, viewerToken} {
+		if rr := do(http.MethodGet, videoPath, token, ""); rr.Code != http.StatusOK {
+			t.Fatalf("expected members to read workspace video, got %d", rr.Code)
+		}
+	}
+	if rr := do(http.MethodGet, videoPath, strangerToken, ""); rr.Code != http.StatusNotFound {
+		t.Fatalf("expected non-members not to read workspace video, got %d", rr.Code)
+	}
+	if rr := do(http.MethodPatch, videoPath, viewerToken, `{"title":"Mine now"}`); rr.Code != http.StatusForbidden {
+		t.Fatalf("expected viewers not to edit, got %d", rr.Code)
+	}
+	if rr := do(http.MethodPatch, videoPath, editorToken, `{"title":"Final cut"}`); rr.Code != http.StatusOK {
+		t.Fatalf("expected editors to edit someone else's video, got %d", rr.Code)
+	}
+
+	rr = do(http.MethodGet, workspacePath+"/videos", viewerToken, "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected members to list videos, got %d", rr.Code)
+	}
+	var videos []database.Video
+	if err := json.Unmarshal(rr.Body.Bytes(), &videos); err != nil {
+		t.Fatalf("failed to decode videos: %v", err)
+	}
+	if len(videos) != 1 || videos[0].Title != "Final cut" {
+		t.Fatalf("expected the edited video in the library, got %+v", videos)
+	}
+
+	ownerPath := workspacePath + "/members/" + owner.ID.String()
+	if rr := do(http.MethodPatch, ownerPath, ownerToken, `{"role":"editor"}`); rr.Code != http.StatusConflict {
+		t.Fatalf("expected the last owner not to be demoted, got %d", rr.Code)
+	}
+	if rr := do(http.MethodDelete, ownerPath, ownerToken, ""); rr.Code != http.StatusConflict {
+		t.Fatalf("expected the last owner not to leave, got %d", rr.Code)
+	}
+	if rr := do(http.MethodDelete, "/api/users/me", ownerToken, `{"password":"hunter2"}`); rr.Code != http.StatusConflict {
+		t.Fatalf("expected sole owner account deletion to be refused, got %d", rr.Code)
+	}
+
+	if rr := do(http.MethodDelete, workspacePath+"/members/"+viewer.ID.String(), viewerToken, ""); rr.Code != http.StatusNoContent {
+		t.Fatalf("expected members to leave, got %d", rr.Code)
+	}
+	if rr := do(http.MethodGet, videoPath, viewerToken, ""); rr.Code != http.StatusNotFound {
+		t.Fatalf("expected former members to lose access, got %d", rr.Code)
+	}
+
+	if rr := do(http.MethodDelete, videoPath, editorToken, ""); rr.Code != http.StatusNoContent {
+		t.Fatalf("expected editors to delete workspace videos, got %d", rr.Code)
+	}
+
+	if rr := do(http.MethodDelete, workspacePath, editorToken, ""); rr.Code != http.StatusForbidden {
+		t.Fatalf("expected editors not to delete the workspace, got %d", rr.Code)
+	}
+	if rr := do(http.MethodDelete, workspacePath, ownerToken, ""); rr.Code != http.StatusNoContent {
+		t.Fatalf("expected owner to delete the workspace, got %d", rr.Code)
+	}
+	rr = do(http.MethodGet, "/api/workspaces", editorToken, "")
+	if rr.Code != http.StatusOK || strings.TrimSpace(rr.Body.String()) != "[]" {
+		t.Fatalf("expected no workspaces left, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestWorkspaceOwnersLeavingConcurrently(t *testing.T) {
+	tempDir := t.TempDir()
+	dbClient, err := database.NewClient(filepath.Join(tempDir, "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create db client: %v", err)
+	}
+	jwtKeys, err := loadJWTKeys("test-secret", "", "")
+	if err != nil {
+		t.Fatalf("failed to load jwt keys: %v", err)
+	}
+	cfg := apiConfig{
+		db:         dbClient,
+		jwtKeys:    jwtKeys,
+		assetsRoot: tempDir,
+		port:       "8091",
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("PATCH /api/workspaces/{workspaceID}/members/{userID}", cfg.handlerWorkspaceMemberUpdate)
+	mux.HandleFunc("DELETE /api/workspaces/{workspaceID}/members/{userID}", cfg.handlerWorkspaceMemberRemove)
+
+	type owner struct {
+		user  *database.User
+		token string
+	}
+	var owners []owner
+	for i := 0; i < 16; i++ {
+		user, err := dbClient.CreateUser(database.CreateUserParams{Email: fmt.Sprintf("owner%d@example.com", i), Password: "unused"})
+		if err != nil {
+			t.Fatalf("failed to create user: %v", err)
+		}
+		token, err := jwtKeys.MakeJWT(user.ID, user.TokenVersion, time.Hour)
+		if err != nil {
+			t.Fatalf("failed to create jwt: %v", err)
+		}
+		owners = append(owners, owner{user, token})
+	}
+	workspace, err := dbClient.CreateWorkspace("Studio", owners[0].user.ID)
+	if err != nil {
+		t.Fatalf("failed to create workspace: %v", err)
+	}
+	for _, o := range owners[1:] {
+		if err := dbClient.SetWorkspaceMember(workspace.ID, o.user.ID, database.WorkspaceRoleOwner); err != nil {
+			t.Fatalf("failed to add owner: %v", err)
+		}
+	}
+
+	// Every owner steps down at once, half by leaving and half by demoting
+	// themselves. Whichever goes last has to be refused.
+	var wg sync.WaitGroup
+	codes := make(chan int, len(owners))
+	for i, o := range owners {
+		method, body := http.MethodDelete, ""
+		if i%2 == 0 {
+			method, body = http.MethodPatch, `{"role":"editor"}`
+		}
+		req := httptest.NewRequest(method, "/api/workspaces/"+workspace.ID.String()+"/members/"+o.user.ID.String(), strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+o.token)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rr := httptest.NewRecorder()
+			mux.ServeHTTP(rr, req)
+			codes <- rr.Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	refused := 0
+	for code := range codes {
+		switch code {
+		case http.StatusOK, http.StatusNoContent:
+		case http.StatusConflict:
+			refused++
+		default:
+			t.Fatalf("expected owners to step down or be refused, got %d", code)
+		}
+	}
+	members, err := dbClient.GetWorkspaceMembers(workspace.ID)
+	if err != nil {
+		t.Fatalf("failed to get members: %v", err)
+	}
+	remaining := 0
+	for _, m := range members {
+		if m.Role == database.WorkspaceRoleOwner {
+			remaining++
+		}
+	}
+	if remaining != 1 || refused != 1 {
+		t.Fatalf("expected exactly one owner to be kept, got %d owners and %d refusals", remaining, refused)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+
+	// Decoders for the formats in uploadImageExtensions.
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+
+	_ "golang.org/x/image/webp"
+)
+
+// uploadError is a problem with an uploaded file that the client should hear
+// about with a specific status and message.
+type uploadError struct {
+	code int
+	msg  string
+	err  error
+}
+
+func (e *uploadError) Error() string {
+	if e.err != nil {
+		return fmt.Sprintf("%s: %v", e.msg, e.err)
+	}
+	return e.msg
+}
+
+func (e *uploadError) Unwrap() error {
+	return e.err
+}
+
+const (
+	// maxImageDimension and maxImagePixels bound how big an uploaded image
+	// may be once decoded, whatever its file size, so a small, highly
+	// compressed file can't exhaust memory.
+	maxImageDimension = 8192
+	maxImagePixels    = 40_000_000
+)
+
+// uploadImageExtensions is the allowlist of image formats users may upload,
+// by the name the image package registers their decoder under. Vector
+// formats like SVG are deliberately absent since they can carry script.
+var uploadImageExtensions = map[string]string{
+	"jpeg": ".jpg",
+	"png":  ".png",
+	"gif":  ".gif",
+	"webp": ".webp",
+}
+
+// decodeUploadedImage checks that data really is an image in one of the
+// allowed formats and within the size limits, and decodes it. The format is
+// taken from the file's contents; a declared Content-Type only matters if it
+// names something other than an allowed image type.
+func decodeUploadedImage(data []byte, declaredType string) (image.Image, string, error) {
+	if len(data) == 0 {
+		return nil, "", &uploadError{code: http.StatusBadRequest, msg: "Empty image file"}
+	}
+	const unsupportedMsg = "Image must be a JPEG, PNG, GIF or WebP file"
+	if declaredType != "" {
+		if parsed, _, err := mime.ParseMediaType(declaredType); err == nil {
+			declaredType = parsed
+		}
+		declaredFormat, isImage := strings.CutPrefix(declaredType, "image/")
+		if declaredFormat == "jpg" || declaredFormat == "pjpeg" {
+			declaredFormat = "jpeg"
+		}
+		_, allowed := uploadImageExtensions[declaredFormat]
+		if declaredType != "application/octet-stream" && (!isImage || !allowed) {
+			return nil, "", &uploadError{code: http.StatusUnsupportedMediaType, msg: unsupportedMsg}
+		}
+	}
+
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		if errors.Is(err, image.ErrFormat) {
+			return nil, "", &uploadError{code: http.StatusUnsupportedMediaType, msg: unsupportedMsg}
+		}
+		return nil, "", &uploadError{code: http.StatusUnprocessableEntity, msg: "Couldn't read image header", err: err}
+	}
+	if _, ok := uploadImageExtensions[format]; !ok {
+		return nil, "", &uploadError{code: http.StatusUnsupportedMediaType, msg: unsupportedMsg}
+	}
+	if config.Width < 1 || config.Height < 1 {
+		return nil, "", &uploadError{code: http.StatusUnprocessableEntity, msg: "Image has no pixels"}
+	}
+	if config.Width > maxImageDimension || config.Height > maxImageDimension {
+		return nil, "", &uploadError{
+			code: http.StatusUnprocessableEntity,
+			msg:  fmt.Sprintf("Image can be at most %dx%d pixels", maxImageDimension, maxImageDimension),
+		}
+	}
+	if int64(config.Width)*int64(config.Height) > maxImagePixels {
+		return nil, "", &uploadError{
+			code: http.StatusUnprocessableEntity,
+			msg:  fmt.Sprintf("Image can have at most %d megapixels", maxImagePixels/1_000_000),
+		}
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", &uploadError{code: http.StatusUnprocessableEntity, msg: "Image is corrupt or truncated", err: err}
+	}
+	return img, format, nil
+}
+
+// readUploadedImage reads the named file from a multipart request, reporting
+// a body over the size limit as 413 rather than a generic parse error.
+func readUploadedImage(r *http.Request, field string, maxSize int64) (multipart.File, *multipart.FileHeader, error) {
+	if err := r.ParseMultipartForm(maxSize); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return nil, nil, &uploadError{
+				code: http.StatusRequestEntityTooLarge,
+				msg:  fmt.Sprintf("Image can be at most %d MB", maxSize>>20),
+				err:  err,
+			}
+		}
+		return nil, nil, &uploadError{code: http.StatusBadRequest, msg: "Couldn't parse multipart form", err: err}
+	}
+	file, header, err := r.FormFile(field)
+	if err != nil {
+		return nil, nil, &uploadError{code: http.StatusBadRequest, msg: "Unable to parse form file", err: err}
+	}
+	return file, header, nil
+}
+
+// respondWithUploadError reports err with its own status if it's an
+// uploadError and as a 500 with fallbackMsg otherwise.
+func respondWithUploadError(w http.ResponseWriter, err error, fallbackMsg string) {
+	var uploadErr *uploadError
+	if errors.As(err, &uploadErr) {
+		respondWithError(w, uploadErr.code, uploadErr.msg, uploadErr.err)
+		return
+	}
+	respondWithError(w, http.StatusInternalServerError, fallbackMsg, err)
+}
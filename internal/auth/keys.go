@@ -0,0 +1,313 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+const minRSAKeyBits = 2048
+
+// SigningKey is a key that access tokens can be signed or verified with. Its
+// ID is published as the token's "kid" header so verifiers can pick the right
+// public key out of the JWKS.
+type SigningKey struct {
+	ID     string
+	method jwt.SigningMethod
+	sign   interface{}
+	verify interface{}
+}
+
+// NewHMACKey returns a shared-secret HS256 key. HMAC keys are never published
+// in the JWKS since their verification key is the signing secret.
+func NewHMACKey(id string, secret []byte) SigningKey {
+	return SigningKey{
+		ID:     id,
+		method: jwt.SigningMethodHS256,
+		sign:   secret,
+		verify: secret,
+	}
+}
+
+// NewRSAKey returns an RS256 key.
+func NewRSAKey(id string, key *rsa.PrivateKey) (SigningKey, error) {
+	if key.N.BitLen() < minRSAKeyBits {
+		return SigningKey{}, fmt.Errorf("RSA key %q is %d bits, need at least %d", id, key.N.BitLen(), minRSAKeyBits)
+	}
+	return SigningKey{
+		ID:     id,
+		method: jwt.SigningMethodRS256,
+		sign:   key,
+		verify: &key.PublicKey,
+	}, nil
+}
+
+// NewEd25519Key returns an EdDSA key.
+func NewEd25519Key(id string, key ed25519.PrivateKey) SigningKey {
+	return SigningKey{
+		ID:     id,
+		method: jwt.SigningMethodEdDSA,
+		sign:   key,
+		verify: key.Public(),
+	}
+}
+
+// ParsePrivateKeyPEM parses an RSA (PKCS#1 or PKCS#8) or Ed25519 (PKCS#8)
+// private key.
+func ParsePrivateKeyPEM(id string, data []byte) (SigningKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return SigningKey{}, fmt.Errorf("key %q: no PEM data found", id)
+	}
+
+	var parsed interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return SigningKey{}, fmt.Errorf("key %q: unsupported PEM block type %q", id, block.Type)
+	}
+	if err != nil {
+		return SigningKey{}, fmt.Errorf("key %q: %w", id, err)
+	}
+
+	switch key := parsed.(type) {
+	case *rsa.PrivateKey:
+		return NewRSAKey(id, key)
+	case ed25519.PrivateKey:
+		return NewEd25519Key(id, key), nil
+	default:
+		return SigningKey{}, fmt.Errorf("key %q: unsupported key type %T", id, parsed)
+	}
+}
+
+// LoadKeysDir loads every *.pem file in dir as a signing key, using the file
+// name without its extension as the key ID.
+func LoadKeysDir(dir string) ([]SigningKey, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	keys := make([]SigningKey, 0, len(paths))
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		id := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+		key, err := ParsePrivateKeyPEM(id, data)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// KeySet signs access tokens with its active key and verifies them against
+// any key it holds. Keeping a retired key in the set means tokens it signed
+// stay valid until they expire, so rotating the active key doesn't log anyone
+// out.
+type KeySet struct {
+	active SigningKey
+	keys   map[string]SigningKey
+	// legacyID names the key used for tokens without a "kid" header, which
+	// were issued before key IDs existed.
+	legacyID string
+}
+
+func NewKeySet(active SigningKey, retired ...SigningKey) (*KeySet, error) {
+	ks := &KeySet{
+		active: active,
+		keys:   map[string]SigningKey{},
+	}
+	for _, key := range append([]SigningKey{active}, retired...) {
+		if key.ID == "" {
+			return nil, errors.New("signing key ID is required")
+		}
+		if _, ok := ks.keys[key.ID]; ok {
+			return nil, fmt.Errorf("duplicate signing key ID %q", key.ID)
+		}
+		ks.keys[key.ID] = key
+	}
+	return ks, nil
+}
+
+// SetLegacyKey makes tokens without a "kid" header verify against the given
+// key.
+func (ks *KeySet) SetLegacyKey(id string) error {
+	if _, ok := ks.keys[id]; !ok {
+		return fmt.Errorf("unknown signing key ID %q", id)
+	}
+	ks.legacyID = id
+	return nil
+}
+
+func (ks *KeySet) MakeJWT(
+	userID uuid.UUID,
+	tokenVersion int,
+	expiresIn time.Duration,
+) (string, error) {
+	return ks.makeToken(TokenTypeAccess, userID, tokenVersion, expiresIn)
+}
+
+// ParseJWT validates an access token and returns its claims.
+func (ks *KeySet) ParseJWT(tokenString string) (AccessClaims, error) {
+	return ks.parseToken(TokenTypeAccess, tokenString)
+}
+
+// MakeMFAChallenge issues the short-lived token handed out in place of access
+// and refresh tokens when a user with two-factor authentication enabled
+// passes the password check.
+func (ks *KeySet) MakeMFAChallenge(
+	userID uuid.UUID,
+	tokenVersion int,
+	expiresIn time.Duration,
+) (string, error) {
+	return ks.makeToken(TokenTypeMFAChallenge, userID, tokenVersion, expiresIn)
+}
+
+func (ks *KeySet) ParseMFAChallenge(tokenString string) (AccessClaims, error) {
+	return ks.parseToken(TokenTypeMFAChallenge, tokenString)
+}
+
+// MakePlaybackToken issues a token that can be put in a streaming URL, where
+// the browser can't send an Authorization header.
+func (ks *KeySet) MakePlaybackToken(videoID uuid.UUID, expiresIn time.Duration) (string, error) {
+	return ks.makeToken(TokenTypePlayback, videoID, 0, expiresIn)
+}
+
+// ParsePlaybackToken validates a playback token and returns the ID of the
+// video it's for.
+func (ks *KeySet) ParsePlaybackToken(tokenString string) (uuid.UUID, error) {
+	claims, err := ks.parseToken(TokenTypePlayback, tokenString)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	return claims.UserID()
+}
+
+func (ks *KeySet) makeToken(
+	tokenType TokenType,
+	userID uuid.UUID,
+	tokenVersion int,
+	expiresIn time.Duration,
+) (string, error) {
+	token := jwt.NewWithClaims(ks.active.method, AccessClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    string(tokenType),
+			IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(expiresIn)),
+			Subject:   userID.String(),
+		},
+		TokenVersion: tokenVersion,
+	})
+	token.Header["kid"] = ks.active.ID
+	return token.SignedString(ks.active.sign)
+}
+
+func (ks *KeySet) parseToken(tokenType TokenType, tokenString string) (AccessClaims, error) {
+	claimsStruct := AccessClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, &claimsStruct, ks.verificationKey)
+	if err != nil {
+		return AccessClaims{}, err
+	}
+
+	issuer, err := token.Claims.GetIssuer()
+	if err != nil {
+		return AccessClaims{}, err
+	}
+	if issuer != string(tokenType) {
+		return AccessClaims{}, errors.New("invalid issuer")
+	}
+
+	if _, err := claimsStruct.UserID(); err != nil {
+		return AccessClaims{}, err
+	}
+	return claimsStruct, nil
+}
+
+func (ks *KeySet) verificationKey(token *jwt.Token) (interface{}, error) {
+	id, _ := token.Header["kid"].(string)
+	if id == "" {
+		id = ks.legacyID
+	}
+	key, ok := ks.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key ID %q", id)
+	}
+	// Pin the algorithm to the key so a token can't, for example, claim HS256
+	// and be verified with an RSA public key as the HMAC secret.
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method %q for key %q", token.Method.Alg(), id)
+	}
+	return key.verify, nil
+}
+
+// JWK is a public key in JSON Web Key format (RFC 7517).
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public half of every asymmetric key in the set, active and
+// retired, so verifiers can check any token that is still valid.
+func (ks *KeySet) JWKS() JWKS {
+	ids := make([]string, 0, len(ks.keys))
+	for id := range ks.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	jwks := JWKS{Keys: []JWK{}}
+	for _, id := range ids {
+		key := ks.keys[id]
+		jwk := JWK{
+			KeyID:     key.ID,
+			Use:       "sig",
+			Algorithm: key.method.Alg(),
+		}
+		switch pub := key.verify.(type) {
+		case *rsa.PublicKey:
+			jwk.KeyType = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.KeyType = "OKP"
+			jwk.Curve = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+		default:
+			continue
+		}
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+	return jwks
+}
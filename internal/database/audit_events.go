@@ -0,0 +1,68 @@
+package database
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// AuditEvent records a security-relevant event for later review.
+type AuditEvent struct {
+	ID        uuid.UUID `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	CreateAuditEventParams
+}
+
+type CreateAuditEventParams struct {
+	Type      string     `json:"type"`
+	UserID    *uuid.UUID `json:"user_id"`
+	IPAddress string     `json:"ip_address"`
+	Details   string     `json:"details"`
+}
+
+func (c Client) CreateAuditEvent(params CreateAuditEventParams) error {
+	var userID *string
+	if params.UserID != nil {
+		id := params.UserID.String()
+		userID = &id
+	}
+
+	query := `
+		INSERT INTO audit_events (id, created_at, type, user_id, ip_address, details)
+		VALUES (?, CURRENT_TIMESTAMP, ?, ?, ?, ?)
+	`
+	_, err := c.db.ExecContext(c.context(), query, uuid.New().String(), params.Type, userID, params.IPAddress, params.Details)
+	return err
+}
+
+func (c Client) GetAuditEvents(limit int) ([]AuditEvent, error) {
+	query := `
+		SELECT id, created_at, type, user_id, ip_address, details
+		FROM audit_events
+		ORDER BY created_at DESC
+		LIMIT ?
+	`
+	rows, err := c.db.QueryContext(c.context(), query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []AuditEvent{}
+	for rows.Next() {
+		var event AuditEvent
+		var userID *string
+		if err := rows.Scan(&event.ID, &event.CreatedAt, &event.Type, &userID, &event.IPAddress, &event.Details); err != nil {
+			return nil, err
+		}
+		if userID != nil {
+			id, err := uuid.Parse(*userID)
+			if err != nil {
+				return nil, err
+			}
+			event.UserID = &id
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
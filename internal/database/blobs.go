@@ -0,0 +1,268 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// BlobKind is what an upload was processed into. The same bytes uploaded as
+// a video and as a thumbnail are stored differently, so they're separate
+// blobs.
+type BlobKind string
+
+const (
+	BlobKindVideo     BlobKind = "video"
+	BlobKindThumbnail BlobKind = "thumbnail"
+)
+
+// Blob is processed media shared by every video whose upload had the same
+// content. Hash is the hex SHA-256 of the original upload. For videos, Key is
+// the storage key of the processed file; for thumbnails it's the URL of the
+// fallback rendition and Srcset lists the rest. Size is the total bytes
+// stored. RefCount is the number of videos (or uploads in progress) using
+// it; once it drops to zero the media can be deleted.
+type Blob struct {
+	Kind      BlobKind
+	Hash      string
+	Key       string
+	Srcset    map[string]string
+	Size      int64
+	RefCount  int
+	CreatedAt time.Time
+}
+
+const blobColumns = "kind, hash, storage_key, srcset, size, ref_count, created_at"
+
+func scanBlob(row rowScanner) (Blob, error) {
+	var blob Blob
+	var srcset string
+	err := row.Scan(&blob.Kind, &blob.Hash, &blob.Key, &srcset, &blob.Size, &blob.RefCount, &blob.CreatedAt)
+	if err != nil {
+		return Blob{}, err
+	}
+	blob.Srcset = map[string]string{}
+	if srcset != "" {
+		if err := json.Unmarshal([]byte(srcset), &blob.Srcset); err != nil {
+			return Blob{}, err
+		}
+	}
+	return blob, nil
+}
+
+// AcquireBlob takes a reference to the stored media for an upload with the
+// given hash, so it can be reused instead of processed again. It returns a
+// zero Blob if there's none. The reference has to be attached to a video
+// with SetVideoFile or SetVideoThumbnail, or given back with ReleaseBlob.
+func (c Client) AcquireBlob(kind BlobKind, hash string) (Blob, error) {
+	query := `
+		UPDATE blobs
+		SET ref_count = ref_count + 1
+		WHERE kind = ? AND hash = ? AND ref_count > 0
+		RETURNING ` + blobColumns + `
+	`
+	blob, err := scanBlob(c.db.QueryRowContext(c.context(), query, kind, hash))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Blob{}, nil
+	}
+	return blob, err
+}
+
+// AddBlob records newly stored media and takes a reference to it, like
+// AcquireBlob. If another upload of the same content got there first, a
+// reference to its blob is taken and returned instead; the caller should
+// then delete what it stored and use the returned Key.
+func (c Client) AddBlob(blob Blob) (Blob, error) {
+	srcset, err := json.Marshal(blob.Srcset)
+	if err != nil {
+		return Blob{}, err
+	}
+	// An existing blob with no references is waiting for its media to be
+	// deleted, so it's taken over rather than reused.
+	query := `
+		INSERT INTO blobs (kind, hash, storage_key, srcset, size, ref_count, created_at)
+		VALUES (?, ?, ?, ?, ?, 1, CURRENT_TIMESTAMP)
+		ON CONFLICT(kind, hash) DO UPDATE SET
+			storage_key = CASE WHEN ref_count > 0 THEN storage_key ELSE excluded.storage_key END,
+			srcset = CASE WHEN ref_count > 0 THEN srcset ELSE excluded.srcset END,
+			size = CASE WHEN ref_count > 0 THEN size ELSE excluded.size END,
+			created_at = CASE WHEN ref_count > 0 THEN created_at ELSE excluded.created_at END,
+			ref_count = ref_count + 1
+		RETURNING ` + blobColumns + `
+	`
+	return scanBlob(c.db.QueryRowContext(c.context(), query, blob.Kind, blob.Hash, blob.Key, string(srcset), blob.Size))
+}
+
+// GetBlob returns the blob with the given hash, or a zero Blob if there's
+// none.
+func (c Client) GetBlob(kind BlobKind, hash string) (Blob, error) {
+	query := `
+		SELECT ` + blobColumns + `
+		FROM blobs
+		WHERE kind = ? AND hash = ?
+	`
+	blob, err := scanBlob(c.db.QueryRowContext(c.context(), query, kind, hash))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Blob{}, nil
+	}
+	return blob, err
+}
+
+// ReleaseBlob gives back a reference from AcquireBlob or AddBlob that
+// wasn't attached to a video.
+func (c Client) ReleaseBlob(kind BlobKind, hash string) error {
+	query := `
+		UPDATE blobs
+		SET ref_count = ref_count - 1
+		WHERE kind = ? AND hash = ? AND ref_count > 0
+	`
+	_, err := c.db.ExecContext(c.context(), query, kind, hash)
+	return err
+}
+
+// GetOrphanedBlobs returns the blobs nothing refers to any more, whose
+// media can be deleted.
+func (c Client) GetOrphanedBlobs() ([]Blob, error) {
+	query := `
+		SELECT ` + blobColumns + `
+		FROM blobs
+		WHERE ref_count <= 0
+		ORDER BY created_at
+	`
+	rows, err := c.db.QueryContext(c.context(), query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	blobs := []Blob{}
+	for rows.Next() {
+		blob, err := scanBlob(rows)
+		if err != nil {
+			return nil, err
+		}
+		blobs = append(blobs, blob)
+	}
+	return blobs, rows.Err()
+}
+
+// DeleteBlob forgets an orphaned blob once its media has been deleted. It
+// does nothing if the blob has been taken over by a new upload meanwhile.
+func (c Client) DeleteBlob(blob Blob) error {
+	query := `
+		DELETE FROM blobs
+		WHERE kind = ? AND hash = ? AND storage_key = ? AND ref_count <= 0
+	`
+	_, err := c.db.ExecContext(c.context(), query, blob.Kind, blob.Hash, blob.Key)
+	return err
+}
+
+// StorageUsage is what a user's videos take up: the bytes of their video
+// files and thumbnail renditions, and how many have a video file. Media from
+// before blobs existed isn't counted in Bytes since its size was never
+// recorded. Workspace videos count against the user who created them.
+type StorageUsage struct {
+	Bytes  int64 `json:"bytes"`
+	Videos int   `json:"videos"`
+}
+
+// StorageLimits caps what a user may store. Zero fields mean no limit.
+type StorageLimits struct {
+	Bytes  int64
+	Videos int
+}
+
+var (
+	ErrStorageQuotaExceeded = errors.New("storage quota exceeded")
+	ErrVideoLimitReached    = errors.New("video limit reached")
+)
+
+// GetStorageUsage adds up the user's stored media. Blobs are shared between
+// videos with the same content, but each video is charged in full.
+func (c Client) GetStorageUsage(userID uuid.UUID) (StorageUsage, error) {
+	return storageUsage(c.db.QueryRowContext(c.context(), storageUsageQuery, BlobKindVideo, BlobKindThumbnail, userID))
+}
+
+// checkStorageLimits fails with ErrStorageQuotaExceeded or
+// ErrVideoLimitReached if the video's owner is over limits, counting the
+// transaction's own changes. Callers write to the video first, so the
+// transaction holds SQLite's write lock and concurrent uploads are checked
+// one after the other rather than against the same usage.
+func checkStorageLimits(tx *sql.Tx, videoID uuid.UUID, limits StorageLimits) error {
+	if limits == (StorageLimits{}) {
+		return nil
+	}
+	var userID uuid.UUID
+	if err := tx.QueryRow("SELECT user_id FROM videos WHERE id = ?", videoID).Scan(&userID); err != nil {
+		return err
+	}
+	usage, err := storageUsage(tx.QueryRow(storageUsageQuery, BlobKindVideo, BlobKindThumbnail, userID))
+	if err != nil {
+		return err
+	}
+	if limits.Videos > 0 && usage.Videos > limits.Videos {
+		return ErrVideoLimitReached
+	}
+	if limits.Bytes > 0 && usage.Bytes > limits.Bytes {
+		return ErrStorageQuotaExceeded
+	}
+	return nil
+}
+
+func storageUsage(row *sql.Row) (StorageUsage, error) {
+	var usage StorageUsage
+	err := row.Scan(&usage.Bytes, &usage.Videos)
+	return usage, err
+}
+
+const storageUsageQuery = `
+	SELECT
+		COALESCE(SUM(COALESCE(vb.size, 0) + COALESCE(tb.size, 0)), 0),
+		COUNT(v.video_url)
+	FROM videos v
+	LEFT JOIN blobs vb ON vb.kind = ? AND vb.hash = v.video_blob_hash
+	LEFT JOIN blobs tb ON tb.kind = ? AND tb.hash = v.thumbnail_blob_hash
+	WHERE v.user_id = ?
+`
+
+// setVideoBlob points the video's column at a blob the caller holds a
+// reference to, and releases the reference held by the blob it replaces.
+// column must not be built from user input.
+func setVideoBlob(tx *sql.Tx, videoID uuid.UUID, column string, kind BlobKind, hash string) error {
+	var previous sql.NullString
+	err := tx.QueryRow("SELECT "+column+" FROM videos WHERE id = ?", videoID).Scan(&previous)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE videos SET "+column+" = ? WHERE id = ?", hash, videoID); err != nil {
+		return err
+	}
+	if previous.String == "" {
+		return nil
+	}
+	_, err = tx.Exec(`
+		UPDATE blobs
+		SET ref_count = ref_count - 1
+		WHERE kind = ? AND hash = ? AND ref_count > 0
+	`, kind, previous.String)
+	return err
+}
+
+// releaseVideoBlobs releases the references the matching videos hold to
+// blobs in column. It's run before the videos are deleted.
+func releaseVideoBlobs(tx *sql.Tx, column string, kind BlobKind, where string, args ...any) error {
+	query := `
+		UPDATE blobs
+		SET ref_count = ref_count - (
+			SELECT COUNT(*) FROM videos
+			WHERE ` + column + ` = blobs.hash AND (` + where + `)
+		)
+		WHERE kind = ? AND hash IN (SELECT ` + column + ` FROM videos WHERE ` + where + `)
+	`
+	queryArgs := append(append(append([]any{}, args...), kind), args...)
+	_, err := tx.Exec(query, queryArgs...)
+	return err
+}
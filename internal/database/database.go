@@ -1,22 +1,47 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/google/uuid"
 )
 
 type Client struct {
 	db *sql.DB
+	// ctx is passed to every statement, so they're traced as part of the
+	// request that made them. It's set with WithContext.
+	ctx context.Context
+}
+
+// WithContext returns a client whose statements run under ctx.
+func (c Client) WithContext(ctx context.Context) Client {
+	c.ctx = ctx
+	return c
+}
+
+func (c Client) context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+// Ping checks that the database can run a query, returning the SQLite
+// version.
+func (c Client) Ping() (string, error) {
+	var version string
+	err := c.db.QueryRowContext(c.context(), "SELECT sqlite_version()").Scan(&version)
+	return version, err
 }
 
 func NewClient(pathToDB string) (Client, error) {
-	db, err := sql.Open("sqlite3", pathToDB)
+	db, err := sql.Open(instrumentedDriverName, pathToDB)
 	if err != nil {
 		return Client{}, err
 	}
-	c := Client{db}
+	c := Client{db: db}
 	err = c.autoMigrate()
 	if err != nil {
 		return Client{}, err
@@ -35,7 +60,7 @@ func (c *Client) autoMigrate() error {
 		email TEXT UNIQUE NOT NULL
 	);
 	`
-	_, err := c.db.Exec(userTable)
+	_, err := c.db.ExecContext(c.context(), userTable)
 	if err != nil {
 		return err
 	}
@@ -50,7 +75,7 @@ func (c *Client) autoMigrate() error {
 		FOREIGN KEY(user_id) REFERENCES users(id)
 	);
 	`
-	_, err = c.db.Exec(refreshTokenTable)
+	_, err = c.db.ExecContext(c.context(), refreshTokenTable)
 	if err != nil {
 		return err
 	}
@@ -68,22 +93,424 @@ func (c *Client) autoMigrate() error {
 		FOREIGN KEY(user_id) REFERENCES users(id)
 	);
 	`
-	_, err = c.db.Exec(videoTable)
+	_, err = c.db.ExecContext(c.context(), videoTable)
+	if err != nil {
+		return err
+	}
+
+	identityTable := `
+	CREATE TABLE IF NOT EXISTS user_identities (
+		issuer TEXT NOT NULL,
+		subject TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		email TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY(issuer, subject),
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.ExecContext(c.context(), identityTable)
+	if err != nil {
+		return err
+	}
+
+	oidcStateTable := `
+	CREATE TABLE IF NOT EXISTS oidc_states (
+		state TEXT PRIMARY KEY,
+		nonce TEXT NOT NULL,
+		code_verifier TEXT NOT NULL,
+		expires_at TIMESTAMP NOT NULL
+	);
+	`
+	_, err = c.db.ExecContext(c.context(), oidcStateTable)
+	if err != nil {
+		return err
+	}
+
+	userTokenTable := `
+	CREATE TABLE IF NOT EXISTS user_tokens (
+		token_hash TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		purpose TEXT NOT NULL,
+		email TEXT NOT NULL,
+		expires_at TIMESTAMP NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		used_at TIMESTAMP,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.ExecContext(c.context(), userTokenTable)
+	if err != nil {
+		return err
+	}
+
+	recoveryCodeTable := `
+	CREATE TABLE IF NOT EXISTS recovery_codes (
+		code_hash TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		used_at TIMESTAMP,
+		PRIMARY KEY(user_id, code_hash),
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.ExecContext(c.context(), recoveryCodeTable)
+	if err != nil {
+		return err
+	}
+
+	loginAttemptTable := `
+	CREATE TABLE IF NOT EXISTS login_attempts (
+		key TEXT PRIMARY KEY,
+		failures INTEGER NOT NULL DEFAULT 0,
+		last_failure_at TIMESTAMP NOT NULL,
+		locked_until TIMESTAMP
+	);
+	`
+	_, err = c.db.ExecContext(c.context(), loginAttemptTable)
+	if err != nil {
+		return err
+	}
+
+	auditEventTable := `
+	CREATE TABLE IF NOT EXISTS audit_events (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		type TEXT NOT NULL,
+		user_id TEXT,
+		ip_address TEXT NOT NULL DEFAULT '',
+		details TEXT NOT NULL DEFAULT ''
+	);
+	`
+	_, err = c.db.ExecContext(c.context(), auditEventTable)
+	if err != nil {
+		return err
+	}
+
+	videoShareTable := `
+	CREATE TABLE IF NOT EXISTS video_shares (
+		video_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY(video_id, user_id),
+		FOREIGN KEY(video_id) REFERENCES videos(id),
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.ExecContext(c.context(), videoShareTable)
+	if err != nil {
+		return err
+	}
+
+	shareLinkTable := `
+	CREATE TABLE IF NOT EXISTS share_links (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		token_hash TEXT UNIQUE NOT NULL,
+		video_id TEXT NOT NULL,
+		password_hash TEXT,
+		expires_at TIMESTAMP,
+		max_views INTEGER,
+		view_count INTEGER NOT NULL DEFAULT 0,
+		revoked_at TIMESTAMP,
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.ExecContext(c.context(), shareLinkTable)
+	if err != nil {
+		return err
+	}
+
+	playlistTable := `
+	CREATE TABLE IF NOT EXISTS playlists (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		title TEXT NOT NULL,
+		description TEXT NOT NULL DEFAULT '',
+		user_id TEXT NOT NULL,
+		visibility TEXT NOT NULL DEFAULT 'private',
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.ExecContext(c.context(), playlistTable)
 	if err != nil {
 		return err
 	}
+
+	playlistItemTable := `
+	CREATE TABLE IF NOT EXISTS playlist_items (
+		playlist_id TEXT NOT NULL,
+		video_id TEXT NOT NULL,
+		position INTEGER NOT NULL,
+		added_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY(playlist_id, video_id),
+		FOREIGN KEY(playlist_id) REFERENCES playlists(id),
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.ExecContext(c.context(), playlistItemTable)
+	if err != nil {
+		return err
+	}
+
+	tagTable := `
+	CREATE TABLE IF NOT EXISTS tags (
+		id TEXT PRIMARY KEY,
+		slug TEXT UNIQUE NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	`
+	_, err = c.db.ExecContext(c.context(), tagTable)
+	if err != nil {
+		return err
+	}
+
+	videoTagTable := `
+	CREATE TABLE IF NOT EXISTS video_tags (
+		video_id TEXT NOT NULL,
+		tag_id TEXT NOT NULL,
+		PRIMARY KEY(video_id, tag_id),
+		FOREIGN KEY(video_id) REFERENCES videos(id),
+		FOREIGN KEY(tag_id) REFERENCES tags(id)
+	);
+	`
+	_, err = c.db.ExecContext(c.context(), videoTagTable)
+	if err != nil {
+		return err
+	}
+
+	workspaceTable := `
+	CREATE TABLE IF NOT EXISTS workspaces (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		name TEXT NOT NULL
+	);
+	`
+	_, err = c.db.ExecContext(c.context(), workspaceTable)
+	if err != nil {
+		return err
+	}
+
+	workspaceMemberTable := `
+	CREATE TABLE IF NOT EXISTS workspace_members (
+		workspace_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		role TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY(workspace_id, user_id),
+		FOREIGN KEY(workspace_id) REFERENCES workspaces(id),
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.ExecContext(c.context(), workspaceMemberTable)
+	if err != nil {
+		return err
+	}
+
+	blobTable := `
+	CREATE TABLE IF NOT EXISTS blobs (
+		kind TEXT NOT NULL,
+		hash TEXT NOT NULL,
+		storage_key TEXT NOT NULL,
+		srcset TEXT NOT NULL DEFAULT '',
+		ref_count INTEGER NOT NULL DEFAULT 0,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY(kind, hash)
+	);
+	`
+	_, err = c.db.ExecContext(c.context(), blobTable)
+	if err != nil {
+		return err
+	}
+
+	rateLimitBucketTable := `
+	CREATE TABLE IF NOT EXISTS rate_limit_buckets (
+		key TEXT PRIMARY KEY,
+		tokens REAL NOT NULL,
+		allowed INTEGER NOT NULL DEFAULT 1,
+		updated_at REAL NOT NULL
+	);
+	`
+	_, err = c.db.ExecContext(c.context(), rateLimitBucketTable)
+	if err != nil {
+		return err
+	}
+
+	columns := []struct {
+		table      string
+		name       string
+		definition string
+	}{
+		{"users", "token_version", "INTEGER NOT NULL DEFAULT 0"},
+		{"users", "email_verified_at", "TIMESTAMP"},
+		{"users", "totp_secret", "TEXT"},
+		{"users", "totp_enabled_at", "TIMESTAMP"},
+		{"users", "totp_last_step", "INTEGER NOT NULL DEFAULT 0"},
+		{"users", "display_name", "TEXT NOT NULL DEFAULT ''"},
+		{"users", "bio", "TEXT NOT NULL DEFAULT ''"},
+		{"users", "avatar_url", "TEXT"},
+		{"users", "avatar_srcset", "TEXT"},
+		{"videos", "visibility", "TEXT NOT NULL DEFAULT 'private'"},
+		{"videos", "workspace_id", "TEXT REFERENCES workspaces(id)"},
+		{"videos", "thumbnail_srcset", "TEXT"},
+		{"videos", "video_blob_hash", "TEXT"},
+		{"videos", "thumbnail_blob_hash", "TEXT"},
+		{"videos", "scan_results", "TEXT"},
+		{"blobs", "size", "INTEGER NOT NULL DEFAULT 0"},
+		{"refresh_tokens", "session_id", "TEXT"},
+		{"refresh_tokens", "user_agent", "TEXT NOT NULL DEFAULT ''"},
+		{"refresh_tokens", "ip_address", "TEXT NOT NULL DEFAULT ''"},
+		{"refresh_tokens", "last_used_at", "TIMESTAMP"},
+	}
+	for _, col := range columns {
+		if err := c.addColumnIfNotExists(col.table, col.name, col.definition); err != nil {
+			return err
+		}
+	}
+
+	return c.backfillSessionIDs()
+}
+
+// backfillSessionIDs gives sessions created before session IDs existed one,
+// in the same UUID format as new sessions, so they can be listed and revoked
+// individually.
+func (c *Client) backfillSessionIDs() error {
+	rows, err := c.db.QueryContext(c.context(), `SELECT token FROM refresh_tokens WHERE session_id IS NULL`)
+	if err != nil {
+		return err
+	}
+	var tokens []string
+	for rows.Next() {
+		var token string
+		if err := rows.Scan(&token); err != nil {
+			rows.Close()
+			return err
+		}
+		tokens = append(tokens, token)
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, token := range tokens {
+		_, err := c.db.ExecContext(c.context(), `
+		UPDATE refresh_tokens
+		SET session_id = ?
+		WHERE token = ? AND session_id IS NULL
+		`, uuid.New().String(), token)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addColumnIfNotExists lets autoMigrate evolve tables that were created by an
+// older version of the schema, since CREATE TABLE IF NOT EXISTS won't.
+func (c *Client) addColumnIfNotExists(table, column, definition string) error {
+	exists, err := c.columnExists(table, column)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+
+	_, err = c.db.ExecContext(c.context(), fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	if err != nil {
+		return fmt.Errorf("failed to add column %s.%s: %w", table, column, err)
+	}
 	return nil
 }
 
+func (c *Client) columnExists(table, column string) (bool, error) {
+	rows, err := c.db.QueryContext(c.context(), fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid        int
+			name       string
+			colType    string
+			notNull    int
+			defaultVal sql.NullString
+			primaryKey int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultVal, &primaryKey); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
 func (c Client) Reset() error {
-	if _, err := c.db.Exec("DELETE FROM refresh_tokens"); err != nil {
+	if _, err := c.db.ExecContext(c.context(), "DELETE FROM workspace_members"); err != nil {
+		return fmt.Errorf("failed to reset table workspace_members: %w", err)
+	}
+	if _, err := c.db.ExecContext(c.context(), "DELETE FROM video_tags"); err != nil {
+		return fmt.Errorf("failed to reset table video_tags: %w", err)
+	}
+	if _, err := c.db.ExecContext(c.context(), "DELETE FROM tags"); err != nil {
+		return fmt.Errorf("failed to reset table tags: %w", err)
+	}
+	if _, err := c.db.ExecContext(c.context(), "DELETE FROM playlist_items"); err != nil {
+		return fmt.Errorf("failed to reset table playlist_items: %w", err)
+	}
+	if _, err := c.db.ExecContext(c.context(), "DELETE FROM playlists"); err != nil {
+		return fmt.Errorf("failed to reset table playlists: %w", err)
+	}
+	if _, err := c.db.ExecContext(c.context(), "DELETE FROM share_links"); err != nil {
+		return fmt.Errorf("failed to reset table share_links: %w", err)
+	}
+	if _, err := c.db.ExecContext(c.context(), "DELETE FROM video_shares"); err != nil {
+		return fmt.Errorf("failed to reset table video_shares: %w", err)
+	}
+	if _, err := c.db.ExecContext(c.context(), "DELETE FROM rate_limit_buckets"); err != nil {
+		return fmt.Errorf("failed to reset table rate_limit_buckets: %w", err)
+	}
+	if _, err := c.db.ExecContext(c.context(), "DELETE FROM login_attempts"); err != nil {
+		return fmt.Errorf("failed to reset table login_attempts: %w", err)
+	}
+	if _, err := c.db.ExecContext(c.context(), "DELETE FROM audit_events"); err != nil {
+		return fmt.Errorf("failed to reset table audit_events: %w", err)
+	}
+	if _, err := c.db.ExecContext(c.context(), "DELETE FROM recovery_codes"); err != nil {
+		return fmt.Errorf("failed to reset table recovery_codes: %w", err)
+	}
+	if _, err := c.db.ExecContext(c.context(), "DELETE FROM user_tokens"); err != nil {
+		return fmt.Errorf("failed to reset table user_tokens: %w", err)
+	}
+	if _, err := c.db.ExecContext(c.context(), "DELETE FROM oidc_states"); err != nil {
+		return fmt.Errorf("failed to reset table oidc_states: %w", err)
+	}
+	if _, err := c.db.ExecContext(c.context(), "DELETE FROM user_identities"); err != nil {
+		return fmt.Errorf("failed to reset table user_identities: %w", err)
+	}
+	if _, err := c.db.ExecContext(c.context(), "DELETE FROM refresh_tokens"); err != nil {
 		return fmt.Errorf("failed to reset table refresh_tokens: %w", err)
 	}
-	if _, err := c.db.Exec("DELETE FROM users"); err != nil {
+	if _, err := c.db.ExecContext(c.context(), "DELETE FROM users"); err != nil {
 		return fmt.Errorf("failed to reset table users: %w", err)
 	}
-	if _, err := c.db.Exec("DELETE FROM videos"); err != nil {
+	if _, err := c.db.ExecContext(c.context(), "DELETE FROM videos"); err != nil {
 		return fmt.Errorf("failed to reset table videos: %w", err)
 	}
+	if _, err := c.db.ExecContext(c.context(), "DELETE FROM workspaces"); err != nil {
+		return fmt.Errorf("failed to reset table workspaces: %w", err)
+	}
+	if _, err := c.db.ExecContext(c.context(), "DELETE FROM blobs"); err != nil {
+		return fmt.Errorf("failed to reset table blobs: %w", err)
+	}
 	return nil
 }
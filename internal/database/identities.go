@@ -0,0 +1,107 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Identity links an account at an external identity provider, identified by
+// the provider's issuer and the subject it assigns the user, to a Tubely user.
+type Identity struct {
+	CreatedAt time.Time `json:"created_at"`
+	CreateIdentityParams
+}
+
+type CreateIdentityParams struct {
+	Issuer  string    `json:"issuer"`
+	Subject string    `json:"subject"`
+	UserID  uuid.UUID `json:"user_id"`
+	Email   string    `json:"email"`
+}
+
+// OIDCState is the per-login state kept between redirecting a user to the
+// identity provider and handling its callback.
+type OIDCState struct {
+	State        string    `json:"state"`
+	Nonce        string    `json:"nonce"`
+	CodeVerifier string    `json:"code_verifier"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+func (c Client) CreateIdentity(params CreateIdentityParams) error {
+	query := `
+		INSERT INTO user_identities (issuer, subject, user_id, email, created_at)
+		VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP)
+	`
+	_, err := c.db.ExecContext(c.context(), query, params.Issuer, params.Subject, params.UserID.String(), params.Email)
+	return err
+}
+
+func (c Client) GetUserByIdentity(issuer, subject string) (*User, error) {
+	query := `
+		SELECT user_id
+		FROM user_identities
+		WHERE issuer = ? AND subject = ?
+	`
+	var idStr string
+	err := c.db.QueryRowContext(c.context(), query, issuer, subject).Scan(&idStr)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	id, err := uuid.Parse(idStr)
+	if err != nil {
+		return nil, err
+	}
+	return c.GetUser(id)
+}
+
+func (c Client) CreateOIDCState(state OIDCState) error {
+	query := `
+		INSERT INTO oidc_states (state, nonce, code_verifier, expires_at)
+		VALUES (?, ?, ?, ?)
+	`
+	_, err := c.db.ExecContext(c.context(), query, state.State, state.Nonce, state.CodeVerifier, state.ExpiresAt)
+	return err
+}
+
+// ConsumeOIDCState returns the login state and deletes it so a callback can't
+// be replayed. Missing or expired states return (nil, nil).
+func (c Client) ConsumeOIDCState(state string) (*OIDCState, error) {
+	tx, err := c.db.BeginTx(c.context(), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := `
+		SELECT state, nonce, code_verifier, expires_at
+		FROM oidc_states
+		WHERE state = ?
+	`
+	var s OIDCState
+	err = tx.QueryRow(query, state).Scan(&s.State, &s.Nonce, &s.CodeVerifier, &s.ExpiresAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM oidc_states WHERE state = ? OR expires_at < ?`, state, time.Now().UTC()); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	if time.Now().After(s.ExpiresAt) {
+		return nil, nil
+	}
+	return &s, nil
+}
@@ -0,0 +1,227 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode"
+
+	"github.com/mattn/go-sqlite3"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// QueryObserver is told about every statement the client runs: its kind,
+// which is the statement's first keyword like "select" or "insert", how
+// long it took and how it failed, if it did. For queries the time includes
+// reading the rows, since SQLite does most of the work then.
+type QueryObserver func(kind string, duration time.Duration, err error)
+
+var queryObserver atomic.Pointer[QueryObserver]
+
+// SetQueryObserver starts reporting statements to observe, for metrics. It
+// applies to every client.
+func SetQueryObserver(observe QueryObserver) {
+	queryObserver.Store(&observe)
+}
+
+const instrumentedDriverName = "sqlite3_instrumented"
+
+func init() {
+	sql.Register(instrumentedDriverName, instrumentedDriver{&sqlite3.SQLiteDriver{}})
+}
+
+// tracer starts a span for each statement run while a request is being
+// traced. Statements outside a trace, like background clean-up, aren't
+// traced rather than each becoming a root span of its own.
+var tracer = otel.Tracer("github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database")
+
+// statementKind is the statement's first keyword, lower-cased.
+func statementKind(query string) string {
+	kind := strings.TrimSpace(query)
+	if end := strings.IndexFunc(kind, unicode.IsSpace); end >= 0 {
+		kind = kind[:end]
+	}
+	if kind == "" {
+		return "unknown"
+	}
+	return strings.ToLower(kind)
+}
+
+// statement is a statement being run, which is reported to the observer and
+// its span once it's done.
+type statement struct {
+	kind  string
+	start time.Time
+	span  trace.Span
+}
+
+func startStatement(ctx context.Context, query string) statement {
+	kind := statementKind(query)
+	span := trace.SpanFromContext(ctx)
+	if span.SpanContext().IsValid() {
+		_, span = tracer.Start(ctx, strings.ToUpper(kind),
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(
+				semconv.DBSystemNameSQLite,
+				semconv.DBOperationName(strings.ToUpper(kind)),
+				semconv.DBQueryText(query),
+			),
+		)
+	}
+	return statement{kind: kind, start: time.Now(), span: span}
+}
+
+func (s statement) end(err error) {
+	if observe := queryObserver.Load(); observe != nil {
+		(*observe)(s.kind, time.Since(s.start), err)
+	}
+	if !s.span.IsRecording() {
+		return
+	}
+	if err != nil {
+		s.span.RecordError(err)
+		s.span.SetStatus(codes.Error, err.Error())
+	}
+	s.span.End()
+}
+
+// instrumentedDriver is the SQLite driver with every Exec and Query timed
+// and traced.
+type instrumentedDriver struct {
+	driver *sqlite3.SQLiteDriver
+}
+
+func (d instrumentedDriver) Open(name string) (driver.Conn, error) {
+	conn, err := d.driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedConn{conn: conn.(*sqlite3.SQLiteConn)}, nil
+}
+
+type instrumentedConn struct {
+	conn *sqlite3.SQLiteConn
+	// txCtx is the context of the transaction in progress. database/sql runs
+	// a transaction's statements with a background context unless it's
+	// given one, so they're traced as part of the transaction instead.
+	txCtx context.Context
+}
+
+func (c *instrumentedConn) Prepare(query string) (driver.Stmt, error) {
+	return c.conn.Prepare(query)
+}
+
+func (c *instrumentedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	return c.conn.PrepareContext(ctx, query)
+}
+
+func (c *instrumentedConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *instrumentedConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *instrumentedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	span := trace.SpanFromContext(ctx)
+	if span.SpanContext().IsValid() {
+		ctx, span = tracer.Start(ctx, "transaction",
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(semconv.DBSystemNameSQLite),
+		)
+	}
+	tx, err := c.conn.BeginTx(ctx, opts)
+	if err != nil {
+		span.End()
+		return nil, err
+	}
+	c.txCtx = ctx
+	return &instrumentedTx{Tx: tx, conn: c, span: span}, nil
+}
+
+func (c *instrumentedConn) Ping(ctx context.Context) error {
+	return c.conn.Ping(ctx)
+}
+
+// statementContext is the context to trace a statement run with ctx under.
+func (c *instrumentedConn) statementContext(ctx context.Context) context.Context {
+	if c.txCtx != nil && !trace.SpanContextFromContext(ctx).IsValid() {
+		return c.txCtx
+	}
+	return ctx
+}
+
+func (c *instrumentedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	stmt := startStatement(c.statementContext(ctx), query)
+	result, err := c.conn.ExecContext(ctx, query, args)
+	stmt.end(err)
+	return result, err
+}
+
+func (c *instrumentedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	stmt := startStatement(c.statementContext(ctx), query)
+	rows, err := c.conn.QueryContext(ctx, query, args)
+	if err != nil {
+		stmt.end(err)
+		return nil, err
+	}
+	return &instrumentedRows{Rows: rows, stmt: stmt}, nil
+}
+
+type instrumentedTx struct {
+	driver.Tx
+	conn *instrumentedConn
+	span trace.Span
+}
+
+func (tx *instrumentedTx) Commit() error {
+	err := tx.Tx.Commit()
+	tx.finish(err)
+	return err
+}
+
+func (tx *instrumentedTx) Rollback() error {
+	err := tx.Tx.Rollback()
+	tx.finish(err)
+	return err
+}
+
+func (tx *instrumentedTx) finish(err error) {
+	tx.conn.txCtx = nil
+	if err != nil {
+		tx.span.RecordError(err)
+		tx.span.SetStatus(codes.Error, err.Error())
+	}
+	tx.span.End()
+}
+
+// instrumentedRows reports its query once the rows are closed, since SQLite
+// does most of a query's work while the rows are read.
+type instrumentedRows struct {
+	driver.Rows
+	stmt statement
+	err  error
+}
+
+func (r *instrumentedRows) Next(dest []driver.Value) error {
+	err := r.Rows.Next(dest)
+	if err != nil && !errors.Is(err, io.EOF) {
+		r.err = err
+	}
+	return err
+}
+
+func (r *instrumentedRows) Close() error {
+	err := r.Rows.Close()
+	r.stmt.end(errors.Join(r.err, err))
+	return err
+}
@@ -0,0 +1,74 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// LoginAttempt tracks recent failed logins for a throttling key, such as an
+// account's email or a client IP.
+type LoginAttempt struct {
+	Key           string     `json:"key"`
+	Failures      int        `json:"failures"`
+	LastFailureAt time.Time  `json:"last_failure_at"`
+	LockedUntil   *time.Time `json:"locked_until"`
+}
+
+func (c Client) GetLoginAttempt(key string) (LoginAttempt, error) {
+	query := `
+		SELECT key, failures, last_failure_at, locked_until
+		FROM login_attempts
+		WHERE key = ?
+	`
+	var attempt LoginAttempt
+	err := c.db.QueryRowContext(c.context(), query, key).Scan(&attempt.Key, &attempt.Failures, &attempt.LastFailureAt, &attempt.LockedUntil)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return LoginAttempt{}, nil
+		}
+		return LoginAttempt{}, err
+	}
+	return attempt, nil
+}
+
+// RecordLoginFailure increments the failure count for key and returns the new
+// count. Failures older than window are forgotten, so the count restarts.
+func (c Client) RecordLoginFailure(key string, window time.Duration) (int, error) {
+	now := time.Now().UTC()
+	query := `
+		INSERT INTO login_attempts (key, failures, last_failure_at)
+		VALUES (?, 1, ?)
+		ON CONFLICT(key) DO UPDATE SET
+			failures = CASE WHEN last_failure_at < ? THEN 1 ELSE failures + 1 END,
+			last_failure_at = excluded.last_failure_at
+		RETURNING failures
+	`
+	var failures int
+	err := c.db.QueryRowContext(c.context(), query, key, now, now.Add(-window)).Scan(&failures)
+	return failures, err
+}
+
+func (c Client) LockLogin(key string, until time.Time) error {
+	query := `
+		UPDATE login_attempts
+		SET locked_until = ?
+		WHERE key = ?
+	`
+	_, err := c.db.ExecContext(c.context(), query, until.UTC(), key)
+	return err
+}
+
+// ClearLoginAttempts forgets failures for key and lifts any lock on it. It
+// reports whether there was anything to clear.
+func (c Client) ClearLoginAttempts(key string) (bool, error) {
+	result, err := c.db.ExecContext(c.context(), `DELETE FROM login_attempts WHERE key = ?`, key)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
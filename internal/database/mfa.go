@@ -0,0 +1,112 @@
+package database
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// SetPendingTOTPSecret stores a freshly generated secret that doesn't protect
+// the account until EnableTOTP confirms the user can produce codes from it.
+func (c Client) SetPendingTOTPSecret(userID uuid.UUID, secret string) error {
+	query := `
+		UPDATE users
+		SET totp_secret = ?, totp_enabled_at = NULL, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`
+	_, err := c.db.ExecContext(c.context(), query, secret, userID.String())
+	return err
+}
+
+// EnableTOTP turns on two-factor authentication and replaces the user's
+// recovery codes in one transaction.
+func (c Client) EnableTOTP(userID uuid.UUID, recoveryCodeHashes []string) error {
+	tx, err := c.db.BeginTx(c.context(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		UPDATE users
+		SET totp_enabled_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`
+	if _, err := tx.Exec(query, userID.String()); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM recovery_codes WHERE user_id = ?`, userID.String()); err != nil {
+		return err
+	}
+	for _, hash := range recoveryCodeHashes {
+		query := `
+			INSERT INTO recovery_codes (code_hash, user_id, created_at)
+			VALUES (?, ?, CURRENT_TIMESTAMP)
+		`
+		if _, err := tx.Exec(query, hash, userID.String()); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (c Client) DisableTOTP(userID uuid.UUID) error {
+	tx, err := c.db.BeginTx(c.context(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		UPDATE users
+		SET totp_secret = NULL, totp_enabled_at = NULL, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`
+	if _, err := tx.Exec(query, userID.String()); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM recovery_codes WHERE user_id = ?`, userID.String()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UseTOTPStep records that the code for a time step was used and reports
+// false if that step (or a later one) was already used, so an intercepted
+// code can't be replayed while it's still valid.
+func (c Client) UseTOTPStep(userID uuid.UUID, step int64) (bool, error) {
+	query := `
+		UPDATE users
+		SET totp_last_step = ?
+		WHERE id = ? AND totp_last_step < ?
+	`
+	result, err := c.db.ExecContext(c.context(), query, step, userID.String(), step)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// UseRecoveryCode marks a recovery code as used, reporting false if it
+// doesn't exist or was used before.
+func (c Client) UseRecoveryCode(userID uuid.UUID, codeHash string) (bool, error) {
+	query := `
+		UPDATE recovery_codes
+		SET used_at = ?
+		WHERE user_id = ? AND code_hash = ? AND used_at IS NULL
+	`
+	result, err := c.db.ExecContext(c.context(), query, time.Now().UTC(), userID.String(), codeHash)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
@@ -0,0 +1,284 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Playlist is an ordered collection of videos. Its thumbnail is the first
+// item's thumbnail, so it follows the playlist as items are reordered.
+type Playlist struct {
+	ID           uuid.UUID `json:"id"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+	ThumbnailURL *string   `json:"thumbnail_url"`
+	ItemCount    int       `json:"item_count"`
+	CreatePlaylistParams
+}
+
+type CreatePlaylistParams struct {
+	Title       string          `json:"title"`
+	Description string          `json:"description"`
+	UserID      uuid.UUID       `json:"user_id"`
+	Visibility  VideoVisibility `json:"visibility"`
+}
+
+const playlistColumns = `
+	p.id,
+	p.created_at,
+	p.updated_at,
+	(
+		SELECT v.thumbnail_url
+		FROM playlist_items pi
+		JOIN videos v ON v.id = pi.video_id
+		WHERE pi.playlist_id = p.id
+		ORDER BY pi.position
+		LIMIT 1
+	),
+	(SELECT COUNT(*) FROM playlist_items pi WHERE pi.playlist_id = p.id),
+	p.title,
+	p.description,
+	p.user_id,
+	p.visibility
+`
+
+func scanPlaylist(row rowScanner) (Playlist, error) {
+	var playlist Playlist
+	err := row.Scan(
+		&playlist.ID,
+		&playlist.CreatedAt,
+		&playlist.UpdatedAt,
+		&playlist.ThumbnailURL,
+		&playlist.ItemCount,
+		&playlist.Title,
+		&playlist.Description,
+		&playlist.UserID,
+		&playlist.Visibility,
+	)
+	return playlist, err
+}
+
+func (c Client) CreatePlaylist(params CreatePlaylistParams) (Playlist, error) {
+	if params.Visibility == "" {
+		params.Visibility = VideoVisibilityPrivate
+	}
+
+	id := uuid.New()
+	query := `
+	INSERT INTO playlists (
+		id,
+		created_at,
+		updated_at,
+		title,
+		description,
+		user_id,
+		visibility
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, ?)
+	`
+	_, err := c.db.ExecContext(c.context(), query, id, params.Title, params.Description, params.UserID, params.Visibility)
+	if err != nil {
+		return Playlist{}, err
+	}
+
+	return c.GetPlaylist(id)
+}
+
+func (c Client) GetPlaylist(id uuid.UUID) (Playlist, error) {
+	query := `
+	SELECT` + playlistColumns + `
+	FROM playlists p
+	WHERE p.id = ?
+	`
+
+	playlist, err := scanPlaylist(c.db.QueryRowContext(c.context(), query, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Playlist{}, nil
+		}
+		return Playlist{}, err
+	}
+	return playlist, nil
+}
+
+func (c Client) GetPlaylists(userID uuid.UUID) ([]Playlist, error) {
+	query := `
+	SELECT` + playlistColumns + `
+	FROM playlists p
+	WHERE p.user_id = ?
+	ORDER BY p.created_at DESC
+	`
+
+	rows, err := c.db.QueryContext(c.context(), query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	playlists := []Playlist{}
+	for rows.Next() {
+		playlist, err := scanPlaylist(rows)
+		if err != nil {
+			return nil, err
+		}
+		playlists = append(playlists, playlist)
+	}
+	return playlists, rows.Err()
+}
+
+func (c Client) UpdatePlaylist(playlist Playlist) error {
+	query := `
+	UPDATE playlists
+	SET
+		title = ?,
+		description = ?,
+		visibility = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.ExecContext(c.context(), query, playlist.Title, playlist.Description, playlist.Visibility, playlist.ID)
+	return err
+}
+
+func (c Client) DeletePlaylist(id uuid.UUID) error {
+	tx, err := c.db.BeginTx(c.context(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM playlist_items WHERE playlist_id = ?", id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM playlists WHERE id = ?", id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetPlaylistVideos returns the playlist's videos in playlist order.
+func (c Client) GetPlaylistVideos(playlistID uuid.UUID) ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	JOIN playlist_items pi ON pi.video_id = videos.id
+	WHERE pi.playlist_id = ?
+	ORDER BY pi.position
+	`
+
+	rows, err := c.db.QueryContext(c.context(), query, playlistID)
+	if err != nil {
+		return nil, err
+	}
+	return scanVideos(rows)
+}
+
+// AddPlaylistItem appends the video to the end of the playlist. It reports
+// false if the video was already in it.
+func (c Client) AddPlaylistItem(playlistID, videoID uuid.UUID) (bool, error) {
+	query := `
+	INSERT INTO playlist_items (playlist_id, video_id, position, added_at)
+	VALUES (
+		?,
+		?,
+		(SELECT COALESCE(MAX(position) + 1, 0) FROM playlist_items WHERE playlist_id = ?),
+		CURRENT_TIMESTAMP
+	)
+	ON CONFLICT(playlist_id, video_id) DO NOTHING
+	`
+	result, err := c.db.ExecContext(c.context(), query, playlistID, videoID, playlistID)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if n > 0 {
+		if err := c.touchPlaylist(c.db, playlistID); err != nil {
+			return false, err
+		}
+	}
+	return n > 0, nil
+}
+
+// RemovePlaylistItem removes the video from the playlist, closing the gap it
+// leaves in the ordering, and reports whether it was there.
+func (c Client) RemovePlaylistItem(playlistID, videoID uuid.UUID) (bool, error) {
+	tx, err := c.db.BeginTx(c.context(), nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("DELETE FROM playlist_items WHERE playlist_id = ? AND video_id = ?", playlistID, videoID)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if n == 0 {
+		return false, nil
+	}
+	if err := renumberPlaylist(tx, playlistID.String()); err != nil {
+		return false, err
+	}
+	if err := c.touchPlaylist(tx, playlistID); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// ReorderPlaylist sets the position of each video to its index in videoIDs,
+// which must list exactly the videos already in the playlist.
+func (c Client) ReorderPlaylist(playlistID uuid.UUID, videoIDs []uuid.UUID) error {
+	tx, err := c.db.BeginTx(c.context(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for i, videoID := range videoIDs {
+		_, err := tx.Exec(
+			"UPDATE playlist_items SET position = ? WHERE playlist_id = ? AND video_id = ?",
+			i, playlistID, videoID,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	if err := c.touchPlaylist(tx, playlistID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+func (c Client) touchPlaylist(db execer, playlistID uuid.UUID) error {
+	_, err := db.Exec("UPDATE playlists SET updated_at = CURRENT_TIMESTAMP WHERE id = ?", playlistID)
+	return err
+}
+
+// renumberPlaylist makes the playlist's positions run 0, 1, 2, ... again
+// after items have been removed, keeping their order.
+func renumberPlaylist(db execer, playlistID string) error {
+	query := `
+	UPDATE playlist_items
+	SET position = ranked.new_position
+	FROM (
+		SELECT video_id, ROW_NUMBER() OVER (ORDER BY position) - 1 AS new_position
+		FROM playlist_items
+		WHERE playlist_id = ?
+	) AS ranked
+	WHERE playlist_items.playlist_id = ? AND playlist_items.video_id = ranked.video_id
+	`
+	_, err := db.Exec(query, playlistID, playlistID)
+	return err
+}
@@ -0,0 +1,38 @@
+package database
+
+import (
+	"time"
+)
+
+// TakeRateLimitToken refills the token bucket for key at ratePerSecond for
+// the time since it was last used, up to burst tokens, and then takes a
+// token if there's one. It returns the tokens left and whether one was
+// taken. New buckets start full.
+func (c Client) TakeRateLimitToken(key string, burst, ratePerSecond float64, now time.Time) (float64, bool, error) {
+	// Timestamps are stored as fractional Unix seconds so the refill can be
+	// computed in SQL, which keeps the whole update a single statement.
+	query := `
+		INSERT INTO rate_limit_buckets (key, tokens, allowed, updated_at)
+		VALUES (?1, ?2 - 1, 1, ?4)
+		ON CONFLICT(key) DO UPDATE SET
+			tokens = MIN(?2, tokens + MAX(0, ?4 - updated_at) * ?3)
+				- (MIN(?2, tokens + MAX(0, ?4 - updated_at) * ?3) >= 1),
+			allowed = MIN(?2, tokens + MAX(0, ?4 - updated_at) * ?3) >= 1,
+			updated_at = MAX(updated_at, ?4)
+		RETURNING tokens, allowed
+	`
+	seconds := float64(now.UnixNano()) / float64(time.Second)
+	var tokens float64
+	var allowed bool
+	err := c.db.QueryRowContext(c.context(), query, key, burst, ratePerSecond, seconds).Scan(&tokens, &allowed)
+	return tokens, allowed, err
+}
+
+// DeleteIdleRateLimitBuckets forgets buckets that haven't been used since
+// before. A bucket that's been idle long enough to refill is the same as a
+// new one, so this only saves space.
+func (c Client) DeleteIdleRateLimitBuckets(before time.Time) error {
+	seconds := float64(before.UnixNano()) / float64(time.Second)
+	_, err := c.db.ExecContext(c.context(), "DELETE FROM rate_limit_buckets WHERE updated_at < ?", seconds)
+	return err
+}
@@ -9,28 +9,50 @@ import (
 
 type RefreshToken struct {
 	CreateRefreshTokenParams
-	CreatedAt time.Time  `json:"created_at"`
-	UpdatedAt time.Time  `json:"updated_at"`
-	RevokedAt *time.Time `json:"revoked_at"`
+	SessionID  string     `json:"session_id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
 }
 
 type CreateRefreshTokenParams struct {
 	Token     string    `json:"token"`
 	UserID    uuid.UUID `json:"user_id"`
 	ExpiresAt time.Time `json:"expires_at"`
+	UserAgent string    `json:"user_agent"`
+	IPAddress string    `json:"ip_address"`
 }
 
+const refreshTokenColumns = `
+	token, session_id, created_at, updated_at, user_id, expires_at, revoked_at,
+	user_agent, ip_address, last_used_at
+`
+
 func (c Client) CreateRefreshToken(params CreateRefreshTokenParams) (RefreshToken, error) {
 	query := `
 		INSERT INTO refresh_tokens (
 			token,
+			session_id,
 			created_at,
 			updated_at,
 			user_id,
-			expires_at
-		) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?)
+			expires_at,
+			user_agent,
+			ip_address,
+			last_used_at
+		) VALUES (?, ?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, ?, CURRENT_TIMESTAMP)
 	`
-	_, err := c.db.Exec(query, params.Token, params.UserID.String(), params.ExpiresAt)
+	_, err := c.db.ExecContext(
+		c.context(),
+		query,
+		params.Token,
+		uuid.New().String(),
+		params.UserID.String(),
+		params.ExpiresAt,
+		params.UserAgent,
+		params.IPAddress,
+	)
 	if err != nil {
 		return RefreshToken{}, err
 	}
@@ -44,33 +66,92 @@ func (c Client) RevokeRefreshToken(token string) error {
 		SET revoked_at = CURRENT_TIMESTAMP
 		WHERE token = ?
 	`
-	_, err := c.db.Exec(query, token)
+	_, err := c.db.ExecContext(c.context(), query, token)
 	return err
 }
 
-func (c Client) GetRefreshToken(token string) (RefreshToken, error) {
+// RevokeSession revokes a single session by its public session ID. It only
+// matches sessions owned by userID and reports whether one was revoked.
+func (c Client) RevokeSession(userID uuid.UUID, sessionID string) (bool, error) {
 	query := `
-		SELECT token, created_at, updated_at, user_id, expires_at, revoked_at
+		UPDATE refresh_tokens
+		SET revoked_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+		WHERE session_id = ? AND user_id = ? AND revoked_at IS NULL
+	`
+	result, err := c.db.ExecContext(c.context(), query, sessionID, userID.String())
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func (c Client) RevokeAllRefreshTokens(userID uuid.UUID) error {
+	query := `
+		UPDATE refresh_tokens
+		SET revoked_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+		WHERE user_id = ? AND revoked_at IS NULL
+	`
+	_, err := c.db.ExecContext(c.context(), query, userID.String())
+	return err
+}
+
+// TouchRefreshToken records that a session was just used, along with the
+// client metadata it was used from.
+func (c Client) TouchRefreshToken(token, userAgent, ipAddress string) error {
+	query := `
+		UPDATE refresh_tokens
+		SET last_used_at = CURRENT_TIMESTAMP,
+			updated_at = CURRENT_TIMESTAMP,
+			user_agent = ?,
+			ip_address = ?
+		WHERE token = ?
+	`
+	_, err := c.db.ExecContext(c.context(), query, userAgent, ipAddress, token)
+	return err
+}
+
+func (c Client) GetRefreshToken(token string) (RefreshToken, error) {
+	query := `SELECT` + refreshTokenColumns + `
 		FROM refresh_tokens
 		WHERE token = ?
 	`
-	var rt RefreshToken
-	var userID string
-	err := c.db.QueryRow(query, token).
-		Scan(&rt.Token, &rt.CreatedAt, &rt.UpdatedAt, &userID, &rt.ExpiresAt, &rt.RevokedAt)
+	rt, err := scanRefreshToken(c.db.QueryRowContext(c.context(), query, token))
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return RefreshToken{}, nil
 		}
 		return RefreshToken{}, err
 	}
+	return rt, nil
+}
 
-	rt.UserID, err = uuid.Parse(userID)
+// GetActiveRefreshTokens returns the user's sessions that are neither revoked
+// nor expired, most recently used first.
+func (c Client) GetActiveRefreshTokens(userID uuid.UUID) ([]RefreshToken, error) {
+	query := `SELECT` + refreshTokenColumns + `
+		FROM refresh_tokens
+		WHERE user_id = ? AND revoked_at IS NULL AND expires_at > ?
+		ORDER BY last_used_at DESC, created_at DESC
+	`
+	rows, err := c.db.QueryContext(c.context(), query, userID.String(), time.Now().UTC())
 	if err != nil {
-		return RefreshToken{}, err
+		return nil, err
 	}
+	defer rows.Close()
 
-	return rt, nil
+	tokens := []RefreshToken{}
+	for rows.Next() {
+		rt, err := scanRefreshToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, rt)
+	}
+	return tokens, rows.Err()
 }
 
 func (c Client) DeleteRefreshToken(token string) error {
@@ -78,6 +159,36 @@ func (c Client) DeleteRefreshToken(token string) error {
 		DELETE FROM refresh_tokens
 		WHERE token = ?
 	`
-	_, err := c.db.Exec(query, token)
+	_, err := c.db.ExecContext(c.context(), query, token)
 	return err
 }
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanRefreshToken(row rowScanner) (RefreshToken, error) {
+	var rt RefreshToken
+	var userID string
+	err := row.Scan(
+		&rt.Token,
+		&rt.SessionID,
+		&rt.CreatedAt,
+		&rt.UpdatedAt,
+		&userID,
+		&rt.ExpiresAt,
+		&rt.RevokedAt,
+		&rt.UserAgent,
+		&rt.IPAddress,
+		&rt.LastUsedAt,
+	)
+	if err != nil {
+		return RefreshToken{}, err
+	}
+
+	rt.UserID, err = uuid.Parse(userID)
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	return rt, nil
+}
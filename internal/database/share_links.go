@@ -0,0 +1,187 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ShareLink gives anyone holding its token access to one video, regardless of
+// the video's visibility, until it expires, runs out of views or is revoked.
+type ShareLink struct {
+	ID           uuid.UUID  `json:"id"`
+	VideoID      uuid.UUID  `json:"video_id"`
+	CreatedAt    time.Time  `json:"created_at"`
+	ExpiresAt    *time.Time `json:"expires_at"`
+	MaxViews     *int       `json:"max_views"`
+	ViewCount    int        `json:"view_count"`
+	HasPassword  bool       `json:"has_password"`
+	PasswordHash string     `json:"-"`
+	RevokedAt    *time.Time `json:"revoked_at"`
+}
+
+// CreateShareLinkParams takes the token's hash; the plaintext token is only
+// shown to the owner once, when the link is created.
+type CreateShareLinkParams struct {
+	TokenHash    string
+	VideoID      uuid.UUID
+	PasswordHash string
+	ExpiresAt    *time.Time
+	MaxViews     *int
+}
+
+const shareLinkColumns = `
+	id, video_id, created_at, expires_at, max_views, view_count,
+	COALESCE(password_hash, ''), revoked_at
+`
+
+func scanShareLink(row rowScanner) (ShareLink, error) {
+	var link ShareLink
+	err := row.Scan(
+		&link.ID,
+		&link.VideoID,
+		&link.CreatedAt,
+		&link.ExpiresAt,
+		&link.MaxViews,
+		&link.ViewCount,
+		&link.PasswordHash,
+		&link.RevokedAt,
+	)
+	if err != nil {
+		return ShareLink{}, err
+	}
+	link.HasPassword = link.PasswordHash != ""
+	return link, nil
+}
+
+// Active reports whether the link can still be used at the given time.
+func (l ShareLink) Active(now time.Time) bool {
+	if l.RevokedAt != nil {
+		return false
+	}
+	if l.ExpiresAt != nil && !l.ExpiresAt.After(now) {
+		return false
+	}
+	if l.MaxViews != nil && l.ViewCount >= *l.MaxViews {
+		return false
+	}
+	return true
+}
+
+func (c Client) CreateShareLink(params CreateShareLinkParams) (ShareLink, error) {
+	var passwordHash *string
+	if params.PasswordHash != "" {
+		passwordHash = &params.PasswordHash
+	}
+
+	id := uuid.New()
+	query := `
+		INSERT INTO share_links (
+			id, created_at, token_hash, video_id, password_hash, expires_at, max_views
+		) VALUES (?, CURRENT_TIMESTAMP, ?, ?, ?, ?, ?)
+	`
+	_, err := c.db.ExecContext(c.context(), query, id, params.TokenHash, params.VideoID, passwordHash, params.ExpiresAt, params.MaxViews)
+	if err != nil {
+		return ShareLink{}, err
+	}
+	return c.GetShareLink(id)
+}
+
+func (c Client) GetShareLink(id uuid.UUID) (ShareLink, error) {
+	query := `SELECT` + shareLinkColumns + `
+		FROM share_links
+		WHERE id = ?
+	`
+	link, err := scanShareLink(c.db.QueryRowContext(c.context(), query, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ShareLink{}, nil
+		}
+		return ShareLink{}, err
+	}
+	return link, nil
+}
+
+func (c Client) GetShareLinkByTokenHash(tokenHash string) (ShareLink, error) {
+	query := `SELECT` + shareLinkColumns + `
+		FROM share_links
+		WHERE token_hash = ?
+	`
+	link, err := scanShareLink(c.db.QueryRowContext(c.context(), query, tokenHash))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ShareLink{}, nil
+		}
+		return ShareLink{}, err
+	}
+	return link, nil
+}
+
+// GetShareLinks returns every link for the video, including revoked and
+// expired ones, newest first.
+func (c Client) GetShareLinks(videoID uuid.UUID) ([]ShareLink, error) {
+	query := `SELECT` + shareLinkColumns + `
+		FROM share_links
+		WHERE video_id = ?
+		ORDER BY created_at DESC
+	`
+	rows, err := c.db.QueryContext(c.context(), query, videoID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	links := []ShareLink{}
+	for rows.Next() {
+		link, err := scanShareLink(rows)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, link)
+	}
+	return links, rows.Err()
+}
+
+// RevokeShareLink revokes one of the video's links and reports whether an
+// unrevoked link was found.
+func (c Client) RevokeShareLink(videoID, id uuid.UUID) (bool, error) {
+	query := `
+		UPDATE share_links
+		SET revoked_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND video_id = ? AND revoked_at IS NULL
+	`
+	result, err := c.db.ExecContext(c.context(), query, id, videoID)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// RecordShareLinkView counts a view against the link if it's still active.
+// The check and the increment happen in one statement so concurrent views
+// can't exceed max_views. It reports whether the view was allowed.
+func (c Client) RecordShareLinkView(id uuid.UUID) (bool, error) {
+	query := `
+		UPDATE share_links
+		SET view_count = view_count + 1
+		WHERE id = ?
+			AND revoked_at IS NULL
+			AND (expires_at IS NULL OR expires_at > ?)
+			AND (max_views IS NULL OR view_count < max_views)
+	`
+	result, err := c.db.ExecContext(c.context(), query, id, time.Now().UTC())
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
@@ -0,0 +1,120 @@
+package database
+
+import (
+	"github.com/google/uuid"
+)
+
+// TagCount is a tag along with how many videos it's on.
+type TagCount struct {
+	Slug  string `json:"slug"`
+	Count int    `json:"count"`
+}
+
+// SetVideoTags replaces the video's tags with the given slugs, which must
+// already be normalized. Tags are created the first time they're used.
+func (c Client) SetVideoTags(videoID uuid.UUID, slugs []string) error {
+	tx, err := c.db.BeginTx(c.context(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM video_tags WHERE video_id = ?", videoID); err != nil {
+		return err
+	}
+	for _, slug := range slugs {
+		_, err := tx.Exec(`
+			INSERT INTO tags (id, slug, created_at)
+			VALUES (?, ?, CURRENT_TIMESTAMP)
+			ON CONFLICT(slug) DO NOTHING
+		`, uuid.New(), slug)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`
+			INSERT INTO video_tags (video_id, tag_id)
+			SELECT ?, id FROM tags WHERE slug = ?
+			ON CONFLICT(video_id, tag_id) DO NOTHING
+		`, videoID, slug)
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("UPDATE videos SET updated_at = CURRENT_TIMESTAMP WHERE id = ?", videoID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetVideosWithTag returns the user's personal videos that have the tag,
+// newest first.
+func (c Client) GetVideosWithTag(userID uuid.UUID, slug string) ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE user_id = ? AND workspace_id IS NULL
+		AND id IN (
+			SELECT vt.video_id FROM video_tags vt
+			JOIN tags t ON t.id = vt.tag_id
+			WHERE t.slug = ?
+		)
+	ORDER BY created_at DESC
+	`
+	rows, err := c.db.QueryContext(c.context(), query, userID, slug)
+	if err != nil {
+		return nil, err
+	}
+	return scanVideos(rows)
+}
+
+// GetUserTagCounts returns every tag on the user's personal videos with the
+// number of their videos it's on, most used first.
+func (c Client) GetUserTagCounts(userID uuid.UUID) ([]TagCount, error) {
+	query := `
+	SELECT t.slug, COUNT(*)
+	FROM video_tags vt
+	JOIN tags t ON t.id = vt.tag_id
+	JOIN videos v ON v.id = vt.video_id
+	WHERE v.user_id = ? AND v.workspace_id IS NULL
+	GROUP BY t.slug
+	ORDER BY COUNT(*) DESC, t.slug
+	`
+	return c.queryTagCounts(query, userID)
+}
+
+// SearchTags returns tags starting with prefix that are on videos the user
+// can see, meaning their own videos and public ones. Only those count towards
+// the totals, so tags that exist only on other people's private videos don't
+// leak. The prefix must be a normalized slug, so it has no LIKE wildcards.
+func (c Client) SearchTags(userID uuid.UUID, prefix string, limit int) ([]TagCount, error) {
+	query := `
+	SELECT t.slug, COUNT(*)
+	FROM video_tags vt
+	JOIN tags t ON t.id = vt.tag_id
+	JOIN videos v ON v.id = vt.video_id
+	WHERE t.slug LIKE ? || '%'
+		AND (v.user_id = ? OR v.visibility = ?)
+	GROUP BY t.slug
+	ORDER BY COUNT(*) DESC, t.slug
+	LIMIT ?
+	`
+	return c.queryTagCounts(query, prefix, userID, VideoVisibilityPublic, limit)
+}
+
+func (c Client) queryTagCounts(query string, args ...any) ([]TagCount, error) {
+	rows, err := c.db.QueryContext(c.context(), query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := []TagCount{}
+	for rows.Next() {
+		var tc TagCount
+		if err := rows.Scan(&tc.Slug, &tc.Count); err != nil {
+			return nil, err
+		}
+		counts = append(counts, tc)
+	}
+	return counts, rows.Err()
+}
@@ -0,0 +1,93 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// UserTokenPurpose scopes a single-use token to the flow it was issued for,
+// so a verification token can't be used to reset a password.
+type UserTokenPurpose string
+
+const (
+	UserTokenVerifyEmail   UserTokenPurpose = "verify_email"
+	UserTokenResetPassword UserTokenPurpose = "reset_password"
+	// UserTokenChangeEmail carries the new address in Email until the user
+	// confirms they own it.
+	UserTokenChangeEmail UserTokenPurpose = "change_email"
+)
+
+type UserToken struct {
+	CreatedAt time.Time  `json:"created_at"`
+	UsedAt    *time.Time `json:"used_at"`
+	CreateUserTokenParams
+}
+
+// CreateUserTokenParams takes the token's hash rather than the token itself;
+// the plaintext only ever lives in the email sent to the user.
+type CreateUserTokenParams struct {
+	TokenHash string           `json:"-"`
+	UserID    uuid.UUID        `json:"user_id"`
+	Purpose   UserTokenPurpose `json:"purpose"`
+	Email     string           `json:"email"`
+	ExpiresAt time.Time        `json:"expires_at"`
+}
+
+func (c Client) CreateUserToken(params CreateUserTokenParams) error {
+	query := `
+		INSERT INTO user_tokens (token_hash, user_id, purpose, email, expires_at, created_at)
+		VALUES (?, ?, ?, ?, ?, CURRENT_TIMESTAMP)
+	`
+	_, err := c.db.ExecContext(c.context(), query, params.TokenHash, params.UserID.String(), params.Purpose, params.Email, params.ExpiresAt)
+	return err
+}
+
+// ConsumeUserToken marks an unused, unexpired token as used and returns it.
+// It returns (nil, nil) if no such token exists. The check and the update are
+// one statement, so a token can only be consumed once however many requests
+// race for it.
+func (c Client) ConsumeUserToken(tokenHash string, purpose UserTokenPurpose) (*UserToken, error) {
+	query := `
+		UPDATE user_tokens
+		SET used_at = CURRENT_TIMESTAMP
+		WHERE token_hash = ? AND purpose = ? AND used_at IS NULL AND expires_at > ?
+		RETURNING token_hash, user_id, purpose, email, expires_at, created_at, used_at
+	`
+	var token UserToken
+	var userID string
+	err := c.db.QueryRowContext(c.context(), query, tokenHash, purpose, time.Now().UTC()).Scan(
+		&token.TokenHash,
+		&userID,
+		&token.Purpose,
+		&token.Email,
+		&token.ExpiresAt,
+		&token.CreatedAt,
+		&token.UsedAt,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	token.UserID, err = uuid.Parse(userID)
+	if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// InvalidateUserTokens marks all of a user's outstanding tokens for a purpose
+// as used, e.g. so only the most recently emailed link works.
+func (c Client) InvalidateUserTokens(userID uuid.UUID, purpose UserTokenPurpose) error {
+	query := `
+		UPDATE user_tokens
+		SET used_at = CURRENT_TIMESTAMP
+		WHERE user_id = ? AND purpose = ? AND used_at IS NULL
+	`
+	_, err := c.db.ExecContext(c.context(), query, userID.String(), purpose)
+	return err
+}
@@ -2,6 +2,7 @@ package database
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"time"
 
@@ -9,15 +10,30 @@ import (
 )
 
 type User struct {
-	ID        uuid.UUID `json:"id"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID              uuid.UUID  `json:"id"`
+	CreatedAt       time.Time  `json:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at"`
+	TokenVersion    int        `json:"-"`
+	EmailVerifiedAt *time.Time `json:"email_verified_at"`
+	TOTPSecret      string     `json:"-"`
+	TOTPEnabledAt   *time.Time `json:"totp_enabled_at"`
+	DisplayName     string     `json:"display_name"`
+	Bio             string     `json:"bio"`
+	AvatarURL       *string    `json:"avatar_url"`
+	// AvatarSrcset is the avatar's renditions, like Video.ThumbnailSrcset.
+	AvatarSrcset map[string]string `json:"avatar_srcset"`
 	CreateUserParams
 }
 
 type CreateUserParams struct {
-	Email    string `json:"email"`
-	Password string `json:"password"`
+	Email string `json:"email"`
+	// Password is the Argon2id hash, which is never sent to clients.
+	Password string `json:"-"`
+}
+
+type UpdateUserProfileParams struct {
+	DisplayName string `json:"display_name"`
+	Bio         string `json:"bio"`
 }
 
 func (c Client) GetUsers() ([]User, error) {
@@ -28,7 +44,7 @@ func (c Client) GetUsers() ([]User, error) {
 		FROM users
 	`
 
-	rows, err := c.db.Query(query)
+	rows, err := c.db.QueryContext(c.context(), query)
 	if err != nil {
 		return nil, err
 	}
@@ -51,21 +67,40 @@ func (c Client) GetUsers() ([]User, error) {
 	return users, nil
 }
 
-func (c Client) GetUserByEmail(email string) (User, error) {
-	query := `
-		SELECT id, created_at, updated_at, email, password
-		FROM users
-		WHERE email = ?
-	`
+const userColumns = `
+	u.id, u.created_at, u.updated_at, u.email, u.password, u.token_version,
+	u.email_verified_at, COALESCE(u.totp_secret, ''), u.totp_enabled_at,
+	u.display_name, u.bio, u.avatar_url, u.avatar_srcset
+`
+
+func scanUser(row rowScanner) (User, error) {
 	var user User
 	var id string
-	err := c.db.QueryRow(query, email).Scan(&id, &user.CreatedAt, &user.UpdatedAt, &user.Email, &user.Password)
+	var avatarSrcset sql.NullString
+	err := row.Scan(
+		&id,
+		&user.CreatedAt,
+		&user.UpdatedAt,
+		&user.Email,
+		&user.Password,
+		&user.TokenVersion,
+		&user.EmailVerifiedAt,
+		&user.TOTPSecret,
+		&user.TOTPEnabledAt,
+		&user.DisplayName,
+		&user.Bio,
+		&user.AvatarURL,
+		&avatarSrcset,
+	)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return User{}, nil
-		}
 		return User{}, err
 	}
+	user.AvatarSrcset = map[string]string{}
+	if avatarSrcset.String != "" {
+		if err := json.Unmarshal([]byte(avatarSrcset.String), &user.AvatarSrcset); err != nil {
+			return User{}, err
+		}
+	}
 	user.ID, err = uuid.Parse(id)
 	if err != nil {
 		return User{}, err
@@ -73,28 +108,34 @@ func (c Client) GetUserByEmail(email string) (User, error) {
 	return user, nil
 }
 
+func (c Client) GetUserByEmail(email string) (User, error) {
+	query := `SELECT` + userColumns + `
+		FROM users u
+		WHERE u.email = ?
+	`
+	user, err := scanUser(c.db.QueryRowContext(c.context(), query, email))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return User{}, nil
+		}
+		return User{}, err
+	}
+	return user, nil
+}
+
 func (c Client) GetUserByRefreshToken(token string) (*User, error) {
-	query := `
-		SELECT u.id, u.email, u.created_at, u.updated_at, u.password
+	query := `SELECT` + userColumns + `
 		FROM users u
 		JOIN refresh_tokens rt ON u.id = rt.user_id
-		WHERE rt.token = ?
+		WHERE rt.token = ? AND rt.revoked_at IS NULL AND rt.expires_at > ?
 	`
-
-	var user User
-	var id string
-	err := c.db.QueryRow(query, token).Scan(&id, &user.Email, &user.CreatedAt, &user.UpdatedAt, &user.Password)
+	user, err := scanUser(c.db.QueryRowContext(c.context(), query, token, time.Now().UTC()))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, nil
 		}
 		return nil, err
 	}
-	user.ID, err = uuid.Parse(id)
-	if err != nil {
-		return nil, err
-	}
-
 	return &user, nil
 }
 
@@ -107,7 +148,7 @@ func (c Client) CreateUser(params CreateUserParams) (*User, error) {
 		VALUES
 		    (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?)
 	`
-	_, err := c.db.Exec(query, id.String(), params.Email, params.Password)
+	_, err := c.db.ExecContext(c.context(), query, id.String(), params.Email, params.Password)
 	if err != nil {
 		return nil, err
 	}
@@ -116,32 +157,134 @@ func (c Client) CreateUser(params CreateUserParams) (*User, error) {
 }
 
 func (c Client) GetUser(id uuid.UUID) (*User, error) {
-	query := `
-		SELECT id, created_at, updated_at, email, password
-		FROM users
-		WHERE id = ?
+	query := `SELECT` + userColumns + `
+		FROM users u
+		WHERE u.id = ?
 	`
-	var user User
-	var idStr string
-	err := c.db.QueryRow(query, id.String()).Scan(&idStr, &user.CreatedAt, &user.UpdatedAt, &user.Email, &user.Password)
+	user, err := scanUser(c.db.QueryRowContext(c.context(), query, id.String()))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, nil
 		}
 		return nil, err
 	}
-	user.ID, err = uuid.Parse(idStr)
+	return &user, nil
+}
+
+// MarkEmailVerified records that the user proved ownership of email. It only
+// applies while email is still the user's address, so a link sent before an
+// email change can't verify the new one.
+func (c Client) MarkEmailVerified(id uuid.UUID, email string) (bool, error) {
+	query := `
+		UPDATE users
+		SET email_verified_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND email = ?
+	`
+	result, err := c.db.ExecContext(c.context(), query, id.String(), email)
 	if err != nil {
-		return nil, err
+		return false, err
 	}
-	return &user, nil
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
 }
 
-func (c Client) DeleteUser(id uuid.UUID) error {
+func (c Client) UpdateUserProfile(id uuid.UUID, params UpdateUserProfileParams) error {
+	query := `
+		UPDATE users
+		SET display_name = ?, bio = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`
+	_, err := c.db.ExecContext(c.context(), query, params.DisplayName, params.Bio, id.String())
+	return err
+}
+
+// UpdateUserAvatar sets the user's avatar and its renditions, or clears
+// them if avatarURL is nil.
+func (c Client) UpdateUserAvatar(id uuid.UUID, avatarURL *string, srcset map[string]string) error {
+	encodedSrcset, err := encodeSrcset(srcset)
+	if err != nil {
+		return err
+	}
+	query := `
+		UPDATE users
+		SET avatar_url = ?, avatar_srcset = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`
+	_, err = c.db.ExecContext(c.context(), query, avatarURL, encodedSrcset, id.String())
+	return err
+}
+
+// UpdateUserEmail changes the user's email to one they've just proven they
+// own, so it's marked verified in the same step.
+func (c Client) UpdateUserEmail(id uuid.UUID, email string) error {
+	query := `
+		UPDATE users
+		SET email = ?, email_verified_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`
+	_, err := c.db.ExecContext(c.context(), query, email, id.String())
+	return err
+}
+
+func (c Client) UpdateUserPassword(id uuid.UUID, password string) error {
 	query := `
-		DELETE FROM users
+		UPDATE users
+		SET password = ?, updated_at = CURRENT_TIMESTAMP
 		WHERE id = ?
 	`
-	_, err := c.db.Exec(query, id.String())
+	_, err := c.db.ExecContext(c.context(), query, password, id.String())
 	return err
 }
+
+// IncrementTokenVersion invalidates every access token issued to the user so
+// far, since tokens carry the version they were minted with.
+func (c Client) IncrementTokenVersion(id uuid.UUID) error {
+	query := `
+		UPDATE users
+		SET token_version = token_version + 1, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`
+	_, err := c.db.ExecContext(c.context(), query, id.String())
+	return err
+}
+
+// DeleteUser removes the user along with every row that belongs to them.
+// Audit events are kept for the security record but no longer point at the
+// user. Stored media outside blobs has to be deleted by the caller first,
+// since the videos referencing it are removed here. Workspaces the user is
+// the last owner of should be dealt with first too, or they'll be left
+// without an owner.
+func (c Client) DeleteUser(id uuid.UUID) error {
+	tx, err := c.db.BeginTx(c.context(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Videos in a workspace belong to the team and outlive their uploader.
+	if err := deleteVideosWhere(tx, "user_id = ? AND workspace_id IS NULL", id.String()); err != nil {
+		return err
+	}
+
+	queries := []string{
+		"DELETE FROM playlist_items WHERE playlist_id IN (SELECT id FROM playlists WHERE user_id = ?)",
+		"DELETE FROM playlists WHERE user_id = ?",
+		"DELETE FROM video_shares WHERE user_id = ?",
+		"DELETE FROM workspace_members WHERE user_id = ?",
+		"DELETE FROM refresh_tokens WHERE user_id = ?",
+		"DELETE FROM user_tokens WHERE user_id = ?",
+		"DELETE FROM recovery_codes WHERE user_id = ?",
+		"DELETE FROM user_identities WHERE user_id = ?",
+		"UPDATE audit_events SET user_id = NULL WHERE user_id = ?",
+		"DELETE FROM users WHERE id = ?",
+	}
+	for _, query := range queries {
+		if _, err := tx.Exec(query, id.String()); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
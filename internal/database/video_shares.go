@@ -0,0 +1,97 @@
+package database
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// VideoShare grants another user read access to a private video.
+type VideoShare struct {
+	VideoID   uuid.UUID `json:"video_id"`
+	UserID    uuid.UUID `json:"user_id"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ShareVideo grants userID read access to the video. Sharing with someone
+// who already has access is a no-op.
+func (c Client) ShareVideo(videoID, userID uuid.UUID) error {
+	query := `
+		INSERT INTO video_shares (video_id, user_id, created_at)
+		VALUES (?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT(video_id, user_id) DO NOTHING
+	`
+	_, err := c.db.ExecContext(c.context(), query, videoID, userID)
+	return err
+}
+
+// UnshareVideo revokes userID's access and reports whether they had any.
+func (c Client) UnshareVideo(videoID, userID uuid.UUID) (bool, error) {
+	query := `
+		DELETE FROM video_shares
+		WHERE video_id = ? AND user_id = ?
+	`
+	result, err := c.db.ExecContext(c.context(), query, videoID, userID)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func (c Client) IsVideoSharedWith(videoID, userID uuid.UUID) (bool, error) {
+	query := `
+		SELECT EXISTS(
+			SELECT 1 FROM video_shares
+			WHERE video_id = ? AND user_id = ?
+		)
+	`
+	var shared bool
+	err := c.db.QueryRowContext(c.context(), query, videoID, userID).Scan(&shared)
+	return shared, err
+}
+
+func (c Client) GetVideoShares(videoID uuid.UUID) ([]VideoShare, error) {
+	query := `
+		SELECT s.video_id, s.user_id, u.email, s.created_at
+		FROM video_shares s
+		JOIN users u ON u.id = s.user_id
+		WHERE s.video_id = ?
+		ORDER BY s.created_at
+	`
+	rows, err := c.db.QueryContext(c.context(), query, videoID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	shares := []VideoShare{}
+	for rows.Next() {
+		var share VideoShare
+		if err := rows.Scan(&share.VideoID, &share.UserID, &share.Email, &share.CreatedAt); err != nil {
+			return nil, err
+		}
+		shares = append(shares, share)
+	}
+	return shares, rows.Err()
+}
+
+// GetVideosSharedWith returns the videos other users have shared with
+// userID, newest first.
+func (c Client) GetVideosSharedWith(userID uuid.UUID) ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE id IN (SELECT video_id FROM video_shares WHERE user_id = ?)
+	ORDER BY created_at DESC
+	`
+	rows, err := c.db.QueryContext(c.context(), query, userID)
+	if err != nil {
+		return nil, err
+	}
+	return scanVideos(rows)
+}
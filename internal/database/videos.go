@@ -2,71 +2,206 @@ package database
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
 )
 
+// VideoVisibility controls who can read a video. Private videos are readable
+// by their owner and the users they're shared with, unlisted videos by anyone
+// who has the link, and public videos are also listed in the browse feed.
+type VideoVisibility string
+
+const (
+	VideoVisibilityPrivate  VideoVisibility = "private"
+	VideoVisibilityUnlisted VideoVisibility = "unlisted"
+	VideoVisibilityPublic   VideoVisibility = "public"
+)
+
+func (v VideoVisibility) Valid() bool {
+	switch v {
+	case VideoVisibilityPrivate, VideoVisibilityUnlisted, VideoVisibilityPublic:
+		return true
+	}
+	return false
+}
+
 type Video struct {
 	ID           uuid.UUID `json:"id"`
 	CreatedAt    time.Time `json:"created_at"`
 	UpdatedAt    time.Time `json:"updated_at"`
 	ThumbnailURL *string   `json:"thumbnail_url"`
-	VideoURL     *string   `json:"video_url"`
+	// ThumbnailSrcset maps an image MIME type to a srcset of the thumbnail
+	// at each of its sizes, ready for a <source> element.
+	ThumbnailSrcset map[string]string `json:"thumbnail_srcset"`
+	VideoURL        *string           `json:"video_url"`
+	Tags            []string          `json:"tags"`
+	// VideoBlobHash and ThumbnailBlobHash identify the blobs the video's
+	// media is stored in. They're empty for media uploaded before blobs
+	// existed, which belongs to this video alone.
+	VideoBlobHash     string `json:"-"`
+	ThumbnailBlobHash string `json:"-"`
+	// ScanResults holds the malware scan verdict for the video's current
+	// upload of each kind. It names the signatures the scanner matched, so
+	// it's left out of the JSON everyone sees.
+	ScanResults map[BlobKind]ScanResult `json:"-"`
 	CreateVideoParams
 }
 
+// ScanResult records what the upload scanner made of a file.
+type ScanResult struct {
+	Verdict   string    `json:"verdict"`
+	Signature string    `json:"signature,omitempty"`
+	Scanner   string    `json:"scanner"`
+	ScannedAt time.Time `json:"scanned_at"`
+}
+
 type CreateVideoParams struct {
-	Title       string    `json:"title"`
-	Description string    `json:"description"`
-	UserID      uuid.UUID `json:"user_id"`
+	Title       string          `json:"title"`
+	Description string          `json:"description"`
+	UserID      uuid.UUID       `json:"user_id"`
+	Visibility  VideoVisibility `json:"visibility"`
+	// WorkspaceID is set for videos in a shared workspace library, whose
+	// members manage them according to their roles. UserID is then only the
+	// uploader.
+	WorkspaceID *uuid.UUID `json:"workspace_id"`
 }
 
-func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
-	query := `
-	SELECT
-		id,
-		created_at,
-		updated_at,
-		title,
-		description,
-		thumbnail_url,
-		video_url,
-		user_id
-	FROM videos
-	WHERE user_id = ?
-	ORDER BY created_at DESC
-	`
+const videoColumns = `
+	id,
+	created_at,
+	updated_at,
+	title,
+	description,
+	thumbnail_url,
+	thumbnail_srcset,
+	video_url,
+	user_id,
+	visibility,
+	workspace_id,
+	video_blob_hash,
+	thumbnail_blob_hash,
+	scan_results,
+	(
+		SELECT GROUP_CONCAT(slug, ',') FROM (
+			SELECT t.slug FROM video_tags vt
+			JOIN tags t ON t.id = vt.tag_id
+			WHERE vt.video_id = videos.id
+			ORDER BY t.slug
+		)
+	)
+`
 
-	rows, err := c.db.Query(query, userID)
+func scanVideo(row rowScanner) (Video, error) {
+	var video Video
+	var srcset, videoBlob, thumbnailBlob, scanResults, tags sql.NullString
+	err := row.Scan(
+		&video.ID,
+		&video.CreatedAt,
+		&video.UpdatedAt,
+		&video.Title,
+		&video.Description,
+		&video.ThumbnailURL,
+		&srcset,
+		&video.VideoURL,
+		&video.UserID,
+		&video.Visibility,
+		&video.WorkspaceID,
+		&videoBlob,
+		&thumbnailBlob,
+		&scanResults,
+		&tags,
+	)
 	if err != nil {
-		return nil, err
+		return Video{}, err
+	}
+
+	video.VideoBlobHash = videoBlob.String
+	video.ThumbnailBlobHash = thumbnailBlob.String
+
+	video.ThumbnailSrcset = map[string]string{}
+	if srcset.String != "" {
+		if err := json.Unmarshal([]byte(srcset.String), &video.ThumbnailSrcset); err != nil {
+			return Video{}, err
+		}
 	}
+
+	video.ScanResults = map[BlobKind]ScanResult{}
+	if scanResults.String != "" {
+		if err := json.Unmarshal([]byte(scanResults.String), &video.ScanResults); err != nil {
+			return Video{}, err
+		}
+	}
+
+	video.Tags = []string{}
+	if tags.String != "" {
+		video.Tags = strings.Split(tags.String, ",")
+	}
+	return video, nil
+}
+
+func scanVideos(rows *sql.Rows) ([]Video, error) {
 	defer rows.Close()
 
 	videos := []Video{}
 	for rows.Next() {
-		var video Video
-		if err := rows.Scan(
-			&video.ID,
-			&video.CreatedAt,
-			&video.UpdatedAt,
-			&video.Title,
-			&video.Description,
-			&video.ThumbnailURL,
-			&video.VideoURL,
-			&video.UserID,
-		); err != nil {
+		video, err := scanVideo(rows)
+		if err != nil {
 			return nil, err
 		}
 		videos = append(videos, video)
 	}
+	return videos, rows.Err()
+}
+
+// GetVideos returns the user's personal videos, leaving out the ones they've
+// uploaded to workspaces.
+func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE user_id = ? AND workspace_id IS NULL
+	ORDER BY created_at DESC
+	`
+
+	rows, err := c.db.QueryContext(c.context(), query, userID)
+	if err != nil {
+		return nil, err
+	}
+	return scanVideos(rows)
+}
 
-	return videos, nil
+// GetPublicVideos returns a page of public videos, newest first, optionally
+// only those with the given tag.
+func (c Client) GetPublicVideos(tag string, limit, offset int) ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE visibility = ?
+		AND (? = '' OR id IN (
+			SELECT vt.video_id FROM video_tags vt
+			JOIN tags t ON t.id = vt.tag_id
+			WHERE t.slug = ?
+		))
+	ORDER BY created_at DESC, id DESC
+	LIMIT ? OFFSET ?
+	`
+
+	rows, err := c.db.QueryContext(c.context(), query, VideoVisibilityPublic, tag, tag, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	return scanVideos(rows)
 }
 
 func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
+	if params.Visibility == "" {
+		params.Visibility = VideoVisibilityPrivate
+	}
+
 	id := uuid.New()
 	query := `
 	INSERT INTO videos (
@@ -75,10 +210,12 @@ func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
 		updated_at,
 		title,
 		description,
-		user_id
-	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?)
+		user_id,
+		visibility,
+		workspace_id
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, ?, ?)
 	`
-	_, err := c.db.Exec(query, id, params.Title, params.Description, params.UserID)
+	_, err := c.db.ExecContext(c.context(), query, id, params.Title, params.Description, params.UserID, params.Visibility, params.WorkspaceID)
 	if err != nil {
 		return Video{}, err
 	}
@@ -88,29 +225,12 @@ func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
 
 func (c Client) GetVideo(id uuid.UUID) (Video, error) {
 	query := `
-	SELECT
-		id,
-		created_at,
-		updated_at,
-		title,
-		description,
-		thumbnail_url,
-		video_url,
-		user_id
+	SELECT` + videoColumns + `
 	FROM videos
 	WHERE id = ?
 	`
 
-	var video Video
-	err := c.db.QueryRow(query, id).Scan(
-		&video.ID,
-		&video.CreatedAt,
-		&video.UpdatedAt,
-		&video.Title,
-		&video.Description,
-		&video.ThumbnailURL,
-		&video.VideoURL,
-		&video.UserID)
+	video, err := scanVideo(c.db.QueryRowContext(c.context(), query, id))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return Video{}, nil
@@ -128,28 +248,186 @@ func (c Client) UpdateVideo(video Video) error {
 		title = ?,
 		description = ?,
 		thumbnail_url = ?,
+		thumbnail_srcset = ?,
 		video_url = ?,
-		user_id = ?
+		user_id = ?,
+		visibility = ?,
+		updated_at = CURRENT_TIMESTAMP
 	WHERE id = ?
 	`
 
-	_, err := c.db.Exec(
+	srcset, err := encodeSrcset(video.ThumbnailSrcset)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.db.ExecContext(
+		c.context(),
 		query,
 		video.Title,
 		video.Description,
 		video.ThumbnailURL,
+		srcset,
 		video.VideoURL,
 		video.UserID,
+		video.Visibility,
 		video.ID,
 	)
 	return err
 }
 
-func (c Client) DeleteVideo(id uuid.UUID) error {
+func encodeSrcset(srcset map[string]string) (sql.NullString, error) {
+	if len(srcset) == 0 {
+		return sql.NullString{}, nil
+	}
+	encoded, err := json.Marshal(srcset)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	return sql.NullString{String: string(encoded), Valid: true}, nil
+}
+
+// SetVideoFile points the video at an uploaded file stored in the blob with
+// the given hash, which the caller holds a reference to from AcquireBlob or
+// AddBlob. The reference to the file it replaces is released. If that would
+// put the video's owner over limits nothing changes and the error is
+// ErrStorageQuotaExceeded or ErrVideoLimitReached.
+func (c Client) SetVideoFile(id uuid.UUID, videoURL, blobHash string, limits StorageLimits) error {
+	tx, err := c.db.BeginTx(c.context(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE videos
+		SET video_url = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`, videoURL, id)
+	if err != nil {
+		return err
+	}
+	if err := setVideoBlob(tx, id, "video_blob_hash", BlobKindVideo, blobHash); err != nil {
+		return err
+	}
+	if err := checkStorageLimits(tx, id, limits); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SetVideoThumbnail is SetVideoFile for the video's thumbnail.
+func (c Client) SetVideoThumbnail(id uuid.UUID, thumbnailURL string, srcset map[string]string, blobHash string, limits StorageLimits) error {
+	encodedSrcset, err := encodeSrcset(srcset)
+	if err != nil {
+		return err
+	}
+
+	tx, err := c.db.BeginTx(c.context(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE videos
+		SET thumbnail_url = ?, thumbnail_srcset = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`, thumbnailURL, encodedSrcset, id)
+	if err != nil {
+		return err
+	}
+	if err := setVideoBlob(tx, id, "thumbnail_blob_hash", BlobKindThumbnail, blobHash); err != nil {
+		return err
+	}
+	if err := checkStorageLimits(tx, id, limits); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SetVideoScanResult records the scan verdict for the video's current upload
+// of the given kind.
+func (c Client) SetVideoScanResult(id uuid.UUID, kind BlobKind, result ScanResult) error {
+	encoded, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
 	query := `
-	DELETE FROM videos
+	UPDATE videos
+	SET scan_results = json_set(COALESCE(scan_results, '{}'), '$.' || ?, json(?))
 	WHERE id = ?
 	`
-	_, err := c.db.Exec(query, id)
+	_, err = c.db.ExecContext(c.context(), query, string(kind), string(encoded), id)
+	return err
+}
+
+func (c Client) DeleteVideo(id uuid.UUID) error {
+	tx, err := c.db.BeginTx(c.context(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := deleteVideosWhere(tx, "id = ?", id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// deleteVideosWhere deletes the videos matching where, along with every row
+// that refers to them, and releases their blobs. where is a condition on the
+// videos table and must not be built from user input.
+func deleteVideosWhere(tx *sql.Tx, where string, args ...any) error {
+	matching := "(SELECT id FROM videos WHERE " + where + ")"
+
+	if err := releaseVideoBlobs(tx, "video_blob_hash", BlobKindVideo, where, args...); err != nil {
+		return err
+	}
+	if err := releaseVideoBlobs(tx, "thumbnail_blob_hash", BlobKindThumbnail, where, args...); err != nil {
+		return err
+	}
+
+	if err := removeVideosFromPlaylists(tx, matching, args...); err != nil {
+		return err
+	}
+	for _, table := range []string{"video_shares", "share_links", "video_tags"} {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE video_id IN "+matching, args...); err != nil {
+			return err
+		}
+	}
+	_, err := tx.Exec("DELETE FROM videos WHERE "+where, args...)
 	return err
 }
+
+// removeVideosFromPlaylists takes the matching videos out of every playlist
+// they're in and renumbers those playlists to close the gaps.
+func removeVideosFromPlaylists(tx *sql.Tx, matching string, args ...any) error {
+	rows, err := tx.Query("SELECT DISTINCT playlist_id FROM playlist_items WHERE video_id IN "+matching, args...)
+	if err != nil {
+		return err
+	}
+	var playlistIDs []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		playlistIDs = append(playlistIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM playlist_items WHERE video_id IN "+matching, args...); err != nil {
+		return err
+	}
+	for _, id := range playlistIDs {
+		if err := renumberPlaylist(tx, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
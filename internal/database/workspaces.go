@@ -0,0 +1,317 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// WorkspaceRole is what a member can do in a workspace. Viewers can read its
+// videos, editors can also upload, change and delete them, and owners can
+// additionally manage members and the workspace itself.
+type WorkspaceRole string
+
+const (
+	WorkspaceRoleOwner  WorkspaceRole = "owner"
+	WorkspaceRoleEditor WorkspaceRole = "editor"
+	WorkspaceRoleViewer WorkspaceRole = "viewer"
+)
+
+func (r WorkspaceRole) Valid() bool {
+	switch r {
+	case WorkspaceRoleOwner, WorkspaceRoleEditor, WorkspaceRoleViewer:
+		return true
+	}
+	return false
+}
+
+// CanEdit reports whether the role may modify the workspace's videos.
+func (r WorkspaceRole) CanEdit() bool {
+	return r == WorkspaceRoleOwner || r == WorkspaceRoleEditor
+}
+
+type Workspace struct {
+	ID        uuid.UUID `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Name      string    `json:"name"`
+}
+
+// UserWorkspace is a workspace as seen by one of its members.
+type UserWorkspace struct {
+	Workspace
+	Role WorkspaceRole `json:"role"`
+}
+
+type WorkspaceMember struct {
+	WorkspaceID uuid.UUID     `json:"workspace_id"`
+	UserID      uuid.UUID     `json:"user_id"`
+	Email       string        `json:"email"`
+	Role        WorkspaceRole `json:"role"`
+	CreatedAt   time.Time     `json:"created_at"`
+}
+
+// CreateWorkspace creates a workspace with ownerID as its first owner.
+func (c Client) CreateWorkspace(name string, ownerID uuid.UUID) (Workspace, error) {
+	tx, err := c.db.BeginTx(c.context(), nil)
+	if err != nil {
+		return Workspace{}, err
+	}
+	defer tx.Rollback()
+
+	id := uuid.New()
+	_, err = tx.Exec(`
+		INSERT INTO workspaces (id, created_at, updated_at, name)
+		VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?)
+	`, id, name)
+	if err != nil {
+		return Workspace{}, err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO workspace_members (workspace_id, user_id, role, created_at)
+		VALUES (?, ?, ?, CURRENT_TIMESTAMP)
+	`, id, ownerID, WorkspaceRoleOwner)
+	if err != nil {
+		return Workspace{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Workspace{}, err
+	}
+
+	return c.GetWorkspace(id)
+}
+
+func (c Client) GetWorkspace(id uuid.UUID) (Workspace, error) {
+	query := `
+		SELECT id, created_at, updated_at, name
+		FROM workspaces
+		WHERE id = ?
+	`
+	var ws Workspace
+	err := c.db.QueryRowContext(c.context(), query, id).Scan(&ws.ID, &ws.CreatedAt, &ws.UpdatedAt, &ws.Name)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Workspace{}, nil
+		}
+		return Workspace{}, err
+	}
+	return ws, nil
+}
+
+// GetUserWorkspaces returns the workspaces the user is a member of, with
+// their role in each.
+func (c Client) GetUserWorkspaces(userID uuid.UUID) ([]UserWorkspace, error) {
+	query := `
+		SELECT w.id, w.created_at, w.updated_at, w.name, m.role
+		FROM workspaces w
+		JOIN workspace_members m ON m.workspace_id = w.id
+		WHERE m.user_id = ?
+		ORDER BY w.name
+	`
+	rows, err := c.db.QueryContext(c.context(), query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	workspaces := []UserWorkspace{}
+	for rows.Next() {
+		var ws UserWorkspace
+		if err := rows.Scan(&ws.ID, &ws.CreatedAt, &ws.UpdatedAt, &ws.Name, &ws.Role); err != nil {
+			return nil, err
+		}
+		workspaces = append(workspaces, ws)
+	}
+	return workspaces, rows.Err()
+}
+
+func (c Client) UpdateWorkspace(ws Workspace) error {
+	query := `
+		UPDATE workspaces
+		SET name = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`
+	_, err := c.db.ExecContext(c.context(), query, ws.Name, ws.ID)
+	return err
+}
+
+// DeleteWorkspace deletes the workspace, its memberships and its videos.
+// Stored media for those videos that isn't in blobs has to be deleted by the
+// caller first.
+func (c Client) DeleteWorkspace(id uuid.UUID) error {
+	tx, err := c.db.BeginTx(c.context(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := deleteVideosWhere(tx, "workspace_id = ?", id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM workspace_members WHERE workspace_id = ?", id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM workspaces WHERE id = ?", id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetWorkspaceRole returns the user's role in the workspace, or "" if they
+// aren't a member.
+func (c Client) GetWorkspaceRole(workspaceID, userID uuid.UUID) (WorkspaceRole, error) {
+	query := `
+		SELECT role FROM workspace_members
+		WHERE workspace_id = ? AND user_id = ?
+	`
+	var role WorkspaceRole
+	err := c.db.QueryRowContext(c.context(), query, workspaceID, userID).Scan(&role)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", nil
+		}
+		return "", err
+	}
+	return role, nil
+}
+
+func (c Client) GetWorkspaceMembers(workspaceID uuid.UUID) ([]WorkspaceMember, error) {
+	query := `
+		SELECT m.workspace_id, m.user_id, u.email, m.role, m.created_at
+		FROM workspace_members m
+		JOIN users u ON u.id = m.user_id
+		WHERE m.workspace_id = ?
+		ORDER BY m.created_at
+	`
+	rows, err := c.db.QueryContext(c.context(), query, workspaceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []WorkspaceMember{}
+	for rows.Next() {
+		var m WorkspaceMember
+		if err := rows.Scan(&m.WorkspaceID, &m.UserID, &m.Email, &m.Role, &m.CreatedAt); err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+	return members, rows.Err()
+}
+
+// ErrLastWorkspaceOwner is returned instead of demoting or removing a
+// workspace's only owner.
+var ErrLastWorkspaceOwner = errors.New("workspace needs at least one owner")
+
+// SetWorkspaceMember adds the user to the workspace with the given role, or
+// changes their role if they're already a member. Demoting the only owner
+// fails with ErrLastWorkspaceOwner; the owners are counted in the same
+// statement so concurrent changes can't both pass the check.
+func (c Client) SetWorkspaceMember(workspaceID, userID uuid.UUID, role WorkspaceRole) error {
+	query := `
+		INSERT INTO workspace_members (workspace_id, user_id, role, created_at)
+		VALUES (?, ?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT(workspace_id, user_id) DO UPDATE SET role = excluded.role
+		WHERE excluded.role = ? OR workspace_members.role <> ? OR (
+			SELECT COUNT(*) FROM workspace_members o
+			WHERE o.workspace_id = excluded.workspace_id AND o.role = ?
+		) > 1
+	`
+	result, err := c.db.ExecContext(c.context(), query, workspaceID, userID, role, WorkspaceRoleOwner, WorkspaceRoleOwner, WorkspaceRoleOwner)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrLastWorkspaceOwner
+	}
+	return nil
+}
+
+// RemoveWorkspaceMember reports whether the user was a member. Removing the
+// only owner fails with ErrLastWorkspaceOwner, checked as in
+// SetWorkspaceMember.
+func (c Client) RemoveWorkspaceMember(workspaceID, userID uuid.UUID) (bool, error) {
+	query := `
+		DELETE FROM workspace_members
+		WHERE workspace_id = ? AND user_id = ? AND (
+			role <> ? OR (
+				SELECT COUNT(*) FROM workspace_members o
+				WHERE o.workspace_id = workspace_members.workspace_id AND o.role = ?
+			) > 1
+		)
+	`
+	result, err := c.db.ExecContext(c.context(), query, workspaceID, userID, WorkspaceRoleOwner, WorkspaceRoleOwner)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if n > 0 {
+		return true, nil
+	}
+
+	// Nothing was deleted: either the user isn't a member or they're the
+	// last owner.
+	role, err := c.GetWorkspaceRole(workspaceID, userID)
+	if err != nil {
+		return false, err
+	}
+	if role == WorkspaceRoleOwner {
+		return false, ErrLastWorkspaceOwner
+	}
+	return false, nil
+}
+
+// GetSoleOwnedWorkspaces returns the workspaces the user is the only owner
+// of, which would be left unmanageable if the user went away.
+func (c Client) GetSoleOwnedWorkspaces(userID uuid.UUID) ([]Workspace, error) {
+	query := `
+		SELECT w.id, w.created_at, w.updated_at, w.name
+		FROM workspaces w
+		JOIN workspace_members m ON m.workspace_id = w.id
+		WHERE m.user_id = ? AND m.role = ?
+			AND (
+				SELECT COUNT(*) FROM workspace_members o
+				WHERE o.workspace_id = w.id AND o.role = ?
+			) = 1
+		ORDER BY w.name
+	`
+	rows, err := c.db.QueryContext(c.context(), query, userID, WorkspaceRoleOwner, WorkspaceRoleOwner)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	workspaces := []Workspace{}
+	for rows.Next() {
+		var ws Workspace
+		if err := rows.Scan(&ws.ID, &ws.CreatedAt, &ws.UpdatedAt, &ws.Name); err != nil {
+			return nil, err
+		}
+		workspaces = append(workspaces, ws)
+	}
+	return workspaces, rows.Err()
+}
+
+func (c Client) GetWorkspaceVideos(workspaceID uuid.UUID) ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE workspace_id = ?
+	ORDER BY created_at DESC
+	`
+	rows, err := c.db.QueryContext(c.context(), query, workspaceID)
+	if err != nil {
+		return nil, err
+	}
+	return scanVideos(rows)
+}
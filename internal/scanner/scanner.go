@@ -0,0 +1,135 @@
+package scanner
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+type Verdict string
+
+const (
+	VerdictClean    Verdict = "clean"
+	VerdictInfected Verdict = "infected"
+	// VerdictUnscanned means no scanner is configured, so the file was
+	// accepted as is.
+	VerdictUnscanned Verdict = "unscanned"
+)
+
+// Result is what a scanner made of a file. Signature names what was found
+// in an infected file.
+type Result struct {
+	Verdict   Verdict `json:"verdict"`
+	Signature string  `json:"signature,omitempty"`
+	Scanner   string  `json:"scanner"`
+}
+
+// ErrTooLarge means the file is bigger than the scanner will accept, so
+// retrying won't help.
+var ErrTooLarge = errors.New("file is too large to scan")
+
+// Scanner checks uploaded files for malware before they're published. An
+// error means the file couldn't be scanned, not that it's infected.
+type Scanner interface {
+	Scan(ctx context.Context, r io.Reader) (Result, error)
+}
+
+// NopScanner accepts everything without looking at it, for deployments that
+// don't need scanning.
+type NopScanner struct{}
+
+func (NopScanner) Scan(ctx context.Context, r io.Reader) (Result, error) {
+	return Result{Verdict: VerdictUnscanned, Scanner: "none"}, nil
+}
+
+// ClamdScanner streams files to a ClamAV daemon with the INSTREAM command.
+// Network is "unix" or "tcp", as for net.Dial.
+type ClamdScanner struct {
+	Network string
+	Address string
+	// Timeout bounds a whole scan; zero means one minute.
+	Timeout time.Duration
+}
+
+// clamdChunkSize is how much of the file is sent per INSTREAM chunk. clamd
+// reads chunks of any size up to its StreamMaxLength in total.
+const clamdChunkSize = 64 << 10
+
+func (s ClamdScanner) Scan(ctx context.Context, r io.Reader) (Result, error) {
+	timeout := s.Timeout
+	if timeout == 0 {
+		timeout = time.Minute
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, s.Network, s.Address)
+	if err != nil {
+		return Result{}, fmt.Errorf("couldn't connect to clamd: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return Result{}, fmt.Errorf("couldn't send clamd command: %w", err)
+	}
+	buf := make([]byte, 4+clamdChunkSize)
+	for {
+		n, err := io.ReadFull(r, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if _, werr := conn.Write(buf[:4+n]); werr != nil {
+				// clamd hangs up when the stream is over its size limit,
+				// and says so in its reply.
+				break
+			}
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			return Result{}, fmt.Errorf("couldn't read file to scan: %w", err)
+		}
+	}
+	// A zero-length chunk ends the stream. It may fail if clamd has already
+	// hung up, in which case the reply explains why.
+	conn.Write([]byte{0, 0, 0, 0})
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && !(errors.Is(err, io.EOF) && reply != "") {
+		return Result{}, fmt.Errorf("couldn't read clamd reply: %w", err)
+	}
+	return parseClamdReply(strings.TrimRight(reply, "\x00\n"))
+}
+
+// parseClamdReply interprets a reply like "stream: OK" or
+// "stream: Eicar-Signature FOUND". Files over clamd's StreamMaxLength get
+// "INSTREAM size limit exceeded. ERROR" instead.
+func parseClamdReply(reply string) (Result, error) {
+	result := strings.TrimSpace(reply)
+	if _, after, ok := strings.Cut(result, ": "); ok {
+		result = after
+	}
+	switch {
+	case result == "OK":
+		return Result{Verdict: VerdictClean, Scanner: "clamd"}, nil
+	case strings.HasSuffix(result, " FOUND"):
+		return Result{
+			Verdict:   VerdictInfected,
+			Signature: strings.TrimSuffix(result, " FOUND"),
+			Scanner:   "clamd",
+		}, nil
+	case strings.HasPrefix(result, "INSTREAM size limit exceeded"):
+		return Result{}, fmt.Errorf("clamd: %w", ErrTooLarge)
+	}
+	return Result{}, fmt.Errorf("clamd couldn't scan the file: %s", strings.TrimSpace(reply))
+}
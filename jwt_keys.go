@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+)
+
+// legacyHMACKeyID identifies the JWT_SECRET key. Tokens signed before key IDs
+// were introduced carry no "kid" and are verified against it.
+const legacyHMACKeyID = "hs256"
+
+// loadJWTKeys builds the access token key set. With a keys directory, the
+// active key signs new tokens and every other key (including JWT_SECRET, if
+// still set) only verifies them until they expire. Without one, JWT_SECRET
+// signs with HS256 as before.
+func loadJWTKeys(secret, keysDir, activeKeyID string) (*auth.KeySet, error) {
+	if keysDir == "" {
+		if secret == "" {
+			return nil, errors.New("JWT_SECRET or JWT_KEYS_DIR must be set")
+		}
+		keys, err := auth.NewKeySet(auth.NewHMACKey(legacyHMACKeyID, []byte(secret)))
+		if err != nil {
+			return nil, err
+		}
+		return keys, keys.SetLegacyKey(legacyHMACKeyID)
+	}
+
+	if activeKeyID == "" {
+		return nil, errors.New("JWT_ACTIVE_KEY_ID must be set when JWT_KEYS_DIR is set")
+	}
+
+	loaded, err := auth.LoadKeysDir(keysDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var active *auth.SigningKey
+	retired := []auth.SigningKey{}
+	for _, key := range loaded {
+		if key.ID == activeKeyID {
+			active = &key
+			continue
+		}
+		retired = append(retired, key)
+	}
+	if active == nil {
+		return nil, fmt.Errorf("active key %q not found in %s", activeKeyID, keysDir)
+	}
+	if secret != "" {
+		retired = append(retired, auth.NewHMACKey(legacyHMACKeyID, []byte(secret)))
+	}
+
+	keys, err := auth.NewKeySet(*active, retired...)
+	if err != nil {
+		return nil, err
+	}
+	if secret != "" {
+		if err := keys.SetLegacyKey(legacyHMACKeyID); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// loginThrottlePolicy slows down repeated failed logins for one key. The first
+// freeAttempts failures cost nothing, each one after that doubles the wait
+// before the next attempt, and reaching lockoutAttempts locks the key out for
+// lockoutDuration. Failures are forgotten after window without another one.
+type loginThrottlePolicy struct {
+	freeAttempts    int
+	backoffBase     time.Duration
+	lockoutAttempts int
+	lockoutDuration time.Duration
+	window          time.Duration
+}
+
+var (
+	accountLoginPolicy = loginThrottlePolicy{
+		freeAttempts:    3,
+		backoffBase:     time.Second,
+		lockoutAttempts: 10,
+		lockoutDuration: 15 * time.Minute,
+		window:          time.Hour,
+	}
+	// Many users can share an IP behind NAT, so IPs get more headroom.
+	ipLoginPolicy = loginThrottlePolicy{
+		freeAttempts:    10,
+		backoffBase:     time.Second,
+		lockoutAttempts: 50,
+		lockoutDuration: 15 * time.Minute,
+		window:          time.Hour,
+	}
+)
+
+const auditEventLoginLockout = "login_lockout"
+
+func (p loginThrottlePolicy) delay(failures int) time.Duration {
+	switch {
+	case failures >= p.lockoutAttempts:
+		return p.lockoutDuration
+	case failures < p.freeAttempts:
+		return 0
+	default:
+		return min(p.backoffBase<<(failures-p.freeAttempts), p.lockoutDuration)
+	}
+}
+
+// accountThrottleKey is keyed by the submitted email rather than a user ID so
+// unknown emails are throttled exactly like real ones.
+func accountThrottleKey(email string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipThrottleKey(ip string) string {
+	return "ip:" + ip
+}
+
+// loginRetryAfter returns how long the client must wait before another login
+// attempt for any of the keys is allowed, or zero if none are locked.
+func (cfg *apiConfig) loginRetryAfter(ctx context.Context, keys ...string) (time.Duration, error) {
+	var wait time.Duration
+	now := time.Now()
+	for _, key := range keys {
+		attempt, err := cfg.requestDB(ctx).GetLoginAttempt(key)
+		if err != nil {
+			return 0, err
+		}
+		if attempt.LockedUntil != nil && attempt.LockedUntil.After(now) {
+			wait = max(wait, attempt.LockedUntil.Sub(now))
+		}
+	}
+	return wait, nil
+}
+
+// recordLoginFailure counts a failed attempt against both the account and the
+// client IP, and writes an audit event whenever one of them becomes locked out.
+func (cfg *apiConfig) recordLoginFailure(r *http.Request, email string, userID *uuid.UUID) error {
+	ip := clientIP(r)
+	throttles := []struct {
+		key    string
+		policy loginThrottlePolicy
+	}{
+		{accountThrottleKey(email), accountLoginPolicy},
+		{ipThrottleKey(ip), ipLoginPolicy},
+	}
+
+	for _, throttle := range throttles {
+		failures, delay, err := cfg.recordThrottledFailure(r.Context(), throttle.key, throttle.policy)
+		if err != nil {
+			return err
+		}
+
+		if failures == throttle.policy.lockoutAttempts {
+			loggerFrom(r.Context()).Warn("Locked out login", "key", throttle.key, "duration", delay, "failures", failures)
+			err := cfg.requestDB(r.Context()).CreateAuditEvent(database.CreateAuditEventParams{
+				Type:      auditEventLoginLockout,
+				UserID:    userID,
+				IPAddress: ip,
+				Details:   fmt.Sprintf("%s locked for %s after %d failed logins", throttle.key, delay, failures),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// recordThrottledFailure counts a failure against key and locks it for as
+// long as the policy asks. It returns the failure count and the lock's length,
+// which is zero while the key is still within its free attempts.
+func (cfg *apiConfig) recordThrottledFailure(ctx context.Context, key string, policy loginThrottlePolicy) (int, time.Duration, error) {
+	failures, err := cfg.requestDB(ctx).RecordLoginFailure(key, policy.window)
+	if err != nil {
+		return 0, 0, err
+	}
+	delay := policy.delay(failures)
+	if delay == 0 {
+		return failures, 0, nil
+	}
+	if err := cfg.requestDB(ctx).LockLogin(key, time.Now().Add(delay)); err != nil {
+		return 0, 0, err
+	}
+	return failures, delay, nil
+}
+
+func respondWithLoginThrottled(w http.ResponseWriter, wait time.Duration) {
+	respondWithThrottled(w, wait, "Too many failed login attempts, try again later")
+}
+
+func respondWithThrottled(w http.ResponseWriter, wait time.Duration, msg string) {
+	seconds := int(wait.Round(time.Second).Seconds())
+	w.Header().Set("Retry-After", strconv.Itoa(max(seconds, 1)))
+	respondWithError(w, http.StatusTooManyRequests, msg, nil)
+}
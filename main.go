@@ -2,11 +2,23 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
+	"net/netip"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/mailer"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/scanner"
 
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
@@ -16,7 +28,7 @@ import (
 
 type apiConfig struct {
 	db               database.Client
-	jwtSecret        string
+	jwtKeys          *auth.KeySet
 	platform         string
 	filepathRoot     string
 	assetsRoot       string
@@ -25,11 +37,47 @@ type apiConfig struct {
 	s3CfDistribution string
 	port             string
 	s3Client         *s3.Client
+	oidc             *oidcClient
+	mailer           mailer.Mailer
+	scanner          scanner.Scanner
+	// rateLimits holds the API's rate limit buckets; nil disables limiting.
+	rateLimits  rateLimitStore
+	appBaseURL  string
+	adminAPIKey string
+	// metricsToken, if set, is the bearer token /metrics requires.
+	metricsToken string
+	// trustedProxies are the load balancers and proxies whose
+	// X-Forwarded-For headers are believed when working out client IPs.
+	trustedProxies []netip.Prefix
+	// videosRoot is where videos are stored when VIDEO_STORAGE=local. They
+	// are served by the stream endpoint, never from /assets/.
+	videosRoot string
+	// storageQuota is how many bytes of media each user may store, and
+	// maxVideosPerUser how many videos they may upload. Zero means no limit.
+	storageQuota     int64
+	maxVideosPerUser int
+	// requireEmailVerification blocks password login until the user has
+	// verified their email address.
+	requireEmailVerification bool
+	// readyzCache holds the last readiness result; nil runs the checks for
+	// every probe.
+	readyzCache *healthCache
 }
 
 func main() {
 	godotenv.Load(".env")
 
+	logger, err := newLogger(os.Getenv("LOG_FORMAT"), os.Getenv("LOG_LEVEL"))
+	if err != nil {
+		log.Fatalf("Couldn't configure logging: %v", err)
+	}
+	slog.SetDefault(logger)
+
+	shutdownTracing, err := setupTracing(context.Background(), os.Getenv("OTEL_TRACES_EXPORTER"))
+	if err != nil {
+		log.Fatalf("Couldn't configure tracing: %v", err)
+	}
+
 	pathToDB := os.Getenv("DB_PATH")
 	if pathToDB == "" {
 		log.Fatal("DB_URL must be set")
@@ -40,9 +88,13 @@ func main() {
 		log.Fatalf("Couldn't connect to database: %v", err)
 	}
 
-	jwtSecret := os.Getenv("JWT_SECRET")
-	if jwtSecret == "" {
-		log.Fatal("JWT_SECRET environment variable is not set")
+	jwtKeys, err := loadJWTKeys(
+		os.Getenv("JWT_SECRET"),
+		os.Getenv("JWT_KEYS_DIR"),
+		os.Getenv("JWT_ACTIVE_KEY_ID"),
+	)
+	if err != nil {
+		log.Fatalf("Couldn't load JWT signing keys: %v", err)
 	}
 
 	platform := os.Getenv("PLATFORM")
@@ -60,19 +112,30 @@ func main() {
 		log.Fatal("ASSETS_ROOT environment variable is not set")
 	}
 
-	s3Bucket := os.Getenv("S3_BUCKET")
-	if s3Bucket == "" {
-		log.Fatal("S3_BUCKET environment variable is not set")
-	}
+	var s3Bucket, s3Region, s3CfDistribution, videosRoot string
+	switch videoStorage := os.Getenv("VIDEO_STORAGE"); videoStorage {
+	case "", "s3":
+		s3Bucket = os.Getenv("S3_BUCKET")
+		if s3Bucket == "" {
+			log.Fatal("S3_BUCKET environment variable is not set")
+		}
 
-	s3Region := os.Getenv("S3_REGION")
-	if s3Region == "" {
-		log.Fatal("S3_REGION environment variable is not set")
-	}
+		s3Region = os.Getenv("S3_REGION")
+		if s3Region == "" {
+			log.Fatal("S3_REGION environment variable is not set")
+		}
 
-	s3CfDistribution := os.Getenv("S3_CF_DISTRO")
-	if s3CfDistribution == "" {
-		log.Fatal("S3_CF_DISTRO environment variable is not set")
+		s3CfDistribution = os.Getenv("S3_CF_DISTRO")
+		if s3CfDistribution == "" {
+			log.Fatal("S3_CF_DISTRO environment variable is not set")
+		}
+	case "local":
+		videosRoot = os.Getenv("VIDEOS_ROOT")
+		if videosRoot == "" {
+			log.Fatal("VIDEOS_ROOT environment variable is not set")
+		}
+	default:
+		log.Fatalf("Unknown VIDEO_STORAGE %q, expected s3 or local", videoStorage)
 	}
 
 	port := os.Getenv("PORT")
@@ -80,16 +143,105 @@ func main() {
 		log.Fatal("PORT environment variable is not set")
 	}
 
-	awsCfg, err := config.LoadDefaultConfig(context.Background(), config.WithRegion(s3Region))
+	mailFrom := os.Getenv("MAIL_FROM")
+	if mailFrom == "" {
+		mailFrom = "Tubely <no-reply@tubely.local>"
+	}
+
+	var mailSender mailer.Mailer
+	switch mailerKind := os.Getenv("MAILER"); mailerKind {
+	case "", "log":
+		mailSender = mailer.LogMailer{From: mailFrom}
+	case "file":
+		mailDir := os.Getenv("MAIL_DIR")
+		if mailDir == "" {
+			log.Fatal("MAIL_DIR environment variable is not set")
+		}
+		mailSender = mailer.FileMailer{Dir: mailDir, From: mailFrom}
+	case "smtp":
+		smtpAddr := os.Getenv("SMTP_ADDR")
+		if smtpAddr == "" {
+			log.Fatal("SMTP_ADDR environment variable is not set")
+		}
+		mailSender = mailer.SMTPMailer{
+			Addr:     smtpAddr,
+			From:     mailFrom,
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+		}
+	default:
+		log.Fatalf("Unknown MAILER %q, expected log, file or smtp", mailerKind)
+	}
+
+	storageQuotaMB, err := intFromEnv("USER_STORAGE_QUOTA_MB")
+	if err != nil {
+		log.Fatal(err)
+	}
+	maxVideosPerUser, err := intFromEnv("USER_MAX_VIDEOS")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var uploadScanner scanner.Scanner
+	switch scannerKind := os.Getenv("UPLOAD_SCANNER"); scannerKind {
+	case "", "none":
+		uploadScanner = scanner.NopScanner{}
+	case "clamd":
+		clamdAddr := os.Getenv("CLAMD_ADDR")
+		if clamdAddr == "" {
+			log.Fatal("CLAMD_ADDR environment variable is not set")
+		}
+		network := "tcp"
+		if strings.HasPrefix(clamdAddr, "/") {
+			network = "unix"
+		}
+		uploadScanner = scanner.ClamdScanner{Network: network, Address: clamdAddr}
+	default:
+		log.Fatalf("Unknown UPLOAD_SCANNER %q, expected none or clamd", scannerKind)
+	}
+
+	var rateLimits rateLimitStore
+	switch storeKind := os.Getenv("RATE_LIMIT_STORE"); storeKind {
+	case "", "memory":
+		rateLimits = newMemoryRateLimitStore()
+	case "sql":
+		rateLimits = newSQLRateLimitStore(db)
+	case "none":
+	default:
+		log.Fatalf("Unknown RATE_LIMIT_STORE %q, expected memory, sql or none", storeKind)
+	}
+
+	trustedProxies, err := parseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
 	if err != nil {
-		log.Fatalf("Couldn't load AWS configuration: %v", err)
+		log.Fatal(err)
 	}
 
-	s3Client := s3.NewFromConfig(awsCfg)
+	var s3Client *s3.Client
+	if videosRoot == "" {
+		awsCfg, err := config.LoadDefaultConfig(context.Background(), config.WithRegion(s3Region))
+		if err != nil {
+			log.Fatalf("Couldn't load AWS configuration: %v", err)
+		}
+		s3Client = s3.NewFromConfig(awsCfg)
+	}
+
+	var oidcProvider *oidcClient
+	if issuerURL := os.Getenv("OIDC_ISSUER_URL"); issuerURL != "" {
+		oidcProvider, err = newOIDCClient(
+			context.Background(),
+			issuerURL,
+			os.Getenv("OIDC_CLIENT_ID"),
+			os.Getenv("OIDC_CLIENT_SECRET"),
+			os.Getenv("OIDC_REDIRECT_URL"),
+		)
+		if err != nil {
+			log.Fatalf("Couldn't configure OIDC login: %v", err)
+		}
+	}
 
 	cfg := apiConfig{
 		db:               db,
-		jwtSecret:        jwtSecret,
+		jwtKeys:          jwtKeys,
 		platform:         platform,
 		filepathRoot:     filepathRoot,
 		assetsRoot:       assetsRoot,
@@ -98,6 +250,20 @@ func main() {
 		s3CfDistribution: s3CfDistribution,
 		port:             port,
 		s3Client:         s3Client,
+		videosRoot:       videosRoot,
+		storageQuota:     int64(storageQuotaMB) << 20,
+		maxVideosPerUser: maxVideosPerUser,
+		oidc:             oidcProvider,
+		mailer:           mailSender,
+		scanner:          uploadScanner,
+		rateLimits:       rateLimits,
+		appBaseURL:       strings.TrimRight(os.Getenv("APP_BASE_URL"), "/"),
+		adminAPIKey:      os.Getenv("ADMIN_API_KEY"),
+		metricsToken:     os.Getenv("METRICS_TOKEN"),
+		trustedProxies:   trustedProxies,
+		readyzCache:      newHealthCache(readyzCacheTTL),
+
+		requireEmailVerification: os.Getenv("REQUIRE_EMAIL_VERIFICATION") == "true",
 	}
 
 	err = cfg.ensureAssetsDir()
@@ -106,32 +272,173 @@ func main() {
 	}
 
 	mux := http.NewServeMux()
-	appHandler := http.StripPrefix("/app", http.FileServer(http.Dir(filepathRoot)))
+	appHandler := staticFileHandler("/app", filepathRoot, func(string) cachePolicy {
+		return revalidateCachePolicy
+	})
 	mux.Handle("/app/", appHandler)
 
-	assetsHandler := http.StripPrefix("/assets", http.FileServer(http.Dir(assetsRoot)))
-	mux.Handle("/assets/", noCacheMiddleware(assetsHandler))
+	assetsHandler := staticFileHandler("/assets", assetsRoot, assetCachePolicy)
+	mux.Handle("/assets/", assetsHandler)
+
+	mux.Handle("GET /.well-known/jwks.json", cacheMiddleware(jwksCachePolicy, http.HandlerFunc(cfg.handlerJWKS)))
 
 	mux.HandleFunc("POST /api/login", cfg.handlerLogin)
+	mux.HandleFunc("POST /api/login/mfa", cfg.handlerLoginMFA)
+	mux.HandleFunc("GET /api/oidc/login", cfg.handlerOIDCLogin)
+	mux.HandleFunc("GET /api/oidc/callback", cfg.handlerOIDCCallback)
 	mux.HandleFunc("POST /api/refresh", cfg.handlerRefresh)
 	mux.HandleFunc("POST /api/revoke", cfg.handlerRevoke)
 
+	mux.HandleFunc("POST /api/mfa/totp/enroll", cfg.handlerTOTPEnroll)
+	mux.HandleFunc("POST /api/mfa/totp/confirm", cfg.handlerTOTPConfirm)
+	mux.HandleFunc("POST /api/mfa/totp/disable", cfg.handlerTOTPDisable)
+
+	mux.HandleFunc("GET /api/sessions", cfg.handlerSessionsList)
+	mux.HandleFunc("DELETE /api/sessions/{sessionID}", cfg.handlerSessionRevoke)
+	mux.HandleFunc("DELETE /api/sessions", cfg.handlerSessionsRevokeAll)
+
 	mux.HandleFunc("POST /api/users", cfg.handlerUsersCreate)
+	mux.HandleFunc("GET /api/users/me", cfg.handlerUsersMeGet)
+	mux.HandleFunc("PATCH /api/users/me", cfg.handlerUsersMeUpdate)
+	mux.HandleFunc("DELETE /api/users/me", cfg.handlerUsersMeDelete)
+	mux.HandleFunc("GET /api/users/me/export", cfg.handlerUsersMeExport)
+	mux.Handle("GET /api/users/me/usage", cacheMiddleware(privateRevalidateCachePolicy, http.HandlerFunc(cfg.handlerUsersMeUsage)))
+	mux.HandleFunc("POST /api/users/me/avatar", cfg.handlerUsersMeAvatarUpload)
+	mux.HandleFunc("DELETE /api/users/me/avatar", cfg.handlerUsersMeAvatarDelete)
+	mux.HandleFunc("POST /api/users/me/password", cfg.handlerUsersMePasswordChange)
+	mux.HandleFunc("POST /api/users/me/email", cfg.handlerUsersMeEmailChange)
+	mux.HandleFunc("POST /api/users/me/email/confirm", cfg.handlerUsersMeEmailConfirm)
+	mux.HandleFunc("POST /api/users/verify_email", cfg.handlerVerifyEmailRequest)
+	mux.HandleFunc("POST /api/users/verify_email/confirm", cfg.handlerVerifyEmailConfirm)
+	mux.HandleFunc("POST /api/users/password_reset", cfg.handlerPasswordResetRequest)
+	mux.HandleFunc("POST /api/users/password_reset/confirm", cfg.handlerPasswordResetConfirm)
 
 	mux.HandleFunc("POST /api/videos", cfg.handlerVideoMetaCreate)
 	mux.HandleFunc("POST /api/thumbnail_upload/{videoID}", cfg.handlerUploadThumbnail)
 	mux.HandleFunc("POST /api/video_upload/{videoID}", cfg.handlerUploadVideo)
-	mux.HandleFunc("GET /api/videos", cfg.handlerVideosRetrieve)
-	mux.HandleFunc("GET /api/videos/{videoID}", cfg.handlerVideoGet)
+	mux.Handle("GET /api/videos", cacheMiddleware(privateRevalidateCachePolicy, http.HandlerFunc(cfg.handlerVideosRetrieve)))
+	mux.Handle("GET /api/videos/public", cacheMiddleware(shortCachePolicy, http.HandlerFunc(cfg.handlerVideosPublic)))
+	mux.HandleFunc("GET /api/videos/shared", cfg.handlerVideosShared)
+	mux.Handle("GET /api/videos/{videoID}", cacheMiddleware(privateRevalidateCachePolicy, http.HandlerFunc(cfg.handlerVideoGet)))
+	mux.HandleFunc("GET /api/videos/{videoID}/playback", cfg.handlerVideoPlayback)
+	mux.HandleFunc("GET /api/videos/{videoID}/stream/{key...}", cfg.handlerVideoStream)
+	mux.HandleFunc("PATCH /api/videos/{videoID}", cfg.handlerVideoMetaUpdate)
+	mux.HandleFunc("GET /api/videos/{videoID}/shares", cfg.handlerVideoSharesList)
+	mux.HandleFunc("POST /api/videos/{videoID}/shares", cfg.handlerVideoShareCreate)
+	mux.HandleFunc("DELETE /api/videos/{videoID}/shares/{userID}", cfg.handlerVideoShareDelete)
+	mux.HandleFunc("PUT /api/videos/{videoID}/tags", cfg.handlerVideoTagsSet)
+	mux.HandleFunc("GET /api/videos/{videoID}/share_links", cfg.handlerShareLinksList)
+	mux.HandleFunc("POST /api/videos/{videoID}/share_links", cfg.handlerShareLinkCreate)
+	mux.HandleFunc("DELETE /api/videos/{videoID}/share_links/{linkID}", cfg.handlerShareLinkRevoke)
+	mux.HandleFunc("POST /api/share_links/{token}", cfg.handlerShareLinkResolve)
 	mux.HandleFunc("DELETE /api/videos/{videoID}", cfg.handlerVideoMetaDelete)
 
+	mux.HandleFunc("GET /api/tags", cfg.handlerTagsRetrieve)
+	mux.HandleFunc("GET /api/tags/autocomplete", cfg.handlerTagsAutocomplete)
+
+	mux.HandleFunc("POST /api/playlists", cfg.handlerPlaylistCreate)
+	mux.HandleFunc("GET /api/playlists", cfg.handlerPlaylistsRetrieve)
+	mux.HandleFunc("GET /api/playlists/{playlistID}", cfg.handlerPlaylistGet)
+	mux.HandleFunc("PATCH /api/playlists/{playlistID}", cfg.handlerPlaylistUpdate)
+	mux.HandleFunc("DELETE /api/playlists/{playlistID}", cfg.handlerPlaylistDelete)
+	mux.HandleFunc("POST /api/playlists/{playlistID}/items", cfg.handlerPlaylistItemAdd)
+	mux.HandleFunc("PUT /api/playlists/{playlistID}/items", cfg.handlerPlaylistReorder)
+	mux.HandleFunc("DELETE /api/playlists/{playlistID}/items/{videoID}", cfg.handlerPlaylistItemRemove)
+
+	mux.HandleFunc("POST /api/workspaces", cfg.handlerWorkspaceCreate)
+	mux.HandleFunc("GET /api/workspaces", cfg.handlerWorkspacesRetrieve)
+	mux.HandleFunc("GET /api/workspaces/{workspaceID}", cfg.handlerWorkspaceGet)
+	mux.HandleFunc("PATCH /api/workspaces/{workspaceID}", cfg.handlerWorkspaceUpdate)
+	mux.HandleFunc("DELETE /api/workspaces/{workspaceID}", cfg.handlerWorkspaceDelete)
+	mux.HandleFunc("GET /api/workspaces/{workspaceID}/videos", cfg.handlerWorkspaceVideos)
+	mux.HandleFunc("POST /api/workspaces/{workspaceID}/members", cfg.handlerWorkspaceMemberAdd)
+	mux.HandleFunc("PATCH /api/workspaces/{workspaceID}/members/{userID}", cfg.handlerWorkspaceMemberUpdate)
+	mux.HandleFunc("DELETE /api/workspaces/{workspaceID}/members/{userID}", cfg.handlerWorkspaceMemberRemove)
+
+	mux.Handle("GET /metrics", cacheMiddleware(noStoreCachePolicy, http.HandlerFunc(cfg.handlerMetrics)))
+	mux.Handle("GET /healthz", cacheMiddleware(noStoreCachePolicy, http.HandlerFunc(cfg.handlerHealthz)))
+	mux.Handle("GET /readyz", cacheMiddleware(noStoreCachePolicy, http.HandlerFunc(cfg.handlerReadyz)))
+
 	mux.HandleFunc("POST /admin/reset", cfg.handlerReset)
+	mux.HandleFunc("POST /admin/login_lockouts/unlock", cfg.handlerAdminUnlockLogin)
+	mux.HandleFunc("GET /admin/audit_events", cfg.handlerAdminAuditEvents)
 
 	srv := &http.Server{
 		Addr:    ":" + port,
-		Handler: mux,
+		Handler: cfg.clientIPMiddleware(tracingMiddleware(cfg.requestLoggingMiddleware(cfg.rateLimitMiddleware(mux)))),
 	}
 
-	log.Printf("Serving on: http://localhost:%s/app/\n", port)
-	log.Fatal(srv.ListenAndServe())
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		slog.Info("Serving", "url", fmt.Sprintf("http://localhost:%s/app/", port))
+		if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+	<-ctx.Done()
+	stop()
+
+	// Requests in flight get to finish, then the spans they produced are
+	// flushed.
+	slog.Info("Shutting down")
+	serverCtx, cancelServer := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancelServer()
+	if err := srv.Shutdown(serverCtx); err != nil {
+		slog.Error("Couldn't shut down the server cleanly", "error", err)
+	}
+	tracingCtx, cancelTracing := context.WithTimeout(context.Background(), tracingShutdownTimeout)
+	defer cancelTracing()
+	if err := shutdownTracing(tracingCtx); err != nil {
+		slog.Error("Couldn't flush traces", "error", err)
+	}
+}
+
+const (
+	// shutdownTimeout bounds how long requests in flight get to finish
+	// when the server is told to stop.
+	shutdownTimeout = 30 * time.Second
+	// tracingShutdownTimeout bounds exporting the spans still batched after
+	// that.
+	tracingShutdownTimeout = 5 * time.Second
+)
+
+// intFromEnv reads an optional non-negative integer setting, which is 0 when
+// unset.
+func intFromEnv(name string) (int, error) {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative integer, got %q", name, raw)
+	}
+	return n, nil
+}
+
+// newLogger builds the logger everything logs through: text or JSON lines on
+// stderr, at the given minimum level.
+func newLogger(format, level string) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{}
+	switch level {
+	case "", "info":
+		opts.Level = slog.LevelInfo
+	case "debug":
+		opts.Level = slog.LevelDebug
+	case "warn":
+		opts.Level = slog.LevelWarn
+	case "error":
+		opts.Level = slog.LevelError
+	default:
+		return nil, fmt.Errorf("unknown LOG_LEVEL %q, expected debug, info, warn or error", level)
+	}
+
+	switch format {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(os.Stderr, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts)), nil
+	}
+	return nil, fmt.Errorf("unknown LOG_FORMAT %q, expected text or json", format)
 }
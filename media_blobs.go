@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// Uploads are deduplicated by the SHA-256 of their bytes: the first upload of
+// some content is processed and stored as a blob, and later uploads of the
+// same content just take a reference to it. Blobs are deleted once no video
+// refers to them.
+
+func uploadHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// removeOrphanedBlobs deletes the media of blobs no video refers to any
+// more. A blob whose media couldn't be deleted is kept, so it's retried the
+// next time.
+func (cfg *apiConfig) removeOrphanedBlobs(ctx context.Context) error {
+	db := cfg.requestDB(ctx)
+	blobs, err := db.GetOrphanedBlobs()
+	if err != nil {
+		return err
+	}
+	for _, blob := range blobs {
+		if err := cfg.removeBlobMedia(ctx, blob); err != nil {
+			return fmt.Errorf("couldn't delete %s blob %s: %w", blob.Kind, blob.Hash, err)
+		}
+		if err := db.DeleteBlob(blob); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cleanUpBlobs is removeOrphanedBlobs for handlers that have already done
+// their job, where a failure only means the files are deleted later. It
+// carries on if the client disconnects.
+func (cfg *apiConfig) cleanUpBlobs(ctx context.Context) {
+	ctx = context.WithoutCancel(ctx)
+	if err := cfg.removeOrphanedBlobs(ctx); err != nil {
+		loggerFrom(ctx).Error("Couldn't remove orphaned blobs", "error", err)
+	}
+}
+
+func (cfg *apiConfig) removeBlobMedia(ctx context.Context, blob database.Blob) error {
+	switch blob.Kind {
+	case database.BlobKindVideo:
+		return cfg.deleteStoredVideo(ctx, blob.Key)
+	case database.BlobKindThumbnail:
+		for _, assetURL := range renditionURLs(blob.Key, blob.Srcset) {
+			if err := cfg.removeAsset(assetURL); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown blob kind %q", blob.Kind)
+}
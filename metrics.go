@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Metrics are registered with the default Prometheus registry, which also
+// carries the Go runtime and process collectors, and served at /metrics.
+var (
+	httpRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tubely_http_requests_total",
+		Help: "HTTP requests handled, by route pattern and status.",
+	}, []string{"method", "route", "status"})
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tubely_http_request_duration_seconds",
+		Help:    "Time taken to handle HTTP requests, by route pattern.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	uploadBytesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tubely_upload_bytes_total",
+		Help: "Bytes of uploaded files received, by kind.",
+	}, []string{"kind"})
+	processingJobs = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tubely_processing_jobs",
+		Help: "Uploads currently being processed, by kind.",
+	}, []string{"kind"})
+
+	mediaCommandDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tubely_media_command_duration_seconds",
+		Help:    "Time taken by ffmpeg and ffprobe runs.",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 12),
+	}, []string{"command"})
+	mediaCommandFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tubely_media_command_failures_total",
+		Help: "ffmpeg and ffprobe runs that failed.",
+	}, []string{"command"})
+
+	s3OperationDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tubely_s3_operation_duration_seconds",
+		Help:    "Time taken by S3 calls, by operation.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 14),
+	}, []string{"operation"})
+	s3OperationErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tubely_s3_operation_errors_total",
+		Help: "S3 calls that failed, by operation.",
+	}, []string{"operation"})
+
+	dbQueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tubely_db_query_duration_seconds",
+		Help:    "Time taken by database statements, by kind of statement.",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+	}, []string{"statement"})
+	dbQueryErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tubely_db_query_errors_total",
+		Help: "Database statements that failed, by kind of statement.",
+	}, []string{"statement"})
+)
+
+func init() {
+	database.SetQueryObserver(func(kind string, duration time.Duration, err error) {
+		dbQueryDuration.WithLabelValues(kind).Observe(duration.Seconds())
+		if err != nil {
+			dbQueryErrors.WithLabelValues(kind).Inc()
+		}
+	})
+}
+
+// observeRequest records a handled request. Requests that didn't match a
+// route share one label, as do unusual methods, so clients can't create new
+// series at will.
+func observeRequest(method, route string, status int, duration time.Duration) {
+	method = metricsMethod(method)
+	if route == "" {
+		route = "unmatched"
+	}
+	httpRequestsTotal.WithLabelValues(method, route, strconv.Itoa(status)).Inc()
+	httpRequestDuration.WithLabelValues(method, route).Observe(duration.Seconds())
+}
+
+// metricsMethod is method if it's one the API uses, or else "other".
+func metricsMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+		http.MethodPatch, http.MethodDelete, http.MethodOptions:
+		return method
+	}
+	return "other"
+}
+
+func observeMediaCommand(command string, duration time.Duration, err error) {
+	mediaCommandDuration.WithLabelValues(command).Observe(duration.Seconds())
+	if err != nil {
+		mediaCommandFailures.WithLabelValues(command).Inc()
+	}
+}
+
+func observeS3Operation(operation string, start time.Time, err error) {
+	s3OperationDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		s3OperationErrors.WithLabelValues(operation).Inc()
+	}
+}
+
+// trackProcessingJob counts an upload as being processed until the returned
+// function is called.
+func trackProcessingJob(kind database.BlobKind) func() {
+	gauge := processingJobs.WithLabelValues(string(kind))
+	gauge.Inc()
+	return gauge.Dec
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/google/uuid"
+	"golang.org/x/oauth2"
+)
+
+var (
+	errOIDCEmailUnverified   = errors.New("an account with this email already exists and the identity provider hasn't verified the email")
+	errOIDCAccountUnverified = errors.New("an account with this email already exists and hasn't verified the email")
+)
+
+// oidcClient holds what's needed to run the OpenID Connect authorization code
+// flow against a single identity provider.
+type oidcClient struct {
+	oauth2   oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+// newOIDCClient discovers the provider's endpoints and signing keys from
+// issuerURL. clientSecret may be empty for public clients, which rely on PKCE
+// alone.
+func newOIDCClient(ctx context.Context, issuerURL, clientID, clientSecret, redirectURL string) (*oidcClient, error) {
+	if clientID == "" || redirectURL == "" {
+		return nil, errors.New("OIDC_CLIENT_ID and OIDC_REDIRECT_URL must be set")
+	}
+
+	provider, err := oidc.NewProvider(ctx, issuerURL)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't discover OIDC provider: %w", err)
+	}
+
+	return &oidcClient{
+		oauth2: oauth2.Config{
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+			RedirectURL:  redirectURL,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       []string{oidc.ScopeOpenID, "email", "profile"},
+		},
+		verifier: provider.Verifier(&oidc.Config{ClientID: clientID}),
+	}, nil
+}
+
+// findOrProvisionOIDCUser returns the user linked to an external identity,
+// linking or creating one on first login. An existing password account is
+// only linked by email when both the provider and the account have verified
+// that email. Otherwise anyone able to register the address at the provider
+// could take the account over, or anyone able to sign up with someone else's
+// address here could share their account once they sign in with SSO.
+func (cfg *apiConfig) findOrProvisionOIDCUser(ctx context.Context, issuer, subject, email string, emailVerified bool) (database.User, error) {
+	user, err := cfg.requestDB(ctx).GetUserByIdentity(issuer, subject)
+	if err != nil {
+		return database.User{}, err
+	}
+	if user != nil {
+		return *user, nil
+	}
+
+	if email == "" {
+		return database.User{}, errors.New("identity provider didn't return an email")
+	}
+
+	existing, err := cfg.requestDB(ctx).GetUserByEmail(email)
+	if err != nil {
+		return database.User{}, err
+	}
+	if existing.ID != uuid.Nil {
+		if !emailVerified {
+			return database.User{}, errOIDCEmailUnverified
+		}
+		if existing.EmailVerifiedAt == nil {
+			return database.User{}, errOIDCAccountUnverified
+		}
+		user = &existing
+	} else {
+		// SSO-only accounts have no password hash, so password login always
+		// fails for them.
+		user, err = cfg.requestDB(ctx).CreateUser(database.CreateUserParams{
+			Email: email,
+		})
+		if err != nil {
+			return database.User{}, err
+		}
+		if emailVerified {
+			if _, err := cfg.requestDB(ctx).MarkEmailVerified(user.ID, email); err != nil {
+				return database.User{}, err
+			}
+			user, err = cfg.requestDB(ctx).GetUser(user.ID)
+			if err != nil {
+				return database.User{}, err
+			}
+		} else {
+			// The provider doesn't vouch for the address, so it goes through
+			// the same verification as a password signup.
+			userID := user.ID
+			sendEmailInBackground(ctx, "verification", func(ctx context.Context) error {
+				return cfg.sendVerificationEmail(ctx, userID, email)
+			})
+		}
+	}
+
+	err = cfg.requestDB(ctx).CreateIdentity(database.CreateIdentityParams{
+		Issuer:  issuer,
+		Subject: subject,
+		UserID:  user.ID,
+		Email:   email,
+	})
+	if err != nil {
+		return database.User{}, err
+	}
+	return *user, nil
+}
+
+func randomURLSafeString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
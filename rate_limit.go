@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// rateLimitPolicy is a token bucket: a client can make burst requests at
+// once, and the bucket refills at burst requests per period. A zero burst
+// means the route isn't limited. perIP policies count every request against
+// the client IP, even if it carries an access token.
+type rateLimitPolicy struct {
+	name   string
+	burst  int
+	period time.Duration
+	perIP  bool
+}
+
+var (
+	noRateLimit = rateLimitPolicy{}
+	// authRateLimit covers routes that check secrets, where each request is
+	// a guess worth slowing down. It comes on top of the login throttle.
+	// Tokens are free to anyone who signs up, so they don't buy more guesses.
+	authRateLimit = rateLimitPolicy{name: "auth", burst: 10, period: 10 * time.Minute, perIP: true}
+	// uploadRateLimit covers uploads, which are expensive to process.
+	uploadRateLimit = rateLimitPolicy{name: "upload", burst: 20, period: time.Hour}
+	writeRateLimit  = rateLimitPolicy{name: "write", burst: 60, period: time.Minute}
+	readRateLimit   = rateLimitPolicy{name: "read", burst: 300, period: time.Minute}
+	// publicRateLimit covers reads that work without an account, which a
+	// token mustn't exempt from the limit on anonymous clients.
+	publicRateLimit = rateLimitPolicy{name: "public", burst: 300, period: time.Minute, perIP: true}
+	probeRateLimit  = rateLimitPolicy{name: "probe", burst: 60, period: time.Minute, perIP: true}
+)
+
+// rateLimitRoutes overrides the method-based default policy for routes, by
+// the pattern they're registered with in main.go.
+var rateLimitRoutes = map[string]rateLimitPolicy{
+	"/app/":    noRateLimit,
+	"/assets/": noRateLimit,
+	// Scrapes come from monitoring, and need METRICS_TOKEN if it's set.
+	"GET /metrics": noRateLimit,
+	// Probes are open to anyone, so they're limited like any other
+	// anonymous route, well above what a load balancer sends.
+	"GET /healthz": probeRateLimit,
+	"GET /readyz":  probeRateLimit,
+
+	"POST /api/login":                        authRateLimit,
+	"POST /api/login/mfa":                    authRateLimit,
+	"GET /api/oidc/login":                    authRateLimit,
+	"GET /api/oidc/callback":                 authRateLimit,
+	"POST /api/refresh":                      authRateLimit,
+	"POST /api/users":                        authRateLimit,
+	"POST /api/users/me/password":            authRateLimit,
+	"POST /api/users/me/email/confirm":       authRateLimit,
+	"POST /api/users/verify_email":           authRateLimit,
+	"POST /api/users/verify_email/confirm":   authRateLimit,
+	"POST /api/users/password_reset":         authRateLimit,
+	"POST /api/users/password_reset/confirm": authRateLimit,
+	"POST /api/share_links/{token}":          authRateLimit,
+
+	"GET /.well-known/jwks.json":                publicRateLimit,
+	"GET /api/videos/public":                    publicRateLimit,
+	"GET /api/videos/{videoID}":                 publicRateLimit,
+	"GET /api/videos/{videoID}/playback":        publicRateLimit,
+	"GET /api/videos/{videoID}/stream/{key...}": publicRateLimit,
+	"GET /api/playlists/{playlistID}":           publicRateLimit,
+
+	"POST /api/users/me/avatar":            uploadRateLimit,
+	"POST /api/thumbnail_upload/{videoID}": uploadRateLimit,
+	"POST /api/video_upload/{videoID}":     uploadRateLimit,
+}
+
+func rateLimitPolicyFor(r *http.Request, pattern string) rateLimitPolicy {
+	if policy, ok := rateLimitRoutes[pattern]; ok {
+		return policy
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return readRateLimit
+	}
+	return writeRateLimit
+}
+
+// rate is how many tokens the bucket gains per second.
+func (p rateLimitPolicy) rate() float64 {
+	return float64(p.burst) / p.period.Seconds()
+}
+
+// refill returns how many tokens a bucket holding tokens has after elapsed.
+func (p rateLimitPolicy) refill(tokens float64, elapsed time.Duration) float64 {
+	return math.Min(float64(p.burst), tokens+max(elapsed.Seconds(), 0)*p.rate())
+}
+
+// rateLimitStore keeps token buckets. take refills key's bucket for the time
+// since it was last used and takes a token from it if there's one, returning
+// the tokens left and whether one was taken.
+type rateLimitStore interface {
+	take(ctx context.Context, key string, policy rateLimitPolicy, now time.Time) (tokens float64, allowed bool, err error)
+}
+
+// memoryRateLimitStore keeps buckets in this process, so with several
+// replicas each one enforces the limits separately.
+type memoryRateLimitStore struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	takes   int
+}
+
+type tokenBucket struct {
+	tokens    float64
+	updatedAt time.Time
+	policy    rateLimitPolicy
+}
+
+// memoryRateLimitPruneEvery is how many takes go by between sweeps for full
+// buckets, which are the same as missing ones.
+const memoryRateLimitPruneEvery = 1000
+
+func newMemoryRateLimitStore() *memoryRateLimitStore {
+	return &memoryRateLimitStore{buckets: map[string]*tokenBucket{}}
+}
+
+func (s *memoryRateLimitStore) take(ctx context.Context, key string, policy rateLimitPolicy, now time.Time) (float64, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.takes++
+	if s.takes%memoryRateLimitPruneEvery == 0 {
+		for k, bucket := range s.buckets {
+			if bucket.policy.refill(bucket.tokens, now.Sub(bucket.updatedAt)) >= float64(bucket.policy.burst) {
+				delete(s.buckets, k)
+			}
+		}
+	}
+
+	bucket, ok := s.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(policy.burst), updatedAt: now}
+		s.buckets[key] = bucket
+	}
+	bucket.policy = policy
+	bucket.tokens = policy.refill(bucket.tokens, now.Sub(bucket.updatedAt))
+	if now.After(bucket.updatedAt) {
+		bucket.updatedAt = now
+	}
+	if bucket.tokens < 1 {
+		return bucket.tokens, false, nil
+	}
+	bucket.tokens--
+	return bucket.tokens, true, nil
+}
+
+// sqlRateLimitStore keeps buckets in the database, so replicas sharing it
+// share the limits.
+type sqlRateLimitStore struct {
+	db database.Client
+
+	mu        sync.Mutex
+	lastPrune time.Time
+}
+
+const (
+	// sqlRateLimitPruneInterval is how often idle buckets are deleted.
+	sqlRateLimitPruneInterval = time.Minute
+	// rateLimitIdleTTL is longer than any policy's period, so a bucket idle
+	// for that long has refilled and can be forgotten.
+	rateLimitIdleTTL = 24 * time.Hour
+)
+
+func newSQLRateLimitStore(db database.Client) *sqlRateLimitStore {
+	return &sqlRateLimitStore{db: db}
+}
+
+func (s *sqlRateLimitStore) take(ctx context.Context, key string, policy rateLimitPolicy, now time.Time) (float64, bool, error) {
+	if s.pruneDue(now) {
+		if err := s.db.DeleteIdleRateLimitBuckets(now.Add(-rateLimitIdleTTL)); err != nil {
+			loggerFrom(ctx).Error("Couldn't delete idle rate limit buckets", "error", err)
+		}
+	}
+	return s.db.TakeRateLimitToken(key, float64(policy.burst), policy.rate(), now)
+}
+
+func (s *sqlRateLimitStore) pruneDue(now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.Sub(s.lastPrune) < sqlRateLimitPruneInterval {
+		return false
+	}
+	s.lastPrune = now
+	return true
+}
+
+// rateLimitKey identifies who a request counts against: the user whose
+// access token it carries, or else the client IP. Checking that the token
+// hasn't been revoked would cost a database lookup on every request, and a
+// revoked token is rejected by the handler anyway; the routes where any
+// token would do have perIP policies.
+func (cfg *apiConfig) rateLimitKey(r *http.Request, policy rateLimitPolicy) string {
+	if policy.perIP {
+		return policy.name + ":ip:" + clientIP(r)
+	}
+	if userID, ok := cfg.tokenUserID(r); ok {
+		return policy.name + ":user:" + userID.String()
+	}
+	return policy.name + ":ip:" + clientIP(r)
+}
+
+// rateLimitMiddleware limits requests to the routes in mux according to
+// their policies, and reports the client's standing in RateLimit-* headers.
+// If the store fails the request is let through, since an outage of the
+// limiter shouldn't take the API down with it.
+func (cfg *apiConfig) rateLimitMiddleware(mux *http.ServeMux) http.Handler {
+	if cfg.rateLimits == nil {
+		return mux
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pattern := mux.Handler(r)
+		policy := rateLimitPolicyFor(r, pattern)
+		if policy.burst == 0 {
+			mux.ServeHTTP(w, r)
+			return
+		}
+
+		tokens, allowed, err := cfg.rateLimits.take(r.Context(), cfg.rateLimitKey(r, policy), policy, time.Now())
+		if err != nil {
+			loggerFrom(r.Context()).Error("Couldn't check rate limit", "policy", policy.name, "error", err)
+			mux.ServeHTTP(w, r)
+			return
+		}
+
+		rate := policy.rate()
+		reset := time.Duration((float64(policy.burst) - tokens) / rate * float64(time.Second))
+		w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", policy.burst, int(policy.period.Seconds())))
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(policy.burst))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(int(max(tokens, 0))))
+		w.Header().Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(reset.Seconds()))))
+		if !allowed {
+			wait := time.Duration((1 - tokens) / rate * float64(time.Second))
+			respondWithThrottled(w, wait, "Too many requests, try again later")
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
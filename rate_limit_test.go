@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestRateLimitStores(t *testing.T) {
+	dbClient, err := database.NewClient(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create db client: %v", err)
+	}
+	policy := rateLimitPolicy{name: "test", burst: 3, period: 3 * time.Second}
+	stores := map[string]rateLimitStore{
+		"memory": newMemoryRateLimitStore(),
+		"sql":    newSQLRateLimitStore(dbClient),
+	}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			now := time.Now()
+			take := func(key string, at time.Time) (float64, bool) {
+				tokens, allowed, err := store.take(context.Background(), key, policy, at)
+				if err != nil {
+					t.Fatalf("take failed: %v", err)
+				}
+				return tokens, allowed
+			}
+
+			for i := 0; i < policy.burst; i++ {
+				tokens, allowed := take("a", now)
+				if !allowed || tokens != float64(policy.burst-i-1) {
+					t.Fatalf("take %d: expected allowed with %d left, got %v with %v", i, policy.burst-i-1, allowed, tokens)
+				}
+			}
+			if _, allowed := take("a", now); allowed {
+				t.Fatalf("expected empty bucket to deny")
+			}
+			if _, allowed := take("b", now); !allowed {
+				t.Fatalf("expected other key to have its own bucket")
+			}
+
+			// One token comes back per second.
+			if _, allowed := take("a", now.Add(500*time.Millisecond)); allowed {
+				t.Fatalf("expected no token after half a second")
+			}
+			if _, allowed := take("a", now.Add(1100*time.Millisecond)); !allowed {
+				t.Fatalf("expected a token after a second")
+			}
+			if tokens, _ := take("a", now.Add(time.Hour)); tokens != float64(policy.burst-1) {
+				t.Fatalf("expected refill to stop at the burst, got %v left", tokens)
+			}
+		})
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	dbClient, err := database.NewClient(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create db client: %v", err)
+	}
+	jwtKeys, err := loadJWTKeys("test-secret", "", "")
+	if err != nil {
+		t.Fatalf("failed to load jwt keys: %v", err)
+	}
+	cfg := apiConfig{
+		db:         dbClient,
+		jwtKeys:    jwtKeys,
+		port:       "8091",
+		rateLimits: newMemoryRateLimitStore(),
+	}
+
+	ok := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/login", ok)
+	mux.HandleFunc("POST /api/video_upload/{videoID}", ok)
+	mux.HandleFunc("GET /api/videos", ok)
+	mux.HandleFunc("/assets/", ok)
+	handler := cfg.rateLimitMiddleware(mux)
+
+	send := func(method, path, ip, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.RemoteAddr = ip + ":1234"
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	// Logins are limited per IP.
+	for i := 0; i < authRateLimit.burst; i++ {
+		w := send("POST", "/api/login", "192.0.2.1", "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("login %d: expected 200, got %d", i, w.Code)
+		}
+		if got := w.Header().Get("RateLimit-Limit"); got != strconv.Itoa(authRateLimit.burst) {
+			t.Fatalf("expected RateLimit-Limit %d, got %q", authRateLimit.burst, got)
+		}
+		if got := w.Header().Get("RateLimit-Remaining"); got != strconv.Itoa(authRateLimit.burst-i-1) {
+			t.Fatalf("login %d: expected RateLimit-Remaining %d, got %q", i, authRateLimit.burst-i-1, got)
+		}
+	}
+	w := send("POST", "/api/login", "192.0.2.1", "")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 once the burst is used, got %d", w.Code)
+	}
+	if retry, err := strconv.Atoi(w.Header().Get("Retry-After")); err != nil || retry < 1 {
+		t.Fatalf("expected a Retry-After in seconds, got %q", w.Header().Get("Retry-After"))
+	}
+	if got := w.Header().Get("RateLimit-Remaining"); got != "0" {
+		t.Fatalf("expected RateLimit-Remaining 0, got %q", got)
+	}
+	if w := send("POST", "/api/login", "192.0.2.2", ""); w.Code != http.StatusOK {
+		t.Fatalf("expected another IP to be allowed, got %d", w.Code)
+	}
+	if w := send("GET", "/api/videos", "192.0.2.1", ""); w.Code != http.StatusOK {
+		t.Fatalf("expected reads to have their own bucket, got %d", w.Code)
+	}
+	w = send("GET", "/assets/thumb.png", "192.0.2.1", "")
+	if w.Code != http.StatusOK || w.Header().Get("RateLimit-Limit") != "" {
+		t.Fatalf("expected static files not to be limited, got %d with limit %q", w.Code, w.Header().Get("RateLimit-Limit"))
+	}
+
+	// Signed-in users are limited per user, whatever their IP.
+	var tokens []string
+	for _, email := range []string{"first@example.com", "second@example.com"} {
+		user, err := dbClient.CreateUser(database.CreateUserParams{Email: email, Password: "unused"})
+		if err != nil {
+			t.Fatalf("failed to create user: %v", err)
+		}
+		token, err := jwtKeys.MakeJWT(user.ID, user.TokenVersion, time.Hour)
+		if err != nil {
+			t.Fatalf("failed to create jwt: %v", err)
+		}
+		tokens = append(tokens, token)
+	}
+	for i := 0; i < uploadRateLimit.burst; i++ {
+		ip := "198.51.100." + strconv.Itoa(i+1)
+		if w := send("POST", "/api/video_upload/x", ip, tokens[0]); w.Code != http.StatusOK {
+			t.Fatalf("upload %d: expected 200, got %d", i, w.Code)
+		}
+	}
+	if w := send("POST", "/api/video_upload/x", "198.51.100.200", tokens[0]); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected user to be limited from a new IP, got %d", w.Code)
+	}
+	if w := send("POST", "/api/video_upload/x", "198.51.100.1", tokens[1]); w.Code != http.StatusOK {
+		t.Fatalf("expected another user on the same IP to be allowed, got %d", w.Code)
+	}
+
+	// Tokens don't get a client more guesses: every account on an IP shares
+	// its auth bucket.
+	for i := 0; i < authRateLimit.burst; i++ {
+		if w := send("POST", "/api/login", "203.0.113.1", tokens[i%2]); w.Code != http.StatusOK {
+			t.Fatalf("signed-in login %d: expected 200, got %d", i, w.Code)
+		}
+	}
+	for _, token := range tokens {
+		if w := send("POST", "/api/login", "203.0.113.1", token); w.Code != http.StatusTooManyRequests {
+			t.Fatalf("expected a new token to share the IP's auth bucket, got %d", w.Code)
+		}
+	}
+}
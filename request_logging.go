@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bounds request IDs taken from clients, which end up in
+// every log line for the request.
+const maxRequestIDLength = 128
+
+// unloggedPathRoutes are routes whose paths carry secrets, so only their
+// pattern is logged.
+var unloggedPathRoutes = map[string]bool{
+	"POST /api/share_links/{token}": true,
+}
+
+// probeRoutes are polled by load balancers every few seconds, so requests
+// to them are only logged at debug level unless they fail.
+var probeRoutes = map[string]bool{
+	"GET /healthz": true,
+	"GET /readyz":  true,
+}
+
+type loggerContextKey struct{}
+
+// loggerFrom returns the logger for the request ctx belongs to, which tags
+// everything with its request ID, or the default logger outside a request.
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerContextKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// responseLogger is loggerFrom for code that only has the ResponseWriter,
+// like respondWithError. It finds the logger by unwrapping w down to the
+// writer requestLoggingMiddleware gave the handler.
+func responseLogger(w http.ResponseWriter) *slog.Logger {
+	for {
+		switch rw := w.(type) {
+		case *loggingResponseWriter:
+			return rw.logger
+		case *bufferedResponseWriter:
+			w = rw.parent
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = rw.Unwrap()
+		default:
+			return slog.Default()
+		}
+	}
+}
+
+// validRequestID reports whether a client-supplied request ID is safe to
+// log and echo back: short and made of characters IDs are usually made of.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// loggingResponseWriter records what was sent so the request can be logged
+// once it's handled.
+type loggingResponseWriter struct {
+	http.ResponseWriter
+	logger      *slog.Logger
+	status      int
+	bytes       int64
+	wroteHeader bool
+}
+
+func (w *loggingResponseWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *loggingResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *loggingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// requestLoggingMiddleware gives every request an ID, taken from its
+// X-Request-ID header when the client or a proxy sent a usable one, and
+// echoes it in the response. Everything logged while handling the request
+// carries the ID, and once it's handled the request is logged and counted in
+// the HTTP metrics.
+func (cfg *apiConfig) requestLoggingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		requestID := r.Header.Get(requestIDHeader)
+		if !validRequestID(requestID) {
+			requestID = uuid.NewString()
+		}
+		r.Header.Set(requestIDHeader, requestID)
+		w.Header().Set(requestIDHeader, requestID)
+
+		logger := slog.Default().With("request_id", requestID)
+		if sc := trace.SpanContextFromContext(r.Context()); sc.IsValid() {
+			logger = logger.With("trace_id", sc.TraceID().String())
+		}
+		lw := &loggingResponseWriter{ResponseWriter: w, logger: logger, status: http.StatusOK}
+		r = r.WithContext(context.WithValue(r.Context(), loggerContextKey{}, logger))
+		next.ServeHTTP(lw, r)
+
+		duration := time.Since(start)
+		observeRequest(r.Method, r.Pattern, lw.status, duration)
+		annotateRequestSpan(r.Context(), r.Pattern, lw.status)
+
+		attrs := []any{
+			"method", r.Method,
+			"route", r.Pattern,
+		}
+		if !unloggedPathRoutes[r.Pattern] {
+			attrs = append(attrs, "path", r.URL.Path)
+		}
+		attrs = append(attrs,
+			"status", lw.status,
+			"bytes", lw.bytes,
+			"duration", duration,
+			"ip", clientIP(r),
+		)
+		if userID, ok := cfg.tokenUserID(r); ok {
+			attrs = append(attrs, "user_id", userID)
+		}
+		level := slog.LevelInfo
+		switch {
+		case lw.status >= 500:
+			level = slog.LevelError
+		case probeRoutes[r.Pattern]:
+			level = slog.LevelDebug
+		}
+		logger.Log(r.Context(), level, "Handled request", attrs...)
+	})
+}
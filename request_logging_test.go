@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestRequestLoggingMiddleware(t *testing.T) {
+	var logs bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&logs, nil)))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+
+	jwtKeys, err := loadJWTKeys("test-secret", "", "")
+	if err != nil {
+		t.Fatalf("failed to load jwt keys: %v", err)
+	}
+	cfg := apiConfig{jwtKeys: jwtKeys, port: "8091"}
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /api/videos/{videoID}", cacheMiddleware(privateRevalidateCachePolicy, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", errors.New("database is locked"))
+	})))
+	mux.HandleFunc("POST /api/share_links/{token}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	handler := cfg.requestLoggingMiddleware(mux)
+
+	readLogs := func() []map[string]any {
+		var entries []map[string]any
+		for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+			var entry map[string]any
+			if err := json.Unmarshal([]byte(line), &entry); err != nil {
+				t.Fatalf("failed to decode log line %q: %v", line, err)
+			}
+			entries = append(entries, entry)
+		}
+		logs.Reset()
+		return entries
+	}
+
+	userID := uuid.New()
+	token, err := jwtKeys.MakeJWT(userID, 0, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create jwt: %v", err)
+	}
+	req := httptest.NewRequest("GET", "/api/videos/123", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	requestID := w.Header().Get(requestIDHeader)
+	if _, err := uuid.Parse(requestID); err != nil {
+		t.Fatalf("expected a generated request ID, got %q", requestID)
+	}
+	entries := readLogs()
+	if len(entries) != 2 {
+		t.Fatalf("expected an error and a request log line, got %v", entries)
+	}
+	for _, entry := range entries {
+		if entry["request_id"] != requestID {
+			t.Fatalf("expected request ID %q on every line, got %v", requestID, entry)
+		}
+	}
+	if entries[0]["error"] != "database is locked" || entries[0]["level"] != "ERROR" {
+		t.Fatalf("expected the handler's error to be logged, got %v", entries[0])
+	}
+	access := entries[1]
+	if access["route"] != "GET /api/videos/{videoID}" || access["path"] != "/api/videos/123" {
+		t.Fatalf("expected route and path to be logged, got %v", access)
+	}
+	if access["status"] != float64(http.StatusInternalServerError) || access["user_id"] != userID.String() {
+		t.Fatalf("expected status and user to be logged, got %v", access)
+	}
+
+	// A usable ID from upstream is kept; paths carrying secrets aren't logged.
+	req = httptest.NewRequest("POST", "/api/share_links/secret-token", nil)
+	req.Header.Set(requestIDHeader, "proxy-abc.123")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if got := w.Header().Get(requestIDHeader); got != "proxy-abc.123" {
+		t.Fatalf("expected upstream request ID to be kept, got %q", got)
+	}
+	if strings.Contains(logs.String(), "secret-token") {
+		t.Fatalf("expected share link token not to be logged, got %s", logs.String())
+	}
+	entries = readLogs()
+	if len(entries) != 1 || entries[0]["request_id"] != "proxy-abc.123" {
+		t.Fatalf("expected one line with the upstream request ID, got %v", entries)
+	}
+	if entries[0]["route"] != "POST /api/share_links/{token}" || entries[0]["path"] != nil {
+		t.Fatalf("expected only the share link route to be logged, got %v", entries[0])
+	}
+
+	req = httptest.NewRequest("POST", "/api/share_links/x", nil)
+	req.Header.Set(requestIDHeader, "bad id\n")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if got := w.Header().Get(requestIDHeader); got == "bad id\n" || got == "" {
+		t.Fatalf("expected unusable request ID to be replaced, got %q", got)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	loginAccessTokenTTL   = time.Hour * 24 * 30
+	refreshAccessTokenTTL = time.Hour
+	refreshTokenTTL       = time.Hour * 24 * 60
+)
+
+var errTokenRevoked = errors.New("token has been revoked")
+
+// validateAccessToken validates the JWT and checks that it was issued at the
+// user's current token version, so "log out everywhere" takes effect
+// immediately rather than when outstanding tokens expire.
+func (cfg *apiConfig) validateAccessToken(ctx context.Context, token string) (uuid.UUID, error) {
+	claims, err := cfg.jwtKeys.ParseJWT(token)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	userID, err := claims.UserID()
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	user, err := cfg.requestDB(ctx).GetUser(userID)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	if user == nil || user.TokenVersion != claims.TokenVersion {
+		return uuid.Nil, errTokenRevoked
+	}
+	return userID, nil
+}
+
+// viewerID returns the user making the request, or uuid.Nil if it's
+// anonymous. A token that's present but invalid is an error rather than being
+// treated as anonymous, so clients notice that their session has ended.
+func (cfg *apiConfig) viewerID(r *http.Request) (uuid.UUID, error) {
+	if r.Header.Get("Authorization") == "" {
+		return uuid.Nil, nil
+	}
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	return cfg.validateAccessToken(r.Context(), token)
+}
+
+// tokenUserID returns the user the request's access token was issued to. It
+// checks the token's signature but not whether it's been revoked, so it's
+// only for attributing requests in logs and rate limits, never for deciding
+// what they may do.
+func (cfg *apiConfig) tokenUserID(r *http.Request) (uuid.UUID, bool) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		return uuid.Nil, false
+	}
+	claims, err := cfg.jwtKeys.ParseJWT(token)
+	if err != nil {
+		return uuid.Nil, false
+	}
+	userID, err := claims.UserID()
+	if err != nil {
+		return uuid.Nil, false
+	}
+	return userID, true
+}
+
+// createSession issues an access token and a refresh token for the user,
+// recording the client the session was started from.
+func (cfg *apiConfig) createSession(r *http.Request, user database.User) (accessToken, refreshToken string, err error) {
+	accessToken, err = cfg.jwtKeys.MakeJWT(
+		user.ID,
+		user.TokenVersion,
+		loginAccessTokenTTL,
+	)
+	if err != nil {
+		return "", "", err
+	}
+
+	refreshToken, err = auth.MakeRefreshToken()
+	if err != nil {
+		return "", "", err
+	}
+
+	_, err = cfg.requestDB(r.Context()).CreateRefreshToken(database.CreateRefreshTokenParams{
+		UserID:    user.ID,
+		Token:     refreshToken,
+		ExpiresAt: time.Now().UTC().Add(refreshTokenTTL),
+		UserAgent: r.UserAgent(),
+		IPAddress: clientIP(r),
+	})
+	if err != nil {
+		return "", "", err
+	}
+	return accessToken, refreshToken, nil
+}
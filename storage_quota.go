@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// multipartOverhead allows for the multipart framing around an uploaded file
+// when comparing a request body with the file size it's allowed.
+const multipartOverhead = 64 << 10
+
+// uploadAllowance is checked before an upload's body is read. It returns how
+// many bytes the video's owner may store for it, counting the media of the
+// same kind it replaces as free, or an uploadError if there's no room left.
+// Without a quota the allowance is math.MaxInt64.
+//
+// Uploads are charged to the video's owner, so media uploaded to a workspace
+// video by another editor counts against the member who created the video.
+// This is only an early check to avoid reading a body that can't fit: the
+// limits are enforced again as the media is attached to the video, which is
+// what stops concurrent uploads from sharing the same room.
+func (cfg *apiConfig) uploadAllowance(ctx context.Context, video database.Video, kind database.BlobKind) (int64, error) {
+	usage, err := cfg.requestDB(ctx).GetStorageUsage(video.UserID)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't get storage usage: %w", err)
+	}
+
+	if kind == database.BlobKindVideo && video.VideoURL == nil &&
+		cfg.maxVideosPerUser > 0 && usage.Videos >= cfg.maxVideosPerUser {
+		return 0, errVideoLimitReached(cfg.maxVideosPerUser)
+	}
+	if cfg.storageQuota <= 0 {
+		return math.MaxInt64, nil
+	}
+
+	hash := video.VideoBlobHash
+	if kind == database.BlobKindThumbnail {
+		hash = video.ThumbnailBlobHash
+	}
+	var replaced int64
+	if hash != "" {
+		blob, err := cfg.requestDB(ctx).GetBlob(kind, hash)
+		if err != nil {
+			return 0, fmt.Errorf("couldn't get blob: %w", err)
+		}
+		replaced = blob.Size
+	}
+
+	allowance := cfg.storageQuota - (usage.Bytes - replaced)
+	if allowance <= 0 {
+		return 0, errStorageQuotaExceeded()
+	}
+	return allowance, nil
+}
+
+// checkBlobAllowance rejects processed media bigger than the allowance from
+// uploadAllowance, giving back the caller's reference to its blob.
+func (cfg *apiConfig) checkBlobAllowance(r *http.Request, blob database.Blob, allowance int64) error {
+	if blob.Size <= allowance {
+		return nil
+	}
+	if err := cfg.requestDB(r.Context()).ReleaseBlob(blob.Kind, blob.Hash); err != nil {
+		return err
+	}
+	cfg.cleanUpBlobs(r.Context())
+	return errStorageQuotaExceeded()
+}
+
+// storageLimits is what SetVideoFile and SetVideoThumbnail hold the video's
+// owner to.
+func (cfg *apiConfig) storageLimits() database.StorageLimits {
+	return database.StorageLimits{Bytes: cfg.storageQuota, Videos: cfg.maxVideosPerUser}
+}
+
+// storageLimitError turns the database's limit errors into the same
+// uploadErrors uploadAllowance returns.
+func (cfg *apiConfig) storageLimitError(err error) error {
+	switch {
+	case errors.Is(err, database.ErrStorageQuotaExceeded):
+		return errStorageQuotaExceeded()
+	case errors.Is(err, database.ErrVideoLimitReached):
+		return errVideoLimitReached(cfg.maxVideosPerUser)
+	}
+	return err
+}
+
+func errVideoLimitReached(limit int) error {
+	return &uploadError{
+		code: http.StatusForbidden,
+		msg:  fmt.Sprintf("You can upload at most %d videos", limit),
+	}
+}
+
+func errStorageQuotaExceeded() error {
+	return &uploadError{
+		code: http.StatusRequestEntityTooLarge,
+		msg:  "Upload would exceed your storage quota",
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestStorageQuotas(t *testing.T) {
+	tempDir := t.TempDir()
+	dbClient, err := database.NewClient(filepath.Join(tempDir, "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create db client: %v", err)
+	}
+	jwtKeys, err := loadJWTKeys("test-secret", "", "")
+	if err != nil {
+		t.Fatalf("failed to load jwt keys: %v", err)
+	}
+	assetsRoot := filepath.Join(tempDir, "assets")
+	if err := os.Mkdir(assetsRoot, 0755); err != nil {
+		t.Fatalf("failed to create assets dir: %v", err)
+	}
+	cfg := apiConfig{
+		db:               dbClient,
+		jwtKeys:          jwtKeys,
+		assetsRoot:       assetsRoot,
+		videosRoot:       filepath.Join(tempDir, "videos"),
+		port:             "8091",
+		maxVideosPerUser: 1,
+	}
+
+	user, err := dbClient.CreateUser(database.CreateUserParams{Email: "quota@example.com", Password: "unused"})
+	if err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	token, err := jwtKeys.MakeJWT(user.ID, user.TokenVersion, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create jwt: %v", err)
+	}
+	var videos []database.Video
+	for _, title := range []string{"First", "Second"} {
+		video, err := dbClient.CreateVideo(database.CreateVideoParams{Title: title, UserID: user.ID})
+		if err != nil {
+			t.Fatalf("failed to create video: %v", err)
+		}
+		videos = append(videos, video)
+	}
+
+	// A previously processed video, so uploads of it don't need ffmpeg.
+	content := append([]byte("\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00mp42isom"), []byte(strings.Repeat("frame", 100))...)
+	const key = "landscape/processed.mp4"
+	if err := os.MkdirAll(filepath.Dir(cfg.localVideoPath(key)), 0755); err != nil {
+		t.Fatalf("failed to create videos dir: %v", err)
+	}
+	if err := os.WriteFile(cfg.localVideoPath(key), content, 0644); err != nil {
+		t.Fatalf("failed to write stored video: %v", err)
+	}
+	_, err = dbClient.AddBlob(database.Blob{Kind: database.BlobKindVideo, Hash: uploadHash(content), Key: key, Size: 1000})
+	if err != nil {
+		t.Fatalf("failed to add blob: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/video_upload/{videoID}", cfg.handlerUploadVideo)
+	mux.HandleFunc("POST /api/thumbnail_upload/{videoID}", cfg.handlerUploadThumbnail)
+	mux.HandleFunc("GET /api/users/me/usage", cfg.handlerUsersMeUsage)
+
+	upload := func(path, field string, data []byte) *httptest.ResponseRecorder {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		part, err := writer.CreateFormFile(field, "upload")
+		if err != nil {
+			t.Fatalf("failed to create form file: %v", err)
+		}
+		part.Write(data)
+		writer.Close()
+		req := httptest.NewRequest(http.MethodPost, path, body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+	type usageResponse struct {
+		BytesUsed      int64  `json:"bytes_used"`
+		BytesQuota     *int64 `json:"bytes_quota"`
+		BytesRemaining *int64 `json:"bytes_remaining"`
+		Videos         int    `json:"videos"`
+		VideoLimit     *int   `json:"video_limit"`
+	}
+	getUsage := func() usageResponse {
+		req := httptest.NewRequest(http.MethodGet, "/api/users/me/usage", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected usage, got %d: %s", rr.Code, rr.Body.String())
+		}
+		var usage usageResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &usage); err != nil {
+			t.Fatalf("failed to decode usage: %v", err)
+		}
+		return usage
+	}
+
+	if rr := upload("/api/video_upload/"+videos[0].ID.String(), "video", content); rr.Code != http.StatusOK {
+		t.Fatalf("expected first video upload to succeed, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr := upload("/api/video_upload/"+videos[1].ID.String(), "video", content); rr.Code != http.StatusForbidden {
+		t.Fatalf("expected video limit to be enforced, got %d", rr.Code)
+	}
+	// Replacing an uploaded video doesn't count as another one.
+	if rr := upload("/api/video_upload/"+videos[0].ID.String(), "video", content); rr.Code != http.StatusOK {
+		t.Fatalf("expected replacing a video to be allowed, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	usage := getUsage()
+	if usage.BytesUsed != 1000 || usage.Videos != 1 || usage.VideoLimit == nil || *usage.VideoLimit != 1 {
+		t.Fatalf("unexpected usage: %+v", usage)
+	}
+	if usage.BytesQuota != nil || usage.BytesRemaining != nil {
+		t.Fatalf("expected no storage quota, got %+v", usage)
+	}
+
+	var thumbnail bytes.Buffer
+	if err := png.Encode(&thumbnail, testImage(400, 300)); err != nil {
+		t.Fatalf("failed to encode thumbnail: %v", err)
+	}
+	cfg.storageQuota = 1500
+	rr := upload("/api/thumbnail_upload/"+videos[0].ID.String(), "thumbnail", thumbnail.Bytes())
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected thumbnail over the quota to be rejected, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if entries, _ := os.ReadDir(assetsRoot); len(entries) != 0 {
+		t.Fatalf("expected rejected renditions to be removed, got %d files", len(entries))
+	}
+
+	cfg.storageQuota = 1 << 20
+	if rr := upload("/api/thumbnail_upload/"+videos[0].ID.String(), "thumbnail", thumbnail.Bytes()); rr.Code != http.StatusOK {
+		t.Fatalf("expected thumbnail within the quota to be stored, got %d: %s", rr.Code, rr.Body.String())
+	}
+	usage = getUsage()
+	if usage.BytesUsed <= 1000 || usage.BytesQuota == nil || *usage.BytesRemaining != *usage.BytesQuota-usage.BytesUsed {
+		t.Fatalf("expected thumbnail renditions to be counted, got %+v", usage)
+	}
+
+	cfg.storageQuota = 500
+	cfg.maxVideosPerUser = 0
+	if rr := upload("/api/video_upload/"+videos[1].ID.String(), "video", content); rr.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected upload to be refused once the quota is used up, got %d", rr.Code)
+	}
+	if usage := getUsage(); *usage.BytesRemaining != 0 {
+		t.Fatalf("expected no remaining space, got %+v", usage)
+	}
+}
+
+func TestStorageQuotaConcurrentUploads(t *testing.T) {
+	tempDir := t.TempDir()
+	dbClient, err := database.NewClient(filepath.Join(tempDir, "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create db client: %v", err)
+	}
+	jwtKeys, err := loadJWTKeys("test-secret", "", "")
+	if err != nil {
+		t.Fatalf("failed to load jwt keys: %v", err)
+	}
+	cfg := apiConfig{
+		db:           dbClient,
+		jwtKeys:      jwtKeys,
+		assetsRoot:   tempDir,
+		videosRoot:   filepath.Join(tempDir, "videos"),
+		port:         "8091",
+		storageQuota: 1500,
+	}
+
+	user, err := dbClient.CreateUser(database.CreateUserParams{Email: "racer@example.com", Password: "unused"})
+	if err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	token, err := jwtKeys.MakeJWT(user.ID, user.TokenVersion, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create jwt: %v", err)
+	}
+
+	content := append([]byte("\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00mp42isom"), []byte(strings.Repeat("frame", 100))...)
+	const key = "landscape/processed.mp4"
+	if err := os.MkdirAll(filepath.Dir(cfg.localVideoPath(key)), 0755); err != nil {
+		t.Fatalf("failed to create videos dir: %v", err)
+	}
+	if err := os.WriteFile(cfg.localVideoPath(key), content, 0644); err != nil {
+		t.Fatalf("failed to write stored video: %v", err)
+	}
+	// Keep the blob around between uploads so each one is only a reference.
+	if _, err := dbClient.AddBlob(database.Blob{Kind: database.BlobKindVideo, Hash: uploadHash(content), Key: key, Size: 1000}); err != nil {
+		t.Fatalf("failed to add blob: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/video_upload/{videoID}", cfg.handlerUploadVideo)
+
+	// Each upload fits on its own, but only one fits in the quota.
+	const uploads = 5
+	codes := make(chan int, uploads)
+	var wg sync.WaitGroup
+	for i := 0; i < uploads; i++ {
+		video, err := dbClient.CreateVideo(database.CreateVideoParams{Title: "Racer", UserID: user.ID})
+		if err != nil {
+			t.Fatalf("failed to create video: %v", err)
+		}
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		part, err := writer.CreateFormFile("video", "upload")
+		if err != nil {
+			t.Fatalf("failed to create form file: %v", err)
+		}
+		part.Write(content)
+		writer.Close()
+		req := httptest.NewRequest(http.MethodPost, "/api/video_upload/"+video.ID.String(), body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rr := httptest.NewRecorder()
+			mux.ServeHTTP(rr, req)
+			codes <- rr.Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	stored := 0
+	for code := range codes {
+		switch code {
+		case http.StatusOK:
+			stored++
+		case http.StatusRequestEntityTooLarge:
+		default:
+			t.Fatalf("expected uploads to succeed or hit the quota, got %d", code)
+		}
+	}
+	if stored != 1 {
+		t.Fatalf("expected exactly one upload to fit in the quota, got %d", stored)
+	}
+	usage, err := dbClient.GetStorageUsage(user.ID)
+	if err != nil {
+		t.Fatalf("failed to get usage: %v", err)
+	}
+	if usage.Bytes > cfg.storageQuota {
+		t.Fatalf("expected usage to stay within the quota, got %d bytes", usage.Bytes)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	maxTagLength    = 50
+	maxTagsPerVideo = 20
+)
+
+// normalizeTag turns a tag as typed by a user into its slug: lowercase ASCII
+// letters and digits separated by single dashes, so "Web Dev", "web_dev" and
+// "WEB--DEV" are all the same tag. It returns "" if nothing is left.
+func normalizeTag(tag string) string {
+	var b strings.Builder
+	pendingDash := false
+	for _, r := range strings.ToLower(tag) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			if pendingDash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			pendingDash = false
+			b.WriteRune(r)
+		default:
+			pendingDash = true
+		}
+	}
+	return b.String()
+}
+
+// normalizeTags normalizes and de-duplicates a list of tags, keeping their
+// order.
+func normalizeTags(tags []string) ([]string, error) {
+	if len(tags) > maxTagsPerVideo {
+		return nil, fmt.Errorf("a video can have at most %d tags", maxTagsPerVideo)
+	}
+
+	slugs := make([]string, 0, len(tags))
+	seen := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		slug := normalizeTag(tag)
+		if slug == "" {
+			return nil, fmt.Errorf("tag %q has no letters or digits", tag)
+		}
+		if len(slug) > maxTagLength {
+			return nil, fmt.Errorf("tag %q is longer than %d characters", tag, maxTagLength)
+		}
+		if seen[slug] {
+			continue
+		}
+		seen[slug] = true
+		slugs = append(slugs, slug)
+	}
+	return slugs, nil
+}
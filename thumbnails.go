@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/HugoSmits86/nativewebp"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	xdraw "golang.org/x/image/draw"
+)
+
+// thumbnailWidths are the sizes every thumbnail is rendered at. Images
+// narrower than a size aren't scaled up to it.
+var thumbnailWidths = []int{320, 640, 1280}
+
+type thumbnailFormat struct {
+	mediaType string
+	ext       string
+	encode    func(io.Writer, image.Image) error
+}
+
+// thumbnailFormats are written in order of preference; the last one is the
+// fallback thumbnail_url points at.
+var thumbnailFormats = []thumbnailFormat{
+	{
+		mediaType: "image/webp",
+		ext:       ".webp",
+		encode: func(w io.Writer, img image.Image) error {
+			return nativewebp.Encode(w, img, nil)
+		},
+	},
+	{
+		mediaType: "image/jpeg",
+		ext:       ".jpg",
+		encode: func(w io.Writer, img image.Image) error {
+			return jpeg.Encode(w, flattenOnWhite(img), &jpeg.Options{Quality: 82})
+		},
+	},
+}
+
+// savedThumbnail is a processed thumbnail: the URL of its largest fallback
+// rendition, a srcset per format, and the bytes all renditions take up.
+type savedThumbnail struct {
+	url    string
+	srcset map[string]string
+	size   int64
+}
+
+// saveThumbnail validates and decodes an uploaded image, turns it upright,
+// and stores it re-encoded at each of thumbnailWidths in every
+// thumbnailFormats format. Re-encoding drops EXIF and any other metadata in
+// the upload.
+func (cfg *apiConfig) saveThumbnail(data []byte, declaredType string) (savedThumbnail, error) {
+	src, _, err := decodeUploadedImage(data, declaredType)
+	if err != nil {
+		return savedThumbnail{}, err
+	}
+	orientation := jpegOrientation(data)
+
+	widths := renditionWidths(orientedSize(src.Bounds().Size(), orientation).X)
+	// Scale down to the largest rendition before rotating, which is much
+	// cheaper than rotating a full-size photo.
+	largest := orient(resizeToWidth(src, widths[len(widths)-1], orientation), orientation)
+
+	randomBytes := make([]byte, 32)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return savedThumbnail{}, fmt.Errorf("couldn't generate image name: %w", err)
+	}
+	baseName := base64.RawURLEncoding.EncodeToString(randomBytes)
+
+	saved := savedThumbnail{srcset: map[string]string{}}
+	var written []string
+	for _, width := range widths {
+		img := largest
+		if width != largest.Bounds().Dx() {
+			img = resizeToWidth(largest, width, 1)
+		}
+		for _, format := range thumbnailFormats {
+			name := fmt.Sprintf("%s-%d%s", baseName, width, format.ext)
+			size, err := cfg.writeAssetFile(name, img, format.encode)
+			if err != nil {
+				for _, n := range written {
+					os.Remove(filepath.Join(cfg.assetsRoot, n))
+				}
+				return savedThumbnail{}, err
+			}
+			written = append(written, name)
+			saved.size += size
+
+			url := fmt.Sprintf("http://localhost:%s/assets/%s", cfg.port, name)
+			if saved.srcset[format.mediaType] != "" {
+				saved.srcset[format.mediaType] += ", "
+			}
+			saved.srcset[format.mediaType] += fmt.Sprintf("%s %dw", url, width)
+			saved.url = url
+		}
+	}
+	return saved, nil
+}
+
+// storeThumbnailBlob returns a blob holding the renditions of an uploaded
+// thumbnail, reusing an existing one if the same image has been uploaded
+// before. The caller gets a reference to the blob.
+func (cfg *apiConfig) storeThumbnailBlob(ctx context.Context, data []byte, declaredType string) (database.Blob, error) {
+	hash := uploadHash(data)
+	blob, err := cfg.requestDB(ctx).AcquireBlob(database.BlobKindThumbnail, hash)
+	if err != nil {
+		return database.Blob{}, err
+	}
+	if blob.Hash != "" {
+		return blob, nil
+	}
+
+	done := trackProcessingJob(database.BlobKindThumbnail)
+	thumbnail, err := cfg.saveThumbnail(data, declaredType)
+	done()
+	if err != nil {
+		return database.Blob{}, err
+	}
+	saved := database.Blob{
+		Kind:   database.BlobKindThumbnail,
+		Hash:   hash,
+		Key:    thumbnail.url,
+		Srcset: thumbnail.srcset,
+		Size:   thumbnail.size,
+	}
+	blob, err = cfg.requestDB(ctx).AddBlob(saved)
+	if err != nil || blob.Key != thumbnail.url {
+		// Either way, the renditions just written aren't going to be used.
+		if err := cfg.removeBlobMedia(ctx, saved); err != nil {
+			loggerFrom(ctx).Error("Couldn't remove unused thumbnail", "url", thumbnail.url, "error", err)
+		}
+	}
+	return blob, err
+}
+
+// writeAssetFile encodes img into the named asset and returns its size.
+func (cfg *apiConfig) writeAssetFile(name string, img image.Image, encode func(io.Writer, image.Image) error) (int64, error) {
+	f, err := os.Create(filepath.Join(cfg.assetsRoot, name))
+	if err != nil {
+		return 0, fmt.Errorf("couldn't create image file: %w", err)
+	}
+	if err := encode(f, img); err != nil {
+		f.Close()
+		return 0, fmt.Errorf("couldn't encode image: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return 0, fmt.Errorf("couldn't stat image file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return 0, fmt.Errorf("couldn't save image file: %w", err)
+	}
+	return info.Size(), nil
+}
+
+// thumbnailAssetURLs returns every stored file the video's thumbnail uses.
+func thumbnailAssetURLs(video database.Video) []string {
+	var fallback string
+	if video.ThumbnailURL != nil {
+		fallback = *video.ThumbnailURL
+	}
+	return renditionURLs(fallback, video.ThumbnailSrcset)
+}
+
+// renditionURLs lists the fallback URL, if any, and every other URL in the
+// srcsets.
+func renditionURLs(fallback string, srcsets map[string]string) []string {
+	var urls []string
+	if fallback != "" {
+		urls = append(urls, fallback)
+	}
+	for _, srcset := range srcsets {
+		for _, candidate := range strings.Split(srcset, ",") {
+			fields := strings.Fields(candidate)
+			if len(fields) > 0 && fields[0] != fallback {
+				urls = append(urls, fields[0])
+			}
+		}
+	}
+	return urls
+}
+
+func renditionWidths(sourceWidth int) []int {
+	var widths []int
+	for _, w := range thumbnailWidths {
+		if w <= sourceWidth {
+			widths = append(widths, w)
+		}
+	}
+	if len(widths) == 0 {
+		widths = append(widths, sourceWidth)
+	}
+	return widths
+}
+
+// resizeToWidth scales img so that, once turned upright for orientation, it
+// is width pixels wide.
+func resizeToWidth(img image.Image, width, orientation int) image.Image {
+	size := img.Bounds().Size()
+	upright := orientedSize(size, orientation)
+	height := max(1, int(int64(upright.Y)*int64(width)/int64(upright.X)))
+	dst := image.Rect(0, 0, width, height)
+	if orientation >= 5 {
+		dst = image.Rect(0, 0, height, width)
+	}
+	if dst.Size() == size {
+		return img
+	}
+
+	out := image.NewNRGBA(dst)
+	xdraw.CatmullRom.Scale(out, dst, img, img.Bounds(), xdraw.Src, nil)
+	return out
+}
+
+func orientedSize(size image.Point, orientation int) image.Point {
+	if orientation >= 5 {
+		return image.Pt(size.Y, size.X)
+	}
+	return size
+}
+
+// orient applies an EXIF orientation (1-8) so the image displays upright.
+func orient(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	size := orientedSize(image.Pt(w, h), orientation)
+	out := image.NewNRGBA(image.Rect(0, 0, size.X, size.Y))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			}
+			out.Set(dx, dy, img.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return out
+}
+
+// flattenOnWhite composites transparent images onto white, since JPEG has no
+// alpha channel and would otherwise turn transparency black.
+func flattenOnWhite(img image.Image) image.Image {
+	if opaque, ok := img.(interface{ Opaque() bool }); ok && opaque.Opaque() {
+		return img
+	}
+	out := image.NewRGBA(img.Bounds())
+	xdraw.Draw(out, out.Bounds(), image.NewUniform(color.White), image.Point{}, xdraw.Src)
+	xdraw.Draw(out, out.Bounds(), img, img.Bounds().Min, xdraw.Over)
+	return out
+}
+
+// jpegOrientation returns the EXIF orientation of a JPEG, or 1 (upright) if
+// data isn't a JPEG or doesn't say.
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return 1
+		}
+		marker := data[i+1]
+		if marker == 0xDA || marker == 0xD9 {
+			// Start of scan: no more metadata segments.
+			return 1
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 || i+2+length > len(data) {
+			return 1
+		}
+		segment := data[i+4 : i+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			if o, err := exifOrientation(segment[6:]); err == nil {
+				return o
+			}
+			return 1
+		}
+		i += 2 + length
+	}
+	return 1
+}
+
+func exifOrientation(tiff []byte) (int, error) {
+	if len(tiff) < 8 {
+		return 0, errors.New("short TIFF header")
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0, errors.New("bad TIFF byte order")
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 0, errors.New("bad IFD offset")
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			break
+		}
+		const orientationTag = 0x0112
+		if order.Uint16(tiff[entry:]) == orientationTag {
+			o := int(order.Uint16(tiff[entry+8:]))
+			if o < 1 || o > 8 {
+				return 0, errors.New("bad orientation")
+			}
+			return o, nil
+		}
+	}
+	return 1, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer comes from the global provider, so spans go nowhere until
+// setupTracing installs an exporter.
+var tracer = otel.Tracer("github.com/bootdotdev/learn-file-storage-s3-golang-starter")
+
+// setupTracing installs the global tracer provider and W3C trace-context
+// propagation. exporter is "none", "otlp", which sends spans over OTLP/HTTP
+// to wherever the standard OTEL_EXPORTER_OTLP_* variables say, or "stdout"
+// for local use. The returned function flushes spans that haven't been
+// exported yet.
+func setupTracing(ctx context.Context, exporter string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	var spanProcessor sdktrace.TracerProviderOption
+	switch exporter {
+	case "", "none":
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+		otlpExporter, err := otlptracehttp.New(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't create OTLP exporter: %w", err)
+		}
+		spanProcessor = sdktrace.WithBatcher(otlpExporter)
+	case "stdout", "console":
+		stdoutExporter, err := stdouttrace.New(stdouttrace.WithPrettyPrint())
+		if err != nil {
+			return nil, fmt.Errorf("couldn't create stdout exporter: %w", err)
+		}
+		// Spans are printed as they end, rather than batched, so they show
+		// up next to the logs of the request they belong to.
+		spanProcessor = sdktrace.WithSyncer(stdoutExporter)
+	default:
+		return nil, fmt.Errorf("unknown OTEL_TRACES_EXPORTER %q, expected none, otlp or stdout", exporter)
+	}
+
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the defaults.
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceName("tubely")),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't describe the service for tracing: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(spanProcessor, sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// tracingMiddleware starts a server span for every request, continuing the
+// trace from its traceparent header if it has one. The span is named after
+// the route once requestLoggingMiddleware knows which one matched.
+func tracingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		method := metricsMethod(r.Method)
+		ctx, span := tracer.Start(ctx, method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(method),
+				semconv.ClientAddress(clientIP(r)),
+				semconv.UserAgentOriginal(r.UserAgent()),
+			),
+		)
+		defer span.End()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// annotateRequestSpan records how a request was handled on its server span.
+func annotateRequestSpan(ctx context.Context, route string, status int) {
+	span := trace.SpanFromContext(ctx)
+	if !span.IsRecording() {
+		return
+	}
+	if route != "" {
+		span.SetName(route)
+		span.SetAttributes(semconv.HTTPRoute(route))
+	}
+	span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+	if status >= 500 {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+}
+
+// requestDB is the database client for statements made on behalf of ctx's
+// request, which are traced as part of it. They aren't cancelled when the
+// client disconnects, so a change made in several statements, or the
+// bookkeeping after one, isn't left half done.
+func (cfg *apiConfig) requestDB(ctx context.Context) database.Client {
+	return cfg.db.WithContext(context.WithoutCancel(ctx))
+}
+
+// endSpan ends a span for an operation that returned err.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// startS3Operation traces and times an S3 call. The returned function must
+// be called with the call's error once it returns.
+func (cfg *apiConfig) startS3Operation(ctx context.Context, operation, key string) (context.Context, func(error)) {
+	start := time.Now()
+	ctx, span := tracer.Start(ctx, "S3/"+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.RPCSystemKey.String("aws-api"),
+			semconv.RPCService("S3"),
+			semconv.RPCMethod(operation),
+			semconv.AWSS3Bucket(cfg.s3Bucket),
+			semconv.AWSS3Key(key),
+		),
+	)
+	return ctx, func(err error) {
+		observeS3Operation(operation, start, err)
+		endSpan(span, err)
+	}
+}
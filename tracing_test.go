@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTracingUploadVideo(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	previousProvider, previousPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(previousProvider)
+		otel.SetTextMapPropagator(previousPropagator)
+	})
+
+	tempDir := t.TempDir()
+	dbClient, err := database.NewClient(filepath.Join(tempDir, "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create db client: %v", err)
+	}
+	jwtKeys, err := loadJWTKeys("test-secret", "", "")
+	if err != nil {
+		t.Fatalf("failed to load jwt keys: %v", err)
+	}
+	cfg := apiConfig{
+		db:         dbClient,
+		jwtKeys:    jwtKeys,
+		assetsRoot: tempDir,
+		videosRoot: filepath.Join(tempDir, "videos"),
+		port:       "8091",
+	}
+
+	user, err := dbClient.CreateUser(database.CreateUserParams{Email: "traced@example.com", Password: "unused"})
+	if err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	token, err := jwtKeys.MakeJWT(user.ID, user.TokenVersion, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create jwt: %v", err)
+	}
+	video, err := dbClient.CreateVideo(database.CreateVideoParams{Title: "Traced", UserID: user.ID})
+	if err != nil {
+		t.Fatalf("failed to create video: %v", err)
+	}
+
+	// Reuse a stored blob so the upload doesn't need ffmpeg.
+	content := append([]byte("\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00mp42isom"), []byte(strings.Repeat("frame", 100))...)
+	const key = "landscape/traced.mp4"
+	storedPath := cfg.localVideoPath(key)
+	if err := os.MkdirAll(filepath.Dir(storedPath), 0755); err != nil {
+		t.Fatalf("failed to create videos dir: %v", err)
+	}
+	if err := os.WriteFile(storedPath, []byte("processed"), 0644); err != nil {
+		t.Fatalf("failed to write stored video: %v", err)
+	}
+	if _, err := dbClient.AddBlob(database.Blob{Kind: database.BlobKindVideo, Hash: uploadHash(content), Key: key}); err != nil {
+		t.Fatalf("failed to add blob: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/video_upload/{videoID}", cfg.handlerUploadVideo)
+	mux.HandleFunc("GET /api/tags", cfg.handlerTagsRetrieve)
+	handler := tracingMiddleware(cfg.requestLoggingMiddleware(mux))
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("video", "clip.mp4")
+	if err != nil {
+		t.Fatalf("failed to create form file: %v", err)
+	}
+	part.Write(content)
+	writer.Close()
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest(http.MethodPost, "/api/video_upload/"+video.ID.String(), body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected upload to succeed, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		if span.SpanContext().TraceID().String() != traceID {
+			t.Fatalf("expected span %q to continue the incoming trace, got trace %s", span.Name(), span.SpanContext().TraceID())
+		}
+		spans[span.Name()] = span
+	}
+	server, ok := spans["POST /api/video_upload/{videoID}"]
+	if !ok {
+		t.Fatalf("expected a server span named after the route, got %v", spanNames(spans))
+	}
+	if server.SpanKind() != trace.SpanKindServer {
+		t.Fatalf("expected a server span, got %v", server.SpanKind())
+	}
+	for _, name := range []string{"parse multipart form", "save upload", "scan upload", "SELECT", "UPDATE"} {
+		span, ok := spans[name]
+		if !ok {
+			t.Fatalf("expected a %q span, got %v", name, spanNames(spans))
+		}
+		if name != "SELECT" && name != "UPDATE" && span.Parent().SpanID() != server.SpanContext().SpanID() {
+			t.Fatalf("expected %q to be a child of the server span", name)
+		}
+	}
+
+	// Other handlers' statements, including the token check, are traced too.
+	recorder.Reset()
+	req = httptest.NewRequest(http.MethodGet, "/api/tags", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected tags to load, got %d: %s", rr.Code, rr.Body.String())
+	}
+	statements := 0
+	for _, span := range recorder.Ended() {
+		if span.Name() == "SELECT" && span.SpanContext().TraceID().String() == traceID {
+			statements++
+		}
+	}
+	if statements < 2 {
+		t.Fatalf("expected the token check and the tags query to be traced, got %d statements", statements)
+	}
+}
+
+func spanNames(spans map[string]sdktrace.ReadOnlySpan) []string {
+	var names []string
+	for name := range spans {
+		names = append(names, name)
+	}
+	return names
+}
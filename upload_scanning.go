@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/scanner"
+	"github.com/google/uuid"
+)
+
+const auditEventUploadInfected = "upload_infected"
+
+// scanUpload runs the configured scanner over an uploaded file before it's
+// processed or stored. Infected files are logged and come back as a 422
+// uploadError; if the file can't be scanned at all it's rejected with 503
+// rather than published unchecked, or 413 if it's over the scanner's size
+// limit.
+func (cfg *apiConfig) scanUpload(r *http.Request, userID, videoID uuid.UUID, kind database.BlobKind, file io.Reader) (database.ScanResult, error) {
+	s := cfg.scanner
+	if s == nil {
+		s = scanner.NopScanner{}
+	}
+	result, err := s.Scan(r.Context(), file)
+	if errors.Is(err, scanner.ErrTooLarge) {
+		return database.ScanResult{}, &uploadError{
+			code: http.StatusRequestEntityTooLarge,
+			msg:  "Upload is larger than the malware scanner accepts",
+			err:  err,
+		}
+	}
+	if err != nil {
+		return database.ScanResult{}, &uploadError{
+			code: http.StatusServiceUnavailable,
+			msg:  "Couldn't scan upload, try again later",
+			err:  err,
+		}
+	}
+	scanned := database.ScanResult{
+		Verdict:   string(result.Verdict),
+		Signature: result.Signature,
+		Scanner:   result.Scanner,
+		ScannedAt: time.Now().UTC(),
+	}
+	if result.Verdict != scanner.VerdictInfected {
+		return scanned, nil
+	}
+
+	loggerFrom(r.Context()).Warn("Rejected infected upload", "kind", kind, "video_id", videoID, "user_id", userID, "signature", result.Signature)
+	err = cfg.requestDB(r.Context()).CreateAuditEvent(database.CreateAuditEventParams{
+		Type:      auditEventUploadInfected,
+		UserID:    &userID,
+		IPAddress: clientIP(r),
+		Details:   fmt.Sprintf("%s upload for video %s matched %s (%s)", kind, videoID, result.Signature, result.Scanner),
+	})
+	if err != nil {
+		loggerFrom(r.Context()).Error("Couldn't record infected upload", "user_id", userID, "error", err)
+	}
+	return scanned, &uploadError{code: http.StatusUnprocessableEntity, msg: "Upload was rejected by the malware scanner"}
+}
+
+// recordScanResult stores the verdict for a video's new upload. The upload
+// has already succeeded by then, so a failure is only logged, and it's
+// recorded even if the client disconnects.
+func (cfg *apiConfig) recordScanResult(ctx context.Context, videoID uuid.UUID, kind database.BlobKind, result database.ScanResult) {
+	if err := cfg.requestDB(ctx).SetVideoScanResult(videoID, kind, result); err != nil {
+		loggerFrom(ctx).Error("Couldn't record scan result", "kind", kind, "video_id", videoID, "error", err)
+	}
+}
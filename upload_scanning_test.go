@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/scanner"
+)
+
+const (
+	fakeSignatureMarker = "EICAR-STANDARD-ANTIVIRUS-TEST-FILE"
+	fakeClamdStreamMax  = 1 << 20
+)
+
+// fakeClamd speaks enough of the clamd protocol to answer INSTREAM scans,
+// reporting any stream that contains fakeSignatureMarker as infected and
+// refusing streams over fakeClamdStreamMax.
+func fakeClamd(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				command, err := r.ReadString(0)
+				if err != nil || command != "zINSTREAM\x00" {
+					conn.Write([]byte("UNKNOWN COMMAND\x00"))
+					return
+				}
+				var stream bytes.Buffer
+				for {
+					var size uint32
+					if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+						return
+					}
+					if size == 0 {
+						break
+					}
+					if _, err := io.CopyN(&stream, r, int64(size)); err != nil {
+						return
+					}
+				}
+				if stream.Len() > fakeClamdStreamMax {
+					conn.Write([]byte("INSTREAM size limit exceeded. ERROR\x00"))
+					return
+				}
+				if bytes.Contains(stream.Bytes(), []byte(fakeSignatureMarker)) {
+					conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+					return
+				}
+				conn.Write([]byte("stream: OK\x00"))
+			}(conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestClamdScanner(t *testing.T) {
+	s := scanner.ClamdScanner{Network: "tcp", Address: fakeClamd(t), Timeout: 5 * time.Second}
+
+	// Bigger than one chunk, so the file is sent in several.
+	clean := strings.Repeat("harmless video bytes ", 10000)
+	result, err := s.Scan(context.Background(), strings.NewReader(clean))
+	if err != nil {
+		t.Fatalf("failed to scan clean file: %v", err)
+	}
+	if result.Verdict != scanner.VerdictClean || result.Scanner != "clamd" {
+		t.Fatalf("expected clean verdict, got %+v", result)
+	}
+
+	result, err = s.Scan(context.Background(), strings.NewReader(clean+fakeSignatureMarker))
+	if err != nil {
+		t.Fatalf("failed to scan infected file: %v", err)
+	}
+	if result.Verdict != scanner.VerdictInfected || result.Signature != "Eicar-Test-Signature" {
+		t.Fatalf("expected infected verdict, got %+v", result)
+	}
+
+	huge := strings.Repeat("x", fakeClamdStreamMax+1)
+	if _, err := s.Scan(context.Background(), strings.NewReader(huge)); !errors.Is(err, scanner.ErrTooLarge) {
+		t.Fatalf("expected ErrTooLarge for a stream over clamd's limit, got %v", err)
+	}
+
+	unreachable := scanner.ClamdScanner{Network: "unix", Address: filepath.Join(t.TempDir(), "missing.sock")}
+	if _, err := unreachable.Scan(context.Background(), strings.NewReader(clean)); err == nil {
+		t.Fatalf("expected an error when clamd is unreachable")
+	}
+}
+
+func TestUploadScanning(t *testing.T) {
+	tempDir := t.TempDir()
+	dbClient, err := database.NewClient(filepath.Join(tempDir, "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create db client: %v", err)
+	}
+	jwtKeys, err := loadJWTKeys("test-secret", "", "")
+	if err != nil {
+		t.Fatalf("failed to load jwt keys: %v", err)
+	}
+	cfg := apiConfig{
+		db:         dbClient,
+		jwtKeys:    jwtKeys,
+		assetsRoot: tempDir,
+		port:       "8091",
+		scanner:    scanner.ClamdScanner{Network: "tcp", Address: fakeClamd(t), Timeout: 5 * time.Second},
+	}
+
+	user, err := dbClient.CreateUser(database.CreateUserParams{Email: "scanned@example.com", Password: "unused"})
+	if err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	token, err := jwtKeys.MakeJWT(user.ID, user.TokenVersion, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create jwt: %v", err)
+	}
+	video, err := dbClient.CreateVideo(database.CreateVideoParams{Title: "Scanned", UserID: user.ID})
+	if err != nil {
+		t.Fatalf("failed to create video: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/thumbnail_upload/{videoID}", cfg.handlerUploadThumbnail)
+	upload := func(extra string) *httptest.ResponseRecorder {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		part, err := writer.CreateFormFile("thumbnail", "thumb.png")
+		if err != nil {
+			t.Fatalf("failed to create form file: %v", err)
+		}
+		if err := png.Encode(part, testImage(64, 36)); err != nil {
+			t.Fatalf("failed to encode thumbnail: %v", err)
+		}
+		// Decoders ignore anything after the image data.
+		part.Write([]byte(extra))
+		writer.Close()
+		req := httptest.NewRequest(http.MethodPost, "/api/thumbnail_upload/"+video.ID.String(), body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := upload(fakeSignatureMarker); rr.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected infected upload to be rejected, got %d: %s", rr.Code, rr.Body.String())
+	}
+	stored, err := dbClient.GetVideo(video.ID)
+	if err != nil {
+		t.Fatalf("failed to get video: %v", err)
+	}
+	if stored.ThumbnailURL != nil {
+		t.Fatalf("expected infected thumbnail not to be stored")
+	}
+	events, err := dbClient.GetAuditEvents(10)
+	if err != nil {
+		t.Fatalf("failed to get audit events: %v", err)
+	}
+	if len(events) != 1 || events[0].Type != auditEventUploadInfected {
+		t.Fatalf("expected infected upload to be audited, got %+v", events)
+	}
+
+	if rr := upload(strings.Repeat("x", fakeClamdStreamMax)); rr.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected upload over the scanner's limit to be refused with 413, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	rr := upload("")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected clean upload to succeed, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var got editorVideo
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+		t.Fatalf("failed to decode video: %v", err)
+	}
+	result := got.ScanResults[database.BlobKindThumbnail]
+	if result.Verdict != string(scanner.VerdictClean) || result.Scanner != "clamd" || result.ScannedAt.IsZero() {
+		t.Fatalf("expected clean verdict to be recorded, got %+v", got.ScanResults)
+	}
+
+	// Anyone can watch a public video, but only its editors see the
+	// scanner's findings.
+	got.Video.Visibility = database.VideoVisibilityPublic
+	if err := dbClient.UpdateVideo(got.Video); err != nil {
+		t.Fatalf("failed to publish video: %v", err)
+	}
+	mux.HandleFunc("GET /api/videos/{videoID}", cfg.handlerVideoGet)
+	for _, tc := range []struct {
+		name        string
+		token       string
+		wantResults bool
+	}{
+		{"anonymous", "", false},
+		{"owner", token, true},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/api/videos/"+video.ID.String(), nil)
+		if tc.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: expected video, got %d: %s", tc.name, rr.Code, rr.Body.String())
+		}
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(rr.Body.Bytes(), &fields); err != nil {
+			t.Fatalf("%s: failed to decode video: %v", tc.name, err)
+		}
+		if _, ok := fields["scan_results"]; ok != tc.wantResults {
+			t.Fatalf("%s: expected scan results shown=%v, got %s", tc.name, tc.wantResults, rr.Body.String())
+		}
+	}
+
+	cfg.scanner = scanner.ClamdScanner{Network: "unix", Address: filepath.Join(tempDir, "missing.sock")}
+	if rr := upload(""); rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected upload to be refused while the scanner is down, got %d", rr.Code)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// canViewVideo reports whether viewerID, which is uuid.Nil for anonymous
+// requests, may read the video. Every handler that returns a video to
+// someone other than its owner has to go through this check. It doesn't
+// cover media URLs: thumbnails under /assets/ and CloudFront video URLs are
+// served to anyone who has them.
+func (cfg *apiConfig) canViewVideo(ctx context.Context, video database.Video, viewerID uuid.UUID) (bool, error) {
+	switch video.Visibility {
+	case database.VideoVisibilityPublic, database.VideoVisibilityUnlisted:
+		return true, nil
+	}
+	if viewerID == uuid.Nil {
+		return false, nil
+	}
+	if video.WorkspaceID != nil {
+		role, err := cfg.requestDB(ctx).GetWorkspaceRole(*video.WorkspaceID, viewerID)
+		if err != nil {
+			return false, err
+		}
+		if role != "" {
+			return true, nil
+		}
+	} else if video.UserID == viewerID {
+		return true, nil
+	}
+	return cfg.requestDB(ctx).IsVideoSharedWith(video.ID, viewerID)
+}
+
+// canEditVideo reports whether userID may change or delete the video. Videos
+// in a workspace can be edited by its editors and owners, whoever uploaded
+// them; personal videos only by their owner.
+func (cfg *apiConfig) canEditVideo(ctx context.Context, video database.Video, userID uuid.UUID) (bool, error) {
+	if video.WorkspaceID == nil {
+		return video.UserID == userID, nil
+	}
+	role, err := cfg.requestDB(ctx).GetWorkspaceRole(*video.WorkspaceID, userID)
+	if err != nil {
+		return false, err
+	}
+	return role.CanEdit(), nil
+}
+
+// editorVideo is a video as returned to someone who can edit it: the public
+// fields plus the scan verdicts for its uploads.
+type editorVideo struct {
+	database.Video
+	ScanResults map[database.BlobKind]database.ScanResult `json:"scan_results"`
+}
+
+func editorView(video database.Video) editorVideo {
+	return editorVideo{Video: video, ScanResults: video.ScanResults}
+}
+
+func editorViews(videos []database.Video) []editorVideo {
+	views := make([]editorVideo, 0, len(videos))
+	for _, video := range videos {
+		views = append(views, editorView(video))
+	}
+	return views
+}
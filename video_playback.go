@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+const maxPlaybackURLTTL = 15 * time.Minute
+
+// presignVideoURL returns a URL the video can be played from until it
+// expires, for viewers who shouldn't get the permanent one. It returns "" if
+// the video hasn't been uploaded yet.
+func (cfg *apiConfig) presignVideoURL(ctx context.Context, video database.Video, ttl time.Duration) (string, error) {
+	if video.VideoURL == nil {
+		return "", nil
+	}
+	if _, ok := cfg.localVideoKey(video.ID, *video.VideoURL); ok {
+		token, err := cfg.jwtKeys.MakePlaybackToken(video.ID, ttl)
+		if err != nil {
+			return "", err
+		}
+		return *video.VideoURL + "?token=" + url.QueryEscape(token), nil
+	}
+	key, ok := cfg.videoObjectKey(*video.VideoURL)
+	if !ok {
+		return "", nil
+	}
+	if cfg.s3Client == nil {
+		return "", errStorageNotConfigured
+	}
+
+	presigned, err := s3.NewPresignClient(cfg.s3Client).PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(cfg.s3Bucket),
+		Key:    aws.String(key),
+	}, s3.WithPresignExpires(ttl))
+	if err != nil {
+		return "", err
+	}
+	return presigned.URL, nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/google/uuid"
+)
+
+// storeVideo saves a processed video under key, either in the S3 bucket or,
+// when cfg.videosRoot is set, on local disk, and returns the URL to record on
+// the video.
+func (cfg *apiConfig) storeVideo(ctx context.Context, videoID uuid.UUID, key, mediaType string, file *os.File) (string, error) {
+	if cfg.videosRoot != "" {
+		return cfg.storeLocalVideo(videoID, key, file)
+	}
+
+	videoURL, err := cfg.videoURL(videoID, key)
+	if err != nil {
+		return "", err
+	}
+	if cfg.s3Client == nil {
+		return "", errStorageNotConfigured
+	}
+	s3Ctx, done := cfg.startS3Operation(ctx, "PutObject", key)
+	_, err = cfg.s3Client.PutObject(s3Ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(cfg.s3Bucket),
+		Key:         aws.String(key),
+		Body:        file,
+		ContentType: aws.String(mediaType),
+	})
+	done(err)
+	if err != nil {
+		return "", err
+	}
+	return videoURL, nil
+}
+
+// videoURL is the URL a video stored under key is played from. Videos with
+// the same content share a key, but each gets its own URL when stored
+// locally, since streams are authorized per video.
+func (cfg *apiConfig) videoURL(videoID uuid.UUID, key string) (string, error) {
+	if cfg.videosRoot != "" {
+		return cfg.localVideoStreamBase(videoID) + "/" + key, nil
+	}
+	cfBase := cfg.cloudFrontBaseURL()
+	if cfBase == "" {
+		return "", errors.New("CloudFront distribution not configured")
+	}
+	return fmt.Sprintf("%s/%s", cfBase, key), nil
+}
+
+// deleteStoredVideo removes the video stored under key by storeVideo. A video
+// that's already gone isn't an error.
+func (cfg *apiConfig) deleteStoredVideo(ctx context.Context, key string) error {
+	if cfg.videosRoot != "" {
+		err := os.Remove(cfg.localVideoPath(key))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	if cfg.s3Client == nil {
+		return errStorageNotConfigured
+	}
+	ctx, done := cfg.startS3Operation(ctx, "DeleteObject", key)
+	_, err := cfg.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(cfg.s3Bucket),
+		Key:    aws.String(key),
+	})
+	done(err)
+	return err
+}
+
+// storeLocalVideo copies the file into the videos directory. It's written
+// under a temporary name and renamed into place so a concurrent stream never
+// sees a partial file.
+func (cfg *apiConfig) storeLocalVideo(videoID uuid.UUID, key string, file *os.File) (string, error) {
+	dst := filepath.Join(cfg.videosRoot, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return "", err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".upload-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err := io.Copy(tmp, file); err != nil {
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		return "", err
+	}
+	return cfg.videoURL(videoID, key)
+}
+
+// localVideoStreamBase is the URL locally stored videos are streamed from.
+// The storage key follows it, so a re-uploaded video gets a new URL.
+func (cfg *apiConfig) localVideoStreamBase(videoID uuid.UUID) string {
+	return fmt.Sprintf("http://localhost:%s/api/videos/%s/stream", cfg.port, videoID)
+}
+
+// localVideoKey maps a video URL made by storeLocalVideo back to its storage
+// key. Keys that could escape the videos directory are rejected.
+func (cfg *apiConfig) localVideoKey(videoID uuid.UUID, videoURL string) (string, bool) {
+	if cfg.videosRoot == "" {
+		return "", false
+	}
+	key, ok := strings.CutPrefix(videoURL, cfg.localVideoStreamBase(videoID)+"/")
+	if !ok || !validLocalVideoKey(key) {
+		return "", false
+	}
+	return key, true
+}
+
+func validLocalVideoKey(key string) bool {
+	return key != "" && path.Clean(key) == key && !path.IsAbs(key) &&
+		key != ".." && !strings.HasPrefix(key, "../")
+}
+
+func (cfg *apiConfig) localVideoPath(key string) string {
+	return filepath.Join(cfg.videosRoot, filepath.FromSlash(key))
+}
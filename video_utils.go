@@ -2,12 +2,18 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"math"
 	"os/exec"
+	"path/filepath"
 	"strings"
+	"time"
+
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type ffprobeStream struct {
@@ -20,19 +26,13 @@ type ffprobeOutput struct {
 	Streams []ffprobeStream `json:"streams"`
 }
 
-func getVideoAspectRatio(filePath string) (string, error) {
-	cmd := exec.Command("ffprobe", "-v", "error", "-print_format", "json", "-show_streams", filePath)
+func getVideoAspectRatio(ctx context.Context, filePath string) (string, error) {
+	cmd := exec.CommandContext(ctx, "ffprobe", "-v", "error", "-print_format", "json", "-show_streams", filePath)
 
 	var stdout bytes.Buffer
-	var stderr bytes.Buffer
 	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-
-	if err := cmd.Run(); err != nil {
-		if stderr.Len() > 0 {
-			return "", fmt.Errorf("ffprobe failed: %w: %s", err, strings.TrimSpace(stderr.String()))
-		}
-		return "", fmt.Errorf("ffprobe failed: %w", err)
+	if err := runMediaCommand(ctx, cmd); err != nil {
+		return "", err
 	}
 
 	var probe ffprobeOutput
@@ -71,10 +71,11 @@ func getVideoAspectRatio(filePath string) (string, error) {
 	}
 }
 
-func processVideoForFastStart(filePath string) (string, error) {
+func processVideoForFastStart(ctx context.Context, filePath string) (string, error) {
 	outputPath := filePath + ".processing"
 
-	cmd := exec.Command(
+	cmd := exec.CommandContext(
+		ctx,
 		"ffmpeg",
 		"-y",
 		"-i", filePath,
@@ -85,15 +86,42 @@ func processVideoForFastStart(filePath string) (string, error) {
 	)
 
 	cmd.Stdout = io.Discard
+	if err := runMediaCommand(ctx, cmd); err != nil {
+		return "", err
+	}
+
+	return outputPath, nil
+}
+
+// runMediaCommand runs an ffmpeg or ffprobe command, logs how it went with
+// the request's logger, and records it in the metrics and as a span. A
+// failure's error includes what the command printed to stderr.
+func runMediaCommand(ctx context.Context, cmd *exec.Cmd) error {
+	name := filepath.Base(cmd.Path)
 	var stderr bytes.Buffer
 	cmd.Stderr = &stderr
 
-	if err := cmd.Run(); err != nil {
-		if stderr.Len() > 0 {
-			return "", fmt.Errorf("ffmpeg failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	_, span := tracer.Start(ctx, name, trace.WithAttributes(
+		semconv.ProcessExecutableName(name),
+		semconv.ProcessCommandArgs(cmd.Args...),
+	))
+	start := time.Now()
+	err := cmd.Run()
+	duration := time.Since(start)
+	observeMediaCommand(name, duration, err)
+	if cmd.ProcessState != nil {
+		span.SetAttributes(semconv.ProcessExitCode(cmd.ProcessState.ExitCode()))
+	}
+	endSpan(span, err)
+	logger := loggerFrom(ctx).With("command", name, "args", cmd.Args[1:], "duration", duration)
+	output := strings.TrimSpace(stderr.String())
+	if err != nil {
+		logger.Error("Media command failed", "error", err, "stderr", output)
+		if output != "" {
+			return fmt.Errorf("%s failed: %w: %s", name, err, output)
 		}
-		return "", fmt.Errorf("ffmpeg failed: %w", err)
+		return fmt.Errorf("%s failed: %w", name, err)
 	}
-
-	return outputPath, nil
+	logger.Debug("Media command finished", "stderr", output)
+	return nil
 }